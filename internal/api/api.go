@@ -16,11 +16,16 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/CrunchyData/pg_featureserv/internal/conf"
 	"github.com/CrunchyData/pg_featureserv/internal/data"
 	"github.com/getkin/kin-openapi/openapi3"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -28,28 +33,115 @@ const (
 	TagCollections = "collections"
 	TagItems       = "items"
 	TagConformance = "conformance"
+	TagQueryables  = "queryables"
+	TagFacets      = "facets"
+	TagLookup      = "lookup"
 	TagAPI         = "api"
 
 	TagFunctions = "functions"
 
-	ParamCrs        = "crs"
-	ParamLimit      = "limit"
-	ParamOffset     = "offset"
-	ParamBbox       = "bbox"
-	ParamBboxCrs    = "bbox-crs"
-	ParamFilter     = "filter"
-	ParamFilterCrs  = "filter-crs"
-	ParamGroupBy    = "groupby"
-	ParamOrderBy    = "orderby"
-	ParamPrecision  = "precision"
-	ParamProperties = "properties"
-	ParamSortBy     = "sortby"
-	ParamTransform  = "transform"
+	ParamCrs          = "crs"
+	ParamLimit        = "limit"
+	ParamOffset       = "offset"
+	ParamBbox         = "bbox"
+	ParamBboxCrs      = "bbox-crs"
+	ParamBboxBuffer   = "bbox-buffer"
+	ParamFilter       = "filter"
+	ParamFilterCrs    = "filter-crs"
+	ParamFilterLang   = "filter-lang"
+	ParamFilterGeom   = "filter-geom"
+	ParamFilterGeomOp = "filter-geom-op"
+	ParamGroupBy      = "groupby"
+	ParamOrderBy      = "orderby"
+	ParamPrecision    = "precision"
+	ParamProperties   = "properties"
+	ParamSortBy       = "sortby"
+	ParamTransform    = "transform"
+	ParamDryRun       = "dry-run"
+	ParamApiKey       = "api_key"
+	ParamFormat       = "f"
+	ParamDatetime     = "datetime"
+	ParamLang         = "lang"
+	ParamSample       = "sample"
+	ParamDistinct     = "distinct"
+	ParamCluster      = "cluster"
+	ParamGeomFormat   = "geometry-format"
+	ParamPoint        = "point"
+	ParamAggregate    = "aggregate"
+	ParamPretty       = "pretty"
+	ParamGeomType     = "geomtype"
+	ParamEmptyGeom    = "empty-geometry"
+	ParamDimension    = "dimension"
+	// ParamResultType is the WFS resultType parameter (query parameter names are lower-cased)
+	ParamResultType = "resulttype"
+	ParamTile       = "tile"
+	ParamEnvelope   = "envelope"
+	ParamMode       = "mode"
+
+	// ModeMerge and ModeReplace are the mode values of an upsert
+	ModeMerge   = "merge"
+	ModeReplace = "replace"
+
+	// ResultTypeResults and ResultTypeHits are the resultType values
+	ResultTypeResults = "results"
+	ResultTypeHits    = "hits"
+
+	// ParamProperty is the property of a facets request.
+	// It is not reserved, since it only applies to the facets path
+	ParamProperty = "property"
+
+	// AggregateCollect and AggregateUnion are the aggregate functions
+	AggregateCollect = "collect"
+	AggregateUnion   = "union"
+
+	// GeomFormatGeoJSON, GeomFormatWKT, GeomFormatWKBHex and GeomFormatEWKB
+	// are the geometry-format encodings
+	GeomFormatGeoJSON = "geojson"
+	GeomFormatWKT     = "wkt"
+	GeomFormatWKBHex  = "wkb-hex"
+	GeomFormatEWKB    = "ewkb"
+
+	// FilterLangText and FilterLangJSON are the filter-lang encodings
+	FilterLangText = "cql2-text"
+	FilterLangJSON = "cql2-json"
+
+	// ParamCategory filters the collections list.
+	// It is not a reserved name, since it does not apply to features
+	ParamCategory = "category"
+
+	// ParamRefreshExtent forces recomputing the cached collection extent
+	ParamRefreshExtent = "refresh-extent"
+
+	// ParamItemCount adds the estimated feature counts to the collections list
+	ParamItemCount = "item-count"
 
 	OrderByDirSep = ":"
 	OrderByDirD   = "d"
 	OrderByDirA   = "a"
 
+	// OrderByCastSep separates a sort property path from the type its JSON value is cast to
+	OrderByCastSep = "::"
+
+	// CrsURICRS84 is the default coordinate system of features (WGS84 longitude/latitude)
+	CrsURICRS84 = "http://www.opengis.net/def/crs/OGC/1.3/CRS84"
+
+	OrderByNullsFirst = "nullsfirst"
+	OrderByNullsLast  = "nullslast"
+
+	// OrderByDistance orders features by distance from the point parameter
+	OrderByDistance = "distance"
+
+	// PropertyGroupPrefix marks the name of a property group in the properties parameter
+	PropertyGroupPrefix = "@"
+
+	PrecisionSep     = ":"
+	PrecisionKeyGeom = "geom"
+	PrecisionKeyProp = "prop"
+
+	DatetimeIntervalSep = "/"
+	DatetimeOpen        = ".."
+	DatetimeNow         = "now"
+
 	RelSelf        = "self"
 	RelAlt         = "alternate"
 	RelServiceDesc = "service-desc"
@@ -58,15 +150,22 @@ const (
 	RelData        = "data"
 	RelFunctions   = "functions"
 	RelItems       = "items"
+	RelQueryables  = "http://www.opengis.net/def/rel/ogc/1.0/queryables"
 
 	TitleFeatuuresGeoJSON = "Features as GeoJSON"
 	TitleDataJSON         = "Data as JSON"
 	TitleMetadata         = "Metadata"
+	TitleQueryables       = "Queryable properties"
 	TitleDocument         = "This document"
 	TitleAsJSON           = " as JSON"
 	TitleAsHTML           = " as HTML"
+	TitleAPIDefinition    = "API definition"
+	TitleConformance      = "OGC API conformance classes implemented by this server"
+	TitleCollections      = "collections"
+	TitleFunctionsList    = "functions"
 
 	GeoJSONFeatureCollection = "FeatureCollection"
+	GeoJSONFeature           = "Feature"
 )
 
 const (
@@ -79,16 +178,56 @@ const (
 	ErrMsgFunctionNotFound      = "Function not found: %v"
 	ErrMsgFunctionAccess        = "Unable to access Function: %v"
 	ErrMsgInvalidParameterValue = "Invalid value for parameter %v: %v"
+	ErrMsgUnknownParameter      = "Unknown query parameter: %v"
+	ErrMsgMissingParameter      = "Missing value for required parameter: %v"
+	ErrMsgOffsetMax             = "Parameter offset exceeds the maximum of %v (use a filter on the sort key to page further)"
+	ErrMsgDistinctNoProperties  = "Parameter distinct requires a properties list"
+	ErrMsgDistinctFormat        = "Parameter distinct is not supported for format: %v"
+	ErrMsgClusterConflict       = "Parameter cluster cannot be used with parameter: %v"
+	ErrMsgClusterFormat         = "Parameter cluster is not supported for format: %v"
+	ErrMsgAggregateConflict     = "Parameter aggregate cannot be used with parameter: %v"
+	ErrMsgAggregateFormat       = "Parameter aggregate is not supported for format: %v"
+	ErrMsgGeomFormat            = "Parameter geometry-format is not supported for format: %v"
+	ErrMsgDistanceNoPoint       = "Ordering by distance requires the point parameter"
 	ErrMsgInvalidQuery          = "Invalid query parameters"
 	ErrMsgDataReadError         = "Unable to read data from: %v"
 	ErrMsgDataWriteError        = "Unable to write data to: %v"
 	ErrMsgNoDataRead            = "No data read from: %v"
 	ErrMsgRequestTimeout        = "Maximum time exceeded.  Request cancelled."
+	ErrMsgCollectionNotEditable = "Collection is not editable: %v"
+	ErrMsgCollectionIsView      = "Collection is a view and cannot be edited: %v"
+	ErrMsgCollectionNoKey       = "Collection has no primary key and cannot be edited: %v"
+	ErrMsgCollectionIDNotUnique = "Collection id column has no unique index and cannot be edited: %v"
+	ErrMsgDataDeleteError       = "Unable to delete data from: %v"
+	ErrMsgInvalidPropertyPath   = "Property path does not reference a JSON column: %v"
+	ErrMsgUnauthorized          = "Missing or invalid API key"
+	ErrMsgInvalidToken          = "Missing or invalid authorization token"
+	ErrMsgNoTenantClaim         = "Authorization token has no tenant claim"
+	ErrMsgFeatureIDNotSupported = "Collection has no primary key and does not support access by feature id: %v"
+	ErrMsgRateLimited           = "Too many requests"
+	ErrMsgBboxMaxArea           = "Parameter bbox area exceeds the maximum of %v (request a smaller area)"
+	ErrMsgFacetProperty         = "Parameter property must be a non-geometry property of the collection: %v"
+	ErrMsgFilterDenied          = "Property cannot be used as a filter: %v"
+	ErrMsgLookupColumn          = "Column is not a lookup column of the collection: %v"
+	ErrMsgLookupNotUnique       = "Lookup value matches more than one feature: %v"
+	ErrMsgFormatNotEnabled      = "Format is not enabled: %v"
+	ErrMsgGeoPackageMaxFeatures = "GeoPackage output is limited to %v features (use a bbox, filter or limit)"
+	ErrMsgComputedFunction      = "Function is not allowed in a computed property: %v"
+	ErrMsgComputedColumn        = "Computed property column is not a column of the collection: %v"
+	ErrMsgResultTypeHits        = "resultType=hits is not supported with %v"
+	ErrMsgTileConflict          = "Parameter tile cannot be used with parameter: %v"
+	ErrMsgInvalidFeatures       = "Invalid feature collection: %v"
+	ErrMsgCrsNotSupported       = "Coordinate system is not supported for parameter %v: %v"
+	ErrMsgInvalidSearch         = "Invalid search request: %v"
+	ErrMsgBodyTooLarge          = "Request body is larger than the maximum of %v bytes"
+	ErrMsgBodyTimeout           = "Request body was not received within %v seconds"
+	ErrMsgAdminNotEnabled       = "Administrative request is not enabled: %v"
 )
 
 const (
 	ErrCodeCollectionNotFound = "CollectionNotFound"
 	ErrCodeFeatureNotFound    = "FeatureNotFound"
+	ErrCodeServiceUnavailable = "ServiceUnavailable"
 )
 
 var ParamReservedNames = []string{
@@ -97,13 +236,36 @@ var ParamReservedNames = []string{
 	ParamOffset,
 	ParamBbox,
 	ParamBboxCrs,
+	ParamBboxBuffer,
 	ParamFilter,
+	ParamFilterCrs,
+	ParamFilterLang,
+	ParamFilterGeom,
+	ParamFilterGeomOp,
 	ParamGroupBy,
 	ParamOrderBy,
 	ParamPrecision,
 	ParamProperties,
 	ParamSortBy,
 	ParamTransform,
+	ParamApiKey,
+	ParamFormat,
+	ParamDatetime,
+	ParamLang,
+	ParamSample,
+	ParamDistinct,
+	ParamCluster,
+	ParamGeomFormat,
+	ParamPoint,
+	ParamAggregate,
+	ParamPretty,
+	ParamGeomType,
+	ParamEmptyGeom,
+	ParamDimension,
+	ParamResultType,
+	ParamTile,
+	ParamEnvelope,
+	ParamMode,
 }
 
 var ParamReservedNamesMap = makeSet(ParamReservedNames)
@@ -192,10 +354,14 @@ var ParameterSchema openapi3.Schema = openapi3.Schema{
 	},
 }
 
-// Bbox for extent
+// Bbox for extent.
+// If the storage coordinate system is not EPSG:4326
+// the extent is also provided in the storage coordinate system
 type Bbox struct {
-	Crs    string    `json:"crs"`
-	Extent []float64 `json:"bbox"`
+	Crs           string    `json:"crs"`
+	Extent        []float64 `json:"bbox"`
+	StorageCrs    string    `json:"storageCrs,omitempty"`
+	StorageExtent []float64 `json:"storageCrsBbox,omitempty"`
 }
 
 // Extent OAPIF Extent structure (partial)
@@ -222,6 +388,17 @@ var BboxSchema openapi3.Schema = openapi3.Schema{
 				Items:    openapi3.NewSchemaRef("", openapi3.NewFloat64Schema().WithMin(-180).WithMax(180)),
 			},
 		},
+		"storageCrs": {
+			Value: openapi3.NewStringSchema(),
+		},
+		"storageCrsBbox": {
+			Value: &openapi3.Schema{
+				Type:     "array",
+				MinItems: 4,
+				MaxItems: openapi3.Uint64Ptr(4),
+				Items:    openapi3.NewSchemaRef("", openapi3.NewFloat64Schema()),
+			},
+		},
 	},
 }
 
@@ -235,27 +412,76 @@ var ExtentSchema openapi3.Schema = openapi3.Schema{
 
 type NameValMap map[string]string
 
+// HealthStatusOK is the status reported by healthy health and readiness checks
+const HealthStatusOK = "ok"
+
+// HealthStatus is the response for health and readiness checks
+type HealthStatus struct {
+	Status string      `json:"status"`
+	Pool   *PoolStatus `json:"pool,omitempty"`
+}
+
+// UpsertSummary is the response for an upsert of features
+type UpsertSummary struct {
+	Inserted int `json:"inserted"`
+	Updated  int `json:"updated"`
+	Deleted  int `json:"deleted"`
+}
+
+// PoolStatus reports the database connection pool usage
+type PoolStatus struct {
+	MaxConns      int32 `json:"maxConns"`
+	TotalConns    int32 `json:"totalConns"`
+	AcquiredConns int32 `json:"acquiredConns"`
+	IdleConns     int32 `json:"idleConns"`
+}
+
 // RequestParam holds the parameters for a request
 type RequestParam struct {
 	Crs           int
+	FlipAxes      bool
 	Limit         int
 	Offset        int
 	Bbox          *data.Extent
 	BboxCrs       int
+	BboxBuffer    float64
 	Properties    []string
 	Filter        string
+	FilterLang    string
 	FilterCrs     int
+	FilterGeom    *data.GeometryFilter
+	Datetime      *data.TimeInterval
+	Sample        float64
+	GeomType      string
+	IsHits        bool
+	NoEnvelope    bool
+	Distinct      bool
+	Cluster       *data.Cluster
+	Aggregate     *data.Aggregate
+	GeomFormat    string
+	EmptyGeometry string
+	Dimension     int
 	GroupBy       []string
 	SortBy        []data.Sorting
 	Precision     int
+	PropPrecision int
 	TransformFuns []data.TransformFunction
-	Values        NameValMap
+	// Computed are the computed properties of the properties parameter
+	Computed []data.ComputedProperty
+	// Aliases maps the property aliases of the collection to their columns
+	Aliases map[string]string
+	// Denied are the columns of the collection which cannot be returned, filtered or sorted by
+	Denied map[string]bool
+	Values NameValMap
 }
 
 // CollectionsInfo for all collections
 type CollectionsInfo struct {
 	Links       []*Link           `json:"links"`
+	Categories  []string          `json:"categories,omitempty"`
 	Collections []*CollectionInfo `json:"collections"`
+	// ItemCount is the total of the collection item counts (if requested)
+	ItemCount *int64 `json:"itemCount,omitempty"`
 }
 
 var CollectionsInfoSchema openapi3.Schema = openapi3.Schema{
@@ -278,6 +504,10 @@ var CollectionsInfoSchema openapi3.Schema = openapi3.Schema{
 				},
 			},
 		},
+		"itemCount": {Value: &openapi3.Schema{
+			Type:        "integer",
+			Description: "Total estimated number of features of the collections",
+		}},
 	},
 }
 
@@ -294,14 +524,54 @@ type Property struct {
 	Description string `json:"description"`
 }
 
+// JSONSchemaDraft is the JSON Schema version of queryables documents
+const JSONSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// Roles of queryable properties
+const (
+	QueryableRoleID       = "id"
+	QueryableRoleGeometry = "primary-geometry"
+)
+
+// Queryables is a JSON Schema describing the properties which can be used in filters
+type Queryables struct {
+	Schema               string                        `json:"$schema"`
+	ID                   string                        `json:"$id"`
+	Type                 string                        `json:"type"`
+	Title                string                        `json:"title,omitempty"`
+	Properties           map[string]*QueryableProperty `json:"properties"`
+	AdditionalProperties bool                          `json:"additionalProperties"`
+}
+
+// QueryableProperty is the JSON Schema of a queryable property
+type QueryableProperty struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Role        string `json:"x-ogc-role,omitempty"`
+}
+
+// FacetValue is a distinct value of a property, with the number of features having it
+type FacetValue struct {
+	Value interface{} `json:"value"`
+	Count int64       `json:"count"`
+}
+
 // CollectionInfo for a collection
 type CollectionInfo struct {
 	Name         string   `json:"id"`
 	Title        string   `json:"title,omitempty"`
 	Description  string   `json:"description,omitempty"`
+	Category     string   `json:"category,omitempty"`
 	Extent       *Extent  `json:"extent,omitempty"`
 	Crs          []string `json:"crs,omitempty"`
+	StorageCrs   string   `json:"storageCrs,omitempty"`
 	GeometryType *string  `json:"geometrytype,omitempty"`
+	// GeometryMixed is set if the geometry column allows more than one geometry type
+	GeometryMixed bool `json:"geometrymixed,omitempty"`
+	// ItemCount is the estimated number of features (only in the collections list, if requested)
+	ItemCount *int64 `json:"itemCount,omitempty"`
 
 	// these are omitempty so they don't show in summary metadata
 	Properties []*Property `json:"properties,omitempty"`
@@ -321,6 +591,7 @@ var CollectionInfoSchema openapi3.Schema = openapi3.Schema{
 		"id":          {Value: &openapi3.Schema{Type: "string"}},
 		"title":       {Value: &openapi3.Schema{Type: "string"}},
 		"description": {Value: &openapi3.Schema{Type: "string"}},
+		"category":    {Value: &openapi3.Schema{Type: "string"}},
 		"extent":      {Value: &ExtentSchema},
 		"crs": {Value: &openapi3.Schema{
 			Type: "array",
@@ -329,7 +600,10 @@ var CollectionInfoSchema openapi3.Schema = openapi3.Schema{
 			},
 		},
 		},
-		"geometrytype": {Value: &openapi3.Schema{Type: "string"}},
+		"storageCrs":    {Value: &openapi3.Schema{Type: "string"}},
+		"geometrytype":  {Value: &openapi3.Schema{Type: "string"}},
+		"geometrymixed": {Value: &openapi3.Schema{Type: "boolean"}},
+		"itemCount":     {Value: &openapi3.Schema{Type: "integer"}},
 		"properties": {Value: &openapi3.Schema{
 			Type:  "array",
 			Items: &openapi3.SchemaRef{Value: &PropertySchema},
@@ -347,10 +621,12 @@ var CollectionInfoSchema openapi3.Schema = openapi3.Schema{
 type FeatureCollectionRaw struct {
 	Type           string             `json:"type"`
 	Features       []*json.RawMessage `json:"features"`
-	NumberMatched  uint               `json:"numberMatched,omitempty"`
+	NumberMatched  *uint              `json:"numberMatched,omitempty"`
 	NumberReturned uint               `json:"numberReturned"`
 	TimeStamp      string             `json:"timeStamp,omitempty"`
-	Links          []*Link            `json:"links"`
+	// Truncated is set if the features were cut off at the server maximum
+	Truncated bool    `json:"truncated,omitempty"`
+	Links     []*Link `json:"links"`
 }
 
 // FunctionsInfo is the API metadata for all functions
@@ -475,6 +751,7 @@ var conformance = Conformance{
 		"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/oas3",
 		"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/geojson",
 		"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/html",
+		"http://www.opengis.net/spec/ogcapi-features-2/1.0/conf/crs",
 		"http://www.opengis.net/spec/ogcapi-common-1/1.0/conf/core",
 		"http://www.opengis.net/spec/ogcapi-common-1/1.0/conf/landing-page",
 		"http://www.opengis.net/spec/ogcapi-common-1/1.0/conf/json",
@@ -482,16 +759,26 @@ var conformance = Conformance{
 		"http://www.opengis.net/spec/ogcapi-common-1/1.0/conf/oas30",
 		"http://www.opengis.net/spec/ogcapi-common-2/1.0/conf/collections",
 		"http://www.opengis.net/spec/ogcapi-common-2/1.0/conf/simple-query",
+		"http://www.opengis.net/spec/ogcapi-features-3/1.0/conf/filter",
+		"http://www.opengis.net/spec/ogcapi-features-3/1.0/conf/features-filter",
+		"http://www.opengis.net/spec/ogcapi-features-3/1.0/conf/queryables",
+		"http://www.opengis.net/spec/ogcapi-features-3/1.0/conf/queryables-query-parameters",
+		"http://www.opengis.net/spec/cql2/1.0/conf/cql2-text",
+		"http://www.opengis.net/spec/cql2/1.0/conf/cql2-json",
 	},
 }
 
 func toBbox(cc *data.Table) *Bbox {
-	// extent bbox is always in 4326 for now
-	crs := "http://www.opengis.net/def/crs/EPSG/0/4326"
-	return &Bbox{
-		Crs:    crs,
+	// extent bbox is in 4326, with lon/lat axis order
+	bbox := &Bbox{
+		Crs:    CrsURICRS84,
 		Extent: []float64{cc.Extent.Minx, cc.Extent.Miny, cc.Extent.Maxx, cc.Extent.Maxy},
 	}
+	if ext := cc.StorageExtent; ext != nil && cc.Srid > 0 {
+		bbox.StorageCrs = CrsURI(cc.Srid)
+		bbox.StorageExtent = []float64{ext.Minx, ext.Miny, ext.Maxx, ext.Maxy}
+	}
+	return bbox
 }
 
 func NewLink(href string, rel string, conType string, title string) *Link {
@@ -519,6 +806,110 @@ func NewCollectionsInfo(tables []*data.Table) *CollectionsInfo {
 	return &csDoc
 }
 
+// crsMaxSrid is the largest SRID of a crs parameter
+const crsMaxSrid = 99999999
+
+var reCrsURIEPSG = regexp.MustCompile(`^https?://www\.opengis\.net/def/crs/EPSG/0/(\d+)$`)
+
+// crsConfig is the configured coordinate systems.
+// list is their URIs, in order, and srids and uris map between the URIs and the SRIDs
+type crsConfig struct {
+	list  []string
+	srids map[string]int
+	uris  map[int]string
+}
+
+// crsConfigured is the current *crsConfig.
+// It is replaced as a whole when the configuration is reloaded
+var crsConfigured atomic.Value
+
+func init() {
+	crsConfigured.Store(&crsConfig{})
+}
+
+// InitCrs loads the coordinate systems supported by the crs parameters.
+// If there are none, any SRID is supported.
+// Entries with no URI or SRID are logged and ignored
+func InitCrs(list []conf.Crs) {
+	cc := &crsConfig{
+		srids: make(map[string]int),
+		uris:  make(map[int]string),
+	}
+	for _, crs := range list {
+		uri := strings.TrimSpace(crs.Uri)
+		if uri == "" || crs.Srid <= 0 || crs.Srid > crsMaxSrid {
+			log.Warnf("Invalid Crs configuration: Uri %v, Srid %v", crs.Uri, crs.Srid)
+			continue
+		}
+		if _, ok := cc.srids[uri]; ok {
+			continue
+		}
+		cc.list = append(cc.list, uri)
+		cc.srids[uri] = crs.Srid
+		if _, ok := cc.uris[crs.Srid]; !ok {
+			cc.uris[crs.Srid] = uri
+		}
+	}
+	crsConfigured.Store(cc)
+}
+
+// CrsSrid returns the SRID of a crs parameter value, which is a CRS URI or an SRID.
+// If coordinate systems are configured, only they and CRS84 are supported.
+// It returns false if the value is not a supported coordinate system
+func CrsSrid(val string) (int, bool) {
+	if val == CrsURICRS84 {
+		return data.SRID_4326, true
+	}
+	cc := crsConfigured.Load().(*crsConfig)
+	if srid, ok := cc.srids[val]; ok {
+		return srid, true
+	}
+	srid, err := strconv.Atoi(val)
+	if err != nil {
+		m := reCrsURIEPSG.FindStringSubmatch(val)
+		if m == nil || len(cc.list) > 0 {
+			return 0, false
+		}
+		srid, _ = strconv.Atoi(m[1])
+	}
+	if srid < 0 || srid > crsMaxSrid {
+		return 0, false
+	}
+	if len(cc.list) > 0 && srid != data.SRID_4326 {
+		_, ok := cc.uris[srid]
+		return srid, ok
+	}
+	return srid, true
+}
+
+// CrsURI is the OGC URI of the coordinate system with an SRID.
+// It is the configured URI, if any, or else the EPSG URI
+func CrsURI(srid int) string {
+	if uri, ok := crsConfigured.Load().(*crsConfig).uris[srid]; ok {
+		return uri
+	}
+	return fmt.Sprintf("http://www.opengis.net/def/crs/EPSG/0/%d", srid)
+}
+
+// collectionCrs lists the default output coordinate system and the supported coordinate systems.
+// If none are configured they are the storage coordinate system,
+// since output in it does not require transforming the geometry
+func collectionCrs(tbl *data.Table) []string {
+	crs := []string{CrsURICRS84}
+	if list := crsConfigured.Load().(*crsConfig).list; len(list) > 0 {
+		for _, uri := range list {
+			if uri != CrsURICRS84 {
+				crs = append(crs, uri)
+			}
+		}
+		return crs
+	}
+	if tbl.Srid > 0 && tbl.Srid != data.SRID_4326 {
+		crs = append(crs, CrsURI(tbl.Srid))
+	}
+	return crs
+}
+
 func NewCollectionInfo(tbl *data.Table) *CollectionInfo {
 	doc := CollectionInfo{
 		Name:        tbl.ID,
@@ -527,28 +918,118 @@ func NewCollectionInfo(tbl *data.Table) *CollectionInfo {
 		Extent: &Extent{
 			Spatial: toBbox(tbl),
 		},
+		Crs: collectionCrs(tbl),
+	}
+	if tbl.Srid > 0 {
+		doc.StorageCrs = CrsURI(tbl.Srid)
 	}
 	return &doc
 }
 
-func TableProperties(tbl *data.Table) []*Property {
-	props := make([]*Property, len(tbl.Columns))
+// TableProperties creates the properties of a collection,
+// omitting the denied columns
+func TableProperties(tbl *data.Table, denied map[string]bool) []*Property {
+	props := []*Property{}
 	for i, name := range tbl.Columns {
-		props[i] = &Property{
-			Name:        name,
+		if denied[name] {
+			continue
+		}
+		props = append(props, &Property{
+			Name:        tbl.OutputName(name),
 			Type:        tbl.JSONTypes[i],
 			Description: tbl.ColDesc[i],
-		}
+		})
 	}
 	return props
 }
 
+// NewQueryables creates the JSON Schema of the queryable properties of a collection.
+// Properties which can not be compared by filters (JSON and array columns) are omitted,
+// as are the denied columns.
+// Properties are named by their alias (if any), as in the collection metadata
+func NewQueryables(tbl *data.Table, id string, denied map[string]bool) *Queryables {
+	doc := Queryables{
+		Schema:     JSONSchemaDraft,
+		ID:         id,
+		Type:       "object",
+		Title:      tbl.Title,
+		Properties: map[string]*QueryableProperty{},
+	}
+	if tbl.GeometryColumn != "" {
+		doc.Properties[tbl.GeometryColumn] = &QueryableProperty{
+			Title:  tbl.GeometryColumn,
+			Format: queryableGeometryFormat(tbl.GeometryType),
+			Role:   QueryableRoleGeometry,
+		}
+	}
+	for i, name := range tbl.Columns {
+		typ, format := queryableType(tbl.DbTypes[name], tbl.JSONTypes[i])
+		if typ == "" || denied[name] {
+			continue
+		}
+		outName := tbl.OutputName(name)
+		prop := &QueryableProperty{
+			Title:       outName,
+			Description: tbl.ColDesc[i],
+			Type:        typ,
+			Format:      format,
+		}
+		if len(tbl.IDColumns) == 1 && tbl.IDColumns[0] == name {
+			prop.Role = QueryableRoleID
+		}
+		doc.Properties[outName] = prop
+	}
+	return &doc
+}
+
+// NewFacetValues creates the response values of a facets request
+func NewFacetValues(facets []*data.Facet) []*FacetValue {
+	values := make([]*FacetValue, len(facets))
+	for i, facet := range facets {
+		values[i] = &FacetValue{Value: facet.Value, Count: facet.Count}
+	}
+	return values
+}
+
+// queryableType returns the JSON Schema type and format of a column,
+// or an empty type if the column is not queryable
+func queryableType(dbType string, jsonType string) (string, string) {
+	switch {
+	case strings.HasPrefix(dbType, "int"):
+		return "integer", ""
+	case strings.HasPrefix(dbType, "float") || dbType == "numeric":
+		return "number", ""
+	case dbType == "bool":
+		return "boolean", ""
+	case dbType == "date":
+		return "string", "date"
+	case strings.HasPrefix(dbType, "timestamp"):
+		return "string", "date-time"
+	case dbType == "uuid":
+		return "string", "uuid"
+	case jsonType == data.JSONTypeString:
+		return "string", ""
+	}
+	return "", ""
+}
+
+// queryableGeometryFormat returns the JSON Schema format of a PostGIS geometry type
+// (e.g. MultiPolygonZ is geometry-multipolygon)
+func queryableGeometryFormat(geomType string) string {
+	name := strings.ToLower(geomType)
+	name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "zm"), "m"), "z")
+	switch name {
+	case "point", "multipoint", "linestring", "multilinestring", "polygon", "multipolygon", "geometrycollection":
+		return "geometry-" + name
+	}
+	return "geometry-any"
+}
+
 func NewFeatureCollectionInfo(featureJSON []string) *FeatureCollectionRaw {
 	ts := time.Now().Format(time.RFC3339)
 	doc := FeatureCollectionRaw{
 		Type:           GeoJSONFeatureCollection,
 		Features:       toRaw(featureJSON),
-		NumberMatched:  0,
 		NumberReturned: uint(len(featureJSON)),
 		TimeStamp:      ts,
 	}
@@ -624,6 +1105,18 @@ func PathCollection(name string) string {
 	return fmt.Sprintf("%v/%v", TagCollections, name)
 }
 
+func PathCollectionQueryables(name string) string {
+	return fmt.Sprintf("%v/%v/%v", TagCollections, name, TagQueryables)
+}
+
+func PathCollectionFacets(name string) string {
+	return fmt.Sprintf("%v/%v/%v", TagCollections, name, TagFacets)
+}
+
+func PathCollectionLookup(name string, column string, value string) string {
+	return fmt.Sprintf("%v/%v/%v/%v/%v", TagCollections, name, TagLookup, column, value)
+}
+
 func PathCollectionItems(name string) string {
 	return fmt.Sprintf("%v/%v/%v", TagCollections, name, TagItems)
 }
@@ -0,0 +1,84 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+)
+
+// csvColumnID is the CSV column containing the feature id
+const csvColumnID = "id"
+
+// CSVOptions controls the encoding of CSV fields
+type CSVOptions struct {
+	// Delimiter separates the fields of a record
+	Delimiter rune
+	// NullValue is the text of NULL property values
+	NullValue string
+}
+
+// featureCSV holds the feature JSON values needed for CSV encoding.
+// The geometry is a JSON string (such as WKT)
+type featureCSV struct {
+	ID         string                     `json:"id"`
+	Geometry   *string                    `json:"geometry"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+// FeatureCollectionCSV encodes features as CSV records,
+// with a header record of the id, property and geometry column names.
+// The feature geometry values must have been output as a string encoding
+func FeatureCollectionCSV(geomName string, columns []string, featureJSON []string, opts CSVOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Comma = opts.Delimiter
+
+	header := make([]string, 0, len(columns)+2)
+	header = append(header, csvColumnID)
+	header = append(header, columns...)
+	header = append(header, geomName)
+	if err := cw.Write(header); err != nil {
+		return nil, err
+	}
+	for _, featJSON := range featureJSON {
+		var feat featureCSV
+		if err := json.Unmarshal([]byte(featJSON), &feat); err != nil {
+			return nil, err
+		}
+		record := make([]string, 0, len(header))
+		record = append(record, feat.ID)
+		for _, name := range columns {
+			val, isNull := gmlPropertyValue(feat.Properties[name])
+			if isNull {
+				val = opts.NullValue
+			}
+			record = append(record, val)
+		}
+		geom := ""
+		if feat.Geometry != nil {
+			geom = *feat.Geometry
+		}
+		record = append(record, geom)
+		if err := cw.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,40 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"testing"
+)
+
+func TestFeatureCollectionCSV(t *testing.T) {
+	feats := []string{
+		`{"id":"1","geometry":"POINT(1 2)","properties":{"name":"a, b","price":"12.50","tags":[1,2]}}`,
+		`{"id":"2","geometry":null,"properties":{"name":null,"price":3}}`,
+	}
+	got, err := FeatureCollectionCSV("geom", []string{"name", "price", "tags"}, feats, CSVOptions{Delimiter: ',', NullValue: "NULL"})
+	if err != nil {
+		t.Fatalf("FeatureCollectionCSV error: %v", err)
+	}
+	want := "id,name,price,tags,geom\n" +
+		"1,\"a, b\",12.50,\"[1,2]\",POINT(1 2)\n" +
+		"2,NULL,3,NULL,\n"
+	if string(got) != want {
+		t.Errorf("CSV =\n%v\nwant\n%v", string(got), want)
+	}
+
+	got, _ = FeatureCollectionCSV("geom", []string{"name"}, feats[:1], CSVOptions{Delimiter: ';'})
+	if string(got) != "id;name;geom\n1;a, b;POINT(1 2)\n" {
+		t.Errorf("CSV with delimiter = %v", string(got))
+	}
+}
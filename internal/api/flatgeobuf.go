@@ -0,0 +1,412 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/CrunchyData/pg_featureserv/internal/data"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// FlatGeobuf encoding, as specified in https://github.com/flatgeobuf/flatgeobuf
+// (schemas header.fbs and feature.fbs)
+
+// fgbMagic is the FlatGeobuf file signature (version 3)
+var fgbMagic = []byte{0x66, 0x67, 0x62, 0x03, 0x66, 0x67, 0x62, 0x00}
+
+// FlatGeobuf geometry types
+const (
+	fgbGeomUnknown            byte = 0
+	fgbGeomPoint              byte = 1
+	fgbGeomLineString         byte = 2
+	fgbGeomPolygon            byte = 3
+	fgbGeomMultiPoint         byte = 4
+	fgbGeomMultiLineString    byte = 5
+	fgbGeomMultiPolygon       byte = 6
+	fgbGeomGeometryCollection byte = 7
+)
+
+var fgbGeomTypes = map[string]byte{
+	"POINT":              fgbGeomPoint,
+	"LINESTRING":         fgbGeomLineString,
+	"POLYGON":            fgbGeomPolygon,
+	"MULTIPOINT":         fgbGeomMultiPoint,
+	"MULTILINESTRING":    fgbGeomMultiLineString,
+	"MULTIPOLYGON":       fgbGeomMultiPolygon,
+	"GEOMETRYCOLLECTION": fgbGeomGeometryCollection,
+}
+
+// FlatGeobuf column types
+const (
+	fgbColBool     byte = 2
+	fgbColShort    byte = 3
+	fgbColInt      byte = 5
+	fgbColLong     byte = 7
+	fgbColFloat    byte = 9
+	fgbColDouble   byte = 10
+	fgbColString   byte = 11
+	fgbColJSON     byte = 12
+	fgbColDateTime byte = 13
+)
+
+// fgbColTypes maps Postgres types to FlatGeobuf column types.
+// Other types are output as strings
+var fgbColTypes = map[string]byte{
+	"bool":        fgbColBool,
+	"int2":        fgbColShort,
+	"int4":        fgbColInt,
+	"int8":        fgbColLong,
+	"float4":      fgbColFloat,
+	"float8":      fgbColDouble,
+	"numeric":     fgbColDouble,
+	"json":        fgbColJSON,
+	"jsonb":       fgbColJSON,
+	"date":        fgbColDateTime,
+	"timestamp":   fgbColDateTime,
+	"timestamptz": fgbColDateTime,
+}
+
+type fgbColumn struct {
+	name    string
+	colType byte
+}
+
+// FlatGeobufWriter writes features as a FlatGeobuf stream, with no spatial index.
+// The feature count is not known in advance, so it is not recorded in the header
+type FlatGeobufWriter struct {
+	w        io.Writer
+	name     string
+	geomType byte
+	srid     int
+	columns  []fgbColumn
+}
+
+// NewFlatGeobufWriter creates a writer for features of a table.
+// The column schema is determined from the table column types
+func NewFlatGeobufWriter(w io.Writer, name string, tbl *data.Table, propNames []string, srid int) *FlatGeobufWriter {
+	columns := make([]fgbColumn, len(propNames))
+	outNames := tbl.OutputNames(propNames)
+	for i, propName := range propNames {
+		colType, ok := fgbColTypes[tbl.DbTypes[propName]]
+		if !ok {
+			colType = fgbColString
+		}
+		columns[i] = fgbColumn{name: outNames[i], colType: colType}
+	}
+	return &FlatGeobufWriter{
+		w:        w,
+		name:     name,
+		geomType: fgbGeometryType(tbl.GeometryType),
+		srid:     srid,
+		columns:  columns,
+	}
+}
+
+// fgbGeometryType converts a PostGIS geometry type name to the FlatGeobuf type.
+// Coordinate dimension suffixes are ignored, since only XY is output
+func fgbGeometryType(geomType string) byte {
+	name := strings.ToUpper(geomType)
+	for _, suffix := range []string{"ZM", "Z", "M"} {
+		if strings.HasSuffix(name, suffix) {
+			name = strings.TrimSuffix(name, suffix)
+			break
+		}
+	}
+	// unknown types (including GEOMETRY) are recorded in each feature
+	return fgbGeomTypes[name]
+}
+
+// WriteHeader writes the file signature and header
+func (fw *FlatGeobufWriter) WriteHeader() error {
+	b := flatbuffers.NewBuilder(1024)
+	colOffs := make([]flatbuffers.UOffsetT, len(fw.columns))
+	for i, col := range fw.columns {
+		nameOff := b.CreateString(col.name)
+		b.StartObject(11)
+		b.PrependUOffsetTSlot(0, nameOff, 0)
+		b.PrependByteSlot(1, col.colType, 0)
+		colOffs[i] = b.EndObject()
+	}
+	colsVec := fgbOffsetVector(b, colOffs)
+
+	orgOff := b.CreateString("EPSG")
+	b.StartObject(6)
+	b.PrependUOffsetTSlot(0, orgOff, 0)
+	b.PrependInt32Slot(1, int32(fw.srid), 0)
+	crsOff := b.EndObject()
+
+	nameOff := b.CreateString(fw.name)
+	b.StartObject(14)
+	b.PrependUOffsetTSlot(0, nameOff, 0)
+	b.PrependByteSlot(2, fw.geomType, 0)
+	b.PrependUOffsetTSlot(7, colsVec, 0)
+	// no spatial index
+	b.PrependUint16Slot(9, 0, 16)
+	b.PrependUOffsetTSlot(10, crsOff, 0)
+	b.Finish(b.EndObject())
+
+	if _, err := fw.w.Write(fgbMagic); err != nil {
+		return err
+	}
+	return fgbWriteSizePrefixed(fw.w, b.FinishedBytes())
+}
+
+// WriteFeature writes a feature provided as GeoJSON
+func (fw *FlatGeobufWriter) WriteFeature(featJSON string) error {
+	var feat struct {
+		Geometry   *fgbGeoJSON                `json:"geometry"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal([]byte(featJSON), &feat); err != nil {
+		return err
+	}
+	props, err := fw.encodeProperties(feat.Properties)
+	if err != nil {
+		return err
+	}
+	b := flatbuffers.NewBuilder(1024)
+	var geomOff flatbuffers.UOffsetT
+	if feat.Geometry != nil {
+		geom, err := feat.Geometry.toGeometry()
+		if err != nil {
+			return err
+		}
+		geomOff = geom.build(b)
+	}
+	propsOff := b.CreateByteVector(props)
+	b.StartObject(3)
+	if geomOff != 0 {
+		b.PrependUOffsetTSlot(0, geomOff, 0)
+	}
+	b.PrependUOffsetTSlot(1, propsOff, 0)
+	b.Finish(b.EndObject())
+	return fgbWriteSizePrefixed(fw.w, b.FinishedBytes())
+}
+
+// encodeProperties encodes property values as pairs of column index and value.
+// Null values are omitted
+func (fw *FlatGeobufWriter) encodeProperties(props map[string]json.RawMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, col := range fw.columns {
+		raw, ok := props[col.name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		val, err := fgbValue(col.colType, raw)
+		if err != nil {
+			return nil, fmt.Errorf("property %v: %v", col.name, err)
+		}
+		binary.Write(&buf, binary.LittleEndian, uint16(i)) //nolint:errcheck
+		buf.Write(val)
+	}
+	return buf.Bytes(), nil
+}
+
+func fgbValue(colType byte, raw json.RawMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	text := string(raw)
+	var err error
+	switch colType {
+	case fgbColBool:
+		var b bool
+		err = json.Unmarshal(raw, &b)
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case fgbColShort, fgbColInt, fgbColLong:
+		var num int64
+		num, err = strconv.ParseInt(numberText(raw), 10, 64)
+		switch colType {
+		case fgbColShort:
+			binary.Write(&buf, binary.LittleEndian, int16(num)) //nolint:errcheck
+		case fgbColInt:
+			binary.Write(&buf, binary.LittleEndian, int32(num)) //nolint:errcheck
+		default:
+			binary.Write(&buf, binary.LittleEndian, num) //nolint:errcheck
+		}
+	case fgbColFloat, fgbColDouble:
+		var num float64
+		num, err = strconv.ParseFloat(numberText(raw), 64)
+		if colType == fgbColFloat {
+			binary.Write(&buf, binary.LittleEndian, math.Float32bits(float32(num))) //nolint:errcheck
+		} else {
+			binary.Write(&buf, binary.LittleEndian, math.Float64bits(num)) //nolint:errcheck
+		}
+	default:
+		//-- strings are unquoted, other values are output as JSON text
+		var str string
+		if json.Unmarshal(raw, &str) != nil {
+			str = text
+		}
+		binary.Write(&buf, binary.LittleEndian, uint32(len(str))) //nolint:errcheck
+		buf.WriteString(str)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// numberText is the text of a numeric property value.
+// Numeric values may be written as JSON strings to keep all of their digits
+// (see Database.NumericAsString)
+func numberText(raw json.RawMessage) string {
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		return str
+	}
+	return string(raw)
+}
+
+func fgbWriteSizePrefixed(w io.Writer, buf []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(buf))); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func fgbOffsetVector(b *flatbuffers.Builder, offs []flatbuffers.UOffsetT) flatbuffers.UOffsetT {
+	b.StartVector(4, len(offs), 4)
+	for i := len(offs) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(offs[i])
+	}
+	return b.EndVector(len(offs))
+}
+
+// fgbGeoJSON is a GeoJSON geometry
+type fgbGeoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometries  []*fgbGeoJSON   `json:"geometries"`
+}
+
+// fgbGeometry is a FlatGeobuf geometry.
+// Multi-part geometries record the end index of each part
+type fgbGeometry struct {
+	geomType byte
+	ends     []uint32
+	xy       []float64
+	parts    []*fgbGeometry
+}
+
+func (gj *fgbGeoJSON) toGeometry() (*fgbGeometry, error) {
+	geom := &fgbGeometry{geomType: fgbGeomTypes[strings.ToUpper(gj.Type)]}
+	var err error
+	switch geom.geomType {
+	case fgbGeomPoint:
+		var pt []float64
+		if err = json.Unmarshal(gj.Coordinates, &pt); err == nil {
+			geom.addPoints([][]float64{pt})
+		}
+	case fgbGeomLineString, fgbGeomMultiPoint:
+		var pts [][]float64
+		if err = json.Unmarshal(gj.Coordinates, &pts); err == nil {
+			geom.addPoints(pts)
+		}
+	case fgbGeomPolygon, fgbGeomMultiLineString:
+		var lines [][][]float64
+		if err = json.Unmarshal(gj.Coordinates, &lines); err == nil {
+			geom.addLines(lines)
+		}
+	case fgbGeomMultiPolygon:
+		var polys [][][][]float64
+		if err = json.Unmarshal(gj.Coordinates, &polys); err == nil {
+			for _, poly := range polys {
+				part := &fgbGeometry{geomType: fgbGeomPolygon}
+				part.addLines(poly)
+				geom.parts = append(geom.parts, part)
+			}
+		}
+	case fgbGeomGeometryCollection:
+		for _, gjPart := range gj.Geometries {
+			part, errPart := gjPart.toGeometry()
+			if errPart != nil {
+				return nil, errPart
+			}
+			geom.parts = append(geom.parts, part)
+		}
+	default:
+		err = fmt.Errorf("unsupported geometry type: %v", gj.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return geom, nil
+}
+
+// addPoints adds the XY values of points
+func (g *fgbGeometry) addPoints(pts [][]float64) {
+	for _, pt := range pts {
+		if len(pt) >= 2 {
+			g.xy = append(g.xy, pt[0], pt[1])
+		}
+	}
+}
+
+// addLines adds the points of lines (or polygon rings), recording the end of each line
+func (g *fgbGeometry) addLines(lines [][][]float64) {
+	for _, line := range lines {
+		g.addPoints(line)
+		g.ends = append(g.ends, uint32(len(g.xy)/2))
+	}
+}
+
+func (g *fgbGeometry) build(b *flatbuffers.Builder) flatbuffers.UOffsetT {
+	partOffs := make([]flatbuffers.UOffsetT, len(g.parts))
+	for i, part := range g.parts {
+		partOffs[i] = part.build(b)
+	}
+	var partsVec, endsVec, xyVec flatbuffers.UOffsetT
+	if len(partOffs) > 0 {
+		partsVec = fgbOffsetVector(b, partOffs)
+	}
+	//-- ends are only needed for more than one part
+	if len(g.ends) > 1 {
+		b.StartVector(4, len(g.ends), 4)
+		for i := len(g.ends) - 1; i >= 0; i-- {
+			b.PrependUint32(g.ends[i])
+		}
+		endsVec = b.EndVector(len(g.ends))
+	}
+	if len(g.xy) > 0 {
+		b.StartVector(8, len(g.xy), 8)
+		for i := len(g.xy) - 1; i >= 0; i-- {
+			b.PrependFloat64(g.xy[i])
+		}
+		xyVec = b.EndVector(len(g.xy))
+	}
+	b.StartObject(8)
+	if endsVec != 0 {
+		b.PrependUOffsetTSlot(0, endsVec, 0)
+	}
+	if xyVec != 0 {
+		b.PrependUOffsetTSlot(1, xyVec, 0)
+	}
+	b.PrependByteSlot(6, g.geomType, fgbGeomUnknown)
+	if partsVec != 0 {
+		b.PrependUOffsetTSlot(7, partsVec, 0)
+	}
+	return b.EndObject()
+}
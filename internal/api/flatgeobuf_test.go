@@ -0,0 +1,154 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/CrunchyData/pg_featureserv/internal/data"
+)
+
+func testTable() *data.Table {
+	return &data.Table{
+		ID:             "public.pts",
+		GeometryType:   "Point",
+		GeometryColumn: "geom",
+		Columns:        []string{"id", "name", "price", "count", "flag"},
+		DbTypes: map[string]string{
+			"id":    "int4",
+			"name":  "text",
+			"price": "numeric",
+			"count": "int8",
+			"flag":  "bool",
+		},
+		PropertyAliases: map[string]string{"name": "label"},
+	}
+}
+
+func TestFgbValue(t *testing.T) {
+	cases := []struct {
+		colType byte
+		raw     string
+		want    []byte
+	}{
+		{fgbColBool, "true", []byte{1}},
+		{fgbColShort, "-2", []byte{0xfe, 0xff}},
+		{fgbColInt, "258", []byte{2, 1, 0, 0}},
+		{fgbColDouble, "12.5", float64Bytes(12.5)},
+		//-- numeric values may be written as strings
+		{fgbColDouble, "\"12.50\"", float64Bytes(12.5)},
+		{fgbColLong, "\"7\"", []byte{7, 0, 0, 0, 0, 0, 0, 0}},
+		{fgbColString, "\"ab\"", []byte{2, 0, 0, 0, 'a', 'b'}},
+		{fgbColJSON, "{\"a\":1}", append([]byte{7, 0, 0, 0}, "{\"a\":1}"...)},
+	}
+	for _, c := range cases {
+		got, err := fgbValue(c.colType, json.RawMessage(c.raw))
+		if err != nil {
+			t.Errorf("fgbValue(%v, %v) error: %v", c.colType, c.raw, err)
+			continue
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("fgbValue(%v, %v) = %v, want %v", c.colType, c.raw, got, c.want)
+		}
+	}
+	if _, err := fgbValue(fgbColDouble, json.RawMessage("\"abc\"")); err == nil {
+		t.Errorf("fgbValue of invalid number: expected error")
+	}
+}
+
+func TestNumberText(t *testing.T) {
+	for raw, want := range map[string]string{"1.50": "1.50", "\"1.50\"": "1.50", "\"NaN\"": "NaN"} {
+		if got := numberText(json.RawMessage(raw)); got != want {
+			t.Errorf("numberText(%v) = %v, want %v", raw, got, want)
+		}
+	}
+}
+
+func TestFgbGeometryType(t *testing.T) {
+	for geomType, want := range map[string]byte{
+		"Point":          fgbGeomPoint,
+		"MULTIPOLYGONZ":  fgbGeomMultiPolygon,
+		"LineStringM":    fgbGeomLineString,
+		"Geometry":       fgbGeomUnknown,
+		"CircularString": fgbGeomUnknown,
+	} {
+		if got := fgbGeometryType(geomType); got != want {
+			t.Errorf("fgbGeometryType(%v) = %v, want %v", geomType, got, want)
+		}
+	}
+}
+
+func TestFgbGeometry(t *testing.T) {
+	var gj fgbGeoJSON
+	json.Unmarshal([]byte(`{"type":"MultiLineString","coordinates":[[[0,0],[1,1]],[[2,2],[3,3],[4,4]]]}`), &gj) //nolint:errcheck
+	geom, err := gj.toGeometry()
+	if err != nil {
+		t.Fatalf("toGeometry error: %v", err)
+	}
+	if !reflect.DeepEqual(geom.ends, []uint32{2, 5}) {
+		t.Errorf("ends = %v, want [2 5]", geom.ends)
+	}
+	if !reflect.DeepEqual(geom.xy, []float64{0, 0, 1, 1, 2, 2, 3, 3, 4, 4}) {
+		t.Errorf("xy = %v", geom.xy)
+	}
+
+	gj = fgbGeoJSON{Type: "Curve"}
+	if _, err := gj.toGeometry(); err == nil {
+		t.Errorf("toGeometry of unsupported type: expected error")
+	}
+}
+
+func TestFlatGeobufWriter(t *testing.T) {
+	var buf bytes.Buffer
+	fw := NewFlatGeobufWriter(&buf, "pts", testTable(), []string{"name", "price", "count"}, 4326)
+	if fw.columns[0].name != "label" || fw.columns[1].colType != fgbColDouble || fw.columns[2].colType != fgbColLong {
+		t.Errorf("columns = %v", fw.columns)
+	}
+	if err := fw.WriteHeader(); err != nil {
+		t.Fatalf("WriteHeader error: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), fgbMagic) {
+		t.Errorf("output does not start with the FlatGeobuf signature")
+	}
+	headerLen := len(buf.Bytes())
+	feat := `{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]},"properties":{"label":"a","price":"12.50","count":null}}`
+	if err := fw.WriteFeature(feat); err != nil {
+		t.Fatalf("WriteFeature error: %v", err)
+	}
+	//-- the feature is written with its size prefix
+	out := buf.Bytes()[headerLen:]
+	size := binary.LittleEndian.Uint32(out)
+	if int(size)+4 != len(out) {
+		t.Errorf("feature size = %v, want %v", size, len(out)-4)
+	}
+	if !bytes.Contains(out, float64Bytes(12.5)) {
+		t.Errorf("feature does not contain the numeric value")
+	}
+
+	err := fw.WriteFeature(`{"type":"Feature","geometry":null,"properties":{"price":"x"}}`)
+	if err == nil {
+		t.Errorf("WriteFeature of invalid number: expected error")
+	}
+}
+
+func float64Bytes(num float64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(num))
+	return b
+}
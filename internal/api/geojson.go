@@ -0,0 +1,137 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// geoJSONFlushFeatures is the number of features written between flushes of a stream
+const geoJSONFlushFeatures = 1000
+
+// GeoJSONWriter writes a GeoJSON feature collection as features are read.
+// The number of features is not known in advance,
+// so numberReturned is written after the features,
+// and numberMatched is written only if it is set.
+// Nothing is written until the first feature or Close,
+// so an error before then can still be reported in the response status
+type GeoJSONWriter struct {
+	w         io.Writer
+	links     []*Link
+	timeStamp string
+	count     int
+	isStarted bool
+	// numberMatched is the number of features selected by the query (if known)
+	numberMatched *uint
+	// isArray writes a bare array of features, with no collection members
+	isArray bool
+}
+
+// NewGeoJSONWriter creates a writer for a feature collection with links
+func NewGeoJSONWriter(w io.Writer, links []*Link) *GeoJSONWriter {
+	return &GeoJSONWriter{
+		w:         w,
+		links:     links,
+		timeStamp: time.Now().Format(time.RFC3339),
+	}
+}
+
+// NewGeoJSONArrayWriter creates a writer for a bare array of features
+func NewGeoJSONArrayWriter(w io.Writer) *GeoJSONWriter {
+	return &GeoJSONWriter{w: w, isArray: true}
+}
+
+// SetNumberMatched sets the number of features selected by the query,
+// which is written at the end of the collection
+func (gw *GeoJSONWriter) SetNumberMatched(count uint) {
+	gw.numberMatched = &count
+}
+
+// IsStarted tests if any of the feature collection has been written
+func (gw *GeoJSONWriter) IsStarted() bool {
+	return gw.isStarted
+}
+
+// WriteFeature writes a feature of the collection.
+// The output is flushed periodically, if the writer supports it
+func (gw *GeoJSONWriter) WriteFeature(featJSON string) error {
+	if err := gw.start(); err != nil {
+		return err
+	}
+	sep := ","
+	if gw.count == 0 {
+		sep = ""
+	}
+	if _, err := io.WriteString(gw.w, sep+featJSON); err != nil {
+		return err
+	}
+	gw.count++
+	if gw.count%geoJSONFlushFeatures == 0 {
+		if f, ok := gw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return nil
+}
+
+// Close writes the end of the feature collection
+func (gw *GeoJSONWriter) Close() error {
+	if err := gw.start(); err != nil {
+		return err
+	}
+	if gw.isArray {
+		_, err := io.WriteString(gw.w, "]")
+		return err
+	}
+	links, err := json.Marshal(gw.links)
+	if err != nil {
+		return err
+	}
+	end := `],"numberReturned":` + strconv.Itoa(gw.count)
+	if gw.numberMatched != nil {
+		end += `,"numberMatched":` + strconv.FormatUint(uint64(*gw.numberMatched), 10)
+	}
+	end += `,"timeStamp":"` + gw.timeStamp + `","links":` + string(links) + `}`
+	_, err = io.WriteString(gw.w, end)
+	return err
+}
+
+func (gw *GeoJSONWriter) start() error {
+	if gw.isStarted {
+		return nil
+	}
+	gw.isStarted = true
+	head := `{"type":"` + GeoJSONFeatureCollection + `","features":[`
+	if gw.isArray {
+		head = "["
+	}
+	_, err := io.WriteString(gw.w, head)
+	return err
+}
+
+// LinkHeader formats links as the value of an HTTP Link header (RFC 8288)
+func LinkHeader(links []*Link) string {
+	var vals []string
+	for _, link := range links {
+		vals = append(vals, fmt.Sprintf(`<%s>; rel="%s"; type="%s"; title=%s`,
+			link.Href, link.Rel, link.Type, strconv.Quote(link.Title)))
+	}
+	return strings.Join(vals, ", ")
+}
@@ -0,0 +1,92 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestGeoJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	links := []*Link{{Href: "http://x/items", Rel: RelSelf, Type: ContentTypeGeoJSON, Title: "self"}}
+	gw := NewGeoJSONWriter(&buf, links)
+	if gw.IsStarted() {
+		t.Errorf("writer is started before writing")
+	}
+	gw.SetNumberMatched(5)
+	for _, feat := range []string{`{"type":"Feature","id":1}`, `{"type":"Feature","id":2}`} {
+		if err := gw.WriteFeature(feat); err != nil {
+			t.Fatalf("WriteFeature error: %v", err)
+		}
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	var fc struct {
+		Type           string            `json:"type"`
+		Features       []json.RawMessage `json:"features"`
+		NumberReturned int               `json:"numberReturned"`
+		NumberMatched  *int              `json:"numberMatched"`
+		Links          []*Link           `json:"links"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &fc); err != nil {
+		t.Fatalf("invalid JSON %v: %v", buf.String(), err)
+	}
+	if fc.Type != GeoJSONFeatureCollection || len(fc.Features) != 2 || fc.NumberReturned != 2 {
+		t.Errorf("unexpected collection: %v", buf.String())
+	}
+	if fc.NumberMatched == nil || *fc.NumberMatched != 5 {
+		t.Errorf("numberMatched = %v, want 5", fc.NumberMatched)
+	}
+	if len(fc.Links) != 1 || fc.Links[0].Href != "http://x/items" {
+		t.Errorf("unexpected links: %v", buf.String())
+	}
+}
+
+func TestGeoJSONWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewGeoJSONWriter(&buf, nil).Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	var fc map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fc); err != nil {
+		t.Fatalf("invalid JSON %v: %v", buf.String(), err)
+	}
+	if _, ok := fc["numberMatched"]; ok {
+		t.Errorf("numberMatched is written when it is not set")
+	}
+
+	buf.Reset()
+	gw := NewGeoJSONArrayWriter(&buf)
+	gw.WriteFeature("{}") //nolint:errcheck
+	gw.WriteFeature("{}") //nolint:errcheck
+	gw.Close()            //nolint:errcheck
+	if buf.String() != "[{},{}]" {
+		t.Errorf("array = %v, want [{},{}]", buf.String())
+	}
+}
+
+func TestLinkHeader(t *testing.T) {
+	links := []*Link{
+		{Href: "http://x/a", Rel: RelSelf, Type: ContentTypeJSON, Title: "this"},
+		{Href: "http://x/b", Rel: RelAlt, Type: ContentTypeJSON, Title: "next \"page\""},
+	}
+	want := `<http://x/a>; rel="self"; type="application/json"; title="this", ` +
+		`<http://x/b>; rel="alternate"; type="application/json"; title="next \"page\""`
+	if got := LinkHeader(links); got != want {
+		t.Errorf("LinkHeader = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// NamespaceGML is the GML 3.2 namespace
+	NamespaceGML = "http://www.opengis.net/gml/3.2"
+
+	// gmlPrefixFeature is the namespace prefix for feature types and properties
+	gmlPrefixFeature = "pgfs"
+)
+
+// featureGML holds the feature JSON values needed for GML encoding.
+// The geometry is a JSON string containing GML
+type featureGML struct {
+	ID         string                     `json:"id"`
+	Geometry   *string                    `json:"geometry"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+// FeatureCollectionGML encodes features as a GML 3.2 FeatureCollection.
+// The feature geometry values must have been output as GML.
+// The feature type and property elements are in the namespace nsURL
+func FeatureCollectionGML(name string, geomName string, featureJSON []string, nsURL string) ([]byte, error) {
+	typeName := xmlName(name)
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, `<gml:FeatureCollection xmlns:gml="%v" xmlns:%v="%v" gml:id="%v">`,
+		NamespaceGML, gmlPrefixFeature, xmlAttr(nsURL), typeName)
+	buf.WriteString("\n")
+	for _, feat := range featureJSON {
+		buf.WriteString("<gml:featureMember>\n")
+		if err := writeFeatureGML(&buf, typeName, xmlName(geomName), feat); err != nil {
+			return nil, err
+		}
+		buf.WriteString("</gml:featureMember>\n")
+	}
+	buf.WriteString("</gml:FeatureCollection>\n")
+	return buf.Bytes(), nil
+}
+
+func writeFeatureGML(buf *bytes.Buffer, typeName string, geomName string, featJSON string) error {
+	var feat featureGML
+	if err := json.Unmarshal([]byte(featJSON), &feat); err != nil {
+		return err
+	}
+	if feat.ID == "" {
+		fmt.Fprintf(buf, "<%v:%v>\n", gmlPrefixFeature, typeName)
+	} else {
+		fmt.Fprintf(buf, "<%v:%v gml:id=\"%v\">\n", gmlPrefixFeature, typeName, xmlName(typeName+"."+feat.ID))
+	}
+	//-- sort property names so output is deterministic
+	names := make([]string, 0, len(feat.Properties))
+	for name := range feat.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		val, isNull := gmlPropertyValue(feat.Properties[name])
+		if isNull {
+			continue
+		}
+		elem := xmlName(name)
+		fmt.Fprintf(buf, "<%v:%v>", gmlPrefixFeature, elem)
+		xml.EscapeText(buf, []byte(val)) //nolint:errcheck
+		fmt.Fprintf(buf, "</%v:%v>\n", gmlPrefixFeature, elem)
+	}
+	if feat.Geometry != nil {
+		fmt.Fprintf(buf, "<%v:%v>%v</%v:%v>\n", gmlPrefixFeature, geomName, *feat.Geometry, gmlPrefixFeature, geomName)
+	}
+	fmt.Fprintf(buf, "</%v:%v>\n", gmlPrefixFeature, typeName)
+	return nil
+}
+
+// gmlPropertyValue converts a JSON property value to element text.
+// Strings are unquoted, and other values are output as JSON
+func gmlPropertyValue(raw json.RawMessage) (string, bool) {
+	val := string(raw)
+	if val == "" || val == "null" {
+		return "", true
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return str, false
+	}
+	return val, false
+}
+
+// xmlName converts a name to a valid XML element name,
+// by replacing invalid characters with underscores
+func xmlName(name string) string {
+	var sb strings.Builder
+	for i, c := range name {
+		isAlpha := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+		isNameChar := isAlpha || (c >= '0' && c <= '9') || c == '-' || c == '.'
+		switch {
+		case i == 0 && !isAlpha:
+			sb.WriteRune('_')
+			if isNameChar {
+				sb.WriteRune(c)
+			}
+		case isNameChar:
+			sb.WriteRune(c)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+func xmlAttr(val string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(val)) //nolint:errcheck
+	return buf.String()
+}
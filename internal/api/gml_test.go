@@ -0,0 +1,60 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFeatureCollectionGML(t *testing.T) {
+	feats := []string{
+		`{"id":"1","geometry":"<gml:Point><gml:pos>1 2</gml:pos></gml:Point>","properties":{"name":"a<b","n":2,"x":null}}`,
+	}
+	got, err := FeatureCollectionGML("public.pts", "geom", feats, "http://x/ns")
+	if err != nil {
+		t.Fatalf("FeatureCollectionGML error: %v", err)
+	}
+	for _, want := range []string{
+		`xmlns:pgfs="http://x/ns" gml:id="public.pts"`,
+		`<pgfs:public.pts gml:id="public.pts.1">`,
+		"<pgfs:n>2</pgfs:n>\n<pgfs:name>a&lt;b</pgfs:name>\n",
+		"<pgfs:geom><gml:Point><gml:pos>1 2</gml:pos></gml:Point></pgfs:geom>",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("GML does not contain %v:\n%v", want, string(got))
+		}
+	}
+	if strings.Contains(string(got), "pgfs:x") {
+		t.Errorf("GML contains a null property:\n%v", string(got))
+	}
+
+	if _, err := FeatureCollectionGML("t", "geom", []string{"{"}, ""); err == nil {
+		t.Errorf("FeatureCollectionGML of invalid JSON: expected error")
+	}
+}
+
+func TestXMLName(t *testing.T) {
+	for name, want := range map[string]string{
+		"name":      "name",
+		"1st":       "_1st",
+		"a b/c":     "a_b_c",
+		"-x":        "_-x",
+		"schema.tb": "schema.tb",
+	} {
+		if got := xmlName(name); got != want {
+			t.Errorf("xmlName(%v) = %v, want %v", name, got, want)
+		}
+	}
+}
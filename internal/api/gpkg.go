@@ -0,0 +1,475 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CrunchyData/pg_featureserv/internal/data"
+)
+
+// GeoPackage encoding, as specified in https://www.geopackage.org/spec121/
+// The file contains the required metadata tables and a single feature table,
+// with no spatial index
+
+const (
+	// gpkgApplicationID is the SQLite application id of a GeoPackage ("GPKG")
+	gpkgApplicationID = 0x47504B47
+	// gpkgUserVersion is the GeoPackage version (1.2)
+	gpkgUserVersion = 10200
+	// gpkgFidColumn is the name of the feature table primary key
+	gpkgFidColumn = "fid"
+	// gpkgGeomColumn is the name of the geometry column of tables which do not name it
+	gpkgGeomColumn = "geom"
+)
+
+const gpkgSQLSpatialRefSys = `CREATE TABLE gpkg_spatial_ref_sys (srs_name TEXT NOT NULL, srs_id INTEGER NOT NULL PRIMARY KEY, organization TEXT NOT NULL, organization_coordsys_id INTEGER NOT NULL, definition TEXT NOT NULL, description TEXT)`
+
+const gpkgSQLContents = `CREATE TABLE gpkg_contents (table_name TEXT NOT NULL PRIMARY KEY, data_type TEXT NOT NULL, identifier TEXT UNIQUE, description TEXT DEFAULT '', last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')), min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE, srs_id INTEGER, CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id))`
+
+const gpkgSQLGeometryColumns = `CREATE TABLE gpkg_geometry_columns (table_name TEXT NOT NULL, column_name TEXT NOT NULL, geometry_type_name TEXT NOT NULL, srs_id INTEGER NOT NULL, z TINYINT NOT NULL, m TINYINT NOT NULL, CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name), CONSTRAINT uk_gc_table_name UNIQUE (table_name), CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name), CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id))`
+
+const gpkgWKT4326 = `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]`
+
+// gpkgColTypes maps Postgres types to GeoPackage column types.
+// Other types are output as text
+var gpkgColTypes = map[string]string{
+	"bool":        "BOOLEAN",
+	"int2":        "SMALLINT",
+	"int4":        "MEDIUMINT",
+	"int8":        "INTEGER",
+	"float4":      "FLOAT",
+	"float8":      "DOUBLE",
+	"numeric":     "DOUBLE",
+	"date":        "DATE",
+	"timestamp":   "DATETIME",
+	"timestamptz": "DATETIME",
+}
+
+type gpkgColumn struct {
+	name    string
+	colType string
+}
+
+// GeoPackageWriter writes features to a GeoPackage file.
+// The features must have their geometry encoded as hex WKB
+type GeoPackageWriter struct {
+	file        *sqliteFile
+	features    *sqliteTable
+	tableName   string
+	identifier  string
+	description string
+	geomColumn  string
+	geomType    string
+	fidColumn   string
+	srid        int
+	columns     []gpkgColumn
+	count       int64
+	extent      gpkgEnvelope
+}
+
+// NewGeoPackageWriter creates a writer for features of a table.
+// The column types are determined from the table column types
+func NewGeoPackageWriter(w io.WriterAt, tableName string, tbl *data.Table, propNames []string, srid int) *GeoPackageWriter {
+	geomColumn := tbl.GeometryColumn
+	if geomColumn == "" {
+		geomColumn = gpkgGeomColumn
+	}
+	columns := make([]gpkgColumn, len(propNames))
+	colNames := map[string]bool{strings.ToLower(geomColumn): true}
+	outNames := tbl.OutputNames(propNames)
+	for i, propName := range propNames {
+		colType, ok := gpkgColTypes[tbl.DbTypes[propName]]
+		if !ok {
+			colType = "TEXT"
+		}
+		columns[i] = gpkgColumn{name: outNames[i], colType: colType}
+		colNames[strings.ToLower(columns[i].name)] = true
+	}
+	//-- SQLite names are case-insensitive
+	fidColumn := gpkgFidColumn
+	for colNames[fidColumn] {
+		fidColumn += "_"
+	}
+	file := newSQLiteFile(w, gpkgApplicationID, gpkgUserVersion)
+	return &GeoPackageWriter{
+		file:        file,
+		features:    file.createTable(),
+		tableName:   tableName,
+		identifier:  tbl.Title,
+		description: tbl.Description,
+		geomColumn:  geomColumn,
+		geomType:    gpkgGeometryType(tbl.GeometryType),
+		fidColumn:   fidColumn,
+		srid:        srid,
+		columns:     columns,
+	}
+}
+
+// gpkgGeometryType converts a PostGIS geometry type name to the GeoPackage type.
+// Coordinate dimension suffixes are ignored, since they are recorded separately
+func gpkgGeometryType(geomType string) string {
+	name := strings.ToUpper(geomType)
+	for _, suffix := range []string{"ZM", "Z", "M"} {
+		if strings.HasSuffix(name, suffix) {
+			name = strings.TrimSuffix(name, suffix)
+			break
+		}
+	}
+	if _, ok := fgbGeomTypes[name]; !ok {
+		return "GEOMETRY"
+	}
+	return name
+}
+
+// WriteFeature writes a feature provided as JSON, with a hex WKB geometry
+func (gw *GeoPackageWriter) WriteFeature(featJSON string) error {
+	var feat struct {
+		Geometry   *string                    `json:"geometry"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal([]byte(featJSON), &feat); err != nil {
+		return err
+	}
+	values := make([]interface{}, 0, len(gw.columns)+2)
+	//-- the primary key is the rowid, so it is not stored in the record
+	values = append(values, nil)
+	if feat.Geometry == nil {
+		values = append(values, nil)
+	} else {
+		wkb, err := hex.DecodeString(*feat.Geometry)
+		if err != nil {
+			return err
+		}
+		geom, err := gw.geometry(wkb)
+		if err != nil {
+			return err
+		}
+		values = append(values, geom)
+	}
+	for _, col := range gw.columns {
+		val, err := gpkgValue(col.colType, feat.Properties[col.name])
+		if err != nil {
+			return fmt.Errorf("property %v: %v", col.name, err)
+		}
+		values = append(values, val)
+	}
+	gw.count++
+	return gw.features.insert(gw.count, values)
+}
+
+// geometry encodes a WKB geometry as a GeoPackage geometry,
+// with the envelope of geometries other than points
+func (gw *GeoPackageWriter) geometry(wkb []byte) ([]byte, error) {
+	var env gpkgEnvelope
+	geomType, err := env.readWKB(bytes.NewReader(wkb))
+	if err != nil {
+		return nil, err
+	}
+	gw.extent.expandEnvelope(env)
+	//-- little-endian header
+	flags := byte(0x01)
+	switch {
+	case !env.isSet:
+		flags |= 0x10
+	case geomType != wkbPoint:
+		flags |= 0x02
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{'G', 'P', 0, flags})
+	binary.Write(&buf, binary.LittleEndian, int32(gw.srid)) //nolint:errcheck
+	if flags&0x02 != 0 {
+		binary.Write(&buf, binary.LittleEndian, []float64{env.minX, env.maxX, env.minY, env.maxY}) //nolint:errcheck
+	}
+	buf.Write(wkb)
+	return buf.Bytes(), nil
+}
+
+func gpkgValue(colType string, raw json.RawMessage) (interface{}, error) {
+	text := string(raw)
+	if len(raw) == 0 || text == "null" {
+		return nil, nil
+	}
+	switch colType {
+	case "BOOLEAN":
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return nil, err
+		}
+		if b {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "SMALLINT", "MEDIUMINT", "INTEGER":
+		return strconv.ParseInt(numberText(raw), 10, 64)
+	case "FLOAT", "DOUBLE":
+		return strconv.ParseFloat(numberText(raw), 64)
+	}
+	//-- strings are unquoted, other values are output as JSON text
+	var str string
+	if json.Unmarshal(raw, &str) != nil {
+		str = text
+	}
+	return str, nil
+}
+
+// Close writes the feature table and the metadata tables
+func (gw *GeoPackageWriter) Close() error {
+	if err := gw.writeSpatialRefSys(); err != nil {
+		return err
+	}
+	if err := gw.writeContents(); err != nil {
+		return err
+	}
+	if err := gw.writeGeometryColumns(); err != nil {
+		return err
+	}
+	rootPage, err := gw.features.finish()
+	if err != nil {
+		return err
+	}
+	if err := gw.file.addSchema("table", gw.tableName, gw.tableName, rootPage, gw.createTableSQL()); err != nil {
+		return err
+	}
+	return gw.file.Close()
+}
+
+func (gw *GeoPackageWriter) createTableSQL() string {
+	cols := []string{
+		sqliteQuote(gw.fidColumn) + " INTEGER PRIMARY KEY",
+		sqliteQuote(gw.geomColumn) + " " + gw.geomType,
+	}
+	for _, col := range gw.columns {
+		cols = append(cols, sqliteQuote(col.name)+" "+col.colType)
+	}
+	return fmt.Sprintf("CREATE TABLE %v (%v)", sqliteQuote(gw.tableName), strings.Join(cols, ", "))
+}
+
+// writeSpatialRefSys writes the required undefined and WGS 84 systems,
+// and the output system if it is different.
+// Rows are in rowid (srs_id) order
+func (gw *GeoPackageWriter) writeSpatialRefSys() error {
+	tbl := gw.file.createTable()
+	rows := [][]interface{}{
+		{"Undefined cartesian SRS", nil, "NONE", int64(-1), "undefined", "undefined cartesian coordinate reference system"},
+		{"Undefined geographic SRS", nil, "NONE", int64(0), "undefined", "undefined geographic coordinate reference system"},
+	}
+	epsg := func(srid int, definition string) []interface{} {
+		return []interface{}{fmt.Sprintf("EPSG:%v", srid), nil, "EPSG", int64(srid), definition, nil}
+	}
+	if gw.srid > 0 && gw.srid < data.SRID_4326 {
+		rows = append(rows, epsg(gw.srid, "undefined"))
+	}
+	rows = append(rows, epsg(data.SRID_4326, gpkgWKT4326))
+	if gw.srid > data.SRID_4326 {
+		rows = append(rows, epsg(gw.srid, "undefined"))
+	}
+	for _, row := range rows {
+		if err := tbl.insert(row[3].(int64), row); err != nil {
+			return err
+		}
+	}
+	rootPage, err := tbl.finish()
+	if err != nil {
+		return err
+	}
+	return gw.file.addSchema("table", "gpkg_spatial_ref_sys", "gpkg_spatial_ref_sys", rootPage, gpkgSQLSpatialRefSys)
+}
+
+func (gw *GeoPackageWriter) writeContents() error {
+	const name = "gpkg_contents"
+	tbl := gw.file.createTable()
+	var minX, minY, maxX, maxY interface{}
+	if gw.extent.isSet {
+		minX, minY, maxX, maxY = gw.extent.minX, gw.extent.minY, gw.extent.maxX, gw.extent.maxY
+	}
+	lastChange := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	row := []interface{}{gw.tableName, "features", gw.identifier, gw.description, lastChange,
+		minX, minY, maxX, maxY, int64(gw.srid)}
+	if err := tbl.insert(1, row); err != nil {
+		return err
+	}
+	rootPage, err := tbl.finish()
+	if err != nil {
+		return err
+	}
+	if err := gw.file.addSchema("table", name, name, rootPage, gpkgSQLContents); err != nil {
+		return err
+	}
+	//-- indexes for the primary key and unique constraints
+	if err := gw.file.addIndex("sqlite_autoindex_gpkg_contents_1", name,
+		[][]byte{sqliteRecord([]interface{}{gw.tableName, int64(1)})}); err != nil {
+		return err
+	}
+	return gw.file.addIndex("sqlite_autoindex_gpkg_contents_2", name,
+		[][]byte{sqliteRecord([]interface{}{gw.identifier, int64(1)})})
+}
+
+func (gw *GeoPackageWriter) writeGeometryColumns() error {
+	const name = "gpkg_geometry_columns"
+	tbl := gw.file.createTable()
+	//-- Z and M values are optional
+	row := []interface{}{gw.tableName, gw.geomColumn, gw.geomType, int64(gw.srid), int64(2), int64(2)}
+	if err := tbl.insert(1, row); err != nil {
+		return err
+	}
+	rootPage, err := tbl.finish()
+	if err != nil {
+		return err
+	}
+	if err := gw.file.addSchema("table", name, name, rootPage, gpkgSQLGeometryColumns); err != nil {
+		return err
+	}
+	if err := gw.file.addIndex("sqlite_autoindex_gpkg_geometry_columns_1", name,
+		[][]byte{sqliteRecord([]interface{}{gw.tableName, gw.geomColumn, int64(1)})}); err != nil {
+		return err
+	}
+	return gw.file.addIndex("sqlite_autoindex_gpkg_geometry_columns_2", name,
+		[][]byte{sqliteRecord([]interface{}{gw.tableName, int64(1)})})
+}
+
+// sqliteQuote quotes an SQL identifier
+func sqliteQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// WKB geometry types
+const (
+	wkbPoint              = 1
+	wkbLineString         = 2
+	wkbPolygon            = 3
+	wkbMultiPoint         = 4
+	wkbMultiLineString    = 5
+	wkbMultiPolygon       = 6
+	wkbGeometryCollection = 7
+)
+
+// gpkgEnvelope is the XY extent of a geometry (not set if it is empty)
+type gpkgEnvelope struct {
+	isSet                  bool
+	minX, minY, maxX, maxY float64
+}
+
+func (env *gpkgEnvelope) expand(x float64, y float64) {
+	if !env.isSet {
+		*env = gpkgEnvelope{isSet: true, minX: x, minY: y, maxX: x, maxY: y}
+		return
+	}
+	env.minX = math.Min(env.minX, x)
+	env.minY = math.Min(env.minY, y)
+	env.maxX = math.Max(env.maxX, x)
+	env.maxY = math.Max(env.maxY, y)
+}
+
+func (env *gpkgEnvelope) expandEnvelope(other gpkgEnvelope) {
+	if other.isSet {
+		env.expand(other.minX, other.minY)
+		env.expand(other.maxX, other.maxY)
+	}
+}
+
+// readWKB expands the envelope by the coordinates of a WKB geometry,
+// and returns its type.
+// Both ISO and PostGIS extended WKB dimension flags are accepted
+func (env *gpkgEnvelope) readWKB(r *bytes.Reader) (uint32, error) {
+	orderByte, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if orderByte == 1 {
+		order = binary.LittleEndian
+	}
+	var geomType uint32
+	if err := binary.Read(r, order, &geomType); err != nil {
+		return 0, err
+	}
+	dims := 2
+	if geomType&0x80000000 != 0 {
+		dims++
+	}
+	if geomType&0x40000000 != 0 {
+		dims++
+	}
+	if geomType&0x20000000 != 0 {
+		var srid uint32
+		if err := binary.Read(r, order, &srid); err != nil {
+			return 0, err
+		}
+	}
+	geomType &= 0x0fffffff
+	switch geomType / 1000 {
+	case 1, 2:
+		dims++
+	case 3:
+		dims += 2
+	}
+	geomType %= 1000
+
+	readCount := func() (uint32, error) {
+		var n uint32
+		err := binary.Read(r, order, &n)
+		return n, err
+	}
+	switch geomType {
+	case wkbPoint:
+		err = env.readPoints(r, order, dims, 1)
+	case wkbLineString:
+		var n uint32
+		if n, err = readCount(); err == nil {
+			err = env.readPoints(r, order, dims, n)
+		}
+	case wkbPolygon:
+		var numRings, n uint32
+		numRings, err = readCount()
+		for i := uint32(0); err == nil && i < numRings; i++ {
+			if n, err = readCount(); err == nil {
+				err = env.readPoints(r, order, dims, n)
+			}
+		}
+	case wkbMultiPoint, wkbMultiLineString, wkbMultiPolygon, wkbGeometryCollection:
+		var numParts uint32
+		numParts, err = readCount()
+		for i := uint32(0); err == nil && i < numParts; i++ {
+			_, err = env.readWKB(r)
+		}
+	default:
+		err = fmt.Errorf("unsupported WKB geometry type: %v", geomType)
+	}
+	return geomType, err
+}
+
+// readPoints reads points with the given number of dimensions.
+// Empty points have NaN coordinates
+func (env *gpkgEnvelope) readPoints(r *bytes.Reader, order binary.ByteOrder, dims int, n uint32) error {
+	coords := make([]float64, dims)
+	for i := uint32(0); i < n; i++ {
+		if err := binary.Read(r, order, coords); err != nil {
+			return err
+		}
+		if !math.IsNaN(coords[0]) {
+			env.expand(coords[0], coords[1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// bufferAt is an in-memory io.WriterAt
+type bufferAt struct {
+	data []byte
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	return copy(b.data[off:], p), nil
+}
+
+func TestGpkgValue(t *testing.T) {
+	cases := []struct {
+		colType string
+		raw     string
+		want    interface{}
+	}{
+		{"BOOLEAN", "true", int64(1)},
+		{"INTEGER", "42", int64(42)},
+		{"DOUBLE", "12.5", 12.5},
+		//-- numeric values may be written as strings
+		{"DOUBLE", "\"12.50\"", 12.5},
+		{"TEXT", "\"ab\"", "ab"},
+		{"TEXT", "[1,2]", "[1,2]"},
+		{"TEXT", "null", nil},
+		{"DOUBLE", "", nil},
+	}
+	for _, c := range cases {
+		got, err := gpkgValue(c.colType, json.RawMessage(c.raw))
+		if err != nil {
+			t.Errorf("gpkgValue(%v, %v) error: %v", c.colType, c.raw, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("gpkgValue(%v, %v) = %v, want %v", c.colType, c.raw, got, c.want)
+		}
+	}
+	if _, err := gpkgValue("DOUBLE", json.RawMessage("\"abc\"")); err == nil {
+		t.Errorf("gpkgValue of invalid number: expected error")
+	}
+}
+
+func TestGpkgEnvelope(t *testing.T) {
+	var env gpkgEnvelope
+	geomType, err := env.readWKB(bytes.NewReader(testWKBLineString(3, -1, 1, 4)))
+	if err != nil {
+		t.Fatalf("readWKB error: %v", err)
+	}
+	if geomType != wkbLineString {
+		t.Errorf("geometry type = %v, want %v", geomType, wkbLineString)
+	}
+	want := gpkgEnvelope{isSet: true, minX: 1, minY: -1, maxX: 3, maxY: 4}
+	if env != want {
+		t.Errorf("envelope = %v, want %v", env, want)
+	}
+}
+
+func TestGeoPackageWriter(t *testing.T) {
+	var out bufferAt
+	tbl := testTable()
+	//-- the fid column is renamed if a property has its name
+	tbl.DbTypes["FID"] = "text"
+	gw := NewGeoPackageWriter(&out, "pts", tbl, []string{"FID", "name", "price"}, 4326)
+	if gw.fidColumn != "fid_" {
+		t.Errorf("fid column = %v, want fid_", gw.fidColumn)
+	}
+	feat := `{"type":"Feature","geometry":"` + hex.EncodeToString(testWKBLineString(0, 0, 2, 3)) +
+		`","properties":{"FID":"x","label":"a","price":"12.50"}}`
+	if err := gw.WriteFeature(feat); err != nil {
+		t.Fatalf("WriteFeature error: %v", err)
+	}
+	if err := gw.WriteFeature(`{"type":"Feature","geometry":null,"properties":{}}`); err != nil {
+		t.Fatalf("WriteFeature error: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if gw.count != 2 {
+		t.Errorf("count = %v, want 2", gw.count)
+	}
+	want := gpkgEnvelope{isSet: true, minX: 0, minY: 0, maxX: 2, maxY: 3}
+	if gw.extent != want {
+		t.Errorf("extent = %v, want %v", gw.extent, want)
+	}
+	checkSQLiteHeader(t, out.data, gpkgApplicationID, gpkgUserVersion)
+	if !bytes.Contains(out.data, []byte(`CREATE TABLE "pts"`)) {
+		t.Errorf("feature table is not in the schema")
+	}
+
+	err := gw.WriteFeature(`{"type":"Feature","geometry":null,"properties":{"price":"x"}}`)
+	if err == nil || !strings.Contains(err.Error(), "price") {
+		t.Errorf("WriteFeature of invalid number: error = %v", err)
+	}
+}
+
+// testWKBLineString encodes a linestring as little-endian WKB
+func testWKBLineString(coords ...float64) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(1)
+	binary.Write(&buf, binary.LittleEndian, uint32(wkbLineString)) //nolint:errcheck
+	binary.Write(&buf, binary.LittleEndian, uint32(len(coords)/2)) //nolint:errcheck
+	for _, c := range coords {
+		binary.Write(&buf, binary.LittleEndian, math.Float64bits(c)) //nolint:errcheck
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,235 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// LangEnglish is the language of the message constants, and the default
+	LangEnglish = "en"
+	LangFrench  = "fr"
+)
+
+// messageCatalog provides the translations of messages for each supported language.
+// Translations are keyed by the English message (which may be a format string),
+// and must use the same format verbs in the same order
+var messageCatalog = map[string]map[string]string{
+	LangFrench: {
+		ErrMsgEncoding:              "Erreur lors de l'encodage de la réponse",
+		ErrMsgLoadCollections:       "Impossible d'accéder aux collections",
+		ErrMsgCollectionNotFound:    "Collection introuvable : %v",
+		ErrMsgCollectionAccess:      "Impossible d'accéder à la collection : %v",
+		ErrMsgFeatureNotFound:       "Entité introuvable : %v",
+		ErrMsgLoadFunctions:         "Impossible d'accéder aux fonctions",
+		ErrMsgFunctionNotFound:      "Fonction introuvable : %v",
+		ErrMsgFunctionAccess:        "Impossible d'accéder à la fonction : %v",
+		ErrMsgInvalidParameterValue: "Valeur invalide pour le paramètre %v : %v",
+		ErrMsgUnknownParameter:      "Paramètre de requête inconnu : %v",
+		ErrMsgMissingParameter:      "Valeur manquante pour le paramètre obligatoire : %v",
+		ErrMsgOffsetMax:             "Le paramètre offset dépasse le maximum de %v (utiliser un filtre sur la clé de tri pour continuer)",
+		ErrMsgDistinctNoProperties:  "Le paramètre distinct nécessite une liste de propriétés",
+		ErrMsgDistinctFormat:        "Le paramètre distinct n'est pas pris en charge pour le format : %v",
+		ErrMsgClusterConflict:       "Le paramètre cluster ne peut pas être utilisé avec le paramètre : %v",
+		ErrMsgClusterFormat:         "Le paramètre cluster n'est pas pris en charge pour le format : %v",
+		ErrMsgAggregateConflict:     "Le paramètre aggregate ne peut pas être utilisé avec le paramètre : %v",
+		ErrMsgAggregateFormat:       "Le paramètre aggregate n'est pas pris en charge pour le format : %v",
+		ErrMsgGeomFormat:            "Le paramètre geometry-format n'est pas pris en charge pour le format : %v",
+		ErrMsgDistanceNoPoint:       "Le tri par distance nécessite le paramètre point",
+		ErrMsgInvalidQuery:          "Paramètres de requête invalides",
+		ErrMsgDataReadError:         "Impossible de lire les données de : %v",
+		ErrMsgDataWriteError:        "Impossible d'écrire les données dans : %v",
+		ErrMsgNoDataRead:            "Aucune donnée lue de : %v",
+		ErrMsgRequestTimeout:        "Durée maximale dépassée.  Requête annulée.",
+		ErrMsgCollectionNotEditable: "La collection n'est pas modifiable : %v",
+		ErrMsgCollectionIsView:      "La collection est une vue et ne peut pas être modifiée : %v",
+		ErrMsgCollectionNoKey:       "La collection n'a pas de clé primaire et ne peut pas être modifiée : %v",
+		ErrMsgCollectionIDNotUnique: "La colonne d'identifiant de la collection n'a pas d'index unique et ne peut pas être modifiée : %v",
+		ErrMsgDataDeleteError:       "Impossible de supprimer les données de : %v",
+		ErrMsgInvalidPropertyPath:   "Le chemin de propriété ne référence pas une colonne JSON : %v",
+		ErrMsgUnauthorized:          "Clé d'API manquante ou invalide",
+		ErrMsgInvalidToken:          "Jeton d'autorisation manquant ou invalide",
+		ErrMsgNoTenantClaim:         "Le jeton d'autorisation n'a pas de revendication de locataire",
+		ErrMsgFeatureIDNotSupported: "La collection n'a pas de clé primaire et ne permet pas l'accès par identifiant d'entité : %v",
+		ErrMsgRateLimited:           "Trop de requêtes",
+		ErrMsgBboxMaxArea:           "La surface du paramètre bbox dépasse le maximum de %v (demander une zone plus petite)",
+		ErrMsgFacetProperty:         "Le paramètre property doit être une propriété non géométrique de la collection : %v",
+		ErrMsgFilterDenied:          "La propriété ne peut pas être utilisée comme filtre : %v",
+		ErrMsgLookupColumn:          "La colonne n'est pas une colonne de recherche de la collection : %v",
+		ErrMsgLookupNotUnique:       "La valeur de recherche correspond à plus d'une entité : %v",
+		ErrMsgFormatNotEnabled:      "Le format n'est pas activé : %v",
+		ErrMsgGeoPackageMaxFeatures: "La sortie GeoPackage est limitée à %v entités (utilisez un bbox, un filtre ou une limite)",
+		ErrMsgComputedFunction:      "La fonction n'est pas autorisée dans une propriété calculée : %v",
+		ErrMsgComputedColumn:        "La colonne de la propriété calculée n'est pas une colonne de la collection : %v",
+		ErrMsgResultTypeHits:        "resultType=hits n'est pas pris en charge avec %v",
+		ErrMsgTileConflict:          "Le paramètre tile ne peut pas être utilisé avec le paramètre : %v",
+		ErrMsgInvalidFeatures:       "Collection d'entités invalide : %v",
+		ErrMsgCrsNotSupported:       "Le système de coordonnées n'est pas pris en charge pour le paramètre %v : %v",
+		ErrMsgInvalidSearch:         "Requête de recherche invalide : %v",
+		ErrMsgBodyTooLarge:          "Le corps de la requête dépasse la taille maximale de %v octets",
+		ErrMsgBodyTimeout:           "Le corps de la requête n'a pas été reçu en %v secondes",
+		ErrMsgAdminNotEnabled:       "La requête d'administration n'est pas activée : %v",
+
+		TitleDocument:      "Ce document",
+		TitleAsJSON:        " en JSON",
+		TitleAsHTML:        " en HTML",
+		TitleAPIDefinition: "Définition de l'API",
+		TitleConformance:   "Classes de conformité OGC API implémentées par ce serveur",
+		TitleCollections:   "collections",
+		TitleFunctionsList: "fonctions",
+	},
+}
+
+// Message returns the translation of a message for a language.
+// Messages with no translation are returned unchanged
+func Message(lang string, msg string) string {
+	if trans, ok := messageCatalog[lang][msg]; ok {
+		return trans
+	}
+	return msg
+}
+
+// LocalizeMessage translates a message which has been formatted from a message format.
+// The format is found by matching the message against the catalog formats.
+// The format arguments are also translated, since they may be messages
+func LocalizeMessage(lang string, text string) string {
+	catalog, ok := messageCatalog[lang]
+	if !ok {
+		return text
+	}
+	if trans, ok := catalog[text]; ok {
+		return trans
+	}
+	for _, format := range messageFormats() {
+		args := format.re.FindStringSubmatch(text)
+		if args == nil {
+			continue
+		}
+		vals := make([]interface{}, len(args)-1)
+		for i, arg := range args[1:] {
+			vals[i] = LocalizeMessage(lang, arg)
+		}
+		return fmt.Sprintf(catalog[format.msg], vals...)
+	}
+	return text
+}
+
+type messageFormat struct {
+	msg string
+	re  *regexp.Regexp
+}
+
+var messageFormatsOnce sync.Once
+var messageFormatsList []messageFormat
+
+var reFormatVerb = regexp.MustCompile(`%[vsd]`)
+
+// messageFormats are the catalog messages containing format verbs,
+// with regular expressions which match messages formatted from them.
+// Longer formats are tested first, so that the most specific format matches
+func messageFormats() []messageFormat {
+	messageFormatsOnce.Do(func() {
+		msgs := make(map[string]bool)
+		for _, catalog := range messageCatalog {
+			for msg := range catalog {
+				if reFormatVerb.MatchString(msg) {
+					msgs[msg] = true
+				}
+			}
+		}
+		for msg := range msgs {
+			parts := reFormatVerb.Split(msg, -1)
+			for i, part := range parts {
+				parts[i] = regexp.QuoteMeta(part)
+			}
+			pattern := "^" + strings.Join(parts, "(.*?)") + "$"
+			messageFormatsList = append(messageFormatsList, messageFormat{msg, regexp.MustCompile(pattern)})
+		}
+		sort.Slice(messageFormatsList, func(i, j int) bool {
+			return len(messageFormatsList[i].msg) > len(messageFormatsList[j].msg)
+		})
+	})
+	return messageFormatsList
+}
+
+// RequestedLang gets the language for a request from the lang query parameter,
+// or the Accept-Language header.
+// Unsupported languages fall back to English
+func RequestedLang(r *http.Request) string {
+	if lang, ok := supportedLang(r.URL.Query().Get(ParamLang)); ok {
+		return lang
+	}
+	for _, tag := range acceptLanguages(r.Header.Get("Accept-Language")) {
+		if lang, ok := supportedLang(tag); ok {
+			return lang
+		}
+	}
+	return LangEnglish
+}
+
+// supportedLang returns the supported language of a language tag (e.g. fr-CA is fr)
+func supportedLang(tag string) (string, bool) {
+	lang := strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	if lang == LangEnglish {
+		return lang, true
+	}
+	_, ok := messageCatalog[lang]
+	return lang, ok
+}
+
+// acceptLanguages returns the language tags of an Accept-Language header, in order of preference
+func acceptLanguages(header string) []string {
+	type langQuality struct {
+		tag string
+		q   float64
+	}
+	var langs []langQuality
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+		tag := strings.TrimSpace(parts[0])
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if val, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = val
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, langQuality{tag, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+	tags := make([]string, len(langs))
+	for i, lang := range langs {
+		tags[i] = lang.tag
+	}
+	return tags
+}
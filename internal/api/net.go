@@ -16,6 +16,7 @@ package api
 import (
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -35,9 +36,30 @@ const (
 	// ContentTypeSVG
 	ContentTypeSVG = "image/svg+xml"
 
+	// ContentTypeGML
+	ContentTypeGML = "application/gml+xml;version=3.2"
+
+	// ContentTypeFlatGeobuf
+	ContentTypeFlatGeobuf = "application/flatgeobuf"
+
+	// ContentTypeCSV
+	ContentTypeCSV = "text/csv"
+
+	// ContentTypeGeoPackage
+	ContentTypeGeoPackage = "application/geopackage+sqlite3"
+
+	// ContentTypeSchemaJSON is the JSON Schema format
+	ContentTypeSchemaJSON = "application/schema+json"
+
+	// ContentTypeMetrics is the Prometheus text format
+	ContentTypeMetrics = "text/plain; version=0.0.4"
+
 	// ContentTypeHTML
 	ContentTypeOpenAPI = "application/vnd.oai.openapi+json;version=3.0"
 
+	// ContentTypeOpenAPIYAML is the OpenAPI document encoded as YAML
+	ContentTypeOpenAPIYAML = "application/vnd.oai.openapi;version=3.0"
+
 	// FormatJSON code and extension for JSON
 	FormatJSON = "json"
 
@@ -49,8 +71,34 @@ const (
 
 	// FormatText code and extension for Text
 	FormatSVG = "svg"
+
+	// FormatGML code and extension for GML
+	FormatGML = "gml"
+
+	// FormatFlatGeobuf code and extension for FlatGeobuf
+	FormatFlatGeobuf = "fgb"
+
+	// FormatCSV code and extension for CSV
+	FormatCSV = "csv"
+
+	// FormatGeoPackage code and extension for GeoPackage
+	FormatGeoPackage = "gpkg"
+
+	// FormatYAML code and extension for YAML
+	FormatYAML = "yaml"
 )
 
+// formatsQuery are the formats which can be requested with the f query parameter
+var formatsQuery = map[string]bool{
+	FormatJSON:       true,
+	FormatHTML:       true,
+	FormatGML:        true,
+	FormatFlatGeobuf: true,
+	FormatCSV:        true,
+	FormatGeoPackage: true,
+	FormatYAML:       true,
+}
+
 // RequestedFormat gets the format for a request from extension or headers
 func RequestedFormat(r *http.Request) string {
 	// first check explicit path
@@ -67,13 +115,73 @@ func RequestedFormat(r *http.Request) string {
 	if strings.HasSuffix(path, ".svg") {
 		return FormatSVG
 	}
+	if strings.HasSuffix(path, ".gml") {
+		return FormatGML
+	}
+	if strings.HasSuffix(path, ".fgb") {
+		return FormatFlatGeobuf
+	}
+	if strings.HasSuffix(path, ".csv") {
+		return FormatCSV
+	}
+	if strings.HasSuffix(path, ".gpkg") {
+		return FormatGeoPackage
+	}
+	if strings.HasSuffix(path, ".yaml") {
+		return FormatYAML
+	}
+	// then check f query parameter
+	fmtQuery := strings.ToLower(r.URL.Query().Get(ParamFormat))
+	if formatsQuery[fmtQuery] {
+		return fmtQuery
+	}
 	// Use Accept header if present
-	hdrAccept := r.Header.Get("Accept")
-	//fmt.Println("Accept:" + hdrAccept)
-	if strings.Contains(hdrAccept, ContentTypeHTML) {
-		return FormatHTML
+	return acceptedFormat(r.Header.Get("Accept"))
+}
+
+// acceptFormats are the formats for the media types of an Accept header
+var acceptFormats = map[string]string{
+	ContentTypeHTML:       FormatHTML,
+	"application/gml+xml": FormatGML,
+	ContentTypeFlatGeobuf: FormatFlatGeobuf,
+	ContentTypeCSV:        FormatCSV,
+	ContentTypeGeoPackage: FormatGeoPackage,
+	ContentTypeGeoJSON:    FormatJSON,
+	ContentTypeJSON:       FormatJSON,
+}
+
+// acceptedFormat returns the format of the media type of an Accept header with the highest quality.
+// Media types of the same quality are preferred in header order,
+// except that application/json is an alias for GeoJSON which is used
+// only if no other media type of its quality is accepted.
+// The format is JSON if no format is accepted
+func acceptedFormat(hdrAccept string) string {
+	format, bestQ, isAlias := FormatJSON, 0.0, false
+	for _, item := range strings.Split(hdrAccept, ",") {
+		parts := strings.Split(item, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if val, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = val
+				}
+			}
+		}
+		itemFormat, ok := acceptFormats[mediaType]
+		if isAcceptYAML(item) {
+			itemFormat, ok = FormatYAML, true
+		}
+		if !ok || q <= 0 {
+			continue
+		}
+		itemIsAlias := mediaType == ContentTypeJSON
+		if q > bestQ || (q == bestQ && isAlias && !itemIsAlias) {
+			format, bestQ, isAlias = itemFormat, q, itemIsAlias
+		}
 	}
-	return FormatJSON
+	return format
 }
 
 // PathStripFormat removes a format extension from a path
@@ -94,3 +202,12 @@ func URLQuery(url *url.URL) string {
 	query := uri[qloc+1:]
 	return query
 }
+
+// isAcceptYAML tests if an Accept header asks for YAML,
+// either as the OpenAPI YAML media type or as plain YAML
+func isAcceptYAML(hdrAccept string) bool {
+	if strings.Contains(hdrAccept, "application/yaml") || strings.Contains(hdrAccept, "application/x-yaml") {
+		return true
+	}
+	return strings.Contains(hdrAccept, "application/vnd.oai.openapi;") && strings.Contains(hdrAccept, "yaml")
+}
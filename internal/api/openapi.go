@@ -53,10 +53,66 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 			AllowEmptyValue: false,
 		},
 	}
+	paramFeatureID := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:            "featureId",
+			Description:     "Id of feature in collection to retrieve data for.",
+			In:              "path",
+			Required:        true,
+			Schema:          &openapi3.SchemaRef{Value: openapi3.NewStringSchema()},
+			AllowEmptyValue: false,
+		},
+	}
+	paramLookupColumn := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:            "lookupColumn",
+			Description:     "Lookup column of collection (which has unique values).",
+			In:              "path",
+			Required:        true,
+			Schema:          &openapi3.SchemaRef{Value: openapi3.NewStringSchema()},
+			AllowEmptyValue: false,
+		},
+	}
+	paramLookupValue := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:            "lookupValue",
+			Description:     "Value of the lookup column of the feature to retrieve data for.",
+			In:              "path",
+			Required:        true,
+			Schema:          &openapi3.SchemaRef{Value: openapi3.NewStringSchema()},
+			AllowEmptyValue: false,
+		},
+	}
+	paramDryRun := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:            "dry-run",
+			Description:     "Check whether the operation is allowed, without modifying any data.",
+			In:              "query",
+			Required:        false,
+			Schema:          &openapi3.SchemaRef{Value: openapi3.NewBoolSchema()},
+			AllowEmptyValue: true,
+		},
+	}
+	paramMode := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamMode,
+			Description: "Whether features which are not in the request are kept (merge) or deleted (replace).",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type:    "string",
+					Enum:    []interface{}{ModeMerge, ModeReplace},
+					Default: ModeMerge,
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
 	paramBbox := openapi3.ParameterRef{
 		Value: &openapi3.Parameter{
 			Name:        "bbox",
-			Description: "Bounding box to restrict results to given extent (as minLon,minLat,maxLon,maxLat).",
+			Description: "Bounding box to restrict results to given extent (as minLon,minLat,maxLon,maxLat). A JSON array, a WKT ENVELOPE or a rectangular WKT or GeoJSON polygon is also accepted.",
 			In:          "query",
 			Required:    false,
 			Explode:     openapi3.BoolPtr(false),
@@ -75,14 +131,13 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 	paramBboxCrs := openapi3.ParameterRef{
 		Value: &openapi3.Parameter{
 			Name:        "bbox-crs",
-			Description: "SRID for coordinate reference system of bbox parameter.",
+			Description: "URI or SRID of the coordinate reference system of the bbox parameter.",
 			In:          "query",
 			Required:    false,
 			Schema: &openapi3.SchemaRef{
 				Value: &openapi3.Schema{
-					Type:    "integer",
-					Min:     openapi3.Float64Ptr(1),
-					Default: 4326,
+					Type:    "string",
+					Default: CrsURICRS84,
 				},
 			},
 			AllowEmptyValue: false,
@@ -98,26 +153,305 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 			AllowEmptyValue: false,
 		},
 	}
+	paramFilterLang := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamFilterLang,
+			Description: "Encoding of the filter.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type:    "string",
+					Enum:    []interface{}{FilterLangText, FilterLangJSON},
+					Default: FilterLangText,
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
 	paramFilterCrs := openapi3.ParameterRef{
 		Value: &openapi3.Parameter{
 			Name:        "filter-crs",
-			Description: "SRID for filter geometry literals.",
+			Description: "URI or SRID of the coordinate reference system of filter geometry literals.",
 			In:          "query",
 			Required:    false,
 			Schema: &openapi3.SchemaRef{
 				Value: &openapi3.Schema{
-					Type:    "integer",
-					Min:     openapi3.Float64Ptr(1),
-					Default: 4326,
+					Type:    "string",
+					Default: CrsURICRS84,
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramBboxBuffer := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamBboxBuffer,
+			Description: "Distance to expand the bbox by, in the units of the bbox-crs coordinate system.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type:    "number",
+					Min:     openapi3.Float64Ptr(0),
+					Default: 0,
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramTile := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:            ParamTile,
+			Description:     "Web Mercator tile (as zoom/column/row) to restrict results to the extent of. May not be used with bbox.",
+			In:              "query",
+			Required:        false,
+			Example:         "10/163/395",
+			Schema:          &openapi3.SchemaRef{Value: openapi3.NewStringSchema()},
+			AllowEmptyValue: false,
+		},
+	}
+	paramFilterGeom := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:            "filter-geom",
+			Description:     "Geometry to filter by, as WKT or GeoJSON, in the filter-crs coordinate system.",
+			In:              "query",
+			Required:        false,
+			Schema:          &openapi3.SchemaRef{Value: openapi3.NewStringSchema()},
+			AllowEmptyValue: false,
+		},
+	}
+	paramFilterGeomOp := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        "filter-geom-op",
+			Description: "Spatial relationship of features to the filter geometry.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type:    "string",
+					Enum:    []interface{}{"intersects", "within", "contains"},
+					Default: "intersects",
 				},
 			},
 			AllowEmptyValue: false,
 		},
 	}
+	paramDatetime := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name: ParamDatetime,
+			Description: "Time instant or interval (start/end, with .. for an open end) to filter features by. " +
+				"Times may be RFC 3339 timestamps, or now with an optional ISO 8601 duration offset (e.g. now-P1D).",
+			In:       "query",
+			Required: false,
+			Example:  "now-P1D/now",
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "string",
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramSample := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamSample,
+			Description: "Percentage of rows to randomly sample (greater than 0, up to 100).",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "number",
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramGeomType := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamGeomType,
+			Description: "Return only features with this geometry type (e.g. polygon).",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "string",
+					Enum: []interface{}{"point", "linestring", "polygon", "multipoint", "multilinestring", "multipolygon", "geometrycollection"},
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramResultType := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        "resultType",
+			Description: "Return the features (results), or only the number of matching features in numberMatched (hits).",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type:    "string",
+					Enum:    []interface{}{ResultTypeResults, ResultTypeHits},
+					Default: ResultTypeResults,
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramDistinct := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamDistinct,
+			Description: "Return only the distinct values of the requested properties (with no geometry).",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "boolean",
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramAggregate := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamAggregate,
+			Description: "Return one feature with the geometries of all selected features aggregated by collect or union, and their count.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "string",
+					Enum: []interface{}{AggregateCollect, AggregateUnion},
+				},
+			},
+		},
+	}
+	paramCluster := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamCluster,
+			Description: "Return clusters of features within a distance (in source units), with an optional minimum number of features: distance[,minpoints].",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "string",
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramPretty := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:            ParamPretty,
+			Description:     "Indent JSON responses for readability.",
+			In:              "query",
+			Required:        false,
+			Schema:          &openapi3.SchemaRef{Value: openapi3.NewBoolSchema()},
+			AllowEmptyValue: true,
+		},
+	}
+	paramEnvelope := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamEnvelope,
+			Description: "Return features in a FeatureCollection (the default), or as a bare JSON array if false. A bare array has no links or counts, and its links are provided in a Link header.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type:    "boolean",
+					Default: true,
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramGeomFormat := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamGeomFormat,
+			Description: "Encoding of feature geometry. Encodings other than GeoJSON are provided as strings.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type:    "string",
+					Enum:    []interface{}{GeomFormatGeoJSON, GeomFormatWKT, GeomFormatWKBHex, GeomFormatEWKB},
+					Default: GeomFormatGeoJSON,
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramEmptyGeom := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamEmptyGeom,
+			Description: "Handling of features with empty geometry: returned unchanged, with null geometry, or excluded. The default is configured for the collection.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "string",
+					Enum: []interface{}{"keep", "null", "exclude"},
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramDimension := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamDimension,
+			Description: "Coordinate dimension of the output geometry. 2 drops any Z and M ordinates. The default is the stored dimension, or as configured for the collection.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "integer",
+					Enum: []interface{}{2},
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramItemCount := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamItemCount,
+			Description: "Include the estimated number of features of each collection, and their total.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{Type: "boolean"},
+			},
+			AllowEmptyValue: true,
+		},
+	}
+	paramFormat := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamFormat,
+			Description: "Response format: json, html, gml, fgb, csv or gpkg. Overrides the Accept header.",
+			In:          "query",
+			Required:    false,
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "string",
+					Enum: []interface{}{FormatJSON, FormatHTML, FormatGML, FormatFlatGeobuf, FormatCSV, FormatGeoPackage},
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
+	paramProperty := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamProperty,
+			Description: "Property to provide the distinct values of",
+			In:          "query",
+			Required:    true,
+			Example:     "region",
+			Schema:      &openapi3.SchemaRef{Value: openapi3.NewStringSchema()},
+		},
+	}
 	paramProperties := openapi3.ParameterRef{
 		Value: &openapi3.Parameter{
 			Name:        "properties",
-			Description: "List of properties to return in response objects",
+			Description: "List of properties to return in response objects, including computed properties (name:function(column))",
 			In:          "query",
 			Required:    false,
 			Explode:     openapi3.BoolPtr(false),
@@ -154,14 +488,13 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 	paramCrs := openapi3.ParameterRef{
 		Value: &openapi3.Parameter{
 			Name:        "crs",
-			Description: "SRID for coordinate reference system of output features.",
+			Description: "URI or SRID of the coordinate reference system of output features.",
 			In:          "query",
 			Required:    false,
 			Schema: &openapi3.SchemaRef{
 				Value: &openapi3.Schema{
-					Type:    "integer",
-					Min:     openapi3.Float64Ptr(1),
-					Default: 4326,
+					Type:    "string",
+					Default: CrsURICRS84,
 				},
 			},
 			AllowEmptyValue: false,
@@ -177,8 +510,8 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 				Value: &openapi3.Schema{
 					Type:    "integer",
 					Min:     openapi3.Float64Ptr(0),
-					Max:     openapi3.Float64Ptr(float64(conf.Configuration.Paging.LimitMax)),
-					Default: conf.Configuration.Paging.LimitDefault,
+					Max:     openapi3.Float64Ptr(float64(conf.Configuration().Paging.LimitMax)),
+					Default: conf.Configuration().Paging.LimitDefault,
 				},
 			},
 			AllowEmptyValue: false,
@@ -194,17 +527,32 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 				Value: &openapi3.Schema{
 					Type: "integer",
 					Min:  openapi3.Float64Ptr(0),
-					//Max:     openapi3.Float64Ptr(float64(conf.Configuration.Paging.LimitMax)),
+					//Max:     openapi3.Float64Ptr(float64(conf.Configuration().Paging.LimitMax)),
 					Default: 0,
 				},
 			},
 			AllowEmptyValue: false,
 		},
 	}
+	paramPoint := openapi3.ParameterRef{
+		Value: &openapi3.Parameter{
+			Name:        ParamPoint,
+			Description: "Point (longitude,latitude) to order features by distance from, with sortby=distance.",
+			In:          "query",
+			Required:    false,
+			Example:     "-123.1,49.25",
+			Schema: &openapi3.SchemaRef{
+				Value: &openapi3.Schema{
+					Type: "string",
+				},
+			},
+			AllowEmptyValue: false,
+		},
+	}
 	paramSortBy := openapi3.ParameterRef{
 		Value: &openapi3.Parameter{
 			Name:            "sortby",
-			Description:     "Column to sort by.",
+			Description:     "Column to sort by, or distance to sort by distance from the point parameter.",
 			In:              "query",
 			Required:        false,
 			Schema:          &openapi3.SchemaRef{Value: openapi3.NewStringSchema()},
@@ -214,8 +562,8 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 	return &openapi3.Swagger{
 		OpenAPI: "3.0.0",
 		Info: openapi3.Info{
-			Title:       conf.Configuration.Metadata.Title,
-			Description: conf.Configuration.Metadata.Description,
+			Title:       conf.Configuration().Metadata.Title,
+			Description: conf.Configuration().Metadata.Description,
 			Version:     conf.AppConfig.Version,
 			License: &openapi3.License{
 				Name: "Apache 2.0",
@@ -280,6 +628,9 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 				Description: "Provides details about feature collections served",
 				Get: &openapi3.Operation{
 					OperationID: "getCollectionsMetaData",
+					Parameters: openapi3.Parameters{
+						&paramItemCount,
+					},
 					Responses: openapi3.Responses{
 						"200": &openapi3.ResponseRef{
 							Value: &openapi3.Response{
@@ -309,6 +660,47 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 					},
 				},
 			},
+			apiBase + "collections/{collectionId}/queryables": &openapi3.PathItem{
+				Summary:     "Queryable properties of collection",
+				Description: "Provides a JSON Schema of the properties of the specified collection which can be used in filters",
+				Get: &openapi3.Operation{
+					OperationID: "getCollectionQueryables",
+					Parameters: openapi3.Parameters{
+						&paramCollectionID},
+					Responses: openapi3.Responses{
+						"200": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Content:     openapi3.NewContentWithJSONSchema(openapi3.NewObjectSchema()),
+								Description: "JSON Schema of the queryable properties of the specified collection",
+							},
+						},
+					},
+				},
+			},
+			apiBase + "collections/{collectionId}/facets": &openapi3.PathItem{
+				Summary:     "Distinct property values of collection",
+				Description: "Provides the distinct values of a property of the specified collection, with the number of features having each value",
+				Get: &openapi3.Operation{
+					OperationID: "getCollectionFacets",
+					Parameters: openapi3.Parameters{
+						&paramCollectionID,
+						&paramProperty,
+						&paramBbox,
+						&paramBboxCrs,
+						&paramFilter,
+						&paramFilterLang,
+						&paramDatetime,
+					},
+					Responses: openapi3.Responses{
+						"200": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Content:     openapi3.NewContentWithJSONSchema(openapi3.NewArraySchema()),
+								Description: "Distinct values of the property, with feature counts, in decreasing order of count",
+							},
+						},
+					},
+				},
+			},
 			apiBase + "collections/{collectionId}/items": &openapi3.PathItem{
 				Summary:     "Feature data for collection",
 				Description: "Provides paged access to data for all features in specified collection",
@@ -318,14 +710,33 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 						&paramCollectionID,
 						&paramBbox,
 						&paramBboxCrs,
+						&paramBboxBuffer,
+						&paramTile,
 						&paramFilter,
+						&paramFilterLang,
 						&paramFilterCrs,
+						&paramFilterGeom,
+						&paramFilterGeomOp,
+						&paramDatetime,
+						&paramSample,
+						&paramGeomType,
+						&paramResultType,
 						&paramTransform,
 						&paramProperties,
+						&paramDistinct,
+						&paramCluster,
+						&paramAggregate,
 						&paramSortBy,
+						&paramPoint,
 						&paramCrs,
+						&paramGeomFormat,
+						&paramEmptyGeom,
+						&paramDimension,
+						&paramPretty,
+						&paramEnvelope,
 						&paramLimit,
 						&paramOffset,
+						&paramFormat,
 						/* TODO
 						&openapi3.ParameterRef{
 							Value: &openapi3.Parameter{
@@ -355,6 +766,93 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 						},
 					},
 				},
+				Put: &openapi3.Operation{
+					OperationID: "upsertCollectionFeatures",
+					Parameters: openapi3.Parameters{
+						&paramCollectionID,
+						&paramMode,
+						&paramDryRun,
+					},
+					RequestBody: &openapi3.RequestBodyRef{
+						Value: openapi3.NewRequestBody().
+							WithDescription("GeoJSON Feature Collection of the features to insert or update by id").
+							WithRequired(true),
+					},
+					Responses: openapi3.Responses{
+						"200": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Numbers of features inserted, updated and deleted",
+							},
+						},
+						"400": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Invalid feature collection",
+							},
+						},
+						"404": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Collection not found",
+							},
+						},
+						"405": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Collection is not editable",
+							},
+						},
+						"409": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Collection is a view or has no primary key",
+							},
+						},
+						"408": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Request body was not received in time",
+							},
+						},
+						"413": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Request body is too large",
+							},
+						},
+					},
+				},
+			},
+			apiBase + "collections/{collectionId}/search": &openapi3.PathItem{
+				Summary:     "Search features of collection",
+				Description: "Provides access to the features of a collection with query parameters given in a JSON request body, for queries too long for a URL",
+				Post: &openapi3.Operation{
+					OperationID: "searchCollectionFeatures",
+					Parameters: openapi3.Parameters{
+						&paramCollectionID,
+					},
+					RequestBody: &openapi3.RequestBodyRef{
+						Value: openapi3.NewRequestBody().
+							WithDescription("JSON object with members bbox, datetime, filter, filter-lang, limit, offset, properties and sortby").
+							WithRequired(true),
+					},
+					Responses: openapi3.Responses{
+						"200": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "GeoJSON Feature Collection document containing data for features",
+							},
+						},
+						"400": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Invalid search request",
+							},
+						},
+						"404": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Collection not found",
+							},
+						},
+						"413": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Request body is too large",
+							},
+						},
+					},
+				},
 			},
 			apiBase + "collections/{collectionId}/items/{featureId}": &openapi3.PathItem{
 				Summary:     "Single feature data from collection",
@@ -363,19 +861,14 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 					OperationID: "getCollectionFeature",
 					Parameters: openapi3.Parameters{
 						&paramCollectionID,
-						&openapi3.ParameterRef{
-							Value: &openapi3.Parameter{
-								Name:            "featureId",
-								Description:     "Id of feature in collection to retrieve data for.",
-								In:              "path",
-								Required:        true,
-								Schema:          &openapi3.SchemaRef{Value: openapi3.NewStringSchema()},
-								AllowEmptyValue: false,
-							},
-						},
+						&paramFeatureID,
 						&paramProperties,
 						&paramTransform,
 						&paramCrs,
+						&paramGeomFormat,
+						&paramEmptyGeom,
+						&paramDimension,
+						&paramPretty,
 					},
 					Responses: openapi3.Responses{
 						"200": &openapi3.ResponseRef{
@@ -393,6 +886,72 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 						},
 					},
 				},
+				Delete: &openapi3.Operation{
+					OperationID: "deleteCollectionFeature",
+					Parameters: openapi3.Parameters{
+						&paramCollectionID,
+						&paramFeatureID,
+						&paramDryRun,
+					},
+					Responses: openapi3.Responses{
+						"204": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Feature was deleted",
+							},
+						},
+						"404": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Collection or feature not found",
+							},
+						},
+						"405": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Collection is not editable",
+							},
+						},
+						"409": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Collection is a view or has no primary key",
+							},
+						},
+					},
+				},
+			},
+			apiBase + "collections/{collectionId}/lookup/{lookupColumn}/{lookupValue}": &openapi3.PathItem{
+				Summary:     "Single feature data from collection by lookup value",
+				Description: "Provides access to the single feature of the specified collection which has a value of a lookup column",
+				Get: &openapi3.Operation{
+					OperationID: "getCollectionFeatureByLookup",
+					Parameters: openapi3.Parameters{
+						&paramCollectionID,
+						&paramLookupColumn,
+						&paramLookupValue,
+						&paramProperties,
+						&paramTransform,
+						&paramCrs,
+						&paramGeomFormat,
+						&paramEmptyGeom,
+						&paramDimension,
+						&paramPretty,
+					},
+					Responses: openapi3.Responses{
+						"200": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "GeoJSON Feature document containing feature data",
+							},
+						},
+						"404": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Collection or feature not found",
+							},
+						},
+						"409": &openapi3.ResponseRef{
+							Value: &openapi3.Response{
+								Description: "Lookup value matches more than one feature",
+							},
+						},
+					},
+				},
 			},
 			apiBase + "functions": &openapi3.PathItem{
 				Summary:     "Functions metadata",
@@ -440,12 +999,21 @@ func GetOpenAPIContent(urlBase string) *openapi3.Swagger {
 						&paramFunctionID,
 						&paramBbox,
 						&paramBboxCrs,
+						&paramBboxBuffer,
+						&paramTile,
 						&paramFilter,
+						&paramFilterLang,
 						&paramFilterCrs,
+						&paramFilterGeom,
+						&paramFilterGeomOp,
 						&paramTransform,
 						&paramProperties,
 						&paramSortBy,
+						&paramPoint,
 						&paramCrs,
+						&paramGeomFormat,
+						&paramPretty,
+						&paramEnvelope,
 						&paramLimit,
 						&paramOffset,
 
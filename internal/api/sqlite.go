@@ -0,0 +1,443 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A minimal writer of SQLite database files, as specified in
+// https://www.sqlite.org/fileformat.html
+// Tables are written in a single pass, with rows in increasing rowid order.
+// Indexes may only have a single page, which is enough for the metadata tables
+// of a GeoPackage.
+// Pages are written at their file offsets, so the output must be seekable
+
+const (
+	sqlitePageSize   = 4096
+	sqliteHeaderSize = 100
+	// sqliteVersion is the SQLite library version recorded in the header (3.31.1)
+	sqliteVersion = 3031001
+)
+
+// SQLite b-tree page types
+const (
+	sqlitePageTableInterior byte = 0x05
+	sqlitePageIndexLeaf     byte = 0x0a
+	sqlitePageTableLeaf     byte = 0x0d
+)
+
+const (
+	sqliteLeafHeaderSize     = 8
+	sqliteInteriorHeaderSize = 12
+	// sqliteCellPointerSize is the size of the page offset of each cell
+	sqliteCellPointerSize = 2
+)
+
+// sqliteFile writes the pages of an SQLite database.
+// Page 1 holds the file header and the root of the schema table,
+// so it is written when the file is closed
+type sqliteFile struct {
+	w           io.WriterAt
+	numPages    uint32
+	page1       []byte
+	schema      *sqliteTable
+	numSchema   int64
+	appID       uint32
+	userVersion uint32
+}
+
+func newSQLiteFile(w io.WriterAt, appID uint32, userVersion uint32) *sqliteFile {
+	f := &sqliteFile{
+		w:           w,
+		numPages:    1,
+		appID:       appID,
+		userVersion: userVersion,
+	}
+	f.schema = &sqliteTable{file: f, isSchema: true}
+	return f
+}
+
+func (f *sqliteFile) allocPage() uint32 {
+	f.numPages++
+	return f.numPages
+}
+
+func (f *sqliteFile) writePage(pageNo uint32, page []byte) error {
+	_, err := f.w.WriteAt(page, int64(pageNo-1)*sqlitePageSize)
+	return err
+}
+
+// addSchema records a table or index in the schema table.
+// The sql of automatic indexes is NULL
+func (f *sqliteFile) addSchema(objType string, name string, tblName string, rootPage uint32, sql interface{}) error {
+	f.numSchema++
+	return f.schema.insert(f.numSchema, []interface{}{objType, name, tblName, int64(rootPage), sql})
+}
+
+// createTable creates a table, returning a writer for its rows.
+// The table is added to the schema when the writer is finished
+func (f *sqliteFile) createTable() *sqliteTable {
+	return &sqliteTable{file: f}
+}
+
+// addIndex writes an index b-tree for the records of its entries,
+// which must be in key order and fit in a single page
+func (f *sqliteFile) addIndex(name string, tblName string, records [][]byte) error {
+	maxLocal := (sqlitePageSize-12)*64/255 - 23
+	cells := make([][]byte, len(records))
+	size := 0
+	for i, record := range records {
+		cell, err := f.payloadCell(sqliteAppendVarint(nil, uint64(len(record))), record, maxLocal)
+		if err != nil {
+			return err
+		}
+		cells[i] = cell
+		size += len(cell) + sqliteCellPointerSize
+	}
+	if size > sqlitePageSize-sqliteLeafHeaderSize {
+		return fmt.Errorf("index %v is too large", name)
+	}
+	pageNo := f.allocPage()
+	if err := f.writePage(pageNo, sqliteBtreePage(sqlitePageIndexLeaf, cells, 0, 0)); err != nil {
+		return err
+	}
+	return f.addSchema("index", name, tblName, pageNo, nil)
+}
+
+// payloadCell appends a record payload to a cell prefix,
+// with the part which does not fit in the page written to overflow pages
+func (f *sqliteFile) payloadCell(cell []byte, payload []byte, maxLocal int) ([]byte, error) {
+	if len(payload) <= maxLocal {
+		return append(cell, payload...), nil
+	}
+	minLocal := (sqlitePageSize-12)*32/255 - 23
+	local := minLocal + (len(payload)-minLocal)%(sqlitePageSize-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	cell = append(cell, payload[:local]...)
+	firstPage, err := f.writeOverflow(payload[local:])
+	if err != nil {
+		return nil, err
+	}
+	var pageNo [4]byte
+	binary.BigEndian.PutUint32(pageNo[:], firstPage)
+	return append(cell, pageNo[:]...), nil
+}
+
+// writeOverflow writes data to a chain of overflow pages.
+// The pages are consecutive, so each page links to the next
+func (f *sqliteFile) writeOverflow(data []byte) (uint32, error) {
+	chunkSize := sqlitePageSize - 4
+	firstPage := f.numPages + 1
+	for start := 0; start < len(data); start += chunkSize {
+		pageNo := f.allocPage()
+		page := make([]byte, sqlitePageSize)
+		end := start + chunkSize
+		if end < len(data) {
+			binary.BigEndian.PutUint32(page, pageNo+1)
+		} else {
+			end = len(data)
+		}
+		copy(page[4:], data[start:end])
+		if err := f.writePage(pageNo, page); err != nil {
+			return 0, err
+		}
+	}
+	return firstPage, nil
+}
+
+// Close writes the schema table and the file header
+func (f *sqliteFile) Close() error {
+	if _, err := f.schema.finish(); err != nil {
+		return err
+	}
+	h := f.page1[:sqliteHeaderSize]
+	copy(h, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(h[16:], sqlitePageSize)
+	// file format versions (legacy), no reserved space
+	h[18] = 1
+	h[19] = 1
+	// payload fractions (fixed values)
+	h[21] = 64
+	h[22] = 32
+	h[23] = 32
+	// change counter
+	binary.BigEndian.PutUint32(h[24:], 1)
+	binary.BigEndian.PutUint32(h[28:], f.numPages)
+	// schema cookie and format
+	binary.BigEndian.PutUint32(h[40:], 1)
+	binary.BigEndian.PutUint32(h[44:], 4)
+	// UTF-8 text encoding
+	binary.BigEndian.PutUint32(h[56:], 1)
+	binary.BigEndian.PutUint32(h[60:], f.userVersion)
+	binary.BigEndian.PutUint32(h[68:], f.appID)
+	// the page count is valid for the change counter
+	binary.BigEndian.PutUint32(h[92:], 1)
+	binary.BigEndian.PutUint32(h[96:], sqliteVersion)
+	return f.writePage(1, f.page1)
+}
+
+// sqliteChild is a b-tree page with the largest rowid it contains
+type sqliteChild struct {
+	pageNo   uint32
+	maxRowID int64
+}
+
+// sqliteTable writes the b-tree of a table.
+// Leaf pages are written when they are full.
+// The interior pages are written when the table is finished
+type sqliteTable struct {
+	file      *sqliteFile
+	isSchema  bool
+	cells     [][]byte
+	cellsSize int
+	lastRowID int64
+	leaves    []sqliteChild
+}
+
+// headerOffset is the offset of the page header.
+// The schema table root is on page 1, after the file header,
+// so all its pages are filled to allow for it
+func (t *sqliteTable) headerOffset() int {
+	if t.isSchema {
+		return sqliteHeaderSize
+	}
+	return 0
+}
+
+// insert adds a row, which must have a larger rowid than the previous row
+func (t *sqliteTable) insert(rowid int64, values []interface{}) error {
+	payload := sqliteRecord(values)
+	cell := sqliteAppendVarint(nil, uint64(len(payload)))
+	cell = sqliteAppendVarint(cell, uint64(rowid))
+	cell, err := t.file.payloadCell(cell, payload, sqlitePageSize-35)
+	if err != nil {
+		return err
+	}
+	capacity := sqlitePageSize - t.headerOffset() - sqliteLeafHeaderSize
+	cellSize := len(cell) + sqliteCellPointerSize
+	if len(t.cells) > 0 && t.cellsSize+cellSize > capacity {
+		if err := t.writeLeaf(); err != nil {
+			return err
+		}
+	}
+	t.cells = append(t.cells, cell)
+	t.cellsSize += cellSize
+	t.lastRowID = rowid
+	return nil
+}
+
+func (t *sqliteTable) writeLeaf() error {
+	pageNo := t.file.allocPage()
+	if err := t.file.writePage(pageNo, sqliteBtreePage(sqlitePageTableLeaf, t.cells, 0, 0)); err != nil {
+		return err
+	}
+	t.leaves = append(t.leaves, sqliteChild{pageNo: pageNo, maxRowID: t.lastRowID})
+	t.cells = nil
+	t.cellsSize = 0
+	return nil
+}
+
+// finish writes the remaining pages of the table, and returns the root page number
+func (t *sqliteTable) finish() (uint32, error) {
+	if len(t.leaves) == 0 {
+		//-- the table has a single leaf page
+		return t.writeRoot(sqliteBtreePage(sqlitePageTableLeaf, t.cells, 0, t.headerOffset()))
+	}
+	if len(t.cells) > 0 {
+		if err := t.writeLeaf(); err != nil {
+			return 0, err
+		}
+	}
+	level := t.leaves
+	for {
+		groups := t.interiorGroups(level)
+		if len(groups) == 1 {
+			return t.writeRoot(sqliteInteriorPage(groups[0], t.headerOffset()))
+		}
+		var parents []sqliteChild
+		for _, group := range groups {
+			pageNo := t.file.allocPage()
+			if err := t.file.writePage(pageNo, sqliteInteriorPage(group, 0)); err != nil {
+				return 0, err
+			}
+			parents = append(parents, sqliteChild{pageNo: pageNo, maxRowID: group[len(group)-1].maxRowID})
+		}
+		level = parents
+	}
+}
+
+// writeRoot writes the root page of the table.
+// The schema table root is on page 1, which is written with the file header
+func (t *sqliteTable) writeRoot(page []byte) (uint32, error) {
+	if t.isSchema {
+		t.file.page1 = page
+		return 1, nil
+	}
+	pageNo := t.file.allocPage()
+	return pageNo, t.file.writePage(pageNo, page)
+}
+
+// interiorGroups divides child pages into the groups which fit in interior pages.
+// In each group the last child is the right-most pointer of the page,
+// and the others are cells
+func (t *sqliteTable) interiorGroups(children []sqliteChild) [][]sqliteChild {
+	capacity := sqlitePageSize - t.headerOffset() - sqliteInteriorHeaderSize
+	var groups [][]sqliteChild
+	var group []sqliteChild
+	size := 0
+	for _, child := range children {
+		if len(group) > 0 {
+			//-- the previous child becomes a cell
+			prev := group[len(group)-1]
+			cellSize := 4 + len(sqliteAppendVarint(nil, uint64(prev.maxRowID))) + sqliteCellPointerSize
+			if size+cellSize > capacity {
+				groups = append(groups, group)
+				group = nil
+				size = 0
+			} else {
+				size += cellSize
+			}
+		}
+		group = append(group, child)
+	}
+	groups = append(groups, group)
+	//-- a page must have a cell, so a single last child is moved from the previous group
+	if n := len(groups); n > 1 && len(groups[n-1]) == 1 {
+		prev := groups[n-2]
+		groups[n-1] = append([]sqliteChild{prev[len(prev)-1]}, groups[n-1]...)
+		groups[n-2] = prev[:len(prev)-1]
+	}
+	return groups
+}
+
+func sqliteInteriorPage(children []sqliteChild, hdrOffset int) []byte {
+	cells := make([][]byte, len(children)-1)
+	for i, child := range children[:len(children)-1] {
+		var cell [4]byte
+		binary.BigEndian.PutUint32(cell[:], child.pageNo)
+		cells[i] = sqliteAppendVarint(cell[:], uint64(child.maxRowID))
+	}
+	rightChild := children[len(children)-1].pageNo
+	return sqliteBtreePage(sqlitePageTableInterior, cells, rightChild, hdrOffset)
+}
+
+// sqliteBtreePage creates a b-tree page, with the cells at the end of the page
+func sqliteBtreePage(pageType byte, cells [][]byte, rightChild uint32, hdrOffset int) []byte {
+	page := make([]byte, sqlitePageSize)
+	hdr := page[hdrOffset:]
+	hdr[0] = pageType
+	hdrSize := sqliteLeafHeaderSize
+	if pageType == sqlitePageTableInterior {
+		hdrSize = sqliteInteriorHeaderSize
+		binary.BigEndian.PutUint32(hdr[8:], rightChild)
+	}
+	binary.BigEndian.PutUint16(hdr[3:], uint16(len(cells)))
+	end := sqlitePageSize
+	for i, cell := range cells {
+		end -= len(cell)
+		copy(page[end:], cell)
+		binary.BigEndian.PutUint16(hdr[hdrSize+i*sqliteCellPointerSize:], uint16(end))
+	}
+	binary.BigEndian.PutUint16(hdr[5:], uint16(end))
+	return page
+}
+
+// sqliteRecord encodes values in the SQLite record format.
+// Values may be nil, int64, float64, string or []byte
+func sqliteRecord(values []interface{}) []byte {
+	var header, body []byte
+	for _, val := range values {
+		serialType, data := sqliteSerialValue(val)
+		header = sqliteAppendVarint(header, serialType)
+		body = append(body, data...)
+	}
+	//-- the header size includes the size varint
+	size := len(header) + 1
+	for len(sqliteAppendVarint(nil, uint64(size)))+len(header) != size {
+		size = len(sqliteAppendVarint(nil, uint64(size))) + len(header)
+	}
+	record := sqliteAppendVarint(nil, uint64(size))
+	record = append(record, header...)
+	return append(record, body...)
+}
+
+// sqliteIntSizes are the sizes of the integer serial types 1 to 6
+var sqliteIntSizes = []int{1, 2, 3, 4, 6, 8}
+
+func sqliteSerialValue(val interface{}) (uint64, []byte) {
+	switch v := val.(type) {
+	case int64:
+		if v == 0 || v == 1 {
+			return uint64(8 + v), nil
+		}
+		for i, size := range sqliteIntSizes {
+			bits := uint(size * 8)
+			if size == 8 || (v >= -(1<<(bits-1)) && v < 1<<(bits-1)) {
+				data := make([]byte, size)
+				for j := 0; j < size; j++ {
+					data[size-1-j] = byte(v >> uint(8*j))
+				}
+				return uint64(i + 1), data
+			}
+		}
+	case float64:
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, math.Float64bits(v))
+		return 7, data
+	case string:
+		return uint64(13 + 2*len(v)), []byte(v)
+	case []byte:
+		return uint64(12 + 2*len(v)), v
+	}
+	return 0, nil
+}
+
+// sqliteAppendVarint appends a value in the SQLite variable-length integer encoding
+// (big-endian groups of 7 bits, with a final 8-bit group if 9 bytes are needed)
+func sqliteAppendVarint(b []byte, v uint64) []byte {
+	if v > 0x00ffffffffffffff {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var groups [8]byte
+	n := 0
+	for {
+		groups[n] = byte(v & 0x7f)
+		n++
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		c := groups[i]
+		if i > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
@@ -0,0 +1,96 @@
+package api
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSQLiteAppendVarint(t *testing.T) {
+	cases := []struct {
+		val  uint64
+		want []byte
+	}{
+		{0, []byte{0}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x81, 0x00}},
+		{16384, []byte{0x81, 0x80, 0x00}},
+		{0xffffffffffffffff, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, c := range cases {
+		if got := sqliteAppendVarint(nil, c.val); !bytes.Equal(got, c.want) {
+			t.Errorf("sqliteAppendVarint(%v) = %x, want %x", c.val, got, c.want)
+		}
+	}
+}
+
+func TestSQLiteRecord(t *testing.T) {
+	got := sqliteRecord([]interface{}{nil, int64(1), int64(300), "ab", 1.5})
+	want := []byte{
+		// header size and serial types
+		6, 0, 9, 2, 17, 7,
+		// body
+		0x01, 0x2c, 'a', 'b', 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("sqliteRecord = %x, want %x", got, want)
+	}
+}
+
+func TestSQLiteFileMultiplePages(t *testing.T) {
+	var out bufferAt
+	f := newSQLiteFile(&out, 1, 2)
+	tbl := f.createTable()
+	//-- enough rows to need interior pages
+	value := string(bytes.Repeat([]byte("x"), 100))
+	for i := int64(1); i <= 1000; i++ {
+		if err := tbl.insert(i, []interface{}{value}); err != nil {
+			t.Fatalf("insert error: %v", err)
+		}
+	}
+	rootPage, err := tbl.finish()
+	if err != nil {
+		t.Fatalf("finish error: %v", err)
+	}
+	if err := f.addSchema("table", "t", "t", rootPage, "CREATE TABLE t (v TEXT)"); err != nil {
+		t.Fatalf("addSchema error: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	checkSQLiteHeader(t, out.data, 1, 2)
+	if page := out.data[int(rootPage-1)*sqlitePageSize:]; page[0] != sqlitePageTableInterior {
+		t.Errorf("root page type = %x, want %x", page[0], sqlitePageTableInterior)
+	}
+}
+
+// checkSQLiteHeader checks the file header and that the file has the recorded number of pages
+func checkSQLiteHeader(t *testing.T, file []byte, appID uint32, userVersion uint32) {
+	t.Helper()
+	if !bytes.HasPrefix(file, []byte("SQLite format 3\x00")) {
+		t.Fatalf("file does not start with the SQLite header")
+	}
+	numPages := binary.BigEndian.Uint32(file[28:])
+	if len(file) != int(numPages)*sqlitePageSize {
+		t.Errorf("file size = %v, want %v pages", len(file), numPages)
+	}
+	if got := binary.BigEndian.Uint32(file[68:]); got != appID {
+		t.Errorf("application id = %x, want %x", got, appID)
+	}
+	if got := binary.BigEndian.Uint32(file[60:]); got != userVersion {
+		t.Errorf("user version = %v, want %v", got, userVersion)
+	}
+}
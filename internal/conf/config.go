@@ -16,14 +16,32 @@ package conf
 import (
 	"fmt"
 	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-// Configuration for system
-var Configuration Config
+// configuration is the current *Config.
+// It is replaced as a whole when the configuration is reloaded,
+// so requests in progress can read it while it is being replaced
+var configuration atomic.Value
+
+func init() {
+	SetConfiguration(Config{})
+}
+
+// Configuration returns the current configuration of the system
+func Configuration() *Config {
+	return configuration.Load().(*Config)
+}
+
+// SetConfiguration replaces the configuration
+func SetConfiguration(config Config) {
+	configuration.Store(&config)
+}
 
 func setDefaultConfig() {
 	viper.SetDefault("Server.HttpHost", "0.0.0.0")
@@ -31,36 +49,117 @@ func setDefaultConfig() {
 	viper.SetDefault("Server.HttpsPort", 9001)
 	viper.SetDefault("Server.TlsServerCertificateFile", "")
 	viper.SetDefault("Server.TlsServerPrivateKeyFile", "")
+	viper.SetDefault("Server.TlsMinVersion", "1.2")
+	viper.SetDefault("Server.HttpsRedirect", false)
 	viper.SetDefault("Server.UrlBase", "")
 	viper.SetDefault("Server.BasePath", "")
-	viper.SetDefault("Server.CORSOrigins", "*")
+	viper.SetDefault("Server.CORSOrigins", "")
 	viper.SetDefault("Server.Debug", false)
 	viper.SetDefault("Server.AssetsPath", "./assets")
 	viper.SetDefault("Server.ReadTimeoutSec", 5)
 	viper.SetDefault("Server.WriteTimeoutSec", 30)
+	viper.SetDefault("Server.ReadyTimeoutSec", 2)
+	viper.SetDefault("Server.ShutdownTimeoutSec", 30)
+	viper.SetDefault("Server.TransformMaxFunctions", 5)
+	viper.SetDefault("Server.PropertyFunctions", []string{"ST_Area", "ST_Length", "ST_Perimeter", "ST_NPoints", "ST_X", "ST_Y"})
+	viper.SetDefault("Server.TransformMaxArgs", 5)
+	viper.SetDefault("Server.TransformMetricFunctions", []string{})
+	viper.SetDefault("Server.TransformMetricSrid", 0)
+	viper.SetDefault("Server.BboxMaxArea", 0)
+	viper.SetDefault("Server.BboxMaxAreaProjected", 0)
+	viper.SetDefault("Server.PrecisionMode", "round")
+	viper.SetDefault("Server.WriteMaxBodyBytes", 10485760)
+	viper.SetDefault("Server.WriteBodyTimeoutSec", 30)
 
 	viper.SetDefault("Database.DbPoolMaxConnLifeTime", "1h")
 	viper.SetDefault("Database.DbPoolMaxConns", 4)
+	viper.SetDefault("Database.DbPoolMinConns", 0)
+	viper.SetDefault("Database.DbPoolMaxConnIdleTime", "30m")
+	viper.SetDefault("Database.DbPoolHealthCheckPeriod", "1m")
+	viper.SetDefault("Database.ExtentCacheTTL", "10m")
+	viper.SetDefault("Database.TableCacheTTL", "1m")
 	viper.SetDefault("Database.TableIncludes", []string{})
 	viper.SetDefault("Database.TableExcludes", []string{})
 	viper.SetDefault("Database.FunctionIncludes", []string{"postgisftw"})
+	viper.SetDefault("Database.RedactQueryArgs", false)
+	viper.SetDefault("Database.NumericAsString", true)
+	viper.SetDefault("Database.IdleInTransactionTimeout", "0s")
+	viper.SetDefault("Database.ReadIsolation", "repeatable read")
 
 	viper.SetDefault("Paging.LimitDefault", 10)
 	viper.SetDefault("Paging.LimitMax", 1000)
+	viper.SetDefault("Paging.OffsetMax", 1000000)
+	viper.SetDefault("Paging.OffsetClamp", false)
+	viper.SetDefault("Paging.AggregateMaxFeatures", 100000)
+	viper.SetDefault("Paging.FacetsMax", 1000)
+	viper.SetDefault("Paging.ResponseMaxFeatures", 100000)
+	viper.SetDefault("Paging.StreamGeoJSON", true)
+	viper.SetDefault("Paging.SortTiebreaker", true)
+	viper.SetDefault("Paging.NumberMatched", true)
 
 	viper.SetDefault("Metadata.Title", "pg-featureserv")
 	viper.SetDefault("Metadata.Description", "Crunchy Data Feature Server for PostGIS")
+	viper.SetDefault("Metadata.DefaultCategory", "default")
 
 	viper.SetDefault("Website.BasemapUrl", "")
+	viper.SetDefault("Website.BasemapAttribution", "")
+
+	viper.SetDefault("Auth.ApiKeys", []string{})
+	viper.SetDefault("Auth.PublicMetadata", true)
+	viper.SetDefault("Auth.AdminKey", "")
+	viper.SetDefault("Auth.JwtAlgorithm", "")
+	viper.SetDefault("Auth.JwtKey", "")
+	viper.SetDefault("Auth.TenantClaim", "tenant")
+	viper.SetDefault("Auth.HideNonTenantCollections", false)
+
+	viper.SetDefault("Cache.TTLSec", 0)
+	viper.SetDefault("Cache.MaxEntries", 1000)
+	viper.SetDefault("Cache.MaxSizeMB", 64)
+
+	viper.SetDefault("RateLimit.RequestsPerSec", 0)
+	viper.SetDefault("RateLimit.Burst", 10)
+
+	viper.SetDefault("Tracing.Endpoint", "")
+	viper.SetDefault("Tracing.SampleRatio", 1.0)
+	viper.SetDefault("Tracing.ServiceName", "pg_featureserv")
+
+	viper.SetDefault("Csv.Delimiter", "comma")
+	viper.SetDefault("Csv.NullValue", "")
+
+	viper.SetDefault("GeoPackage.Enabled", false)
+	viper.SetDefault("GeoPackage.MaxFeatures", 100000)
+
+	viper.SetDefault("Download.Filename", "{collection}")
+	viper.SetDefault("Download.Disposition.json", "inline")
+	viper.SetDefault("Download.Disposition.gml", "attachment")
+	viper.SetDefault("Download.Disposition.csv", "attachment")
+	viper.SetDefault("Download.Disposition.fgb", "attachment")
+	viper.SetDefault("Download.Disposition.gpkg", "attachment")
 }
 
 // Config for system
 type Config struct {
-	Server   Server
-	Paging   Paging
-	Metadata Metadata
-	Database Database
-	Website  Website
+	Server      Server
+	Paging      Paging
+	Metadata    Metadata
+	Database    Database
+	Website     Website
+	Auth        Auth
+	Cache       Cache
+	Cors        []Cors
+	Collections []Collection
+	// SqlCollections are collections provided by SQL queries
+	SqlCollections []SqlCollection
+	RateLimit      RateLimit
+	Tracing        Tracing
+	Csv            Csv
+	GeoPackage     GeoPackage
+	Download       Download
+	// Databases are additional databases providing collections
+	Databases []DatabaseSource
+	// Crs are the coordinate systems supported by the crs parameters.
+	// If there are none, any SRID is supported
+	Crs []Crs
 }
 
 // Server config
@@ -77,33 +176,346 @@ type Server struct {
 	AssetsPath               string
 	ReadTimeoutSec           int
 	WriteTimeoutSec          int
+	ReadyTimeoutSec          int
+	ShutdownTimeoutSec       int
+	StrictQueryParams        bool
 	TransformFunctions       []string
+	// PropertyFunctions are the functions allowed in computed properties
+	PropertyFunctions []string
+	// AuthoritativeAxisOrderSrids are the CRSs which use their
+	// authoritative (latitude/northing first) axis order when requested
+	AuthoritativeAxisOrderSrids []int
+	// TlsMinVersion is the minimum TLS version accepted (1.0, 1.1, 1.2 or 1.3)
+	TlsMinVersion string
+	// HttpsRedirect redirects HTTP requests to HTTPS, if TLS is enabled
+	HttpsRedirect bool
+	// TransformMaxFunctions is the maximum number of functions in a transform parameter
+	// (0 for no limit)
+	TransformMaxFunctions int
+	// TransformMaxArgs is the maximum number of arguments of a transform function
+	// (0 for no limit)
+	TransformMaxArgs int
+	// TransformMetricFunctions are the transform functions whose arguments
+	// are in meters for geometry in a geographic CRS
+	TransformMetricFunctions []string
+	// TransformMetricSrid is the projected CRS the metric functions are computed in
+	// (0 for a zone chosen for each geometry)
+	TransformMetricSrid int
+	// BboxMaxArea is the maximum area of a bbox in a geographic CRS, in square degrees
+	// (0 for no limit)
+	BboxMaxArea float64
+	// BboxMaxAreaProjected is the maximum area of a bbox in a projected CRS,
+	// in square CRS units (0 for no limit)
+	BboxMaxAreaProjected float64
+	// PrecisionMode is how coordinates are reduced to the precision parameter
+	// (round, halfeven, halfup or truncate)
+	PrecisionMode string
+	// WriteMaxBodyBytes is the maximum size of the body of a feature edit
+	// or search request (0 for no limit)
+	WriteMaxBodyBytes int64
+	// WriteBodyTimeoutSec is the time allowed to receive the body of a feature edit
+	// or search request (0 for no limit other than ReadTimeoutSec)
+	WriteBodyTimeoutSec int
 }
 
 // Paging config
 type Paging struct {
 	LimitDefault int
 	LimitMax     int
+	// OffsetMax is the maximum offset of a request (0 for no limit)
+	OffsetMax int
+	// OffsetClamp reduces larger offsets to OffsetMax, rather than rejecting them
+	OffsetClamp bool
+	// AggregateMaxFeatures is the maximum number of features aggregated
+	// by the aggregate query parameter (0 for no limit)
+	AggregateMaxFeatures int
+	// FacetsMax is the maximum number of values in a facets response (0 for no limit)
+	FacetsMax int
+	// ResponseMaxFeatures is the maximum number of features read for a buffered response,
+	// regardless of the limit (0 for no limit)
+	ResponseMaxFeatures int
+	// StreamGeoJSON writes GeoJSON features as they are read, rather than buffering them
+	StreamGeoJSON bool
+	// SortTiebreaker orders features with equal sortby values by the id columns
+	SortTiebreaker bool
+	// NumberMatched provides numberMatched in GeoJSON items responses,
+	// counted in the same transaction as the features
+	NumberMatched bool
 }
 
 // Database config
 type Database struct {
-	DbConnection          string
-	DbPoolMaxConnLifeTime string
-	DbPoolMaxConns        int
-	TableIncludes         []string
-	TableExcludes         []string
-	FunctionIncludes      []string
+	DbConnection            string
+	DbPoolMaxConnLifeTime   string
+	DbPoolMaxConns          int
+	DbPoolMinConns          int
+	DbPoolMaxConnIdleTime   string
+	DbPoolHealthCheckPeriod string
+	ExtentCacheTTL          string
+	TableCacheTTL           string
+	TableIncludes           []string
+	TableExcludes           []string
+	FunctionIncludes        []string
+	// RedactQueryArgs omits the argument values of queries from the debug log
+	RedactQueryArgs bool
+	// NumericAsString writes numeric column values as JSON strings,
+	// so that clients parsing numbers as floats do not lose precision
+	NumericAsString bool
+	// IdleInTransactionTimeout is the idle_in_transaction_session_timeout
+	// of streamed feature queries (0 streams them without a transaction)
+	IdleInTransactionTimeout string
+	// ReadIsolation is the isolation level of the read-only transaction
+	// reading the number of features matched (if Paging.NumberMatched is set) with the features
+	// (read committed runs them as separate statements)
+	ReadIsolation string
+}
+
+// DatabaseSource config (an additional database providing collections).
+// It uses the pool settings of the Database config
+type DatabaseSource struct {
+	// Name is the prefix of the ids of the collections of the database
+	Name string
+	// DbConnection is the connection string of the database
+	DbConnection string
 }
 
 // Metadata config
 type Metadata struct {
 	Title       string //`mapstructure:"METADATA_TITLE"`
 	Description string
+	// DefaultCategory is the category of collections which do not have one
+	DefaultCategory string
 }
 
 type Website struct {
 	BasemapUrl string
+	// BasemapAttribution is the attribution text (or HTML) shown on the basemap
+	BasemapAttribution string
+}
+
+// Auth config
+type Auth struct {
+	// ApiKeys are the keys allowed to access the service (if empty, no key is required)
+	ApiKeys []string
+	// PublicMetadata allows access to the landing page, API and conformance documents without a key
+	PublicMetadata bool
+	// AdminKey is the key required by administrative requests (such as /refresh).
+	// If empty, administrative requests are disabled
+	AdminKey string
+	// JwtAlgorithm is the signing algorithm of request JWTs (HS256 or RS256).
+	// If empty, JWTs are not used
+	JwtAlgorithm string
+	// JwtKey is the HS256 secret or the RS256 public key (PEM)
+	JwtKey string
+	// TenantClaim is the JWT claim providing the tenant of a request
+	TenantClaim string
+	// HideNonTenantCollections hides collections which have no tenant column
+	HideNonTenantCollections bool
+}
+
+// Cache config (the shared cache of collection data responses)
+type Cache struct {
+	// TTLSec is the time responses are cached for (if 0, responses are not cached)
+	TTLSec int
+	// MaxEntries and MaxSizeMB limit the number and total size of cached responses
+	MaxEntries int
+	MaxSizeMB  int
+}
+
+// RateLimit config (the request rate allowed for each client)
+type RateLimit struct {
+	// RequestsPerSec is the sustained request rate of a client (if 0, requests are not limited)
+	RequestsPerSec float64
+	// Burst is the number of requests a client may make at once
+	Burst int
+	// TrustedProxies are the IP addresses or CIDR ranges of proxies
+	// whose X-Forwarded-For header identifies the client
+	TrustedProxies []string
+}
+
+// Tracing config (the export of OpenTelemetry trace spans)
+type Tracing struct {
+	// Endpoint is the OTLP/HTTP traces URL of a collector (if empty, tracing is disabled)
+	Endpoint string
+	// SampleRatio is the fraction of new traces which are recorded
+	SampleRatio float64
+	// ServiceName identifies the service in traces
+	ServiceName string
+}
+
+// Csv config (the encoding of CSV responses)
+type Csv struct {
+	// Delimiter is the field delimiter (comma, semicolon, tab or a single character)
+	Delimiter string
+	// NullValue is the text of NULL property values (default is an empty field)
+	NullValue string
+}
+
+// GeoPackage config (the GeoPackage export format)
+type GeoPackage struct {
+	// Enabled allows items to be requested as GeoPackage files
+	Enabled bool
+	// MaxFeatures is the maximum number of features in a GeoPackage file
+	MaxFeatures int
+}
+
+// Download config (the Content-Disposition of collection items responses)
+type Download struct {
+	// Disposition is inline or attachment for each items format (if not set, no header is returned)
+	Disposition map[string]string
+	// Filename is the downloaded file name (without extension).
+	// {collection} and {timestamp} are replaced by the collection id and the UTC time
+	Filename string
+}
+
+// Crs config (a coordinate system supported by the server)
+type Crs struct {
+	// Uri is the OGC URI of the coordinate system
+	Uri string
+	// Srid is the PostGIS SRID of the coordinate system
+	Srid int
+}
+
+// Cors config (a CORS policy for a set of request paths)
+type Cors struct {
+	// Paths are the patterns of the request paths the policy applies to (if empty, all paths)
+	Paths []string
+	// AllowedOrigins are the origins allowed to access the paths (* allows all)
+	AllowedOrigins []string
+	// AllowedMethods are the allowed request methods (if empty, GET and HEAD)
+	AllowedMethods []string
+	// AllowedHeaders are the request headers allowed in preflight requests (* allows all)
+	AllowedHeaders []string
+	// AllowCredentials allows requests with credentials (cookies or authorization).
+	// It cannot be used with the * origin
+	AllowCredentials bool
+	// MaxAgeSec is the time browsers may cache preflight responses for
+	MaxAgeSec int
+}
+
+// Collection config (settings for a single published collection)
+type Collection struct {
+	Id       string
+	Editable bool
+	// Title and Description override the table comment
+	Title       string
+	Description string
+	// PropertyDescriptions override the column comments (keyed by column name)
+	PropertyDescriptions map[string]string
+	// PropertyAliases are the names columns are returned with (keyed by column name).
+	// Requests may use either the column name or the alias
+	PropertyAliases map[string]string
+	// TenantColumn restricts access to rows with the value of the request tenant claim
+	TenantColumn string
+	// Category groups related collections
+	Category string
+	// DatetimeColumn is the temporal column filtered by the datetime parameter.
+	// If DatetimeEndColumn is set, they are the start and end of a time range
+	DatetimeColumn    string
+	DatetimeEndColumn string
+	// UpdatedColumn is the timestamp column providing the Last-Modified time of features
+	UpdatedColumn string
+	// CacheTTLSec overrides the Cache TTLSec, if set (less than 0 disables caching)
+	CacheTTLSec int
+	// LimitDefault and LimitMax override the Paging settings, if set
+	LimitDefault int
+	LimitMax     int
+	// PropertyGroups are named lists of properties,
+	// which can be requested as @name in the properties parameter
+	PropertyGroups map[string][]string
+	// IdColumn is the column providing feature ids, overriding the primary key.
+	// Its values must be unique
+	IdColumn string
+	// MakeValid repairs invalid feature geometry in responses using ST_MakeValid
+	MakeValid bool
+	// DropInvalid omits features whose geometry cannot be repaired by MakeValid
+	DropInvalid bool
+	// MaxGeometryPoints is the number of points above which feature geometry
+	// is simplified in responses (0 for no limit)
+	MaxGeometryPoints int
+	// OmitComplexGeometry omits geometry with more than MaxGeometryPoints, rather than simplifying it
+	OmitComplexGeometry bool
+	// EmptyGeometry is how features with empty geometry are returned:
+	// keep (the default), null, or exclude
+	EmptyGeometry string
+	// Dimension is the coordinate dimension geometry is returned with:
+	// 2 drops any Z and M ordinates, 0 (the default) returns the stored coordinates
+	Dimension int
+	// DeniedColumns are never returned as properties, and cannot be filtered by
+	DeniedColumns []string
+	// LookupColumns are unique columns which features can be looked up by
+	LookupColumns []string
+	// UnorderedPaging disables ordering features by the id columns
+	// when no sort order is requested
+	UnorderedPaging bool
+	// MapDisabled omits the map from the HTML pages of the collection features
+	MapDisabled bool
+}
+
+// SqlCollection config publishes the result of a SQL query as a read-only collection
+type SqlCollection struct {
+	Id          string
+	Title       string
+	Description string
+	// Sql is the query providing the features.
+	// It may contain placeholders (:name) for the Parameters
+	Sql string
+	// GeometryColumn and IdColumn are the query columns
+	// providing the feature geometry and a stable feature id
+	GeometryColumn string
+	IdColumn       string
+	// Srid is the coordinate system of the geometry (default is 4326)
+	Srid       int
+	Parameters []SqlParameter
+}
+
+// SqlParameter config is a parameter of a SqlCollection query,
+// provided by the request query parameter of the same name
+type SqlParameter struct {
+	Name string
+	// Type is one of text, int, float, bool, date or timestamp
+	Type string
+	// Default is used when the request does not provide a value.
+	// Parameters with no default are required
+	Default string
+}
+
+// CollectionConfig returns the configuration for the collection with the given id.
+// Collections which are not configured get the default settings.
+func (conf *Config) CollectionConfig(id string) Collection {
+	for _, coll := range conf.Collections {
+		if strings.EqualFold(coll.Id, id) {
+			return coll
+		}
+	}
+	return Collection{Id: id}
+}
+
+// CollectionCategory returns the category of the collection with the given id.
+// Collections without a category are in the default category
+func (conf *Config) CollectionCategory(id string) string {
+	category := conf.CollectionConfig(id).Category
+	if category == "" {
+		return conf.Metadata.DefaultCategory
+	}
+	return category
+}
+
+// CollectionPaging returns the paging limits for the collection with the given id.
+// Limits which are not configured for the collection are taken from the Paging settings.
+func (conf *Config) CollectionPaging(id string) Paging {
+	paging := conf.Paging
+	coll := conf.CollectionConfig(id)
+	if coll.LimitMax > 0 {
+		paging.LimitMax = coll.LimitMax
+	}
+	if coll.LimitDefault > 0 {
+		paging.LimitDefault = coll.LimitDefault
+	}
+	if paging.LimitDefault > paging.LimitMax {
+		paging.LimitDefault = paging.LimitMax
+	}
+	return paging
 }
 
 // IsHTTPSEnabled tests whether HTTPS is enabled
@@ -148,35 +560,134 @@ func InitConfig(configFilename string, isDebug bool) {
 	}
 
 	log.Infof("Using config file: %s", viper.ConfigFileUsed())
-	errUnM := viper.Unmarshal(&Configuration)
+	var config Config
+	errUnM := viper.Unmarshal(&config)
 	if errUnM != nil {
 		log.Fatal(fmt.Errorf("fatal error decoding config file: %v", errUnM))
 	}
+	dbconnSrc := applyEnvConfig(&config)
+	if err := validateConfig(&config); err != nil {
+		log.Fatal(fmt.Errorf("fatal error in config file: %v", err))
+	}
+	SetConfiguration(config)
+	log.Infof("Using database connection info from %v", dbconnSrc)
+}
 
+// applyEnvConfig sets the configuration provided by environment variables,
+// and sanitizes the configuration.
+// It returns the source of the database configuration
+func applyEnvConfig(config *Config) string {
 	// Read environment variable database configuration
 	// It takes precedence over config file (if any)
 	// A blank value is ignored
 	dbconnSrc := "config file"
 	if dbURL := os.Getenv(AppConfig.EnvDBURL); dbURL != "" {
-		Configuration.Database.DbConnection = dbURL
+		config.Database.DbConnection = dbURL
 		dbconnSrc = "environment variable " + AppConfig.EnvDBURL
 	}
-	log.Infof("Using database connection info from %v", dbconnSrc)
 
 	// sanitize the configuration
-	Configuration.Server.BasePath = strings.TrimRight(Configuration.Server.BasePath, "/")
+	config.Server.BasePath = strings.TrimRight(config.Server.BasePath, "/")
+	return dbconnSrc
+}
+
+// validateConfig checks settings which cannot be used together.
+// A CORS policy allowing credentials must list its origins,
+// since allowing all origins would let any web site make requests
+// with the credentials of the user
+func validateConfig(config *Config) error {
+	for i, policy := range config.Cors {
+		if !policy.AllowCredentials {
+			continue
+		}
+		for _, origin := range policy.AllowedOrigins {
+			if origin == "*" {
+				return fmt.Errorf("[[Cors]] policy %v allows credentials for all origins (*)", i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// ReloadConfig reads the config file again, and replaces the configuration.
+// Settings which are only used at startup keep their current values.
+// The names of any of these settings which were changed are returned,
+// since they require a restart to take effect
+func ReloadConfig() ([]string, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var reloaded Config
+	if err := viper.Unmarshal(&reloaded); err != nil {
+		return nil, err
+	}
+	applyEnvConfig(&reloaded)
+	if err := validateConfig(&reloaded); err != nil {
+		return nil, err
+	}
+	changed := keepStartupSettings(Configuration(), &reloaded)
+	SetConfiguration(reloaded)
+	return changed, nil
+}
+
+// keepStartupSettings sets the startup settings of a reloaded configuration
+// to the current values, and returns the names of the settings which were changed
+func keepStartupSettings(current *Config, reloaded *Config) []string {
+	settings := []struct {
+		name     string
+		current  interface{}
+		reloaded interface{}
+	}{
+		{"HttpHost", &current.Server.HttpHost, &reloaded.Server.HttpHost},
+		{"HttpPort", &current.Server.HttpPort, &reloaded.Server.HttpPort},
+		{"HttpsPort", &current.Server.HttpsPort, &reloaded.Server.HttpsPort},
+		{"TlsServerCertificateFile", &current.Server.TlsServerCertificateFile, &reloaded.Server.TlsServerCertificateFile},
+		{"TlsServerPrivateKeyFile", &current.Server.TlsServerPrivateKeyFile, &reloaded.Server.TlsServerPrivateKeyFile},
+		{"TlsMinVersion", &current.Server.TlsMinVersion, &reloaded.Server.TlsMinVersion},
+		{"HttpsRedirect", &current.Server.HttpsRedirect, &reloaded.Server.HttpsRedirect},
+		{"BasePath", &current.Server.BasePath, &reloaded.Server.BasePath},
+		{"CORSOrigins", &current.Server.CORSOrigins, &reloaded.Server.CORSOrigins},
+		{"Debug", &current.Server.Debug, &reloaded.Server.Debug},
+		{"AssetsPath", &current.Server.AssetsPath, &reloaded.Server.AssetsPath},
+		{"ReadTimeoutSec", &current.Server.ReadTimeoutSec, &reloaded.Server.ReadTimeoutSec},
+		{"WriteTimeoutSec", &current.Server.WriteTimeoutSec, &reloaded.Server.WriteTimeoutSec},
+		{"Database", &current.Database.DbConnection, &reloaded.Database.DbConnection},
+		{"DbPoolMaxConnLifeTime", &current.Database.DbPoolMaxConnLifeTime, &reloaded.Database.DbPoolMaxConnLifeTime},
+		{"DbPoolMaxConns", &current.Database.DbPoolMaxConns, &reloaded.Database.DbPoolMaxConns},
+		{"DbPoolMinConns", &current.Database.DbPoolMinConns, &reloaded.Database.DbPoolMinConns},
+		{"DbPoolMaxConnIdleTime", &current.Database.DbPoolMaxConnIdleTime, &reloaded.Database.DbPoolMaxConnIdleTime},
+		{"DbPoolHealthCheckPeriod", &current.Database.DbPoolHealthCheckPeriod, &reloaded.Database.DbPoolHealthCheckPeriod},
+		{"FunctionIncludes", &current.Database.FunctionIncludes, &reloaded.Database.FunctionIncludes},
+		{"Auth", &current.Auth, &reloaded.Auth},
+		{"MaxEntries", &current.Cache.MaxEntries, &reloaded.Cache.MaxEntries},
+		{"MaxSizeMB", &current.Cache.MaxSizeMB, &reloaded.Cache.MaxSizeMB},
+		{"Cors", &current.Cors, &reloaded.Cors},
+		{"Tracing", &current.Tracing, &reloaded.Tracing},
+		{"Databases", &current.Databases, &reloaded.Databases},
+	}
+	var changed []string
+	for _, setting := range settings {
+		cur := reflect.ValueOf(setting.current).Elem()
+		rel := reflect.ValueOf(setting.reloaded).Elem()
+		if !reflect.DeepEqual(cur.Interface(), rel.Interface()) {
+			changed = append(changed, setting.name)
+			rel.Set(cur)
+		}
+	}
+	return changed
 }
 
 func DumpConfig() {
 	log.Debugf("--- Configuration ---")
 	//fmt.Printf("Viper: %v\n", viper.AllSettings())
 	//fmt.Printf("Config: %v\n", Configuration)
-	var basemapURL = Configuration.Website.BasemapUrl
+	config := Configuration()
+	var basemapURL = config.Website.BasemapUrl
 	if basemapURL == "" {
 		basemapURL = "*** NO URL PROVIDED ***"
 	}
 	log.Debugf("  BasemapUrl = %v", basemapURL)
-	log.Debugf("  TableIncludes = %v", Configuration.Database.TableIncludes)
-	log.Debugf("  TableExcludes = %v", Configuration.Database.TableExcludes)
-	log.Debugf("  FunctionIncludes = %v", Configuration.Database.FunctionIncludes)
+	log.Debugf("  TableIncludes = %v", config.Database.TableIncludes)
+	log.Debugf("  TableExcludes = %v", config.Database.TableExcludes)
+	log.Debugf("  FunctionIncludes = %v", config.Database.FunctionIncludes)
 }
@@ -16,6 +16,7 @@ package cql
 // Build grammar with: antlr -Dlanguage=Go -package cql CqlLexer.g4 CQLParser.g4
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -23,9 +24,25 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func TranspileToSQL(cqlStr string, filterSRID int, sourceSRID int) (string, error) {
+func TranspileToSQL(cqlStr string, filterSRID int, sourceSRID int) (string, []interface{}, error) {
+	return TranspileToSQLResolved(cqlStr, filterSRID, sourceSRID, nil)
+}
+
+// NameResolver provides the column of a property name used in a filter.
+// It returns an error if the property cannot be filtered by
+type NameResolver func(name string) (string, error)
+
+// TranspileToSQLResolved converts a CQL filter to SQL,
+// with the property names mapped to columns by a resolver (if not nil).
+// Geometry literals are bound as parameters $1..$n,
+// whose values are returned along with the SQL
+func TranspileToSQLResolved(cqlStr string, filterSRID int, sourceSRID int, resolve NameResolver) (string, []interface{}, error) {
 	if len(cqlStr) < 1 {
-		return "", nil
+		return "", nil, nil
+	}
+	cqlStr, err := rewriteSpatialText(cqlStr)
+	if err != nil {
+		return "", nil, err
 	}
 	// Setup the input
 	is := antlr.NewInputStream(cqlStr)
@@ -46,15 +63,19 @@ func TranspileToSQL(cqlStr string, filterSRID int, sourceSRID int) (string, erro
 	tree := parser.CqlFilter()
 	//-- parse the CQL expression
 	listener := NewCqlListener(filterSRID, sourceSRID)
+	listener.resolve = resolve
 	antlr.ParseTreeWalkerDefault.Walk(listener, tree)
 
 	if parseErrors.errorCount > 0 {
 		log.Debug("CQL parser error = " + parseErrors.msg)
 		msg := syntaxErrorMsg(cqlStr, parseErrors.col)
 		err := fmt.Errorf("CQL syntax error: %s", msg)
-		return "", err
+		return "", nil, err
+	}
+	if listener.err != nil {
+		return "", nil, listener.err
 	}
-	return listener.GetSQL(), nil
+	return listener.GetSQL(), listener.args, nil
 }
 
 func syntaxErrorMsg(input string, col int) string {
@@ -79,6 +100,124 @@ func syntaxErrorMsg(input string, col int) string {
 	return msg
 }
 
+// rewriteSpatialText converts the CQL2 forms of spatial predicates
+// to the forms accepted by the grammar.
+// CQL2 spatial operator names (such as S_INTERSECTS) have their S_ prefix removed,
+// and GeoJSON geometry literals are converted to WKT.
+// Text in quoted strings and names is not changed
+func rewriteSpatialText(cqlStr string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(cqlStr); {
+		ch := cqlStr[i]
+		switch {
+		case ch == '\'' || ch == '"':
+			end := quotedEnd(cqlStr, i)
+			sb.WriteString(cqlStr[i:end])
+			i = end
+		case ch == '{':
+			end := jsonObjectEnd(cqlStr, i)
+			wkt, err := geoJSONToText(cqlStr[i:end])
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(wkt)
+			i = end
+		case isNameChar(ch):
+			end := i
+			for end < len(cqlStr) && isNameChar(cqlStr[end]) {
+				end++
+			}
+			name, err := spatialOperatorName(cqlStr[i:end], cqlStr[end:])
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(name)
+			i = end
+		default:
+			sb.WriteByte(ch)
+			i++
+		}
+	}
+	return sb.String(), nil
+}
+
+// spatialOperatorName converts a CQL2 spatial operator name to the grammar form.
+// A name with the S_ prefix which is called as a function must be a spatial operator
+func spatialOperatorName(name string, rest string) (string, error) {
+	nameLow := strings.ToLower(name)
+	if !strings.HasPrefix(nameLow, "s_") || !strings.HasPrefix(strings.TrimLeft(rest, " \t\r\n"), "(") {
+		return name, nil
+	}
+	if op, ok := jsonOpsSpatial[nameLow]; ok {
+		return op, nil
+	}
+	return "", fmt.Errorf("CQL: unknown spatial operator: %v", name)
+}
+
+// geoJSONToText converts a GeoJSON geometry literal to WKT
+func geoJSONToText(geomJSON string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(geomJSON))
+	dec.UseNumber()
+	var geom map[string]interface{}
+	if err := dec.Decode(&geom); err != nil {
+		return "", fmt.Errorf("CQL: invalid GeoJSON geometry: %v", err)
+	}
+	if _, ok := geom["type"].(string); !ok {
+		return "", fmt.Errorf("CQL: invalid GeoJSON geometry: missing type")
+	}
+	wkt, err := jsonGeometryText(geom)
+	if err != nil {
+		return "", fmt.Errorf("CQL: invalid GeoJSON geometry: %v", err)
+	}
+	return wkt, nil
+}
+
+// quotedEnd is the index after the end of a quoted string or name.
+// A doubled quote character is part of the text
+func quotedEnd(s string, start int) int {
+	quote := s[start]
+	i := start + 1
+	for i < len(s) {
+		if s[i] == quote {
+			if i+1 < len(s) && s[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(s)
+}
+
+// jsonObjectEnd is the index after the end of a JSON object,
+// skipping braces in JSON strings
+func jsonObjectEnd(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(s)
+}
+
+func isNameChar(ch byte) bool {
+	return ch == '_' || ch == '$' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
 // ======================================
 type CqlErrorListener struct {
 	*antlr.DefaultErrorListener
@@ -117,6 +256,12 @@ type cqlListener struct {
 	filterSRID int
 	// SRID for source CRS
 	sourceSRID int
+	// resolver for property names (if any)
+	resolve NameResolver
+	// first error resolving a property name
+	err error
+	// values of the geometry literal parameters
+	args []interface{}
 
 	// final result SQL
 	sql string
@@ -132,8 +277,29 @@ func (l *cqlListener) GetSQL() string {
 	return l.sql
 }
 
+// sqlPropertyName is the SQL column for a property name
+func (l *cqlListener) sqlPropertyName(ctx antlr.ParserRuleContext) string {
+	name := getText(ctx)
+	if l.resolve == nil {
+		return quotedName(name)
+	}
+	if strings.HasPrefix(name, "\"") && strings.HasSuffix(name, "\"") && len(name) > 1 {
+		name = strings.ReplaceAll(name[1:len(name)-1], "\"\"", "\"")
+	}
+	col, err := l.resolve(name)
+	if err != nil {
+		if l.err == nil {
+			l.err = err
+		}
+		return ""
+	}
+	return "\"" + strings.ReplaceAll(col, "\"", "\"\"") + "\""
+}
+
+// sqlGeometryLiteral binds the WKT of a geometry literal as a parameter
 func (l *cqlListener) sqlGeometryLiteral(wkt string) string {
-	sql := fmt.Sprintf("'SRID=%d;%s'::geometry", l.filterSRID, wkt)
+	l.args = append(l.args, wkt)
+	sql := fmt.Sprintf("ST_GeomFromText($%d::text,%d)", len(l.args), l.filterSRID)
 	return sql
 }
 
@@ -300,7 +466,7 @@ func (l *cqlListener) ExitBinaryComparisonPredicate(ctx *BinaryComparisonPredica
 }
 
 func (l *cqlListener) ExitLiteralName(ctx *LiteralNameContext) {
-	sql := quotedName(getText(ctx.PropertyName()))
+	sql := l.sqlPropertyName(ctx.PropertyName())
 	ctx.SetSql(sql)
 }
 
@@ -344,7 +510,7 @@ func (l *cqlListener) ExitScalarExpr(ctx *ScalarExprContext) {
 
 func (l *cqlListener) ExitIsLikePredicate(ctx *IsLikePredicateContext) {
 	var sb strings.Builder
-	sb.WriteString(quotedName(getText(ctx.PropertyName())))
+	sb.WriteString(l.sqlPropertyName(ctx.PropertyName()))
 	if ctx.NOT() != nil {
 		sb.WriteString(" NOT")
 	}
@@ -370,7 +536,7 @@ func (l *cqlListener) ExitIsBetweenPredicate(ctx *IsBetweenPredicateContext) {
 }
 
 func (l *cqlListener) ExitIsNullPredicate(ctx *IsNullPredicateContext) {
-	prop := quotedName(getText(ctx.PropertyName()))
+	prop := l.sqlPropertyName(ctx.PropertyName())
 	not := ""
 	if ctx.NOT() != nil {
 		not = " NOT"
@@ -381,7 +547,7 @@ func (l *cqlListener) ExitIsNullPredicate(ctx *IsNullPredicateContext) {
 
 func (l *cqlListener) ExitIsInListPredicate(ctx *IsInListPredicateContext) {
 	var sb strings.Builder
-	sb.WriteString(quotedName(getText(ctx.PropertyName())))
+	sb.WriteString(l.sqlPropertyName(ctx.PropertyName()))
 	if ctx.NOT() != nil {
 		sb.WriteString(" NOT")
 	}
@@ -443,7 +609,7 @@ func (l *cqlListener) ExitDistancePredicate(ctx *DistancePredicateContext) {
 func (l *cqlListener) ExitGeomExpression(ctx *GeomExpressionContext) {
 	var sb strings.Builder
 	if ctx.PropertyName() != nil {
-		sb.WriteString(quotedName(getText(ctx.PropertyName())))
+		sb.WriteString(l.sqlPropertyName(ctx.PropertyName()))
 	} else {
 		sb.WriteString(sqlFor(ctx.GeomLiteral()))
 	}
@@ -462,6 +628,10 @@ func (l *cqlListener) ExitTemporalLiteral(ctx *TemporalLiteralContext) {
 }
 
 func (l *cqlListener) ExitGeomLiteral(ctx *GeomLiteralContext) {
+	// members of a geometry collection are part of its WKT
+	if _, isMember := ctx.GetParent().(*GeometryCollectionContext); isMember {
+		return
+	}
 	envCtx, ok := ctx.GetChild(0).(*EnvelopeContext)
 	var sql string
 	if ok {
@@ -0,0 +1,310 @@
+package cql
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TranspileJSONToSQL converts a CQL2-JSON filter to SQL.
+// The filter is converted to CQL2 text, so that both encodings
+// are parsed and transpiled by the same grammar
+func TranspileJSONToSQL(cqlJSON string, filterSRID int, sourceSRID int) (string, []interface{}, error) {
+	if len(strings.TrimSpace(cqlJSON)) < 1 {
+		return "", nil, nil
+	}
+	cqlStr, err := JSONToText(cqlJSON)
+	if err != nil {
+		return "", nil, err
+	}
+	return TranspileToSQL(cqlStr, filterSRID, sourceSRID)
+}
+
+// JSONToText converts a CQL2-JSON filter to CQL2 text
+func JSONToText(cqlJSON string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(cqlJSON)))
+	dec.UseNumber()
+	var expr interface{}
+	if err := dec.Decode(&expr); err != nil {
+		return "", fmt.Errorf("CQL2-JSON syntax error: %v", err)
+	}
+	if dec.More() {
+		return "", fmt.Errorf("CQL2-JSON syntax error: unexpected content after expression")
+	}
+	return jsonExprText(expr)
+}
+
+var jsonOpsLogical = map[string]string{
+	"and": " AND ",
+	"or":  " OR ",
+}
+
+var jsonOpsComparison = map[string]bool{
+	"=": true, "<>": true, "<": true, ">": true, "<=": true, ">=": true,
+}
+
+var jsonOpsArithmetic = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true, "%": true, "^": true,
+}
+
+var jsonOpsSpatial = map[string]string{
+	"s_contains":   "CONTAINS",
+	"s_crosses":    "CROSSES",
+	"s_disjoint":   "DISJOINT",
+	"s_equals":     "EQUALS",
+	"s_intersects": "INTERSECTS",
+	"s_overlaps":   "OVERLAPS",
+	"s_touches":    "TOUCHES",
+	"s_within":     "WITHIN",
+}
+
+var reJSONPropertyName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_$]*$`)
+
+func jsonExprText(expr interface{}) (string, error) {
+	switch val := expr.(type) {
+	case string:
+		return "'" + strings.Replace(val, "'", "''", -1) + "'", nil
+	case json.Number:
+		return val.String(), nil
+	case bool:
+		if val {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case map[string]interface{}:
+		return jsonObjectText(val)
+	}
+	return "", fmt.Errorf("CQL2-JSON: unsupported expression: %v", expr)
+}
+
+func jsonObjectText(obj map[string]interface{}) (string, error) {
+	if op, ok := obj["op"].(string); ok {
+		args, ok := obj["args"].([]interface{})
+		if !ok {
+			return "", fmt.Errorf("CQL2-JSON: missing args for op: %v", op)
+		}
+		return jsonOpText(strings.ToLower(op), args)
+	}
+	if name, ok := obj["property"].(string); ok {
+		if !reJSONPropertyName.MatchString(name) {
+			return "", fmt.Errorf("CQL2-JSON: invalid property name: %v", name)
+		}
+		return name, nil
+	}
+	if ts, ok := obj["timestamp"].(string); ok {
+		return ts, nil
+	}
+	if date, ok := obj["date"].(string); ok {
+		return date, nil
+	}
+	if bbox, ok := obj["bbox"].([]interface{}); ok {
+		if len(bbox) != 4 {
+			return "", fmt.Errorf("CQL2-JSON: bbox must have 4 values")
+		}
+		nums, err := jsonNumberList(bbox)
+		if err != nil {
+			return "", err
+		}
+		return "ENVELOPE(" + strings.Join(nums, ",") + ")", nil
+	}
+	if _, ok := obj["type"]; ok {
+		return jsonGeometryText(obj)
+	}
+	return "", fmt.Errorf("CQL2-JSON: unsupported expression object")
+}
+
+func jsonOpText(op string, args []interface{}) (string, error) {
+	argsText := make([]string, len(args))
+	//-- the in list is handled separately
+	if op != "in" {
+		for i, arg := range args {
+			txt, err := jsonExprText(arg)
+			if err != nil {
+				return "", err
+			}
+			argsText[i] = txt
+		}
+	}
+	switch {
+	case jsonOpsLogical[op] != "":
+		if len(args) < 2 {
+			return "", fmt.Errorf("CQL2-JSON: op %v requires at least 2 args", op)
+		}
+		return "(" + strings.Join(argsText, jsonOpsLogical[op]) + ")", nil
+	case op == "not":
+		if err := checkArgCount(op, args, 1); err != nil {
+			return "", err
+		}
+		return "NOT (" + argsText[0] + ")", nil
+	case jsonOpsComparison[op]:
+		if err := checkArgCount(op, args, 2); err != nil {
+			return "", err
+		}
+		return argsText[0] + " " + op + " " + argsText[1], nil
+	case jsonOpsArithmetic[op]:
+		if err := checkArgCount(op, args, 2); err != nil {
+			return "", err
+		}
+		return "(" + argsText[0] + " " + op + " " + argsText[1] + ")", nil
+	case op == "like":
+		if err := checkArgCount(op, args, 2); err != nil {
+			return "", err
+		}
+		return argsText[0] + " LIKE " + argsText[1], nil
+	case op == "between":
+		if err := checkArgCount(op, args, 3); err != nil {
+			return "", err
+		}
+		return argsText[0] + " BETWEEN " + argsText[1] + " AND " + argsText[2], nil
+	case op == "isnull":
+		if err := checkArgCount(op, args, 1); err != nil {
+			return "", err
+		}
+		return argsText[0] + " IS NULL", nil
+	case op == "in":
+		return jsonInText(args)
+	case jsonOpsSpatial[op] != "":
+		if err := checkArgCount(op, args, 2); err != nil {
+			return "", err
+		}
+		return jsonOpsSpatial[op] + "(" + argsText[0] + ", " + argsText[1] + ")", nil
+	}
+	return "", fmt.Errorf("CQL2-JSON: unsupported op: %v", op)
+}
+
+func jsonInText(args []interface{}) (string, error) {
+	if err := checkArgCount("in", args, 2); err != nil {
+		return "", err
+	}
+	prop, err := jsonExprText(args[0])
+	if err != nil {
+		return "", err
+	}
+	list, ok := args[1].([]interface{})
+	if !ok || len(list) == 0 {
+		return "", fmt.Errorf("CQL2-JSON: op in requires a list of values")
+	}
+	vals := make([]string, len(list))
+	for i, item := range list {
+		txt, err := jsonExprText(item)
+		if err != nil {
+			return "", err
+		}
+		vals[i] = txt
+	}
+	return prop + " IN (" + strings.Join(vals, ",") + ")", nil
+}
+
+func checkArgCount(op string, args []interface{}, count int) error {
+	if len(args) != count {
+		return fmt.Errorf("CQL2-JSON: op %v requires %d args", op, count)
+	}
+	return nil
+}
+
+// jsonGeometryText converts a GeoJSON geometry to WKT
+func jsonGeometryText(geom map[string]interface{}) (string, error) {
+	typ, _ := geom["type"].(string)
+	if typ == "GeometryCollection" {
+		geoms, ok := geom["geometries"].([]interface{})
+		if !ok {
+			return "", fmt.Errorf("CQL2-JSON: invalid GeometryCollection")
+		}
+		parts := make([]string, len(geoms))
+		for i, g := range geoms {
+			gobj, ok := g.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("CQL2-JSON: invalid GeometryCollection")
+			}
+			txt, err := jsonGeometryText(gobj)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = txt
+		}
+		return "GEOMETRYCOLLECTION(" + strings.Join(parts, ",") + ")", nil
+	}
+	//-- the nesting depth of the coordinates of each geometry type
+	depth := map[string]int{
+		"Point":           0,
+		"LineString":      1,
+		"MultiPoint":      1,
+		"Polygon":         2,
+		"MultiLineString": 2,
+		"MultiPolygon":    3,
+	}
+	d, ok := depth[typ]
+	if !ok {
+		return "", fmt.Errorf("CQL2-JSON: unsupported geometry type: %v", typ)
+	}
+	//-- points (including those of a MultiPoint) are enclosed in parentheses
+	coords := geom["coordinates"]
+	switch typ {
+	case "Point":
+		coords = []interface{}{coords}
+		d = 1
+	case "MultiPoint":
+		pts, _ := coords.([]interface{})
+		wrapped := make([]interface{}, len(pts))
+		for i, pt := range pts {
+			wrapped[i] = []interface{}{pt}
+		}
+		coords = wrapped
+		d = 2
+	}
+	coordsText, err := jsonCoordsText(coords, d)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(typ) + coordsText, nil
+}
+
+func jsonCoordsText(coords interface{}, depth int) (string, error) {
+	list, ok := coords.([]interface{})
+	if !ok || len(list) == 0 {
+		return "", fmt.Errorf("CQL2-JSON: invalid geometry coordinates")
+	}
+	if depth == 0 {
+		nums, err := jsonNumberList(list)
+		if err != nil {
+			return "", err
+		}
+		return strings.Join(nums, " "), nil
+	}
+	parts := make([]string, len(list))
+	for i, item := range list {
+		txt, err := jsonCoordsText(item, depth-1)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = txt
+	}
+	return "(" + strings.Join(parts, ",") + ")", nil
+}
+
+func jsonNumberList(list []interface{}) ([]string, error) {
+	nums := make([]string, len(list))
+	for i, item := range list {
+		num, ok := item.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("CQL2-JSON: invalid number: %v", item)
+		}
+		nums[i] = num.String()
+	}
+	return nums, nil
+}
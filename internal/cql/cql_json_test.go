@@ -0,0 +1,88 @@
+package cql
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestJSONComparison(t *testing.T) {
+	checkCQLJSON(t, `{"op": "=", "args": [{"property": "id"}, 1]}`, "\"id\" = 1")
+	checkCQLJSON(t, `{"op": ">=", "args": [{"property": "id"}, -1.5]}`, "\"id\" >= -1.5")
+	checkCQLJSON(t, `{"op": "<>", "args": [{"property": "name"}, "it's"]}`, "\"name\" <> 'it''s'")
+	checkCQLJSON(t, `{"op": ">", "args": [{"property": "p"}, {"op": "+", "args": [1, {"property": "x"}]}]}`,
+		"\"p\" > (1 + \"x\")")
+}
+
+func TestJSONPredicates(t *testing.T) {
+	checkCQLJSON(t, `{"op": "like", "args": [{"property": "name"}, "Ca%"]}`, "\"name\" LIKE 'Ca%'")
+	checkCQLJSON(t, `{"op": "between", "args": [{"property": "id"}, 1, 2]}`, "\"id\" BETWEEN 1 AND 2")
+	checkCQLJSON(t, `{"op": "in", "args": [{"property": "id"}, [1, 2, 3]]}`, "\"id\" IN (1,2,3)")
+	checkCQLJSON(t, `{"op": "isNull", "args": [{"property": "id"}]}`, "\"id\" IS NULL")
+	checkCQLJSON(t, `{"op": ">", "args": [{"property": "t"}, {"timestamp": "2020-01-01T00:00:00Z"}]}`,
+		"\"t\" > timestamp '2020-01-01T00:00:00Z'")
+}
+
+func TestJSONBoolean(t *testing.T) {
+	checkCQLJSON(t, `{"op": "and", "args": [
+			{"op": "=", "args": [{"property": "x"}, 1]},
+			{"op": "or", "args": [
+				{"op": "=", "args": [{"property": "y"}, 2]},
+				{"op": "not", "args": [{"op": "=", "args": [{"property": "z"}, 3]}]}
+			]}
+		]}`,
+		"(\"x\" = 1 AND (\"y\" = 2 OR NOT (\"z\" = 3)))")
+}
+
+func TestJSONSpatial(t *testing.T) {
+	checkCQLJSON(t, `{"op": "s_intersects", "args": [{"property": "geom"}, {"type": "Point", "coordinates": [1, 2]}]}`,
+		"ST_Intersects(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(1 2)")
+	checkCQLJSON(t, `{"op": "s_within", "args": [{"property": "geom"}, {"bbox": [1, 2, 3, 4]}]}`,
+		"ST_Within(\"geom\",ST_MakeEnvelope(1,2,3,4,4326))")
+	checkCQLJSON(t, `{"op": "s_equals", "args": [{"property": "geom"},
+			{"type": "Polygon", "coordinates": [[[0, 0], [0, 9], [9, 0], [0, 0]]]}]}`,
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "POLYGON((0 0,0 9,9 0,0 0))")
+	checkCQLJSON(t, `{"op": "s_equals", "args": [{"property": "geom"},
+			{"type": "MultiPoint", "coordinates": [[0, 0], [0, 9]]}]}`,
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "MULTIPOINT((0 0),(0 9))")
+}
+
+func TestJSONErrors(t *testing.T) {
+	checkCQLJSONError(t, `{"op": "=", "args": [{"property": "id"}, 1]`)
+	checkCQLJSONError(t, `{"op": "=", "args": [{"property": "id"}]}`)
+	checkCQLJSONError(t, `{"op": "unknown", "args": [1, 2]}`)
+	checkCQLJSONError(t, `{"op": "=", "args": [{"property": "id; drop"}, 1]}`)
+	checkCQLJSONError(t, `{"op": "s_intersects", "args": [{"property": "geom"}, {"type": "Circle"}]}`)
+}
+
+func checkCQLJSON(t *testing.T, cqlJSON string, sql string, wkt ...interface{}) {
+	actual, args, err := TranspileJSONToSQL(cqlJSON, 4326, 4326)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		t.FailNow()
+	}
+	actual = strings.TrimSpace(actual)
+	equals(t, sql, actual, "")
+	if len(wkt) == 0 {
+		wkt = nil
+	}
+	equals(t, wkt, args, "args")
+}
+
+func checkCQLJSONError(t *testing.T, cqlJSON string) {
+	_, _, err := TranspileJSONToSQL(cqlJSON, 4326, 4326)
+	isError(t, err, "")
+}
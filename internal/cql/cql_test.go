@@ -64,16 +64,32 @@ func TestNullPredicate(t *testing.T) {
 }
 
 func TestSpatialPredicate(t *testing.T) {
-	checkCQL(t, "crosses(geom, POINT(0 0))", "ST_Crosses(\"geom\",'SRID=4326;POINT(0 0)'::geometry)")
-	checkCQL(t, "Contains(geom, POINT(0 0))", "ST_Contains(\"geom\",'SRID=4326;POINT(0 0)'::geometry)")
-	checkCQL(t, "DISJOINT(geom, POINT(0 0))", "ST_Disjoint(\"geom\",'SRID=4326;POINT(0 0)'::geometry)")
-	checkCQL(t, "EQUALS(geom, POINT(0 0))", "ST_Equals(\"geom\",'SRID=4326;POINT(0 0)'::geometry)")
-	checkCQL(t, "INTERSECTS(geom, POINT(0 0))", "ST_Intersects(\"geom\",'SRID=4326;POINT(0 0)'::geometry)")
-	checkCQL(t, "OVERLAPS(geom, POINT(0 0))", "ST_Overlaps(\"geom\",'SRID=4326;POINT(0 0)'::geometry)")
-	checkCQL(t, "TOUCHES(geom, POINT(0 0))", "ST_Touches(\"geom\",'SRID=4326;POINT(0 0)'::geometry)")
-	checkCQL(t, "within(geom, POINT(0 0))", "ST_Within(\"geom\",'SRID=4326;POINT(0 0)'::geometry)")
-
-	checkCQL(t, "Dwithin(geom, POINT(0 0), 100)", "ST_DWithin(\"geom\",'SRID=4326;POINT(0 0)'::geometry,100)")
+	checkCQL(t, "crosses(geom, POINT(0 0))", "ST_Crosses(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(0 0)")
+	checkCQL(t, "Contains(geom, POINT(0 0))", "ST_Contains(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(0 0)")
+	checkCQL(t, "DISJOINT(geom, POINT(0 0))", "ST_Disjoint(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(0 0)")
+	checkCQL(t, "EQUALS(geom, POINT(0 0))", "ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(0 0)")
+	checkCQL(t, "INTERSECTS(geom, POINT(0 0))", "ST_Intersects(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(0 0)")
+	checkCQL(t, "OVERLAPS(geom, POINT(0 0))", "ST_Overlaps(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(0 0)")
+	checkCQL(t, "TOUCHES(geom, POINT(0 0))", "ST_Touches(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(0 0)")
+	checkCQL(t, "within(geom, POINT(0 0))", "ST_Within(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(0 0)")
+
+	checkCQL(t, "Dwithin(geom, POINT(0 0), 100)", "ST_DWithin(\"geom\",ST_GeomFromText($1::text,4326),100)", "POINT(0 0)")
+}
+
+func TestSpatialPredicateCQL2(t *testing.T) {
+	checkCQL(t, "S_INTERSECTS(geom, POINT(5 50))", "ST_Intersects(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(5 50)")
+	checkCQL(t, "s_within (geom, POINT(5 50))", "ST_Within(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(5 50)")
+	checkCQL(t, `S_WITHIN(geom, {"type": "Polygon", "coordinates": [[[0,0],[0,1],[1,1],[0,0]]]})`,
+		"ST_Within(\"geom\",ST_GeomFromText($1::text,4326))", "POLYGON((0 0,0 1,1 1,0 0))")
+	checkCQL(t, `S_INTERSECTS(geom, {"type":"Point","coordinates":[5,50]}) AND name = 'S_WITHIN(x)'`,
+		"ST_Intersects(\"geom\",ST_GeomFromText($1::text,4326)) AND \"name\" = 'S_WITHIN(x)'", "POINT(5 50)")
+	//-- names with the prefix which are not called are not changed
+	checkCQL(t, "s_code = 1", "\"s_code\" = 1")
+
+	checkCQLError(t, "S_NEAR(geom, POINT(5 50))")
+	checkCQLError(t, `S_WITHIN(geom, {"type":"Point"})`)
+	checkCQLError(t, `S_WITHIN(geom, {"type":"Point","coordinates":[5,"a"]})`)
+	checkCQLError(t, `S_WITHIN(geom, {"type":"Point"`)
 }
 
 func TestArithmetic(t *testing.T) {
@@ -96,28 +112,31 @@ func TestLiteral(t *testing.T) {
 
 func TestGeometryLiteral(t *testing.T) {
 	checkCQL(t, "equals(geom, POINT(0 0))",
-		"ST_Equals(\"geom\",'SRID=4326;POINT(0 0)'::geometry)")
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "POINT(0 0)")
 	checkCQL(t, "equals(geom, LINESTRING(0 0, 1 1))",
-		"ST_Equals(\"geom\",'SRID=4326;LINESTRING(0 0,1 1)'::geometry)")
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "LINESTRING(0 0,1 1)")
 	checkCQL(t, "equals(geom, POLYGON((0 0, 0 9, 9 0, 0 0)))",
-		"ST_Equals(\"geom\",'SRID=4326;POLYGON((0 0,0 9,9 0,0 0))'::geometry)")
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "POLYGON((0 0,0 9,9 0,0 0))")
 	checkCQL(t, "equals(geom, POLYGON((0 0, 0 9, 9 0, 0 0),(1 1, 1 8, 8 1, 1 1)))",
-		"ST_Equals(\"geom\",'SRID=4326;POLYGON((0 0,0 9,9 0,0 0),(1 1,1 8,8 1,1 1))'::geometry)")
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "POLYGON((0 0,0 9,9 0,0 0),(1 1,1 8,8 1,1 1))")
 	checkCQL(t, "equals(geom, MULTIPOINT((0 0), (0 9)))",
-		"ST_Equals(\"geom\",'SRID=4326;MULTIPOINT((0 0),(0 9))'::geometry)")
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "MULTIPOINT((0 0),(0 9))")
 	checkCQL(t, "equals(geom, MULTILINESTRING((0 0, 1 1),(1 1, 2 2)))",
-		"ST_Equals(\"geom\",'SRID=4326;MULTILINESTRING((0 0,1 1),(1 1,2 2))'::geometry)")
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "MULTILINESTRING((0 0,1 1),(1 1,2 2))")
 	checkCQL(t, "equals(geom, MULTIPOLYGON(((1 4, 4 1, 1 1, 1 4)), ((1 9, 4 9, 1 6, 1 9))))",
-		"ST_Equals(\"geom\",'SRID=4326;MULTIPOLYGON(((1 4,4 1,1 1,1 4)),((1 9,4 9,1 6,1 9)))'::geometry)")
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "MULTIPOLYGON(((1 4,4 1,1 1,1 4)),((1 9,4 9,1 6,1 9)))")
 	checkCQL(t, "equals(geom, GEOMETRYCOLLECTION(POLYGON((1 4, 4 1, 1 1, 1 4)),LINESTRING (3 3, 5 5), POINT (1 5)))",
-		"ST_Equals(\"geom\",'SRID=4326;GEOMETRYCOLLECTION(POLYGON((1 4,4 1,1 1,1 4)),LINESTRING(3 3,5 5),POINT(1 5))'::geometry)")
+		"ST_Equals(\"geom\",ST_GeomFromText($1::text,4326))", "GEOMETRYCOLLECTION(POLYGON((1 4,4 1,1 1,1 4)),LINESTRING(3 3,5 5),POINT(1 5))")
 	checkCQL(t, "equals(geom, ENVELOPE(1,2,3,4))",
 		"ST_Equals(\"geom\",ST_MakeEnvelope(1,2,3,4,4326))")
+	checkCQL(t, "intersects(geom, POINT(0 0)) OR within(geom, POINT(1 1))",
+		"ST_Intersects(\"geom\",ST_GeomFromText($1::text,4326)) OR ST_Within(\"geom\",ST_GeomFromText($2::text,4326))",
+		"POINT(0 0)", "POINT(1 1)")
 }
 
 func TestGeometryLiteralWithSRID(t *testing.T) {
 	checkCQLWithSRID(t, "equals(geom, POINT(0 0))", 1111, 2222,
-		"ST_Equals(\"geom\",ST_Transform('SRID=1111;POINT(0 0)'::geometry,2222))")
+		"ST_Equals(\"geom\",ST_Transform(ST_GeomFromText($1::text,1111),2222))", "POINT(0 0)")
 	checkCQLWithSRID(t, "equals(geom, ENVELOPE(1,2,3,4))", 1111, 2222,
 		"ST_Equals(\"geom\",ST_Transform(ST_MakeEnvelope(1,2,3,4,1111),2222))")
 }
@@ -162,28 +181,52 @@ func TestSyntaxErrors(t *testing.T) {
 	checkCQLError(t, "p > 2000-01-01T01")
 }
 
-func checkCQL(t *testing.T, cqlStr string, sql string) {
-	actual, err := TranspileToSQL(cqlStr, 4326, 4326)
-	if err != nil {
-		fmt.Printf("%v\n", err)
-		t.FailNow()
+func TestResolvedNames(t *testing.T) {
+	resolve := func(name string) (string, error) {
+		switch name {
+		case "secret":
+			return "", fmt.Errorf("denied: %v", name)
+		case "Name":
+			return "name_col", nil
+		}
+		return name, nil
 	}
-	actual = strings.TrimSpace(actual)
-	equals(t, sql, actual, "")
+	sql, _, err := TranspileToSQLResolved("Name = 'a' AND id IN (1,2)", 4326, 4326, resolve)
+	equals(t, nil, err, "error")
+	equals(t, "\"name_col\" = 'a' AND \"id\" IN (1,2)", strings.TrimSpace(sql), "resolved sql")
+	sql, _, err = TranspileToSQLResolved("\"Name\" IS NULL", 4326, 4326, resolve)
+	equals(t, nil, err, "error")
+	equals(t, "\"name_col\" IS NULL", strings.TrimSpace(sql), "resolved quoted name")
+	sql, args, err := TranspileToSQLResolved("intersects(geom, POINT(0 0))", 4326, 4326, resolve)
+	equals(t, nil, err, "error")
+	equals(t, "ST_Intersects(\"geom\",ST_GeomFromText($1::text,4326))", strings.TrimSpace(sql), "geometry property")
+	equals(t, []interface{}{"POINT(0 0)"}, args, "geometry args")
+
+	_, _, err = TranspileToSQLResolved("id = 1 OR secret LIKE 'a%'", 4326, 4326, resolve)
+	isError(t, err, "denied property")
 }
 
-func checkCQLWithSRID(t *testing.T, cqlStr string, filterSRID int, sourceSRID int, sql string) {
-	actual, err := TranspileToSQL(cqlStr, filterSRID, sourceSRID)
+// checkCQL checks the SQL of a filter and the WKT of its geometry parameters
+func checkCQL(t *testing.T, cqlStr string, sql string, wkt ...interface{}) {
+	checkCQLWithSRID(t, cqlStr, 4326, 4326, sql, wkt...)
+}
+
+func checkCQLWithSRID(t *testing.T, cqlStr string, filterSRID int, sourceSRID int, sql string, wkt ...interface{}) {
+	actual, args, err := TranspileToSQL(cqlStr, filterSRID, sourceSRID)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		t.FailNow()
 	}
 	actual = strings.TrimSpace(actual)
 	equals(t, sql, actual, "")
+	if len(wkt) == 0 {
+		wkt = nil
+	}
+	equals(t, wkt, args, "args")
 }
 
 func checkCQLError(t *testing.T, cqlStr string) {
-	_, err := TranspileToSQL(cqlStr, 4326, 4326)
+	_, _, err := TranspileToSQL(cqlStr, 4326, 4326)
 	isError(t, err, "")
 }
 
@@ -2,8 +2,12 @@ package data
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 )
 
 /*
@@ -23,7 +27,24 @@ const (
 	//errMsgCollectionNotFound = "Collection not found: %v"
 	//errMsgFeatureNotFound    = "Feature not found: %v"
 	SRID_4326    = 4326
+	SRID_3857    = 3857
 	SRID_UNKNOWN = -1
+
+	errMsgTableNotFound = "Table not found: %v"
+
+	// errMsgInvalidFeatureID reports a feature id without a value for each key column
+	errMsgInvalidFeatureID = "Invalid feature id: %v"
+
+	// errMsgTablePrivilege reports a dry run of a change the user is not allowed to make
+	errMsgTablePrivilege = "Permission denied for table: %v"
+
+	// FeatureIDSeparator separates the key values in the id of a feature
+	// from a table with a composite primary key
+	FeatureIDSeparator = ","
+
+	// PropertyPathSeparator separates the column name and keys
+	// in the path of a property in a JSON column
+	PropertyPathSeparator = "."
 )
 
 // Catalog tbd
@@ -36,17 +57,60 @@ type Catalog interface {
 	// It returns nil if the table does not exist
 	TableByName(name string) (*Table, error)
 
-	// TableReload reloads volatile table data
-	TableReload(name string)
+	// TableReload reloads volatile table data.
+	// The table extent is cached, unless force is set
+	TableReload(name string, force bool)
+
+	// InvalidateTables discards the cached table metadata,
+	// so it is read from the database when next used
+	InvalidateTables()
 
 	// TableFeatures returns an array of the JSON for the features in a table
 	// It returns nil if the table does not exist
 	TableFeatures(ctx context.Context, name string, param *QueryParam) ([]string, error)
 
+	// TableFeaturesEach calls a function with the JSON for each feature in a table,
+	// as the features are read from the database.
+	// Reading stops if the function returns an error
+	TableFeaturesEach(ctx context.Context, name string, param *QueryParam, fn func(feature string) error) error
+
 	// TableFeature returns the JSON text for a table feature with given id
+	// The id of a feature with a composite key is the escaped key values joined by FeatureIDSeparator
 	// It returns an empty string if the table or feature does not exist
 	TableFeature(ctx context.Context, name string, id string, param *QueryParam) (string, error)
 
+	// TableLastModified returns the latest value of a timestamp column
+	// for the table features selected by the query filters.
+	// It returns nil if no features are selected
+	TableLastModified(ctx context.Context, name string, column string, param *QueryParam) (*time.Time, error)
+
+	// TableFeatureCount returns the number of table features selected by the query filters.
+	// The limit and offset are not applied
+	TableFeatureCount(ctx context.Context, name string, param *QueryParam) (int, error)
+
+	// TableFeaturesMatched returns the features of a query (as TableFeatures does)
+	// and the number of features selected by the query filters (as TableFeatureCount does).
+	// Both are read in a single read-only transaction with the configured ReadIsolation,
+	// so that the count is consistent with the features under concurrent writes
+	TableFeaturesMatched(ctx context.Context, name string, param *QueryParam) ([]string, int, error)
+
+	// TableFeaturesEachMatched calls a function for each feature of a query (as TableFeaturesEach does),
+	// and returns the number of features selected by the query filters.
+	// The count is read before the features, in the same transaction
+	TableFeaturesEachMatched(ctx context.Context, name string, param *QueryParam, fn func(feature string) error) (int, error)
+
+	// TableEstimatedCounts returns the estimated numbers of features in tables,
+	// by table name, from the planner statistics (which is fast but approximate).
+	// Tables with no statistics (such as views, SQL collections,
+	// and tables which have not been analyzed) are omitted
+	TableEstimatedCounts(ctx context.Context, names []string) (map[string]int64, error)
+
+	// TableFacets returns the distinct values of a column
+	// for the table features selected by the query filters,
+	// with the number of features having each value, in decreasing order of count.
+	// The number of values is limited by the query limit
+	TableFacets(ctx context.Context, name string, column string, param *QueryParam) ([]*Facet, error)
+
 	Functions() ([]*Function, error)
 
 	// FunctionByName returns the function with given name.
@@ -57,6 +121,27 @@ type Catalog interface {
 
 	FunctionData(ctx context.Context, name string, args map[string]string, param *QueryParam) ([]map[string]interface{}, error)
 
+	// DeleteTableFeature deletes the table feature with given id.
+	// If dryRun is true the feature is not deleted,
+	// but it is checked that it exists and that the user may delete it.
+	// It returns false if the feature does not exist
+	DeleteTableFeature(ctx context.Context, name string, id string, dryRun bool) (bool, error)
+
+	// UpsertTableFeatures inserts or updates table features by id, in a single transaction.
+	// If replace is true, table features which are not in the list are deleted.
+	// If dryRun is true the table is only read, to count the changes
+	// and check that the user may make them.
+	// It returns nil if the table does not exist
+	UpsertTableFeatures(ctx context.Context, name string, features []*FeatureEdit, replace bool, dryRun bool) (*UpsertCounts, error)
+
+	// Ping checks that the database is reachable
+	// and that the connection pool is not exhausted
+	Ping(ctx context.Context) error
+
+	// PoolStats returns the current database connection pool statistics
+	// It returns nil if there is no connection pool
+	PoolStats() *PoolStats
+
 	Close()
 }
 
@@ -64,33 +149,280 @@ type Catalog interface {
 type TransformFunction struct {
 	Name string
 	Arg  []string
+	// IsMetric computes the function in a projected CRS,
+	// so the arguments are in meters for geometry in a geographic CRS
+	IsMetric bool
+	// MetricSrid is the projected CRS of a metric function
+	// (0 for the zone best suited to each geometry)
+	MetricSrid int
 }
 
 type Sorting struct {
 	Name   string
 	IsDesc bool // false = ASC (default), true = DESC
+	// Nulls is the position of NULL values (default is the database order)
+	Nulls string
+	// Point orders by the distance of the geometry from a point, if set
+	Point *Point
+	// IsPath orders by the value of a key in a JSON column, given as a property path
+	IsPath bool
+	// Cast is the SQL type a property path value is cast to for ordering (if any).
+	// Otherwise JSON values are ordered as text
+	Cast string
+}
+
+// sortCastTypes are the SQL types allowed for ordering by JSON values,
+// by the name used in a request
+var sortCastTypes = map[string]string{
+	"int":       "integer",
+	"integer":   "integer",
+	"bigint":    "bigint",
+	"numeric":   "numeric",
+	"float":     "double precision",
+	"date":      "date",
+	"timestamp": "timestamptz",
+	"boolean":   "boolean",
+	"text":      "text",
+}
+
+// SortCastType returns the SQL type for a sort cast name,
+// or false if the cast is not allowed
+func SortCastType(name string) (string, bool) {
+	sqlType, ok := sortCastTypes[name]
+	return sqlType, ok
+}
+
+// Facet is a distinct value of a column, with the number of features having it
+type Facet struct {
+	Value interface{}
+	Count int64
 }
 
+// Point is a location in geographic coordinates (longitude/latitude)
+type Point struct {
+	X, Y float64
+}
+
+// Positions of NULL values in a Sorting
+const (
+	NullsDefault = ""
+	NullsFirst   = "NULLS FIRST"
+	NullsLast    = "NULLS LAST"
+)
+
 type PropertyFilter struct {
 	Name  string
 	Value string
 }
 
+type contextKey string
+
+const (
+	contextKeyTenantFilter contextKey = "tenantFilter"
+	contextKeyRequestID    contextKey = "requestID"
+)
+
+// WithTenantFilter returns a context which restricts table data access
+// to rows matching a tenant filter.
+// The filter is applied to all table queries and edits made with the context
+func WithTenantFilter(ctx context.Context, filter *PropertyFilter) context.Context {
+	return context.WithValue(ctx, contextKeyTenantFilter, filter)
+}
+
+// tenantFilterFrom returns the tenant filter for a context (if any)
+func tenantFilterFrom(ctx context.Context) *PropertyFilter {
+	filter, _ := ctx.Value(contextKeyTenantFilter).(*PropertyFilter)
+	return filter
+}
+
+// WithRequestID returns a context for the queries of a request.
+// The request id is included in the query debug log
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKeyRequestID, id)
+}
+
+// requestIDFrom returns the request id for a context (if any)
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(contextKeyRequestID).(string)
+	return id
+}
+
+// PoolStats holds database connection pool statistics
+type PoolStats struct {
+	MaxConns      int32
+	TotalConns    int32
+	AcquiredConns int32
+	IdleConns     int32
+}
+
+// Spatial relationships for a geometry filter
+const (
+	GeometryFilterOpIntersects = "intersects"
+	GeometryFilterOpWithin     = "within"
+	GeometryFilterOpContains   = "contains"
+)
+
+// GeometryFilter is a filter by the spatial relationship of features to a geometry
+type GeometryFilter struct {
+	Op        string
+	Geom      string // WKT or GeoJSON text
+	IsGeoJSON bool
+	Srid      int
+}
+
+// TimeInterval is a time instant or interval.
+// A nil Start or End is an open interval boundary
+type TimeInterval struct {
+	Start *time.Time
+	End   *time.Time
+}
+
+// IsInstant tests if the interval is a single time instant
+func (ti *TimeInterval) IsInstant() bool {
+	return ti.Start != nil && ti.End != nil && ti.Start.Equal(*ti.End)
+}
+
 // QueryParam holds the optional parameters for a data query
 type QueryParam struct {
-	Crs       int
-	Limit     int
-	Offset    int
-	Bbox      *Extent
-	BboxCrs   int
+	Crs     int
+	Limit   int
+	Offset  int
+	Bbox    *Extent
+	BboxCrs int
+	// BboxBuffer expands the Bbox by a distance in the units of the BboxCrs
+	BboxBuffer float64
+	FilterGeom *GeometryFilter
+	// Datetime filters the values of TimeColumn, if both are set.
+	// If TimeEndColumn is set, the time ranges from TimeColumn to TimeEndColumn
+	// which overlap the Datetime are selected
+	Datetime      *TimeInterval
+	TimeColumn    string
+	TimeEndColumn string
+	// Sample is the percentage of rows to sample (if 0, all rows are queried)
+	Sample float64
+	// GeomType selects only features with this geometry type (e.g. Polygon), if set
+	GeomType  string
 	FilterSql string
-	Filter    []*PropertyFilter
+	// FilterArgs are the values of the FilterSql parameters, which are numbered first
+	FilterArgs []interface{}
+	Filter     []*PropertyFilter
 	// Columns is the list of columns to return
-	Columns       []string
-	GroupBy       []string
-	SortBy        []Sorting
-	Precision     int
+	Columns []string
+	// Distinct returns only the distinct values of the columns, with no geometry
+	Distinct  bool
+	GroupBy   []string
+	SortBy    []Sorting
+	Precision int
+	// PrecisionMode is how coordinates are reduced to the Precision (one of the PrecisionMode values)
+	PrecisionMode string
+	// PropPrecision is the number of decimal places for numeric property values
+	PropPrecision int
 	TransformFuns []TransformFunction
+	// Computed are the computed properties included in Columns
+	Computed []ComputedProperty
+	// FlipAxes outputs geometry coordinates in y/x order
+	FlipAxes bool
+	// GeomFormat is the encoding of feature geometry values.
+	// For GML the feature geometry is a JSON string containing GML
+	GeomFormat string
+	// Cluster returns clusters of the features instead of the features, if set
+	Cluster *Cluster
+	// Aggregate returns one feature aggregating the features, if set
+	Aggregate *Aggregate
+	// SqlArgs are the values of the table SqlParameters, in order
+	SqlArgs []interface{}
+	// MakeValid repairs invalid feature geometry in the output
+	MakeValid bool
+	// DropInvalid omits features whose geometry is empty after it is repaired.
+	// It only applies if MakeValid is set
+	DropInvalid bool
+	// MaxGeomPoints is the number of points above which feature geometry is simplified (0 for no limit)
+	MaxGeomPoints int
+	// OmitComplexGeom outputs geometry with more than MaxGeomPoints as null, rather than simplifying it.
+	// Features then have the GeometryOmittedColumn property
+	OmitComplexGeom bool
+	// EmptyGeometry is how features with empty geometry are output (one of the EmptyGeometry values)
+	EmptyGeometry string
+	// Dimension is the coordinate dimension geometry is output with.
+	// Dimension2D drops any Z and M ordinates; 0 outputs the stored coordinates
+	Dimension int
+	// DefaultOrder are the columns ordering the features if there is no SortBy,
+	// and ordering features with equal SortBy values, so that paging is stable
+	DefaultOrder []string
+	// Truncated is set by the catalog if the features read
+	// were cut off at the ResponseMaxFeatures limit
+	Truncated bool
+}
+
+// Geometry encodings for feature output.
+// Encodings other than GeoJSON are output as JSON strings
+const (
+	GeomFormatGeoJSON = ""
+	GeomFormatGML     = "gml"
+	GeomFormatWKT     = "wkt"
+	GeomFormatWKBHex  = "wkb-hex"
+	GeomFormatEWKB    = "ewkb"
+)
+
+// geometryTypes are the OGC geometry type names, by lower-case name
+var geometryTypes = map[string]string{
+	"point":              "Point",
+	"linestring":         "LineString",
+	"polygon":            "Polygon",
+	"multipoint":         "MultiPoint",
+	"multilinestring":    "MultiLineString",
+	"multipolygon":       "MultiPolygon",
+	"geometrycollection": "GeometryCollection",
+}
+
+// GeometryTypeName returns the OGC geometry type with a name (in any case),
+// or false if it is not a geometry type
+func GeometryTypeName(name string) (string, bool) {
+	geomType, ok := geometryTypes[strings.ToLower(name)]
+	return geomType, ok
+}
+
+// IsGeometryMixed tests if the geometry column of a table allows more than one geometry type.
+// Z and M variants of the generic types are included
+func (tbl *Table) IsGeometryMixed() bool {
+	geomType := strings.ToUpper(tbl.GeometryType)
+	geomType = strings.TrimRight(geomType, "ZM")
+	return geomType == "GEOMETRY" || geomType == "GEOMETRYCOLLECTION"
+}
+
+// ClusterCountColumn is the property of a cluster feature
+// providing the number of features in the cluster
+const ClusterCountColumn = "count"
+
+// GeometryOmittedColumn is the property of a feature indicating
+// that its geometry is omitted because it has too many points
+const GeometryOmittedColumn = "geometry_omitted"
+
+// Aggregate functions of feature geometries
+const (
+	AggregateCollect = "ST_Collect"
+	AggregateUnion   = "ST_Union"
+)
+
+// Aggregate holds the parameters for aggregating the geometry of features.
+// The aggregate is output as one feature, with the number of aggregated
+// features in the ClusterCountColumn property
+type Aggregate struct {
+	// Function is one of the Aggregate functions
+	Function string
+	// MaxFeatures is the maximum number of features aggregated (0 for no limit)
+	MaxFeatures int
+}
+
+// Cluster holds the parameters for DBSCAN clustering of features.
+// A cluster is output as one feature with the centroid of the clustered geometries
+type Cluster struct {
+	// Distance is the maximum distance between clustered features,
+	// in the units of the source coordinate system
+	Distance float64
+	// MinPoints is the minimum number of features which form a cluster.
+	// Features not in a cluster are output as clusters of one feature
+	MinPoints int
 }
 
 // Table holds metadata for table/view objects
@@ -102,20 +434,177 @@ type Table struct {
 	Description    string
 	GeometryType   string
 	GeometryColumn string
-	IDColumn       string
+	IDColumns      []string // primary key columns, in key order
+	IsView         bool
 	Srid           int
 	Extent         Extent
-	Columns        []string
-	DbTypes        map[string]string
-	JSONTypes      []string
-	ColDesc        []string
+	// UniqueColumns are the columns with a unique index of their own
+	UniqueColumns []string
+	// IDNotUnique indicates that the configured id column has no unique index,
+	// so features cannot be written by id
+	IDNotUnique bool
+	// StorageExtent is the extent in the storage coordinate system,
+	// if it is not EPSG:4326 (and the extent is known)
+	StorageExtent *Extent
+	Columns       []string
+	DbTypes       map[string]string
+	JSONTypes     []string
+	ColDesc       []string
+	// Sql is the query providing the features of a SQL collection.
+	// Its parameter placeholders are bound to the QueryParam SqlArgs
+	Sql           string
+	SqlParameters []SqlParameter
+	// Source is the name of the database providing the table.
+	// It is empty for the primary database
+	Source string
+	// PropertyAliases are the names of columns in responses, keyed by column name
+	PropertyAliases map[string]string
 }
 
+// FeatureEdit is a feature to be written to a table
+type FeatureEdit struct {
+	// ID is the feature id, with the key values joined as by FeatureID
+	ID string
+	// Geometry is the GeoJSON geometry, or empty for no geometry
+	Geometry string
+	// Properties are the column values to write.
+	// Columns which are not given are unchanged (or have their default value if inserted)
+	Properties map[string]interface{}
+}
+
+// UpsertCounts are the numbers of features changed by an upsert
+type UpsertCounts struct {
+	Inserted int
+	Updated  int
+	Deleted  int
+}
+
+// IsInvalidDataError tests if an error is a database error
+// caused by invalid data values or an integrity constraint (SQLSTATE classes 22 and 23)
+func IsInvalidDataError(err error) bool {
+	var sqlErr interface{ SQLState() string }
+	if !errors.As(err, &sqlErr) {
+		return false
+	}
+	state := sqlErr.SQLState()
+	return strings.HasPrefix(state, "22") || strings.HasPrefix(state, "23")
+}
+
+// IsIdleTransactionTimeout tests if an error is caused by the database ending a session
+// which was idle in a transaction for longer than the idle_in_transaction_session_timeout
+// (SQLSTATE 25P03)
+func IsIdleTransactionTimeout(err error) bool {
+	var sqlErr interface{ SQLState() string }
+	return errors.As(err, &sqlErr) && sqlErr.SQLState() == "25P03"
+}
+
+// SqlParameter is a parameter of a SQL collection query
+type SqlParameter struct {
+	Name string
+	// Type is one of the SqlParamType values
+	Type string
+	// Default is the value used if none is provided.
+	// If it is empty the parameter is required
+	Default string
+}
+
+// Types of SQL collection parameters
+const (
+	SqlParamTypeText      = "text"
+	SqlParamTypeInt       = "int"
+	SqlParamTypeFloat     = "float"
+	SqlParamTypeBool      = "bool"
+	SqlParamTypeDate      = "date"
+	SqlParamTypeTimestamp = "timestamp"
+)
+
 // Extent of a table
 type Extent struct {
 	Minx, Miny, Maxx, Maxy float64
 }
 
+// IsAntimeridianCrossing tests if a geographic extent crosses the antimeridian.
+// This is indicated by the minimum longitude being greater than the maximum
+func (e *Extent) IsAntimeridianCrossing() bool {
+	return e.Minx > e.Maxx
+}
+
+// Area is the area of an extent, in square CRS units.
+// Geographic extents crossing the antimeridian wrap around it.
+// Other inverted extents have the area of the same extent with the corners swapped
+func (e *Extent) Area(isGeographic bool) float64 {
+	width := e.Maxx - e.Minx
+	if isGeographic && e.IsAntimeridianCrossing() {
+		width += 360
+	}
+	return math.Abs(width) * math.Abs(e.Maxy-e.Miny)
+}
+
+// Expand returns the extent expanded by a distance on all sides.
+// A nil extent is not expanded
+func (e *Extent) Expand(dist float64) *Extent {
+	if e == nil || dist == 0 {
+		return e
+	}
+	return &Extent{Minx: e.Minx - dist, Miny: e.Miny - dist, Maxx: e.Maxx + dist, Maxy: e.Maxy + dist}
+}
+
+// Precision modes are how coordinates are reduced to a precision.
+// PrecisionModeRound uses the rounding of the geometry encoder.
+// The other modes are applied to the encoded coordinates as features are read
+const (
+	PrecisionModeRound    = "round"
+	PrecisionModeHalfEven = "halfeven"
+	PrecisionModeHalfUp   = "halfup"
+	PrecisionModeTruncate = "truncate"
+)
+
+// EmptyGeometryKeep returns features with empty geometry unchanged (the default).
+// EmptyGeometryNull outputs empty geometry as null,
+// and EmptyGeometryExclude omits features with empty geometry
+const (
+	EmptyGeometryKeep    = "keep"
+	EmptyGeometryNull    = "null"
+	EmptyGeometryExclude = "exclude"
+)
+
+// Dimension2D is the coordinate dimension of geometry output with only X and Y ordinates
+const Dimension2D = 2
+
+// IsEmptyGeometryMode tests if a name is a way of handling empty geometry
+func IsEmptyGeometryMode(mode string) bool {
+	switch mode {
+	case EmptyGeometryKeep, EmptyGeometryNull, EmptyGeometryExclude:
+		return true
+	}
+	return false
+}
+
+// IsPrecisionMode tests if a name is a precision mode
+func IsPrecisionMode(mode string) bool {
+	switch mode {
+	case PrecisionModeRound, PrecisionModeHalfEven, PrecisionModeHalfUp, PrecisionModeTruncate:
+		return true
+	}
+	return false
+}
+
+// WebMercatorMax is the maximum coordinate of the Web Mercator (EPSG:3857) world extent
+const WebMercatorMax = 20037508.342789244
+
+// TileExtent returns the Web Mercator extent of the tile at a zoom level, column and row.
+// Rows are numbered from the top of the world extent, as in XYZ tile schemes.
+// The tile indexes are not checked
+func TileExtent(z, x, y int) *Extent {
+	size := 2 * WebMercatorMax / float64(uint64(1)<<uint(z))
+	return &Extent{
+		Minx: -WebMercatorMax + float64(x)*size,
+		Miny: WebMercatorMax - float64(y+1)*size,
+		Maxx: -WebMercatorMax + float64(x+1)*size,
+		Maxy: WebMercatorMax - float64(y)*size,
+	}
+}
+
 // Function tbd
 type Function struct {
 	ID             string
@@ -135,6 +624,137 @@ type Function struct {
 	IDColumn       string
 }
 
+// SplitPropertyPath splits a property path into the column name and the JSON keys.
+// A plain column name has no keys
+func SplitPropertyPath(path string) (string, []string) {
+	parts := strings.Split(path, PropertyPathSeparator)
+	return parts[0], parts[1:]
+}
+
+// PropertyName is the name of a property in the response.
+// For a property path this is the last JSON key
+func PropertyName(path string) string {
+	parts := strings.Split(path, PropertyPathSeparator)
+	return parts[len(parts)-1]
+}
+
+// featureIDEscaper percent-encodes the separator in the key values of a composite feature id
+// (and the escape character, so that encoded values are unambiguous)
+var featureIDEscaper = strings.NewReplacer("%", "%25", FeatureIDSeparator, "%2C")
+
+var featureIDUnescaper = strings.NewReplacer("%25", "%", "%2C", FeatureIDSeparator, "%2c", FeatureIDSeparator)
+
+// FeatureID is the id of a feature with key values.
+// The values of a composite key are escaped and joined by FeatureIDSeparator
+func FeatureID(keyVals []string) string {
+	if len(keyVals) == 1 {
+		return keyVals[0]
+	}
+	escaped := make([]string, len(keyVals))
+	for i, val := range keyVals {
+		escaped[i] = featureIDEscaper.Replace(val)
+	}
+	return strings.Join(escaped, FeatureIDSeparator)
+}
+
+// SplitFeatureID splits a feature id into the values of a key with a number of columns.
+// It returns nil if the id does not have a value for each column
+func SplitFeatureID(id string, numKeys int) []string {
+	if numKeys == 1 {
+		return []string{id}
+	}
+	keyVals := strings.Split(id, FeatureIDSeparator)
+	if len(keyVals) != numKeys {
+		return nil
+	}
+	for i, val := range keyVals {
+		keyVals[i] = featureIDUnescaper.Replace(val)
+	}
+	return keyVals
+}
+
+// SupportsFeatureID indicates whether features of the table can be accessed by id.
+// Tables with no primary key are published read-only,
+// with feature ids synthesized from the row ctid (or row number for views)
+func (tbl *Table) SupportsFeatureID() bool {
+	return len(tbl.IDColumns) > 0
+}
+
+// ParamNames are the names of the request query parameters for the table columns
+// (and their aliases) and the SQL parameters
+func (tbl *Table) ParamNames() []string {
+	names := append([]string{}, tbl.Columns...)
+	for _, alias := range tbl.PropertyAliases {
+		names = append(names, alias)
+	}
+	for _, p := range tbl.SqlParameters {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// OutputName is the name of a property in responses,
+// which is the alias of its column if it has one
+func (tbl *Table) OutputName(path string) string {
+	if alias, ok := tbl.PropertyAliases[path]; ok {
+		return alias
+	}
+	return PropertyName(path)
+}
+
+// OutputNames are the names of a list of properties in responses.
+// A property path whose name is the same as another property is named by its full path,
+// so that the names are unique
+func (tbl *Table) OutputNames(paths []string) []string {
+	names := make([]string, len(paths))
+	count := make(map[string]int)
+	for i, path := range paths {
+		names[i] = tbl.OutputName(path)
+		count[names[i]]++
+	}
+	for i, path := range paths {
+		if count[names[i]] > 1 && names[i] != path {
+			names[i] = path
+		}
+	}
+	return names
+}
+
+// FeatureOutputNames are the names of the properties of the features of a query.
+// The GeometryOmittedColumn property follows the columns, if complex geometry is omitted
+func (tbl *Table) FeatureOutputNames(param *QueryParam) []string {
+	names := tbl.OutputNames(param.Columns)
+	if isGeomOmittable(tbl.GeometryColumn, param) {
+		names = append(names, GeometryOmittedColumn)
+	}
+	return names
+}
+
+// PropertyNames are the names of a list of properties in responses,
+// for a source which has no property aliases
+func PropertyNames(paths []string) []string {
+	return (&Table{}).OutputNames(paths)
+}
+
+// AliasColumns maps the property aliases of the table to their columns
+func (tbl *Table) AliasColumns() map[string]string {
+	cols := make(map[string]string, len(tbl.PropertyAliases))
+	for col, alias := range tbl.PropertyAliases {
+		cols[alias] = col
+	}
+	return cols
+}
+
+// RequiredInNames are the names of the input parameters without defaults.
+// Postgres requires parameters after one with a default to also have a default,
+// so these are the leading input parameters
+func (fun *Function) RequiredInNames() []string {
+	if fun.NumNoDefault <= 0 || fun.NumNoDefault > len(fun.InNames) {
+		return nil
+	}
+	return fun.InNames[:fun.NumNoDefault]
+}
+
 func (fun *Function) IsGeometryFunction() bool {
 	for _, typ := range fun.OutDbTypes {
 		if typ == "geometry" {
@@ -144,6 +764,18 @@ func (fun *Function) IsGeometryFunction() bool {
 	return false
 }
 
+// ComputedProperty is a property computed by a function of a column
+type ComputedProperty struct {
+	Name     string
+	Column   string
+	Function TransformFunction
+}
+
+// sqlExpr is the select list expression of a computed property
+func (comp *ComputedProperty) sqlExpr() string {
+	return fmt.Sprintf("%v AS %v", comp.Function.apply(strconv.Quote(comp.Column)), strconv.Quote(comp.Name))
+}
+
 func (fun *TransformFunction) apply(expr string) string {
 	if fun.Name == "" {
 		return expr
@@ -155,6 +787,27 @@ func (fun *TransformFunction) apply(expr string) string {
 	return fmt.Sprintf("%v( %v, %v )", fun.Name, expr, args)
 }
 
+// sqlFmtMetricTransform computes a function in a projected CRS,
+// and transforms the result back to the source CRS
+const sqlFmtMetricTransform = "ST_Transform( %v, %v )"
+
+// applyMetric applies a function to a geometry expression in a geographic CRS.
+// The geometry is transformed to the configured projected CRS,
+// or to the UTM or polar zone best suited to it
+func (fun *TransformFunction) applyMetric(expr string, sourceSRID int) string {
+	srid := strconv.Itoa(fun.MetricSrid)
+	if fun.MetricSrid <= 0 {
+		srid = fmt.Sprintf("_ST_BestSRID( (%v)::geography )", expr)
+	}
+	projected := fmt.Sprintf(sqlFmtMetricTransform, fmt.Sprintf("(%v)::geometry", expr), srid)
+	return fmt.Sprintf(sqlFmtMetricTransform, fun.apply(projected), sourceSRID)
+}
+
+// IsGeographicSrid tests if a SRID is an EPSG geographic CRS
+func IsGeographicSrid(srid int) bool {
+	return srid >= 4000 && srid < 5000
+}
+
 // Creates a fully qualified function id.
 // adds default postgisftw schema if name arg has no schema
 func FunctionQualifiedId(name string) string {
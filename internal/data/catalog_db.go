@@ -17,11 +17,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/CrunchyData/pg_featureserv/internal/conf"
+	"github.com/CrunchyData/pg_featureserv/internal/tracing"
 	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/log/logrusadapter"
@@ -39,27 +45,47 @@ const (
 	JSONTypeStringArray  = "string[]"
 	JSONTypeNumberArray  = "number[]"
 
-	PGTypeBool      = "bool"
-	PGTypeNumeric   = "numeric"
-	PGTypeJSON      = "json"
-	PGTypeGeometry  = "geometry"
-	PGTypeTextArray = "_text"
+	PGTypeBool         = "bool"
+	PGTypeNumeric      = "numeric"
+	PGTypeJSON         = "json"
+	PGTypeJSONB        = "jsonb"
+	PGTypeGeometry     = "geometry"
+	PGTypeTextArray    = "_text"
+	PGTypeNumericArray = "_numeric"
 )
 
 type catalogDB struct {
-	dbconn        *pgxpool.Pool
-	tableIncludes map[string]string
-	tableExcludes map[string]string
+	dbconn *pgxpool.Pool
+	// sources are the connection pools of the additional databases, by name
+	sources       map[string]*pgxpool.Pool
+	tableIncludes []namePattern
+	tableExcludes []namePattern
 	tables        []*Table
 	tableMap      map[string]*Table
 	functions     []*Function
 	functionMap   map[string]*Function
+	// tablesLoadTime is when the table metadata was read, for the TableCacheTTL
+	tablesLoadTime time.Time
+	// extents caches table extents, since computing them may be slow
+	extents map[string]extentCacheEntry
+}
+
+type extentCacheEntry struct {
+	extent        Extent
+	storageExtent *Extent
+	loadTime      time.Time
 }
 
 var isStartup bool
 var isFunctionsLoaded bool
 var instanceDB catalogDB
 
+// extentsLock guards the table extent cache
+var extentsLock sync.Mutex
+
+// tablesLock guards the table metadata, which is reloaded when the cache expires
+var tablesLock sync.RWMutex
+
 const fmtQueryStats = "Database query result: %v rows in %v"
 
 func init() {
@@ -74,15 +100,47 @@ func CatDBInstance() Catalog {
 }
 
 func newCatalogDB() catalogDB {
-	conn := dbConnect()
+	conn := dbConnect(conf.Configuration().Database.DbConnection)
 	cat := catalogDB{
-		dbconn: conn,
+		dbconn:  conn,
+		sources: connectSources(conf.Configuration().Databases),
 	}
 	return cat
 }
 
-func dbConnect() *pgxpool.Pool {
-	dbconfig := dbConfig()
+// connectSources connects to the additional databases.
+// Their names prefix the collection ids, so they must be unique and not contain a dot
+func connectSources(sources []conf.DatabaseSource) map[string]*pgxpool.Pool {
+	pools := make(map[string]*pgxpool.Pool)
+	for _, src := range sources {
+		if err := checkSourceName(src.Name, pools); err != nil {
+			log.Fatal(err)
+		}
+		pools[src.Name] = dbConnect(src.DbConnection)
+	}
+	return pools
+}
+
+func checkSourceName(name string, pools map[string]*pgxpool.Pool) error {
+	if name == "" || strings.Contains(name, ".") {
+		return fmt.Errorf("Invalid database Name: '%v' (must be non-empty and not contain '.')", name)
+	}
+	if _, ok := pools[name]; ok {
+		return fmt.Errorf("Duplicate database Name: %v", name)
+	}
+	return nil
+}
+
+// db is the connection pool of the database providing a table
+func (cat *catalogDB) db(tbl *Table) *pgxpool.Pool {
+	if tbl.Source == "" {
+		return cat.dbconn
+	}
+	return cat.sources[tbl.Source]
+}
+
+func dbConnect(dbconf string) *pgxpool.Pool {
+	dbconfig := dbConfig(dbconf)
 
 	db, err := pgxpool.ConnectConfig(context.Background(), dbconfig)
 	if err != nil {
@@ -95,29 +153,45 @@ func dbConnect() *pgxpool.Pool {
 	return db
 }
 
-func dbConfig() *pgxpool.Config {
-	dbconf := conf.Configuration.Database.DbConnection
+func dbConfig(dbconf string) *pgxpool.Config {
 	// disallow blank config for safety
 	if dbconf == "" {
 		log.Fatal("Blank DbConnection is disallowed for security reasons")
 	}
 
-	dbconfig, err := pgxpool.ParseConfig(conf.Configuration.Database.DbConnection)
+	dbconfig, err := pgxpool.ParseConfig(dbconf)
 	if err != nil {
 		log.Fatal(err)
 	}
 	// Read and parse connection lifetime
-	dbPoolMaxLifeTime, errt := time.ParseDuration(conf.Configuration.Database.DbPoolMaxConnLifeTime)
+	dbPoolMaxLifeTime, errt := time.ParseDuration(conf.Configuration().Database.DbPoolMaxConnLifeTime)
 	if errt != nil {
 		log.Fatal(errt)
 	}
 	dbconfig.MaxConnLifetime = dbPoolMaxLifeTime
 
 	// Read and parse max connections
-	dbPoolMaxConns := conf.Configuration.Database.DbPoolMaxConns
+	dbPoolMaxConns := conf.Configuration().Database.DbPoolMaxConns
 	if dbPoolMaxConns > 0 {
 		dbconfig.MaxConns = int32(dbPoolMaxConns)
 	}
+	// Read and parse min connections
+	dbPoolMinConns := conf.Configuration().Database.DbPoolMinConns
+	if dbPoolMinConns > 0 {
+		dbconfig.MinConns = int32(dbPoolMinConns)
+	}
+	// Read and parse connection idle time
+	dbPoolMaxIdleTime, errt := time.ParseDuration(conf.Configuration().Database.DbPoolMaxConnIdleTime)
+	if errt != nil {
+		log.Fatal(errt)
+	}
+	dbconfig.MaxConnIdleTime = dbPoolMaxIdleTime
+	// Read and parse health check period
+	dbPoolHealthCheckPeriod, errt := time.ParseDuration(conf.Configuration().Database.DbPoolHealthCheckPeriod)
+	if errt != nil {
+		log.Fatal(errt)
+	}
+	dbconfig.HealthCheckPeriod = dbPoolHealthCheckPeriod
 
 	// Read current log level and use one less-fine level
 	dbconfig.ConnConfig.Logger = logrusadapter.NewLogger(log.New())
@@ -129,122 +203,1077 @@ func dbConfig() *pgxpool.Config {
 }
 
 func (cat *catalogDB) SetIncludeExclude(includeList []string, excludeList []string) {
+	//-- the tables are loaded with the lock held, so this does not change them while loading
+	tablesLock.Lock()
+	defer tablesLock.Unlock()
 	//-- include schemas / tables
-	cat.tableIncludes = make(map[string]string)
-	for _, name := range includeList {
-		nameLow := strings.ToLower(name)
-		cat.tableIncludes[nameLow] = nameLow
+	cat.tableIncludes = namePatterns(includeList)
+	//-- excluded schemas / tables
+	cat.tableExcludes = namePatterns(excludeList)
+}
+
+// namePattern is a case-insensitive pattern for a schema or schema.table name
+type namePattern struct {
+	isQualified bool
+	regex       *regexp.Regexp
+}
+
+// namePatterns converts a list of schema or schema.table names to patterns.
+// A name may contain * wildcards, which match any sequence of characters
+func namePatterns(names []string) []namePattern {
+	var patterns []namePattern
+	for _, name := range names {
+		expr := strings.Replace(regexp.QuoteMeta(name), `\*`, ".*", -1)
+		patterns = append(patterns, namePattern{
+			isQualified: strings.Contains(name, "."),
+			regex:       regexp.MustCompile("(?i)^" + expr + "$"),
+		})
+	}
+	return patterns
+}
+
+func (cat *catalogDB) Close() {
+	cat.dbconn.Close()
+	for _, pool := range cat.sources {
+		pool.Close()
+	}
+}
+
+// PoolStats provides the statistics of all the database connection pools
+func (cat *catalogDB) PoolStats() *PoolStats {
+	stats := &PoolStats{}
+	addStats := func(pool *pgxpool.Pool) {
+		stat := pool.Stat()
+		stats.MaxConns += stat.MaxConns()
+		stats.TotalConns += stat.TotalConns()
+		stats.AcquiredConns += stat.AcquiredConns()
+		stats.IdleConns += stat.IdleConns()
+	}
+	addStats(cat.dbconn)
+	for _, pool := range cat.sources {
+		addStats(pool)
+	}
+	return stats
+}
+
+// Ping checks each database.
+// The errors for additional databases include the database name
+func (cat *catalogDB) Ping(ctx context.Context) error {
+	if err := pingDB(ctx, cat.dbconn); err != nil {
+		return err
+	}
+	for name, pool := range cat.sources {
+		if err := pingDB(ctx, pool); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func pingDB(ctx context.Context, db *pgxpool.Pool) error {
+	stat := db.Stat()
+	if stat.AcquiredConns() >= stat.MaxConns() {
+		return fmt.Errorf("connection pool exhausted (%v connections in use)", stat.AcquiredConns())
+	}
+	var one int
+	err := db.QueryRow(ctx, "SELECT 1").Scan(&one)
+	if err != nil {
+		return fmt.Errorf("database unreachable: %v", err)
+	}
+	return nil
+}
+
+func (cat *catalogDB) Tables() ([]*Table, error) {
+	cat.refreshTables(false)
+	tablesLock.RLock()
+	defer tablesLock.RUnlock()
+	return cat.tables, nil
+}
+
+func (cat *catalogDB) InvalidateTables() {
+	tablesLock.Lock()
+	defer tablesLock.Unlock()
+	cat.tablesLoadTime = time.Time{}
+	isStartup = true
+	log.Infoln("Collection metadata cache invalidated")
+}
+
+func (cat *catalogDB) TableReload(name string, force bool) {
+	tablesLock.RLock()
+	tbl, ok := cat.tableMap[name]
+	tablesLock.RUnlock()
+	if !ok {
+		return
+	}
+	// the extent of a SQL collection depends on its parameters
+	if tbl.Sql != "" {
+		return
+	}
+	extentsLock.Lock()
+	entry, isCached := cat.extents[name]
+	if !force && isCached && isExtentCacheValid(entry.loadTime, extentCacheTTL(), time.Now()) {
+		tbl.Extent = entry.extent
+		tbl.StorageExtent = entry.storageExtent
+		extentsLock.Unlock()
+		return
+	}
+	extentsLock.Unlock()
+
+	// load extent (which may change over time).
+	// The lock is not held while querying, so readers of other extents are not blocked
+	sqlExtentEst := sqlExtentEstimated(tbl)
+	extent, storageExtent, isExtentLoaded := cat.loadExtent(sqlExtentEst, tbl)
+	if !isExtentLoaded {
+		log.Debugf("Can't get estimated extent for %s", name)
+		sqlExtentExact := sqlExtentExact(tbl)
+		extent, storageExtent, isExtentLoaded = cat.loadExtent(sqlExtentExact, tbl)
+	}
+	if !isExtentLoaded {
+		return
+	}
+	extentsLock.Lock()
+	defer extentsLock.Unlock()
+	tbl.Extent = extent
+	tbl.StorageExtent = storageExtent
+	if cat.extents == nil {
+		cat.extents = make(map[string]extentCacheEntry)
+	}
+	cat.extents[name] = extentCacheEntry{extent: extent, storageExtent: storageExtent, loadTime: time.Now()}
+}
+
+// extentCacheTTL is the time that table extents are cached for
+func extentCacheTTL() time.Duration {
+	ttl, err := time.ParseDuration(conf.Configuration().Database.ExtentCacheTTL)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+// isExtentCacheValid tests if an extent loaded at a given time can still be used
+func isExtentCacheValid(loadTime time.Time, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(loadTime) < ttl
+}
+
+// tableCacheTTL is the time that table metadata is cached for.
+// A zero duration caches it until it is invalidated
+func tableCacheTTL() time.Duration {
+	ttl, err := time.ParseDuration(conf.Configuration().Database.TableCacheTTL)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+// isTableCacheValid tests if table metadata loaded at a given time can still be used
+func isTableCacheValid(loadTime time.Time, ttl time.Duration, now time.Time) bool {
+	return ttl <= 0 || now.Sub(loadTime) < ttl
+}
+
+// loadExtent queries the extent of a table in EPSG:4326,
+// and in the storage coordinate system if it is not EPSG:4326.
+// It returns false if no extent was read
+func (cat *catalogDB) loadExtent(sql string, tbl *Table) (Extent, *Extent, bool) {
+	var (
+		xmin pgtype.Float8
+		xmax pgtype.Float8
+		ymin pgtype.Float8
+		ymax pgtype.Float8
+		// the extent in the storage coordinate system
+		nxmin pgtype.Float8
+		nxmax pgtype.Float8
+		nymin pgtype.Float8
+		nymax pgtype.Float8
+	)
+	log.Debug("Extent query: " + sql)
+	err := cat.db(tbl).QueryRow(context.Background(), sql).Scan(&xmin, &ymin, &xmax, &ymax, &nxmin, &nymin, &nxmax, &nymax)
+	if err != nil {
+		log.Debugf("Error querying Extent for %s: %v", tbl.ID, err)
+	}
+	// no extent was read (perhaps a view...)
+	if xmin.Status == pgtype.Null {
+		return Extent{}, nil, false
+	}
+	extent := Extent{Minx: xmin.Float, Miny: ymin.Float, Maxx: xmax.Float, Maxy: ymax.Float}
+	var storageExtent *Extent
+	if tbl.Srid != SRID_4326 && nxmin.Status != pgtype.Null {
+		storageExtent = &Extent{Minx: nxmin.Float, Miny: nymin.Float, Maxx: nxmax.Float, Maxy: nymax.Float}
+	}
+	return extent, storageExtent, true
+}
+
+func (cat *catalogDB) TableByName(name string) (*Table, error) {
+	cat.refreshTables(false)
+	tablesLock.RLock()
+	defer tablesLock.RUnlock()
+	tbl, ok := cat.tableMap[name]
+	if !ok {
+		return nil, nil
+	}
+	return tbl, nil
+}
+
+func (cat *catalogDB) TableFeatures(ctx context.Context, name string, param *QueryParam) ([]string, error) {
+	tbl, err := cat.TableByName(name)
+	if err != nil || tbl == nil {
+		return nil, err
+	}
+	cat.logRepairedCount(ctx, tbl, param)
+	return tableFeatures(ctx, cat.db(tbl), tbl, param)
+}
+
+// tableFeatures reads the features of a query, on a connection pool or in a transaction
+func tableFeatures(ctx context.Context, db dbQuerier, tbl *Table, param *QueryParam) ([]string, error) {
+	cols := tbl.FeatureOutputNames(param)
+	sql, argValues := sqlFeatures(tbl, responseQueryParam(param), tenantFilterFrom(ctx))
+	logQuery(ctx, "Features query", tbl.ID, sql, argValues)
+	idColIndexes := featuresIDColIndexes(tbl, param)
+
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, tbl.ID)
+	features, err := readFeaturesWithArgs(ctx, db, sql, argValues, idColIndexes, cols, newCoordRounding(param))
+	endQuerySpan(span, len(features), err)
+	return truncateFeatures(features, tbl.ID, param), err
+}
+
+func (cat *catalogDB) TableFeaturesMatched(ctx context.Context, name string, param *QueryParam) ([]string, int, error) {
+	tbl, err := cat.TableByName(name)
+	if err != nil || tbl == nil {
+		return nil, 0, err
+	}
+	cat.logRepairedCount(ctx, tbl, param)
+	isoLevel := readIsoLevel()
+	if isoLevel == pgx.ReadCommitted {
+		//-- each statement sees its own snapshot, so a transaction would not make them consistent
+		count, err := tableFeatureCount(ctx, cat.db(tbl), tbl, param)
+		if err != nil {
+			return nil, 0, err
+		}
+		runAfterFeatureCount(ctx)
+		features, err := tableFeatures(ctx, cat.db(tbl), tbl, param)
+		return features, count, err
+	}
+	tx, err := cat.db(tbl).BeginTx(ctx, pgx.TxOptions{IsoLevel: isoLevel, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, 0, err
+	}
+	//-- the transaction only reads, so it is always rolled back
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	count, err := tableFeatureCount(ctx, tx, tbl, param)
+	if err != nil {
+		return nil, 0, err
+	}
+	runAfterFeatureCount(ctx)
+	features, err := tableFeatures(ctx, tx, tbl, param)
+	return features, count, err
+}
+
+// afterFeatureCount is called after the number of features matched is read,
+// before the features are queried.
+// Tests use it to change the data between the queries
+var afterFeatureCount func(ctx context.Context)
+
+func runAfterFeatureCount(ctx context.Context) {
+	if afterFeatureCount != nil {
+		afterFeatureCount(ctx)
+	}
+}
+
+// readIsoLevel is the isolation level of the transaction reading features with their count.
+// Unknown levels use the default of repeatable read
+func readIsoLevel() pgx.TxIsoLevel {
+	switch strings.ToLower(strings.TrimSpace(conf.Configuration().Database.ReadIsolation)) {
+	case "read committed":
+		return pgx.ReadCommitted
+	case "serializable":
+		//-- a read-only serializable transaction can not fail due to concurrent writes
+		return pgx.Serializable
+	}
+	return pgx.RepeatableRead
+}
+
+// responseQueryParam returns the query parameters to read the features of a buffered response.
+// If the limit allows more than ResponseMaxFeatures features
+// the query reads one more feature than that, to detect when the response is truncated
+func responseQueryParam(param *QueryParam) *QueryParam {
+	max := conf.Configuration().Paging.ResponseMaxFeatures
+	if max <= 0 || (param.Limit >= 0 && param.Limit <= max) {
+		return param
+	}
+	capped := *param
+	capped.Limit = max + 1
+	return &capped
+}
+
+// truncateFeatures cuts off features read past the ResponseMaxFeatures limit,
+// and flags the query parameters as truncated
+func truncateFeatures(features []string, name string, param *QueryParam) []string {
+	max := conf.Configuration().Paging.ResponseMaxFeatures
+	if max <= 0 || len(features) <= max {
+		return features
+	}
+	log.Warnf("Response for %v truncated at ResponseMaxFeatures = %v", name, max)
+	param.Truncated = true
+	return features[:max]
+}
+
+// logRepairedCount logs the number of features selected by a query
+// whose geometry is repaired by MakeValid.
+// This requires another query, so it is only done when debug logging is enabled
+func (cat *catalogDB) logRepairedCount(ctx context.Context, tbl *Table, param *QueryParam) {
+	if !param.MakeValid || tbl.GeometryColumn == "" || !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	sql, argValues := sqlInvalidCount(tbl, param, tenantFilterFrom(ctx))
+	logQuery(ctx, "Invalid geometry count query", tbl.ID, sql, argValues)
+	var count int
+	if err := cat.db(tbl).QueryRow(ctx, sql, argValues...).Scan(&count); err != nil {
+		log.Debugf("Error running Invalid geometry count query: %v", err)
+		return
+	}
+	log.Debugf("Repaired invalid geometry of %v features selected by the query filters", count)
+}
+
+func (cat *catalogDB) TableFeaturesEach(ctx context.Context, name string, param *QueryParam, fn func(feature string) error) error {
+	_, err := cat.tableFeaturesEach(ctx, name, param, false, fn)
+	return err
+}
+
+func (cat *catalogDB) TableFeaturesEachMatched(ctx context.Context, name string, param *QueryParam, fn func(feature string) error) (int, error) {
+	return cat.tableFeaturesEach(ctx, name, param, true, fn)
+}
+
+// tableFeaturesEach calls a function for each feature of a query,
+// after reading the number of features matched (if isMatched is set).
+// The features are read in a read-only transaction if they are fetched from a cursor,
+// or if they are read with the count at an isolation level which provides one snapshot
+func (cat *catalogDB) tableFeaturesEach(ctx context.Context, name string, param *QueryParam, isMatched bool, fn func(feature string) error) (int, error) {
+	tbl, err := cat.TableByName(name)
+	if err != nil {
+		return 0, err
+	}
+	if tbl == nil {
+		return 0, fmt.Errorf(errMsgTableNotFound, name)
+	}
+	cols := tbl.FeatureOutputNames(param)
+	sql, argValues := sqlFeatures(tbl, param, tenantFilterFrom(ctx))
+	logQuery(ctx, "Features query", name, sql, argValues)
+	idColIndexes := featuresIDColIndexes(tbl, param)
+	cat.logRepairedCount(ctx, tbl, param)
+
+	timeout := idleTransactionTimeout()
+	isoLevel := readIsoLevel()
+	var db dbQuerier = cat.db(tbl)
+	var tx pgx.Tx
+	if timeout > 0 || (isMatched && isoLevel != pgx.ReadCommitted) {
+		txOptions := pgx.TxOptions{AccessMode: pgx.ReadOnly}
+		if isMatched {
+			txOptions.IsoLevel = isoLevel
+		}
+		tx, err = cat.db(tbl).BeginTx(ctx, txOptions)
+		if err != nil {
+			return 0, err
+		}
+		//-- the transaction only reads, so it is always rolled back
+		defer tx.Rollback(ctx) //nolint:errcheck
+		db = tx
+	}
+	matched := 0
+	if isMatched {
+		matched, err = tableFeatureCount(ctx, db, tbl, param)
+		if err != nil {
+			return 0, err
+		}
+		runAfterFeatureCount(ctx)
+	}
+
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, name)
+	count := 0
+	defer func() { endQuerySpan(span, count, err) }()
+
+	start := time.Now()
+	round := newCoordRounding(param)
+	scanFn := func(rows pgx.Rows) error {
+		if err := fn(scanFeature(rows, idColIndexes, cols, round)); err != nil {
+			return err
+		}
+		count++
+		return nil
+	}
+	if timeout > 0 {
+		err = queryEachCursor(ctx, tx, sql, argValues, timeout, scanFn)
+	} else {
+		err = queryEach(ctx, db, sql, argValues, scanFn)
+	}
+	if err != nil {
+		return matched, err
+	}
+	log.Debugf(fmtQueryStats, count, time.Since(start))
+	return matched, nil
+}
+
+// queryEach runs a query and calls a function for each row
+func queryEach(ctx context.Context, db dbQuerier, sql string, args []interface{}, fn func(rows pgx.Rows) error) error {
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		log.Warnf("Error running Features query: %v", err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		log.Warnf("Error scanning rows for Features: %v", err)
+		return err
+	}
+	return nil
+}
+
+// cursorFetchSize is the number of rows read by each fetch from a cursor
+const cursorFetchSize = 1000
+
+const sqlFmtSetIdleTimeout = `SET LOCAL idle_in_transaction_session_timeout = %d`
+
+const sqlFmtDeclareCursor = `DECLARE _features NO SCROLL CURSOR FOR %v`
+
+const sqlFmtFetchCursor = `FETCH FORWARD %d FROM _features`
+
+// queryEachCursor runs a query in a transaction,
+// fetching the rows from a cursor in batches and calling a function for each row.
+// The session is idle in the transaction while the rows are processed
+// (for instance, written to a slow client),
+// so the idle_in_transaction_session_timeout ends a transaction
+// which would otherwise hold a connection (and old row versions) indefinitely
+func queryEachCursor(ctx context.Context, tx pgx.Tx, sql string, args []interface{}, timeout time.Duration, fn func(rows pgx.Rows) error) error {
+	if _, err := tx.Exec(ctx, fmt.Sprintf(sqlFmtSetIdleTimeout, timeout.Milliseconds())); err != nil {
+		return err
+	}
+	sqlCursor := fmt.Sprintf(sqlFmtDeclareCursor, strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	if _, err := tx.Exec(ctx, sqlCursor, args...); err != nil {
+		log.Warnf("Error running Features query: %v", err)
+		return err
+	}
+	sqlFetch := fmt.Sprintf(sqlFmtFetchCursor, cursorFetchSize)
+	for {
+		rows, err := tx.Query(ctx, sqlFetch)
+		if err != nil {
+			return err
+		}
+		numRows := 0
+		for rows.Next() {
+			numRows++
+			if err := fn(rows); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := rows.Err(); err != nil {
+			if !IsIdleTransactionTimeout(err) {
+				log.Warnf("Error scanning rows for Features: %v", err)
+			}
+			return err
+		}
+		if numRows < cursorFetchSize {
+			return nil
+		}
+	}
+}
+
+// idleTransactionTimeout is the idle_in_transaction_session_timeout of streamed queries.
+// Zero streams queries without a transaction
+func idleTransactionTimeout() time.Duration {
+	timeout, err := time.ParseDuration(conf.Configuration().Database.IdleInTransactionTimeout)
+	if err != nil {
+		return 0
+	}
+	return timeout
+}
+
+func (cat *catalogDB) TableLastModified(ctx context.Context, name string, column string, param *QueryParam) (*time.Time, error) {
+	tbl, err := cat.TableByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if tbl == nil {
+		return nil, fmt.Errorf(errMsgTableNotFound, name)
+	}
+	sql, argValues := sqlLastModified(tbl, column, param, tenantFilterFrom(ctx))
+	logQuery(ctx, "Last modified query", name, sql, argValues)
+
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, name)
+	var lastModified *time.Time
+	err = cat.db(tbl).QueryRow(ctx, sql, argValues...).Scan(&lastModified)
+	endQuerySpan(span, 1, err)
+	if err != nil {
+		log.Warnf("Error running Last modified query: %v", err)
+		return nil, err
+	}
+	return lastModified, nil
+}
+
+func (cat *catalogDB) TableFeatureCount(ctx context.Context, name string, param *QueryParam) (int, error) {
+	tbl, err := cat.TableByName(name)
+	if err != nil {
+		return 0, err
+	}
+	if tbl == nil {
+		return 0, fmt.Errorf(errMsgTableNotFound, name)
+	}
+	return tableFeatureCount(ctx, cat.db(tbl), tbl, param)
+}
+
+// tableFeatureCount reads the number of features selected by the query filters,
+// on a connection pool or in a transaction
+func tableFeatureCount(ctx context.Context, db dbQuerier, tbl *Table, param *QueryParam) (int, error) {
+	sql, argValues := sqlFeatureCount(tbl, param, tenantFilterFrom(ctx))
+	logQuery(ctx, "Feature count query", tbl.ID, sql, argValues)
+
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, tbl.ID)
+	var count int
+	err := db.QueryRow(ctx, sql, argValues...).Scan(&count)
+	endQuerySpan(span, 1, err)
+	if err != nil {
+		log.Warnf("Error running Feature count query: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
+
+func (cat *catalogDB) TableEstimatedCounts(ctx context.Context, names []string) (map[string]int64, error) {
+	//-- the tables of each database are estimated in a single query
+	sourceTables := make(map[string][]*Table)
+	for _, name := range names {
+		tbl, err := cat.TableByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if tbl == nil || tbl.IsView || tbl.Sql != "" {
+			continue
+		}
+		sourceTables[tbl.Source] = append(sourceTables[tbl.Source], tbl)
+	}
+	counts := make(map[string]int64)
+	for _, tables := range sourceTables {
+		schemas := make([]string, len(tables))
+		relNames := make([]string, len(tables))
+		for i, tbl := range tables {
+			schemas[i] = tbl.Schema
+			relNames[i] = tbl.Table
+		}
+		log.Debugf("Estimated count query: %v", sqlTableEstimatedCounts)
+		rows, err := cat.db(tables[0]).Query(ctx, sqlTableEstimatedCounts, schemas, relNames)
+		if err != nil {
+			log.Warnf("Error running Estimated count query: %v", err)
+			return nil, err
+		}
+		estimates := make(map[string]int64)
+		for rows.Next() {
+			var schema, relName string
+			var count int64
+			if err := rows.Scan(&schema, &relName, &count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			estimates[schema+"."+relName] = count
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		for _, tbl := range tables {
+			if count, ok := estimates[tbl.Schema+"."+tbl.Table]; ok {
+				counts[tbl.ID] = count
+			}
+		}
+	}
+	return counts, nil
+}
+
+func (cat *catalogDB) TableFacets(ctx context.Context, name string, column string, param *QueryParam) ([]*Facet, error) {
+	tbl, err := cat.TableByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if tbl == nil {
+		return nil, fmt.Errorf(errMsgTableNotFound, name)
+	}
+	sql, argValues := sqlFacets(tbl, column, param, tenantFilterFrom(ctx))
+	logQuery(ctx, "Facets query", name, sql, argValues)
+
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, name)
+	facets, err := readFacets(ctx, cat.db(tbl), sql, argValues)
+	endQuerySpan(span, len(facets), err)
+	if err != nil {
+		log.Warnf("Error running Facets query: %v", err)
+		return nil, err
+	}
+	return facets, nil
+}
+
+func readFacets(ctx context.Context, db *pgxpool.Pool, sql string, args []interface{}) ([]*Facet, error) {
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	facets := []*Facet{}
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		count, _ := vals[1].(int64)
+		facets = append(facets, &Facet{Value: toJSONValue(vals[0]), Count: count})
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return facets, rows.Err()
+}
+
+// featuresIDColIndexes returns the indexes of the feature id columns in a features query
+func featuresIDColIndexes(tbl *Table, param *QueryParam) []int {
+	if param.Cluster != nil || param.Aggregate != nil {
+		return nil
+	}
+	if isRowIDSynthesized(tbl, param) {
+		//--- synthesized row id column follows the property columns
+		return []int{len(tbl.FeatureOutputNames(param))}
+	}
+	return indexesOfNames(param.Columns, tbl.IDColumns)
+}
+
+func (cat *catalogDB) TableFeature(ctx context.Context, name string, id string, param *QueryParam) (string, error) {
+	tbl, err := cat.TableByName(name)
+	if err != nil || tbl == nil {
+		return "", err
+	}
+	//--- Add SQL args for the feature ID key values
+	argValues, isValidID := featureIDArgs(tbl, id)
+	if !isValidID {
+		return "", nil
+	}
+	tenant := tenantFilterFrom(ctx)
+	argValues = appendFilterArg(argValues, tenant)
+	argValues = append(argValues, param.SqlArgs...)
+	cols := tbl.FeatureOutputNames(param)
+	sql := sqlFeature(tbl, param, tenant)
+	logQuery(ctx, "Feature query", name, sql, argValues)
+	idColIndexes := indexesOfNames(param.Columns, tbl.IDColumns)
+
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, name)
+	features, err := readFeaturesWithArgs(ctx, cat.db(tbl), sql, argValues, idColIndexes, cols, newCoordRounding(param))
+	endQuerySpan(span, len(features), err)
+
+	if len(features) == 0 {
+		return "", err
+	}
+	return features[0], nil
+}
+
+func (cat *catalogDB) DeleteTableFeature(ctx context.Context, name string, id string, dryRun bool) (bool, error) {
+	tbl, err := cat.TableByName(name)
+	if err != nil || tbl == nil {
+		return false, err
+	}
+	argValues, isValidID := featureIDArgs(tbl, id)
+	if !isValidID {
+		return false, nil
+	}
+	tenant := tenantFilterFrom(ctx)
+	argValues = appendFilterArg(argValues, tenant)
+	if dryRun {
+		return cat.isTableFeatureDeletable(ctx, tbl, argValues, tenant)
+	}
+	sql := sqlDeleteFeature(tbl, tenant)
+	logQuery(ctx, "Delete feature query", name, sql, argValues)
+
+	tx, err := cat.db(tbl).Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	//-- rollback is a no-op if the transaction has been committed
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	ctx, span := startQuerySpan(ctx, sqlOpDelete, name)
+	tag, err := tx.Exec(ctx, sql, argValues...)
+	endQuerySpan(span, int(tag.RowsAffected()), err)
+	if err != nil {
+		log.Warnf("Error running Delete query: %v", err)
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isTableFeatureDeletable checks a deletion without running it,
+// so that triggers are not fired and rows are not locked.
+// It returns false if the feature does not exist,
+// and an error if the user does not have the privilege to delete it
+func (cat *catalogDB) isTableFeatureDeletable(ctx context.Context, tbl *Table, argValues []interface{}, tenant *PropertyFilter) (bool, error) {
+	db := cat.db(tbl)
+	if err := checkTablePrivileges(ctx, db, tbl, "DELETE"); err != nil {
+		return false, err
+	}
+	sql := sqlFeatureExists(tbl, tenant)
+	logQuery(ctx, "Feature exists query", tbl.ID, sql, argValues)
+
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, tbl.ID)
+	var isFound bool
+	err := db.QueryRow(ctx, sql, argValues...).Scan(&isFound)
+	endQuerySpan(span, 1, err)
+	if err != nil {
+		log.Warnf("Error running Feature exists query: %v", err)
+		return false, err
+	}
+	return isFound, nil
+}
+
+// checkTablePrivileges returns an error if the current user
+// does not have all the given privileges on a table
+func checkTablePrivileges(ctx context.Context, db dbQuerier, tbl *Table, privileges ...string) error {
+	sql := sqlTablePrivileges(privileges...)
+	var isAllowed bool
+	err := db.QueryRow(ctx, sql, sqlTableName(tbl)).Scan(&isAllowed)
+	if err != nil {
+		return err
+	}
+	if !isAllowed {
+		return fmt.Errorf(errMsgTablePrivilege, tbl.ID)
+	}
+	return nil
+}
+
+func (cat *catalogDB) UpsertTableFeatures(ctx context.Context, name string, features []*FeatureEdit, replace bool, dryRun bool) (*UpsertCounts, error) {
+	tbl, err := cat.TableByName(name)
+	if err != nil || tbl == nil {
+		return nil, err
+	}
+	tenant := tenantFilterFrom(ctx)
+	if dryRun {
+		return cat.checkUpsertTableFeatures(ctx, tbl, features, replace, tenant)
+	}
+	tx, err := cat.db(tbl).Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	//-- rollback is a no-op if the transaction has been committed
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	ctx, span := startQuerySpan(ctx, sqlOpUpsert, name)
+	counts, err := upsertFeatures(ctx, tx, tbl, features, replace, tenant)
+	if counts != nil {
+		endQuerySpan(span, counts.Inserted+counts.Updated+counts.Deleted, err)
+	} else {
+		endQuerySpan(span, 0, err)
+	}
+	if err != nil {
+		log.Warnf("Error running Upsert query: %v", err)
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// checkUpsertTableFeatures computes the counts of an upsert without running it,
+// so that triggers are not fired, rows are not locked and sequences are not used.
+// The feature values are converted to the column types as for the upsert,
+// in a read-only transaction so that the counts are from a single snapshot.
+// It returns an error if the user does not have the privileges for the upsert
+func (cat *catalogDB) checkUpsertTableFeatures(ctx context.Context, tbl *Table, features []*FeatureEdit, replace bool, tenant *PropertyFilter) (*UpsertCounts, error) {
+	tx, err := cat.db(tbl).BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	//-- the transaction only reads, so it is always rolled back
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	privileges := []string{"INSERT", "UPDATE"}
+	if replace {
+		privileges = append(privileges, "DELETE")
+	}
+	if err := checkTablePrivileges(ctx, tx, tbl, privileges...); err != nil {
+		return nil, err
+	}
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, tbl.ID)
+	counts, err := checkUpsertFeatures(ctx, tx, tbl, features, replace, tenant)
+	if counts != nil {
+		endQuerySpan(span, counts.Inserted+counts.Updated+counts.Deleted, err)
+	} else {
+		endQuerySpan(span, 0, err)
+	}
+	if err != nil {
+		log.Warnf("Error running Upsert check query: %v", err)
+		return nil, err
+	}
+	return counts, nil
+}
+
+// upsertFeatures writes features in a transaction.
+// Features of other tenants are not updated or deleted
+func upsertFeatures(ctx context.Context, tx pgx.Tx, tbl *Table, features []*FeatureEdit, replace bool, tenant *PropertyFilter) (*UpsertCounts, error) {
+	counts := &UpsertCounts{}
+	keys := make([]map[string]interface{}, 0, len(features))
+	for _, feat := range features {
+		args, cols, key, err := featureUpsertArgs(tbl, feat, tenant)
+		if err != nil {
+			return nil, err
+		}
+		sql := sqlUpsertFeature(tbl, cols, tbl.GeometryColumn != "", tenant)
+		logQuery(ctx, "Upsert feature query", tbl.ID, sql, args)
+
+		var isInserted bool
+		err = tx.QueryRow(ctx, sql, args...).Scan(&isInserted)
+		switch {
+		case err == pgx.ErrNoRows:
+			//-- the feature belongs to another tenant
+		case err != nil:
+			return nil, err
+		case isInserted:
+			counts.Inserted++
+		default:
+			counts.Updated++
+		}
+		keys = append(keys, key)
 	}
-	//-- excluded schemas / tables
-	cat.tableExcludes = make(map[string]string)
-	for _, name := range excludeList {
-		nameLow := strings.ToLower(name)
-		cat.tableExcludes[nameLow] = nameLow
+	if !replace {
+		return counts, nil
+	}
+	args, err := otherFeaturesArgs(keys, tenant)
+	if err != nil {
+		return nil, err
 	}
+	sql := sqlDeleteOtherFeatures(tbl, tenant)
+	logQuery(ctx, "Delete features query", tbl.ID, sql, args)
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	counts.Deleted = int(tag.RowsAffected())
+	return counts, nil
 }
 
-func (cat *catalogDB) Close() {
-	cat.dbconn.Close()
-}
+// checkUpsertFeatures counts the features an upsert would insert, update and delete,
+// by reading the table only.
+// A feature given more than once is inserted at most once, and then updated
+func checkUpsertFeatures(ctx context.Context, tx pgx.Tx, tbl *Table, features []*FeatureEdit, replace bool, tenant *PropertyFilter) (*UpsertCounts, error) {
+	counts := &UpsertCounts{}
+	keys := make([]map[string]interface{}, 0, len(features))
+	//-- whether a feature given earlier was written, by key
+	isWritten := make(map[string]bool)
+	for _, feat := range features {
+		args, _, key, err := featureUpsertArgs(tbl, feat, tenant)
+		if err != nil {
+			return nil, err
+		}
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		sql := sqlUpsertFeatureCheck(tbl, tbl.GeometryColumn != "", tenant)
+		logQuery(ctx, "Upsert feature check query", tbl.ID, sql, args)
 
-func (cat *catalogDB) Tables() ([]*Table, error) {
-	cat.refreshTables(true)
-	return cat.tables, nil
+		var isFound, isTenant, hasGeom bool
+		err = tx.QueryRow(ctx, sql, args...).Scan(&isFound, &isTenant, &hasGeom)
+		if err != nil {
+			return nil, err
+		}
+		written, isGiven := isWritten[string(keyJSON)]
+		switch {
+		case isGiven && written:
+			counts.Updated++
+		case isGiven:
+			//-- the feature belongs to another tenant
+		case !isFound:
+			counts.Inserted++
+		case isTenant:
+			counts.Updated++
+		}
+		if !isGiven {
+			isWritten[string(keyJSON)] = !isFound || isTenant
+		}
+		keys = append(keys, key)
+	}
+	if !replace {
+		return counts, nil
+	}
+	args, err := otherFeaturesArgs(keys, tenant)
+	if err != nil {
+		return nil, err
+	}
+	sql := sqlCountOtherFeatures(tbl, tenant)
+	logQuery(ctx, "Count features query", tbl.ID, sql, args)
+	if err := tx.QueryRow(ctx, sql, args...).Scan(&counts.Deleted); err != nil {
+		return nil, err
+	}
+	return counts, nil
 }
 
-func (cat *catalogDB) TableReload(name string) {
-	tbl, ok := cat.tableMap[name]
+// featureUpsertArgs creates the SQL args for the upsert of a feature:
+// the JSON record of its column values, the GeoJSON geometry (if the table has one),
+// and the tenant value (if any).
+// It also returns the record columns and the key values of the feature
+func featureUpsertArgs(tbl *Table, feat *FeatureEdit, tenant *PropertyFilter) ([]interface{}, []string, map[string]interface{}, error) {
+	record, cols, ok := featureRecord(tbl, feat, tenant)
 	if !ok {
-		return
+		return nil, nil, nil, fmt.Errorf(errMsgInvalidFeatureID, feat.ID)
 	}
-	// load extent (which may change over time
-	sqlExtentEst := sqlExtentEstimated(tbl)
-	isExtentLoaded := cat.loadExtent(sqlExtentEst, tbl)
-	if !isExtentLoaded {
-		log.Debugf("Can't get estimated extent for %s", name)
-		sqlExtentExact := sqlExtentExact(tbl)
-		cat.loadExtent(sqlExtentExact, tbl)
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	args := []interface{}{string(recordJSON)}
+	if tbl.GeometryColumn != "" {
+		var geom interface{}
+		if feat.Geometry != "" {
+			geom = feat.Geometry
+		}
+		args = append(args, geom)
+	}
+	args = appendFilterArg(args, tenant)
+	key := make(map[string]interface{}, len(tbl.IDColumns))
+	for _, col := range tbl.IDColumns {
+		key[col] = record[col]
 	}
+	return args, cols, key, nil
 }
 
-func (cat *catalogDB) loadExtent(sql string, tbl *Table) bool {
-	var (
-		xmin pgtype.Float8
-		xmax pgtype.Float8
-		ymin pgtype.Float8
-		ymax pgtype.Float8
-	)
-	log.Debug("Extent query: " + sql)
-	err := cat.dbconn.QueryRow(context.Background(), sql).Scan(&xmin, &ymin, &xmax, &ymax)
+// otherFeaturesArgs creates the SQL args for the features not having the given keys:
+// the JSON array of the key records, and the tenant value (if any)
+func otherFeaturesArgs(keys []map[string]interface{}, tenant *PropertyFilter) ([]interface{}, error) {
+	keysJSON, err := json.Marshal(keys)
 	if err != nil {
-		log.Debugf("Error querying Extent for %s: %v", tbl.ID, err)
-	}
-	// no extent was read (perhaps a view...)
-	if xmin.Status == pgtype.Null {
-		return false
+		return nil, err
 	}
-	tbl.Extent.Minx = xmin.Float
-	tbl.Extent.Miny = ymin.Float
-	tbl.Extent.Maxx = xmax.Float
-	tbl.Extent.Maxy = ymax.Float
-	return true
+	return appendFilterArg([]interface{}{string(keysJSON)}, tenant), nil
 }
 
-func (cat *catalogDB) TableByName(name string) (*Table, error) {
-	cat.refreshTables(false)
-	tbl, ok := cat.tableMap[name]
+// featureRecord creates the JSON record of the column values of a feature,
+// with the key columns set from the feature id, and the tenant column set to the tenant.
+// It returns the record columns (the key columns, then the others in table column order),
+// and false if the id does not have a value for each key column
+func featureRecord(tbl *Table, feat *FeatureEdit, tenant *PropertyFilter) (map[string]interface{}, []string, bool) {
+	keyVals, ok := featureIDArgs(tbl, feat.ID)
 	if !ok {
-		return nil, nil
+		return nil, nil, false
 	}
-	return tbl, nil
+	record := make(map[string]interface{})
+	for name, val := range feat.Properties {
+		record[name] = val
+	}
+	cols := append([]string{}, tbl.IDColumns...)
+	for i, col := range tbl.IDColumns {
+		record[col] = keyVals[i]
+	}
+	if tenant != nil {
+		record[tenant.Name] = tenant.Value
+	}
+	for _, col := range tbl.Columns {
+		if _, ok := record[col]; ok && !isNameIn(col, tbl.IDColumns) {
+			cols = append(cols, col)
+		}
+	}
+	return record, cols, true
 }
 
-func (cat *catalogDB) TableFeatures(ctx context.Context, name string, param *QueryParam) ([]string, error) {
-	tbl, err := cat.TableByName(name)
-	if err != nil || tbl == nil {
-		return nil, err
+func isNameIn(name string, names []string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
 	}
-	cols := param.Columns
-	sql, argValues := sqlFeatures(tbl, param)
-	log.Debug("Features query: " + sql)
-	idColIndex := indexOfName(cols, tbl.IDColumn)
-
-	features, err := readFeaturesWithArgs(ctx, cat.dbconn, sql, argValues, idColIndex, cols)
-	return features, err
+	return false
 }
 
-func (cat *catalogDB) TableFeature(ctx context.Context, name string, id string, param *QueryParam) (string, error) {
-	tbl, err := cat.TableByName(name)
-	if err != nil {
-		return "", err
+// featureIDArgs splits a feature id into SQL arg values for the table id columns.
+// It returns false if the id does not have a value for each id column.
+func featureIDArgs(tbl *Table, id string) ([]interface{}, bool) {
+	if len(tbl.IDColumns) == 0 {
+		return nil, false
 	}
-	cols := param.Columns
-	sql := sqlFeature(tbl, param)
-	log.Debug("Feature query: " + sql)
-	idColIndex := indexOfName(cols, tbl.IDColumn)
-
-	//--- Add a SQL arg for the feature ID
-	argValues := make([]interface{}, 0)
-	argValues = append(argValues, id)
-	features, err := readFeaturesWithArgs(ctx, cat.dbconn, sql, argValues, idColIndex, cols)
+	keyVals := SplitFeatureID(id, len(tbl.IDColumns))
+	if keyVals == nil {
+		return nil, false
+	}
+	args := make([]interface{}, len(keyVals))
+	for i, val := range keyVals {
+		args[i] = val
+	}
+	return args, true
+}
 
-	if len(features) == 0 {
-		return "", err
+// appendFilterArg appends the value of a filter (if any) to a list of SQL arg values
+func appendFilterArg(args []interface{}, filter *PropertyFilter) []interface{} {
+	if filter == nil {
+		return args
 	}
-	return features[0], nil
+	return append(args, filter.Value)
 }
 
+// refreshTables reads the table metadata if it is not loaded,
+// or the cache has expired, or force is set
 func (cat *catalogDB) refreshTables(force bool) {
-	// TODO: refresh on timed basis?
-	if force || isStartup {
-		cat.loadTables()
-		isStartup = false
+	tablesLock.RLock()
+	isValid := cat.isTablesCacheValid()
+	tablesLock.RUnlock()
+	if isValid && !force {
+		return
+	}
+	tablesLock.Lock()
+	defer tablesLock.Unlock()
+	//-- another request may have loaded the tables while this one waited
+	if !force && cat.isTablesCacheValid() {
+		return
 	}
+	cat.loadTables()
+	cat.tablesLoadTime = time.Now()
+	isStartup = false
+}
+
+func (cat *catalogDB) isTablesCacheValid() bool {
+	return !isStartup && isTableCacheValid(cat.tablesLoadTime, tableCacheTTL(), time.Now())
 }
 
 func (cat *catalogDB) loadTables() {
-	cat.tableMap = cat.readTables(cat.dbconn)
+	cat.tableMap = cat.readTables(cat.dbconn, "")
+	for _, src := range conf.Configuration().Databases {
+		pool, ok := cat.sources[src.Name]
+		if !ok {
+			continue
+		}
+		addSourceTables(cat.tableMap, cat.readTables(pool, src.Name))
+	}
 	cat.tables = tablesSorted(cat.tableMap)
+	//-- reloaded tables keep their cached extents
+	extentsLock.Lock()
+	defer extentsLock.Unlock()
+	now := time.Now()
+	for name, entry := range cat.extents {
+		tbl, ok := cat.tableMap[name]
+		if ok && isExtentCacheValid(entry.loadTime, extentCacheTTL(), now) {
+			tbl.Extent = entry.extent
+			tbl.StorageExtent = entry.storageExtent
+		}
+	}
 }
 
 func tablesSorted(tableMap map[string]*Table) []*Table {
@@ -259,7 +1288,23 @@ func tablesSorted(tableMap map[string]*Table) []*Table {
 	return lsort
 }
 
-func (cat *catalogDB) readTables(db *pgxpool.Pool) map[string]*Table {
+// addSourceTables adds the tables of an additional database to the tables.
+// Their ids are prefixed by the database name, so they are distinct
+// from those of other databases
+func addSourceTables(tables map[string]*Table, sourceTables map[string]*Table) {
+	for id, tbl := range sourceTables {
+		if _, ok := tables[id]; ok {
+			log.Warnf("Skipping collection %v of database %v: the id is already used", id, tbl.Source)
+			continue
+		}
+		tables[id] = tbl
+	}
+}
+
+// readTables reads the tables of a database.
+// The ids of the tables of an additional database are prefixed by its name.
+// SQL collections are read from the primary database
+func (cat *catalogDB) readTables(db *pgxpool.Pool, source string) map[string]*Table {
 	log.Debugf("Load table catalog:\n%v", sqlTables)
 	rows, err := db.Query(context.Background(), sqlTables)
 	if err != nil {
@@ -268,7 +1313,17 @@ func (cat *catalogDB) readTables(db *pgxpool.Pool) map[string]*Table {
 	tables := make(map[string]*Table)
 	for rows.Next() {
 		tbl := scanTable(rows)
+		//-- includes and excludes match the unprefixed table name
 		if cat.isIncluded(tbl) {
+			if source != "" {
+				tbl.ID = source + "." + tbl.ID
+				tbl.Source = source
+			}
+			coll := conf.Configuration().CollectionConfig(tbl.ID)
+			applyCollectionMetadata(tbl, coll)
+			if err := applyCollectionIDColumn(tbl, coll.IdColumn); err != nil {
+				log.Errorf("Collection %v: %v (using primary key %v)", tbl.ID, err, tbl.IDColumns)
+			}
 			tables[tbl.ID] = tbl
 		}
 	}
@@ -277,9 +1332,152 @@ func (cat *catalogDB) readTables(db *pgxpool.Pool) map[string]*Table {
 		log.Fatal(err)
 	}
 	rows.Close()
+	if source != "" {
+		return tables
+	}
+	for _, coll := range conf.Configuration().SqlCollections {
+		tbl, err := readSqlCollection(db, coll)
+		if err != nil {
+			log.Warnf("Skipping SQL collection %v: %v", coll.Id, err)
+			continue
+		}
+		tables[tbl.ID] = tbl
+	}
 	return tables
 }
 
+// readSqlCollection creates the table for a SQL collection.
+// The query columns are determined by running it with NULL parameter values
+func readSqlCollection(db *pgxpool.Pool, coll conf.SqlCollection) (*Table, error) {
+	tbl, err := sqlCollectionTable(coll)
+	if err != nil {
+		return nil, err
+	}
+	sql := sqlDescribeSqlCollection(tbl)
+	log.Debugf("SQL collection query: %v", sql)
+	rows, err := db.Query(context.Background(), sql)
+	if err != nil {
+		return nil, err
+	}
+	fields := rows.FieldDescriptions()
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(fields))
+	oids := make([]int64, len(fields))
+	for i, fld := range fields {
+		names[i] = string(fld.Name)
+		oids[i] = int64(fld.DataTypeOID)
+	}
+	typeNames, err := readTypeNames(db, oids)
+	if err != nil {
+		return nil, err
+	}
+	datatypes := make([]string, len(fields))
+	for i, oid := range oids {
+		datatypes[i] = typeNames[oid]
+	}
+	if err := setSqlCollectionColumns(tbl, names, datatypes); err != nil {
+		return nil, err
+	}
+	return tbl, nil
+}
+
+// sqlCollectionTable creates a table for the configuration of a SQL collection
+func sqlCollectionTable(coll conf.SqlCollection) (*Table, error) {
+	if coll.Id == "" || coll.Sql == "" {
+		return nil, fmt.Errorf("Id and Sql must be provided")
+	}
+	if coll.GeometryColumn == "" || coll.IdColumn == "" {
+		return nil, fmt.Errorf("GeometryColumn and IdColumn must be provided")
+	}
+	srid := coll.Srid
+	if srid == 0 {
+		srid = SRID_4326
+	}
+	var params []SqlParameter
+	for _, p := range coll.Parameters {
+		if _, ok := sqlParamTypes[p.Type]; !ok {
+			return nil, fmt.Errorf("invalid type %v of parameter %v", p.Type, p.Name)
+		}
+		params = append(params, SqlParameter{Name: p.Name, Type: p.Type, Default: p.Default})
+	}
+	title := coll.Title
+	if title == "" {
+		title = coll.Id
+	}
+	description := coll.Description
+	if description == "" {
+		description = fmt.Sprintf("Data for query %v", coll.Id)
+	}
+	return &Table{
+		ID:             coll.Id,
+		Table:          coll.Id,
+		Title:          title,
+		Description:    description,
+		GeometryColumn: coll.GeometryColumn,
+		Srid:           srid,
+		GeometryType:   "Geometry",
+		IDColumns:      []string{coll.IdColumn},
+		IsView:         true,
+		Sql:            coll.Sql,
+		SqlParameters:  params,
+	}, nil
+}
+
+// setSqlCollectionColumns sets the property columns of a SQL collection
+// from the query columns, and checks that the configured columns are provided
+func setSqlCollectionColumns(tbl *Table, names []string, datatypes []string) error {
+	tbl.DbTypes = make(map[string]string)
+	isGeomFound := false
+	for i, name := range names {
+		if datatypes[i] == PGTypeGeometry || datatypes[i] == "geography" {
+			if name == tbl.GeometryColumn {
+				isGeomFound = true
+			}
+			continue
+		}
+		tbl.Columns = append(tbl.Columns, name)
+		tbl.DbTypes[name] = datatypes[i]
+		tbl.JSONTypes = append(tbl.JSONTypes, toJSONTypeFromPG(datatypes[i]))
+		tbl.ColDesc = append(tbl.ColDesc, "")
+	}
+	if !isGeomFound {
+		return fmt.Errorf("query has no geometry column %v", tbl.GeometryColumn)
+	}
+	if _, ok := tbl.DbTypes[tbl.IDColumns[0]]; !ok {
+		return fmt.Errorf("query has no id column %v", tbl.IDColumns[0])
+	}
+	for _, p := range tbl.SqlParameters {
+		if _, ok := tbl.DbTypes[p.Name]; ok {
+			return fmt.Errorf("parameter %v has the same name as a column", p.Name)
+		}
+	}
+	return nil
+}
+
+const sqlTypeNames = `SELECT oid::int8, typname FROM pg_type WHERE oid = ANY($1)`
+
+// readTypeNames reads the names of Postgres types
+func readTypeNames(db *pgxpool.Pool, oids []int64) (map[int64]string, error) {
+	rows, err := db.Query(context.Background(), sqlTypeNames, oids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make(map[int64]string)
+	for rows.Next() {
+		var oid int64
+		var name string
+		if err := rows.Scan(&oid, &name); err != nil {
+			return nil, err
+		}
+		names[oid] = name
+	}
+	return names, rows.Err()
+}
+
 func (cat *catalogDB) isIncluded(tbl *Table) bool {
 	//--- if no includes defined, always include
 	isIncluded := true
@@ -293,14 +1491,18 @@ func (cat *catalogDB) isIncluded(tbl *Table) bool {
 	return isIncluded && !isExcluded
 }
 
-func isMatchSchemaTable(tbl *Table, list map[string]string) bool {
-	schemaLow := strings.ToLower(tbl.Schema)
-	if _, ok := list[schemaLow]; ok {
-		return true
-	}
-	idLow := strings.ToLower(tbl.ID)
-	if _, ok := list[idLow]; ok {
-		return true
+// isMatchSchemaTable tests if a table matches a pattern in a list.
+// Patterns containing a dot match the schema-qualified table name,
+// otherwise they match the schema name
+func isMatchSchemaTable(tbl *Table, list []namePattern) bool {
+	for _, pattern := range list {
+		name := tbl.Schema
+		if pattern.isQualified {
+			name = tbl.ID
+		}
+		if pattern.regex.MatchString(name) {
+			return true
+		}
 	}
 	return false
 }
@@ -309,12 +1511,15 @@ func scanTable(rows pgx.Rows) *Table {
 	var (
 		id, schema, table, description, geometryCol string
 		srid                                        int
-		geometryType, idColumn                      string
+		geometryType                                string
+		idColumnsTA                                 pgtype.TextArray
+		uniqueColumnsTA                             pgtype.TextArray
+		isView                                      bool
 		props                                       pgtype.TextArray
 	)
 
 	err := rows.Scan(&id, &schema, &table, &description, &geometryCol,
-		&srid, &geometryType, &idColumn, &props)
+		&srid, &geometryType, &idColumnsTA, &uniqueColumnsTA, &isView, &props)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -353,9 +1558,12 @@ func scanTable(rows pgx.Rows) *Table {
 		colDesc[i] = props.Elements[elmPos+2].String
 	}
 
-	// Synthesize a title for now
-	title := id
-	// synthesize a description if none provided
+	// a multi-line comment provides the title on the first line
+	title, description := titleFromComment(description)
+	// synthesize a title and description if none provided
+	if title == "" {
+		title = id
+	}
 	if description == "" {
 		description = fmt.Sprintf("Data for table %v", id)
 	}
@@ -369,7 +1577,9 @@ func scanTable(rows pgx.Rows) *Table {
 		GeometryColumn: geometryCol,
 		Srid:           srid,
 		GeometryType:   geometryType,
-		IDColumn:       idColumn,
+		IDColumns:      toArray(idColumnsTA),
+		UniqueColumns:  toArray(uniqueColumnsTA),
+		IsView:         isView,
 		Columns:        columns,
 		DbTypes:        datatypes,
 		JSONTypes:      jsontypes,
@@ -377,15 +1587,170 @@ func scanTable(rows pgx.Rows) *Table {
 	}
 }
 
+// titleFromComment splits a comment into a title and description.
+// If the comment has more than one line the first line is the title,
+// otherwise the comment is the description
+func titleFromComment(comment string) (string, string) {
+	comment = strings.TrimSpace(comment)
+	lines := strings.SplitN(comment, "\n", 2)
+	if len(lines) < 2 {
+		return "", comment
+	}
+	return strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1])
+}
+
+// applyCollectionMetadata overrides the table and column comments
+// with the metadata in the collection configuration, if provided
+func applyCollectionMetadata(tbl *Table, coll conf.Collection) {
+	if coll.Title != "" {
+		tbl.Title = coll.Title
+	}
+	if coll.Description != "" {
+		tbl.Description = coll.Description
+	}
+	for name, desc := range coll.PropertyDescriptions {
+		//-- config keys may be lower-cased, so match case-insensitively
+		for i, col := range tbl.Columns {
+			if strings.EqualFold(col, name) && i < len(tbl.ColDesc) {
+				tbl.ColDesc[i] = desc
+			}
+		}
+	}
+	tbl.PropertyAliases = propertyAliases(tbl, coll.PropertyAliases)
+}
+
+// propertyAliases matches the configured property aliases to the table columns.
+// An alias which is the name of a column (or contains a property path separator)
+// is ignored, so that column names always refer to their own column.
+// An alias of more than one column is ignored for all of them,
+// since it could not be resolved to a single column
+func propertyAliases(tbl *Table, aliases map[string]string) map[string]string {
+	if len(aliases) == 0 {
+		return nil
+	}
+	colSet := make(map[string]bool, len(tbl.Columns))
+	for _, col := range tbl.Columns {
+		colSet[col] = true
+	}
+	result := make(map[string]string)
+	for name, alias := range aliases {
+		if colSet[alias] || alias == "" || strings.Contains(alias, PropertyPathSeparator) {
+			log.Warnf("Collection %v: ignoring property alias %q of %v", tbl.ID, alias, name)
+			continue
+		}
+		//-- config keys may be lower-cased, so match case-insensitively
+		for _, col := range tbl.Columns {
+			if strings.EqualFold(col, name) {
+				result[col] = alias
+			}
+		}
+	}
+	aliasCols := make(map[string][]string)
+	for col, alias := range result {
+		aliasCols[alias] = append(aliasCols[alias], col)
+	}
+	for alias, cols := range aliasCols {
+		if len(cols) < 2 {
+			continue
+		}
+		sort.Strings(cols)
+		log.Warnf("Collection %v: ignoring property alias %q of more than one column: %v", tbl.ID, alias, strings.Join(cols, ", "))
+		for _, col := range cols {
+			delete(result, col)
+		}
+	}
+	return result
+}
+
+// applyCollectionIDColumn sets the configured id column of a table, if any.
+// It is an error if the table has no such column, in which case the ids are unchanged
+func applyCollectionIDColumn(tbl *Table, idColumn string) error {
+	if idColumn == "" {
+		return nil
+	}
+	//-- match case-insensitively, but use the column name from the database
+	for _, col := range tbl.Columns {
+		if col == idColumn {
+			setIDColumn(tbl, col)
+			return nil
+		}
+	}
+	for _, col := range tbl.Columns {
+		if strings.EqualFold(col, idColumn) {
+			setIDColumn(tbl, col)
+			return nil
+		}
+	}
+	return fmt.Errorf("IdColumn %v is not a column of the table", idColumn)
+}
+
+// setIDColumn sets the id column of a table,
+// noting whether it has a unique index (which features can be upserted on)
+func setIDColumn(tbl *Table, col string) {
+	tbl.IDColumns = []string{col}
+	tbl.IDNotUnique = !isNameIn(col, tbl.UniqueColumns)
+}
+
 //=================================================
 
+// SQL operations of query trace spans
+const (
+	sqlOpSelect = "SELECT"
+	sqlOpDelete = "DELETE"
+	sqlOpUpsert = "UPSERT"
+)
+
+// logQuery logs the SQL and argument values of a query of a collection or function.
+// The entry includes the request id, to correlate it with the request log.
+// Argument values are redacted if configured, since they may contain sensitive data
+func logQuery(ctx context.Context, desc string, collection string, sql string, args []interface{}) {
+	if !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	argValues := make([]string, len(args))
+	for i, arg := range args {
+		val := fmt.Sprintf("%v", arg)
+		if conf.Configuration().Database.RedactQueryArgs {
+			val = redactedArg
+		}
+		argValues[i] = fmt.Sprintf("$%v=%v", i+1, val)
+	}
+	log.Debugf("%v [collection %v, request %v]: %v Args: [%v]", desc, collection, requestIDFrom(ctx), sql, strings.Join(argValues, ", "))
+}
+
+// redactedArg is the logged value of a redacted query argument
+const redactedArg = "<redacted>"
+
+// startQuerySpan starts a trace span for a database query of a collection or function.
+// The span is nil if the request is not traced
+func startQuerySpan(ctx context.Context, operation string, collection string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartSpan(ctx, operation+" "+collection, tracing.KindClient)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.operation.name", operation)
+	span.SetAttribute("db.collection.name", collection)
+	return ctx, span
+}
+
+// endQuerySpan ends a query trace span, recording the number of rows read or written
+func endQuerySpan(span *tracing.Span, rowCount int, err error) {
+	span.SetAttribute("db.response.returned_rows", rowCount)
+	span.SetError(err)
+	span.End()
+}
+
 //nolint:unused
-func readFeatures(ctx context.Context, db *pgxpool.Pool, sql string, idColIndex int, propCols []string) ([]string, error) {
-	return readFeaturesWithArgs(ctx, db, sql, nil, idColIndex, propCols)
+func readFeatures(ctx context.Context, db *pgxpool.Pool, sql string, idColIndexes []int, propCols []string) ([]string, error) {
+	return readFeaturesWithArgs(ctx, db, sql, nil, idColIndexes, propCols, nil)
+}
+
+// dbQuerier runs queries on a connection pool or in a transaction
+type dbQuerier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
 }
 
 //nolint:unused
-func readFeaturesWithArgs(ctx context.Context, db *pgxpool.Pool, sql string, args []interface{}, idColIndex int, propCols []string) ([]string, error) {
+func readFeaturesWithArgs(ctx context.Context, db dbQuerier, sql string, args []interface{}, idColIndexes []int, propCols []string, round *coordRounding) ([]string, error) {
 	start := time.Now()
 	rows, err := db.Query(ctx, sql, args...)
 	if err != nil {
@@ -394,7 +1759,7 @@ func readFeaturesWithArgs(ctx context.Context, db *pgxpool.Pool, sql string, arg
 	}
 	defer rows.Close()
 
-	data, err := scanFeatures(ctx, rows, idColIndex, propCols)
+	data, err := scanFeatures(ctx, rows, idColIndexes, propCols, round)
 	if err != nil {
 		return data, err
 	}
@@ -402,11 +1767,11 @@ func readFeaturesWithArgs(ctx context.Context, db *pgxpool.Pool, sql string, arg
 	return data, nil
 }
 
-func scanFeatures(ctx context.Context, rows pgx.Rows, idColIndex int, propCols []string) ([]string, error) {
+func scanFeatures(ctx context.Context, rows pgx.Rows, idColIndexes []int, propCols []string, round *coordRounding) ([]string, error) {
 	// init features array to empty (not nil)
 	var features []string = []string{}
 	for rows.Next() {
-		feature := scanFeature(rows, idColIndex, propCols)
+		feature := scanFeature(rows, idColIndexes, propCols, round)
 		//log.Println(feature)
 		features = append(features, feature)
 	}
@@ -425,7 +1790,7 @@ func scanFeatures(ctx context.Context, rows pgx.Rows, idColIndex int, propCols [
 	return features, nil
 }
 
-func scanFeature(rows pgx.Rows, idColIndex int, propNames []string) string {
+func scanFeature(rows pgx.Rows, idColIndexes []int, propNames []string, round *coordRounding) string {
 	var id, geom string
 	vals, err := rows.Values()
 	if err != nil {
@@ -442,13 +1807,148 @@ func scanFeature(rows pgx.Rows, idColIndex int, propNames []string) string {
 	}
 
 	propOffset := 1
-	if idColIndex >= 0 {
-		id = fmt.Sprintf("%v", vals[idColIndex+propOffset])
+	if len(idColIndexes) > 0 {
+		keyVals := make([]string, len(idColIndexes))
+		for i, idColIndex := range idColIndexes {
+			keyVals[i] = fmt.Sprintf("%v", vals[idColIndex+propOffset])
+		}
+		id = FeatureID(keyVals)
 	}
 
 	//fmt.Println(geom)
 	props := extractProperties(vals, propOffset, propNames)
-	return makeFeatureJSON(id, geom, props)
+	return makeFeatureJSON(id, round.apply(geom), props)
+}
+
+// coordRounding reduces the coordinates in encoded geometry to a precision,
+// for the precision modes which the geometry encoders do not provide
+type coordRounding struct {
+	precision int
+	mode      string
+}
+
+// newCoordRounding returns the coordinate rounding for query parameters,
+// or nil if coordinates are rounded by the encoder.
+// WKB has no decimal coordinates, so is not rounded
+func newCoordRounding(param *QueryParam) *coordRounding {
+	if param.Precision < 0 || param.PrecisionMode == "" || param.PrecisionMode == PrecisionModeRound {
+		return nil
+	}
+	if param.GeomFormat == GeomFormatWKBHex || param.GeomFormat == GeomFormatEWKB {
+		return nil
+	}
+	return &coordRounding{precision: param.Precision, mode: param.PrecisionMode}
+}
+
+// apply reduces the decimal numbers in GeoJSON, WKT or GML geometry text.
+// Integers (such as EPSG codes) are unchanged
+func (cr *coordRounding) apply(geom string) string {
+	if cr == nil || geom == "" {
+		return geom
+	}
+	var sb strings.Builder
+	for i := 0; i < len(geom); {
+		c := geom[i]
+		isNum := isDigit(c) || (c == '-' && i+1 < len(geom) && isDigit(geom[i+1]))
+		if !isNum || (i > 0 && isNameByte(geom[i-1])) {
+			sb.WriteByte(c)
+			i++
+			continue
+		}
+		end := numberEnd(geom, i)
+		sb.WriteString(cr.reduce(geom[i:end]))
+		i = end
+	}
+	return sb.String()
+}
+
+// reduce reduces a decimal number to the precision.
+// The digits are those of the shortest decimal representing the number,
+// so that values such as 0.29 are not truncated to 0.28
+func (cr *coordRounding) reduce(num string) string {
+	val, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return num
+	}
+	digits := strconv.FormatFloat(math.Abs(val), 'f', -1, 64)
+	intPart, frac := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		intPart, frac = digits[:i], digits[i+1:]
+	}
+	if len(frac) <= cr.precision {
+		return num
+	}
+	kept, rest := frac[:cr.precision], frac[cr.precision:]
+	reduced := intPart
+	if cr.precision > 0 {
+		reduced += "." + kept
+	}
+	allKept := intPart + kept
+	if cr.isRoundedUp(allKept[len(allKept)-1], rest) {
+		abs, _ := strconv.ParseFloat(reduced, 64)
+		reduced = strconv.FormatFloat(abs+math.Pow10(-cr.precision), 'f', cr.precision, 64)
+	}
+	if strings.Contains(reduced, ".") {
+		reduced = strings.TrimRight(strings.TrimRight(reduced, "0"), ".")
+	}
+	if val < 0 && reduced != "0" {
+		return "-" + reduced
+	}
+	return reduced
+}
+
+// isRoundedUp tests if the magnitude of a number is rounded up,
+// given its last kept digit and the digits removed
+func (cr *coordRounding) isRoundedUp(last byte, rest string) bool {
+	switch cr.mode {
+	case PrecisionModeHalfUp:
+		return rest[0] >= '5'
+	case PrecisionModeHalfEven:
+		if rest[0] != '5' || strings.TrimRight(rest[1:], "0") != "" {
+			return rest[0] >= '5'
+		}
+		return (last-'0')%2 == 1
+	}
+	return false
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isNameByte tests if a byte may be part of a name, so a following digit is not a number
+func isNameByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// numberEnd is the index after the end of the number starting at an index
+func numberEnd(s string, start int) int {
+	i := start
+	if s[i] == '-' {
+		i++
+	}
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	if i+1 < len(s) && s[i] == '.' && isDigit(s[i+1]) {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+	if i+1 < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if s[j] == '+' || s[j] == '-' {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			for j < len(s) && isDigit(s[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	return i
 }
 
 func extractProperties(vals []interface{}, propOffset int, propNames []string) map[string]interface{} {
@@ -466,10 +1966,7 @@ func toJSONValue(value interface{}) interface{} {
 	//fmt.Printf("toJSONValue: %v\n", reflect.TypeOf(value))
 	switch v := value.(type) {
 	case *pgtype.Numeric:
-		var num float64
-		// TODO: handle error
-		v.AssignTo(&num) //nolint:errcheck
-		return num
+		return numericJSONValue(v)
 	case *pgtype.JSON:
 		var jsonval string
 		v.AssignTo(&jsonval) //nolint:errcheck
@@ -503,8 +2000,10 @@ func toJSONValue(value interface{}) interface{} {
 		v.AssignTo(&numarr) //nolint:errcheck
 		return numarr
 	case *pgtype.NumericArray:
-		var numarr []float64
-		v.AssignTo(&numarr) //nolint:errcheck
+		numarr := make([]interface{}, len(v.Elements))
+		for i := range v.Elements {
+			numarr[i] = numericJSONValue(&v.Elements[i])
+		}
 		return numarr
 		// TODO: handle other conversions?
 	}
@@ -513,6 +2012,40 @@ func toJSONValue(value interface{}) interface{} {
 	return value
 }
 
+// numericJSONValue converts a numeric value to a JSON string or number
+// with all of its digits, since converting to a float may lose precision
+func numericJSONValue(num *pgtype.Numeric) interface{} {
+	if num.Status != pgtype.Present {
+		return nil
+	}
+	text := numericText(num.Int, num.Exp)
+	if conf.Configuration().Database.NumericAsString {
+		return text
+	}
+	return json.Number(text)
+}
+
+// numericText formats the decimal value digits * 10^exp
+func numericText(digits *big.Int, exp int32) string {
+	sign := ""
+	if digits.Sign() < 0 {
+		sign = "-"
+	}
+	text := new(big.Int).Abs(digits).String()
+	if exp >= 0 {
+		if digits.Sign() == 0 {
+			return "0"
+		}
+		return sign + text + strings.Repeat("0", int(exp))
+	}
+	scale := int(-exp)
+	if len(text) <= scale {
+		text = strings.Repeat("0", scale-len(text)+1) + text
+	}
+	point := len(text) - scale
+	return sign + text[:point] + "." + text[point:]
+}
+
 func toJSONTypeFromPGArray(pgTypes []string) []string {
 	jsonTypes := make([]string, len(pgTypes))
 	for i, pgType := range pgTypes {
@@ -529,11 +2062,20 @@ func toJSONTypeFromPG(pgType string) string {
 	if strings.HasPrefix(pgType, "_int") || strings.HasPrefix(pgType, "_float") {
 		return JSONTypeNumberArray
 	}
+	if pgType == PGTypeNumericArray {
+		if conf.Configuration().Database.NumericAsString {
+			return JSONTypeStringArray
+		}
+		return JSONTypeNumberArray
+	}
 	if strings.HasPrefix(pgType, "_bool") {
 		return JSONTypeBooleanArray
 	}
 	switch pgType {
 	case PGTypeNumeric:
+		if conf.Configuration().Database.NumericAsString {
+			return JSONTypeString
+		}
 		return JSONTypeNumber
 	case PGTypeBool:
 		return JSONTypeBoolean
@@ -580,6 +2122,22 @@ func makeFeatureJSON(id string, geom string, props map[string]interface{}) strin
 	return jsonStr
 }
 
+// indexesOfNames finds the indexes of a list of names in an array of names
+// It returns nil if any name is not found
+func indexesOfNames(names []string, findNames []string) []int {
+	if len(findNames) == 0 {
+		return nil
+	}
+	indexes := make([]int, len(findNames))
+	for i, name := range findNames {
+		indexes[i] = indexOfName(names, name)
+		if indexes[i] < 0 {
+			return nil
+		}
+	}
+	return indexes
+}
+
 // indexOfName finds the index of a name in an array of names
 // It returns the index or -1 if not found
 func indexOfName(names []string, name string) int {
@@ -53,7 +53,7 @@ func (cat *catalogDB) refreshFunctions(force bool) {
 }
 
 func (cat *catalogDB) loadFunctions() {
-	cat.functions, cat.functionMap = readFunctionDefs(cat.dbconn, conf.Configuration.Database.FunctionIncludes)
+	cat.functions, cat.functionMap = readFunctionDefs(cat.dbconn, conf.Configuration().Database.FunctionIncludes)
 }
 
 func readFunctionDefs(db *pgxpool.Pool, funSchemas []string) ([]*Function, map[string]*Function) {
@@ -191,12 +191,13 @@ func (cat *catalogDB) FunctionFeatures(ctx context.Context, name string, args ma
 		return nil, errArg
 	}
 	propCols := removeNames(param.Columns, fn.GeometryColumn, "")
-	idColIndex := indexOfName(propCols, FunctionIDColumnName)
-	sql, argValues := sqlGeomFunction(fn, args, propCols, param)
-	log.Debugf("Function features query: %v", sql)
-	log.Debugf("Function %v Args: %v", name, argValues)
-	features, err := readFeaturesWithArgs(ctx, cat.dbconn, sql, argValues, idColIndex, propCols)
-	return features, err
+	idColIndexes := indexesOfNames(propCols, []string{FunctionIDColumnName})
+	sql, argValues := sqlGeomFunction(fn, args, propCols, responseQueryParam(param))
+	logQuery(ctx, "Function features query", name, sql, argValues)
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, name)
+	features, err := readFeaturesWithArgs(ctx, cat.dbconn, sql, argValues, idColIndexes, PropertyNames(propCols), newCoordRounding(param))
+	endQuerySpan(span, len(features), err)
+	return truncateFeatures(features, name, param), err
 }
 
 func (cat *catalogDB) FunctionData(ctx context.Context, name string, args map[string]string, param *QueryParam) ([]map[string]interface{}, error) {
@@ -210,9 +211,10 @@ func (cat *catalogDB) FunctionData(ctx context.Context, name string, args map[st
 	}
 	propCols := param.Columns
 	sql, argValues := sqlFunction(fn, args, propCols, param)
-	log.Debugf("Function data query: %v", sql)
-	log.Debugf("Function %v Args: %v", name, argValues)
+	logQuery(ctx, "Function data query", name, sql, argValues)
+	ctx, span := startQuerySpan(ctx, sqlOpSelect, name)
 	data, err := readDataWithArgs(ctx, cat.dbconn, propCols, sql, argValues)
+	endQuerySpan(span, len(data), err)
 	return data, err
 }
 
@@ -246,7 +248,7 @@ func readDataWithArgs(ctx context.Context, db *pgxpool.Pool, propCols []string,
 		return nil, err
 	}
 	defer rows.Close()
-	data := scanData(ctx, rows, propCols)
+	data := scanData(ctx, rows, PropertyNames(propCols))
 	log.Debugf(fmtQueryStats, len(data), time.Since(start))
 	return data, nil
 }
@@ -0,0 +1,766 @@
+package data
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CrunchyData/pg_featureserv/internal/conf"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestIsIncluded(t *testing.T) {
+	cat := &catalogDB{}
+	cat.SetIncludeExclude([]string{"public", "Data.road_*", "*.poi"}, []string{"public.tmp_*"})
+
+	checkIncluded(t, cat, "public", "countries", true)
+	checkIncluded(t, cat, "PUBLIC", "countries", true)
+	checkIncluded(t, cat, "public", "tmp_countries", false)
+	checkIncluded(t, cat, "data", "road_segments", true)
+	checkIncluded(t, cat, "data", "Road_Segments", true)
+	checkIncluded(t, cat, "data", "rail", false)
+	checkIncluded(t, cat, "other", "poi", true)
+	checkIncluded(t, cat, "other", "poi2", false)
+	checkIncluded(t, cat, "publicx", "countries", false)
+}
+
+func TestIsIncludedNoIncludes(t *testing.T) {
+	cat := &catalogDB{}
+	cat.SetIncludeExclude(nil, []string{"priv*"})
+
+	checkIncluded(t, cat, "public", "countries", true)
+	checkIncluded(t, cat, "private", "countries", false)
+}
+
+func checkIncluded(t *testing.T, cat *catalogDB, schema string, table string, expected bool) {
+	t.Helper()
+	tbl := &Table{ID: schema + "." + table, Schema: schema, Table: table}
+	if cat.isIncluded(tbl) != expected {
+		t.Errorf("%v: expected included = %v", tbl.ID, expected)
+	}
+}
+
+func TestTitleFromComment(t *testing.T) {
+	title, desc := titleFromComment("Countries of the world")
+	if title != "" || desc != "Countries of the world" {
+		t.Errorf("Single-line comment should be description: %q, %q", title, desc)
+	}
+	title, desc = titleFromComment("Countries\nCountries of the world\nfrom Natural Earth")
+	if title != "Countries" || desc != "Countries of the world\nfrom Natural Earth" {
+		t.Errorf("Multi-line comment should provide title: %q, %q", title, desc)
+	}
+}
+
+func TestApplyCollectionMetadata(t *testing.T) {
+	tbl := &Table{
+		ID:          "public.countries",
+		Title:       "Countries",
+		Description: "From comment",
+		Columns:     []string{"name", "Pop"},
+		ColDesc:     []string{"Name comment", "Population comment"},
+	}
+	applyCollectionMetadata(tbl, conf.Collection{
+		Description:          "From config",
+		PropertyDescriptions: map[string]string{"pop": "Population"},
+	})
+	if tbl.Title != "Countries" || tbl.Description != "From config" {
+		t.Errorf("Config should override description only: %q, %q", tbl.Title, tbl.Description)
+	}
+	if !reflect.DeepEqual(tbl.ColDesc, []string{"Name comment", "Population"}) {
+		t.Errorf("Config should override column description: %v", tbl.ColDesc)
+	}
+}
+
+func TestApplyCollectionAliases(t *testing.T) {
+	tbl := &Table{
+		ID:      "public.countries",
+		Columns: []string{"name", "Pop_Est", "code"},
+		ColDesc: []string{"", "", ""},
+	}
+	applyCollectionMetadata(tbl, conf.Collection{
+		//-- an alias which is another column name is ignored
+		PropertyAliases: map[string]string{"pop_est": "population", "name": "code", "code": "iso.code"},
+	})
+	if !reflect.DeepEqual(tbl.PropertyAliases, map[string]string{"Pop_Est": "population"}) {
+		t.Errorf("Aliases should match columns case-insensitively, and not be column names: %v", tbl.PropertyAliases)
+	}
+	if names := tbl.OutputNames([]string{"name", "Pop_Est"}); !reflect.DeepEqual(names, []string{"name", "population"}) {
+		t.Errorf("Output names should be aliased: %v", names)
+	}
+	if cols := tbl.AliasColumns(); cols["population"] != "Pop_Est" {
+		t.Errorf("Alias should map to its column: %v", cols)
+	}
+
+	//-- an alias of more than one column is ignored for all of them
+	tbl = &Table{ID: "public.countries", Columns: []string{"name", "Name", "pop_est", "pop_2020"}}
+	tbl.PropertyAliases = propertyAliases(tbl, map[string]string{"name": "label", "pop_est": "population", "pop_2020": "population"})
+	if len(tbl.PropertyAliases) != 0 {
+		t.Errorf("Aliases of more than one column should be ignored: %v", tbl.PropertyAliases)
+	}
+}
+
+func TestApplyCollectionIDColumn(t *testing.T) {
+	tbl := &Table{ID: "public.parcels", IDColumns: []string{"id"}, Columns: []string{"id", "GID", "name"}}
+	if err := applyCollectionIDColumn(tbl, "gid"); err != nil {
+		t.Errorf("Configured id column should be found: %v", err)
+	}
+	if !reflect.DeepEqual(tbl.IDColumns, []string{"GID"}) {
+		t.Errorf("Configured id column should replace the primary key: %v", tbl.IDColumns)
+	}
+	if err := applyCollectionIDColumn(tbl, "uuid"); err == nil {
+		t.Errorf("Missing id column should be an error")
+	}
+	if !reflect.DeepEqual(tbl.IDColumns, []string{"GID"}) {
+		t.Errorf("Missing id column should not change the id columns: %v", tbl.IDColumns)
+	}
+	if !tbl.IDNotUnique {
+		t.Errorf("Configured id column with no unique index should be noted")
+	}
+	//-- tables with no primary key support feature ids with a configured id column
+	tbl = &Table{ID: "public.nokey", Columns: []string{"code"}, UniqueColumns: []string{"code"}}
+	if err := applyCollectionIDColumn(tbl, "code"); err != nil || !tbl.SupportsFeatureID() {
+		t.Errorf("Configured id column should provide feature ids: %v", err)
+	}
+	if tbl.IDNotUnique {
+		t.Errorf("Configured id column with a unique index should be unique")
+	}
+}
+
+func TestCheckSourceName(t *testing.T) {
+	pools := map[string]*pgxpool.Pool{"east": nil}
+	if err := checkSourceName("west", pools); err != nil {
+		t.Errorf("Database name should be valid: %v", err)
+	}
+	for _, name := range []string{"", "west.db", "east"} {
+		if err := checkSourceName(name, pools); err == nil {
+			t.Errorf("Database name should be invalid: '%v'", name)
+		}
+	}
+}
+
+func TestSourceTables(t *testing.T) {
+	primary := &pgxpool.Pool{}
+	east := &pgxpool.Pool{}
+	cat := &catalogDB{dbconn: primary, sources: map[string]*pgxpool.Pool{"east": east}}
+	tables := map[string]*Table{"public.roads": {ID: "public.roads"}}
+	addSourceTables(tables, map[string]*Table{
+		"east.public.roads": {ID: "east.public.roads", Source: "east"},
+	})
+	if len(tables) != 2 {
+		t.Errorf("Tables of databases with the same name should be distinct: %v", tables)
+	}
+	if cat.db(tables["public.roads"]) != primary || cat.db(tables["east.public.roads"]) != east {
+		t.Errorf("Tables should be queried in their database")
+	}
+	//-- an id which is already used is not replaced
+	addSourceTables(tables, map[string]*Table{"public.roads": {ID: "public.roads", Source: "east"}})
+	if tables["public.roads"].Source != "" {
+		t.Errorf("Existing table should not be replaced")
+	}
+}
+
+func TestIsExtentCacheValid(t *testing.T) {
+	loadTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if !isExtentCacheValid(loadTime, 10*time.Minute, loadTime.Add(5*time.Minute)) {
+		t.Errorf("Extent should be cached within TTL")
+	}
+	if isExtentCacheValid(loadTime, 10*time.Minute, loadTime.Add(15*time.Minute)) {
+		t.Errorf("Extent should expire after TTL")
+	}
+	if isExtentCacheValid(loadTime, 0, loadTime) {
+		t.Errorf("Extent should not be cached with zero TTL")
+	}
+}
+
+func TestSqlCollectionTable(t *testing.T) {
+	tbl, err := sqlCollectionTable(conf.SqlCollection{
+		Id: "busy_stops", Sql: "SELECT id, name, geom FROM stops WHERE count >= :min_count",
+		GeometryColumn: "geom", IdColumn: "id",
+		Parameters: []conf.SqlParameter{{Name: "min_count", Type: "int", Default: "10"}},
+	})
+	if err != nil {
+		t.Fatalf("SQL collection should be valid: %v", err)
+	}
+	if tbl.Srid != SRID_4326 || !tbl.IsView || !reflect.DeepEqual(tbl.IDColumns, []string{"id"}) {
+		t.Errorf("SQL collection should be a read-only table in 4326: %+v", tbl)
+	}
+	err = setSqlCollectionColumns(tbl, []string{"id", "name", "geom"}, []string{"int4", "text", "geometry"})
+	if err != nil {
+		t.Fatalf("SQL collection columns should be valid: %v", err)
+	}
+	if !reflect.DeepEqual(tbl.Columns, []string{"id", "name"}) || !reflect.DeepEqual(tbl.JSONTypes, []string{JSONTypeNumber, JSONTypeString}) {
+		t.Errorf("SQL collection should have the non-geometry columns: %v %v", tbl.Columns, tbl.JSONTypes)
+	}
+
+	_, err = sqlCollectionTable(conf.SqlCollection{Id: "q", Sql: "SELECT 1", GeometryColumn: "geom", IdColumn: "id",
+		Parameters: []conf.SqlParameter{{Name: "p", Type: "money"}}})
+	if err == nil {
+		t.Errorf("SQL collection parameter type should be checked")
+	}
+	tbl, _ = sqlCollectionTable(conf.SqlCollection{Id: "q", Sql: "SELECT 1", GeometryColumn: "geom", IdColumn: "id",
+		Parameters: []conf.SqlParameter{{Name: "name", Type: "text"}}})
+	err = setSqlCollectionColumns(tbl, []string{"id", "name", "geom"}, []string{"int4", "text", "geometry"})
+	if err == nil {
+		t.Errorf("SQL collection parameter should not have a column name")
+	}
+	tbl, _ = sqlCollectionTable(conf.SqlCollection{Id: "q", Sql: "SELECT 1", GeometryColumn: "geom", IdColumn: "id"})
+	err = setSqlCollectionColumns(tbl, []string{"id", "name"}, []string{"int4", "text"})
+	if err == nil {
+		t.Errorf("SQL collection should require the geometry column")
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	savedRedact := conf.Configuration().Database.RedactQueryArgs
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(level)
+		conf.Configuration().Database.RedactQueryArgs = savedRedact
+	}()
+	ctx := WithRequestID(context.Background(), "req-1")
+	args := []interface{}{"secret", 42}
+
+	conf.Configuration().Database.RedactQueryArgs = false
+	logQuery(ctx, "Features query", "public.a", "SELECT 1", args)
+	logged := out.String()
+	if !strings.Contains(logged, "collection public.a, request req-1") || !strings.Contains(logged, "$1=secret, $2=42") {
+		t.Errorf("query log entry: %v", logged)
+	}
+
+	out.Reset()
+	conf.Configuration().Database.RedactQueryArgs = true
+	logQuery(ctx, "Features query", "public.a", "SELECT 1", args)
+	logged = out.String()
+	if strings.Contains(logged, "secret") || !strings.Contains(logged, "$1="+redactedArg) {
+		t.Errorf("redacted query log entry: %v", logged)
+	}
+
+	out.Reset()
+	log.SetLevel(log.InfoLevel)
+	logQuery(ctx, "Features query", "public.a", "SELECT 1", args)
+	if out.Len() > 0 {
+		t.Errorf("query logged at info level: %v", out.String())
+	}
+}
+
+func TestResponseQueryParam(t *testing.T) {
+	savedMax := conf.Configuration().Paging.ResponseMaxFeatures
+	defer func() { conf.Configuration().Paging.ResponseMaxFeatures = savedMax }()
+	conf.Configuration().Paging.ResponseMaxFeatures = 100
+
+	param := &QueryParam{Limit: 50}
+	if p := responseQueryParam(param); p != param {
+		t.Errorf("limit within maximum changed: %v", p.Limit)
+	}
+	param = &QueryParam{Limit: 1000}
+	if p := responseQueryParam(param); p.Limit != 101 || param.Limit != 1000 {
+		t.Errorf("capped limit = %v, original limit = %v", p.Limit, param.Limit)
+	}
+	param = &QueryParam{Limit: -1}
+	if p := responseQueryParam(param); p.Limit != 101 {
+		t.Errorf("capped unlimited = %v", p.Limit)
+	}
+
+	features := make([]string, 101)
+	if got := truncateFeatures(features, "a", param); len(got) != 100 || !param.Truncated {
+		t.Errorf("truncated features = %v, flag = %v", len(got), param.Truncated)
+	}
+	param = &QueryParam{Limit: 1000}
+	if got := truncateFeatures(features[:100], "a", param); len(got) != 100 || param.Truncated {
+		t.Errorf("features within maximum = %v, flag = %v", len(got), param.Truncated)
+	}
+}
+
+func TestIsTableCacheValid(t *testing.T) {
+	loadTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if !isTableCacheValid(loadTime, time.Minute, loadTime.Add(30*time.Second)) {
+		t.Error("tables within TTL should be valid")
+	}
+	if isTableCacheValid(loadTime, time.Minute, loadTime.Add(2*time.Minute)) {
+		t.Error("tables past TTL should not be valid")
+	}
+	if !isTableCacheValid(loadTime, 0, loadTime.Add(24*time.Hour)) {
+		t.Error("tables with zero TTL should be valid until invalidated")
+	}
+}
+
+// sqlStateError is a database error with a SQLSTATE code
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "SQLSTATE " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestIdleTransactionTimeout(t *testing.T) {
+	saved := conf.Configuration().Database.IdleInTransactionTimeout
+	defer func() { conf.Configuration().Database.IdleInTransactionTimeout = saved }()
+
+	conf.Configuration().Database.IdleInTransactionTimeout = "90s"
+	if timeout := idleTransactionTimeout(); timeout != 90*time.Second {
+		t.Errorf("timeout should be 90s: %v", timeout)
+	}
+	for _, val := range []string{"0s", "", "soon"} {
+		conf.Configuration().Database.IdleInTransactionTimeout = val
+		if timeout := idleTransactionTimeout(); timeout != 0 {
+			t.Errorf("timeout %q should be disabled: %v", val, timeout)
+		}
+	}
+
+	if !IsIdleTransactionTimeout(fmt.Errorf("fetch: %w", sqlStateError("25P03"))) {
+		t.Error("25P03 should be an idle transaction timeout")
+	}
+	if IsIdleTransactionTimeout(sqlStateError("57014")) || IsIdleTransactionTimeout(context.Canceled) {
+		t.Error("other errors should not be an idle transaction timeout")
+	}
+}
+
+func TestReadIsoLevel(t *testing.T) {
+	saved := conf.Configuration().Database.ReadIsolation
+	defer func() { conf.Configuration().Database.ReadIsolation = saved }()
+
+	levels := map[string]pgx.TxIsoLevel{
+		"repeatable read": pgx.RepeatableRead,
+		"Read Committed":  pgx.ReadCommitted,
+		"serializable":    pgx.Serializable,
+		"":                pgx.RepeatableRead,
+		"snapshot":        pgx.RepeatableRead,
+	}
+	for val, level := range levels {
+		conf.Configuration().Database.ReadIsolation = val
+		if isoLevel := readIsoLevel(); isoLevel != level {
+			t.Errorf("isolation %q should be %v: %v", val, level, isoLevel)
+		}
+	}
+}
+
+func TestCoordRounding(t *testing.T) {
+	geom := `{"type":"Point","crs":{"type":"name","properties":{"name":"EPSG:4326"}},"coordinates":[-1.2351,0.29,15,2.5e-7]}`
+	cases := []struct {
+		mode      string
+		precision int
+		expected  string
+	}{
+		{PrecisionModeTruncate, 2, `[-1.23,0.29,15,0]`},
+		{PrecisionModeHalfUp, 3, `[-1.235,0.29,15,0]`},
+		{PrecisionModeHalfUp, 2, `[-1.24,0.29,15,0]`},
+		{PrecisionModeTruncate, 0, `[-1,0,15,0]`},
+		{PrecisionModeHalfUp, 7, `[-1.2351,0.29,15,0.0000003]`},
+	}
+	for _, c := range cases {
+		round := newCoordRounding(&QueryParam{Precision: c.precision, PrecisionMode: c.mode})
+		actual := round.apply(geom)
+		if !strings.Contains(actual, `"EPSG:4326"`) || !strings.HasSuffix(actual, `"coordinates":`+c.expected+`}`) {
+			t.Errorf("%v %v: %v", c.mode, c.precision, actual)
+		}
+	}
+	halfEven := &coordRounding{precision: 1, mode: PrecisionModeHalfEven}
+	if actual := halfEven.apply("POINT(0.25 0.35 0.251 -0.45)"); actual != "POINT(0.2 0.4 0.3 -0.4)" {
+		t.Errorf("half even: %v", actual)
+	}
+	if newCoordRounding(&QueryParam{Precision: 2, PrecisionMode: PrecisionModeRound}) != nil {
+		t.Errorf("encoder rounding should not reduce coordinates")
+	}
+	if newCoordRounding(&QueryParam{Precision: -1, PrecisionMode: PrecisionModeTruncate}) != nil {
+		t.Errorf("no precision should not reduce coordinates")
+	}
+}
+
+func TestToJSONTypeFromPG(t *testing.T) {
+	savedNumeric := conf.Configuration().Database.NumericAsString
+	defer func() {
+		conf.Configuration().Database.NumericAsString = savedNumeric
+	}()
+	conf.Configuration().Database.NumericAsString = false
+	cases := map[string]string{
+		"int2":        JSONTypeNumber,
+		"int4":        JSONTypeNumber,
+		"int8":        JSONTypeNumber,
+		"float4":      JSONTypeNumber,
+		"float8":      JSONTypeNumber,
+		"numeric":     JSONTypeNumber,
+		"bool":        JSONTypeBoolean,
+		"json":        JSONTypeJSON,
+		"_text":       JSONTypeStringArray,
+		"_int8":       JSONTypeNumberArray,
+		"_numeric":    JSONTypeNumberArray,
+		"_bool":       JSONTypeBooleanArray,
+		"text":        JSONTypeString,
+		"timestamptz": JSONTypeString,
+		"date":        JSONTypeString,
+		"uuid":        JSONTypeString,
+	}
+	for pgType, jsonType := range cases {
+		if actual := toJSONTypeFromPG(pgType); actual != jsonType {
+			t.Errorf("%v: expected %v, actual %v", pgType, jsonType, actual)
+		}
+	}
+	conf.Configuration().Database.NumericAsString = true
+	if actual := toJSONTypeFromPG("numeric"); actual != JSONTypeString {
+		t.Errorf("numeric as string: actual %v", actual)
+	}
+	if actual := toJSONTypeFromPG("_numeric"); actual != JSONTypeStringArray {
+		t.Errorf("numeric array as string: actual %v", actual)
+	}
+}
+
+func TestToJSONValue(t *testing.T) {
+	savedNumeric := conf.Configuration().Database.NumericAsString
+	defer func() {
+		conf.Configuration().Database.NumericAsString = savedNumeric
+	}()
+	large := &pgtype.Numeric{}
+	large.Set("12345678901234567890.125") //nolint:errcheck
+	small := &pgtype.Numeric{}
+	small.Set("-0.05") //nolint:errcheck
+	nums := &pgtype.NumericArray{Status: pgtype.Present, Elements: []pgtype.Numeric{
+		{Int: big.NewInt(150), Exp: -2, Status: pgtype.Present},
+		{Int: big.NewInt(2), Exp: 2, Status: pgtype.Present},
+	}}
+	ints := &pgtype.Int8Array{}
+	ints.Set([]int64{9007199254740993}) //nolint:errcheck
+	bools := &pgtype.BoolArray{}
+	bools.Set([]bool{true, false}) //nolint:errcheck
+	jsonVal := &pgtype.JSON{}
+	jsonVal.Set(`{"a":1}`) //nolint:errcheck
+
+	conf.Configuration().Database.NumericAsString = false
+	props := map[string]interface{}{
+		"i2":   toJSONValue(int16(-2)),
+		"i4":   toJSONValue(int32(40000)),
+		"i8":   toJSONValue(int64(9007199254740993)),
+		"f8":   toJSONValue(float64(1.5)),
+		"b":    toJSONValue(true),
+		"t":    toJSONValue("2024-03-01T10:30:00+00:00"),
+		"n":    toJSONValue(large),
+		"s":    toJSONValue(small),
+		"na":   toJSONValue(nums),
+		"ia":   toJSONValue(ints),
+		"ba":   toJSONValue(bools),
+		"j":    toJSONValue(jsonVal),
+		"null": toJSONValue(nil),
+	}
+	checkJSON(t, props, `{"b":true,"ba":[true,false],"f8":1.5,"i2":-2,"i4":40000,"i8":9007199254740993,`+
+		`"ia":[9007199254740993],"j":{"a":1},"n":12345678901234567890.125,"na":[1.50,200],"null":null,`+
+		`"s":-0.05,"t":"2024-03-01T10:30:00+00:00"}`)
+
+	conf.Configuration().Database.NumericAsString = true
+	checkJSON(t, map[string]interface{}{"n": toJSONValue(large), "na": toJSONValue(nums)},
+		`{"n":"12345678901234567890.125","na":["1.50","200"]}`)
+}
+
+func checkJSON(t *testing.T, val interface{}, expected string) {
+	t.Helper()
+	actual, err := json.Marshal(val)
+	if err != nil {
+		t.Fatalf("Error encoding JSON: %v", err)
+	}
+	if string(actual) != expected {
+		t.Errorf("Expected JSON\n%v\nactual\n%v", expected, string(actual))
+	}
+}
+
+func TestNumericText(t *testing.T) {
+	cases := []struct {
+		digits   int64
+		exp      int32
+		expected string
+	}{
+		{150, -2, "1.50"},
+		{-5, -3, "-0.005"},
+		{12, 3, "12000"},
+		{0, 2, "0"},
+		{0, -2, "0.00"},
+		{-7, 0, "-7"},
+	}
+	for _, c := range cases {
+		if actual := numericText(new(big.Int).SetInt64(c.digits), c.exp); actual != c.expected {
+			t.Errorf("%v e%v: expected %v, actual %v", c.digits, c.exp, c.expected, actual)
+		}
+	}
+}
+
+// TestExplainFeaturesSpatialIndex checks that a features query combining
+// bbox, datetime and attribute conditions can use the spatial index.
+// It requires a PostGIS database, given by the DATABASE_URL environment variable
+func TestExplainFeaturesSpatialIndex(t *testing.T) {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, dbURL)
+	if err != nil {
+		t.Fatalf("Error connecting to database: %v", err)
+	}
+	defer pool.Close()
+	//-- the temporary table is only visible to one connection
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Error acquiring connection: %v", err)
+	}
+	defer conn.Release()
+	for _, sql := range []string{
+		"CREATE TEMP TABLE explain_pts (id integer PRIMARY KEY, name text, t timestamptz, geom geometry(Point, 4326))",
+		"CREATE INDEX explain_pts_geom_idx ON explain_pts USING GIST (geom)",
+		//-- the test table is small, so a sequential scan would otherwise be chosen
+		"SET enable_seqscan = off",
+	} {
+		if _, err := conn.Exec(ctx, sql); err != nil {
+			t.Fatalf("Error running %v: %v", sql, err)
+		}
+	}
+
+	tbl := &Table{Schema: "pg_temp", Table: "explain_pts", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"}}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	param := &QueryParam{Crs: 4326, Precision: -1, Limit: 10, Columns: []string{"name"},
+		Bbox: &Extent{Minx: 0, Miny: 0, Maxx: 1, Maxy: 1}, BboxCrs: 4326,
+		TimeColumn: "t", Datetime: &TimeInterval{Start: &start},
+		Filter: []*PropertyFilter{{Name: "name", Value: "a"}},
+	}
+	sql, args := sqlFeatures(tbl, param, nil)
+	rows, err := conn.Query(ctx, "EXPLAIN "+strings.TrimSuffix(sql, ";"), args...)
+	if err != nil {
+		t.Fatalf("Error running EXPLAIN: %v", err)
+	}
+	defer rows.Close()
+	var plan strings.Builder
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			t.Fatalf("Error reading plan: %v", err)
+		}
+		plan.WriteString(line + "\n")
+	}
+	if !strings.Contains(plan.String(), "explain_pts_geom_idx") {
+		t.Errorf("Features query plan should use the spatial index:\n%v", plan.String())
+	}
+}
+
+// TestFeaturesMatchedSnapshot checks that the number of features matched is read
+// in the same snapshot as the features, for buffered and streamed queries,
+// unless the read isolation is read committed.
+// A row is inserted by another connection between the count and the features query.
+// It requires a PostGIS database, given by the DATABASE_URL environment variable
+func TestFeaturesMatchedSnapshot(t *testing.T) {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, dbURL)
+	if err != nil {
+		t.Fatalf("Error connecting to database: %v", err)
+	}
+	defer pool.Close()
+	//-- the table must be visible to the connection inserting rows, so it is not temporary
+	for _, sql := range []string{
+		"DROP TABLE IF EXISTS public.pgfs_test_matched",
+		"CREATE TABLE public.pgfs_test_matched (id integer PRIMARY KEY, name text, geom geometry(Point, 4326))",
+		"INSERT INTO public.pgfs_test_matched SELECT i, 'a', ST_MakePoint(i, i) FROM generate_series(1, 3) AS i",
+	} {
+		if _, err := pool.Exec(ctx, sql); err != nil {
+			t.Fatalf("Error running %v: %v", sql, err)
+		}
+	}
+	defer pool.Exec(ctx, "DROP TABLE public.pgfs_test_matched") //nolint:errcheck
+
+	dbSaved := conf.Configuration().Database
+	defer func() {
+		conf.Configuration().Database = dbSaved
+		afterFeatureCount = nil
+	}()
+	nextID := 4
+	afterFeatureCount = func(ctx context.Context) {
+		//-- the pool provides another connection than the one reading the features
+		if _, err := pool.Exec(ctx, "INSERT INTO public.pgfs_test_matched VALUES ($1, 'a', ST_MakePoint(0, 0))", nextID); err != nil {
+			t.Fatalf("Error inserting row: %v", err)
+		}
+		nextID++
+	}
+
+	tbl := &Table{ID: "public.pgfs_test_matched", Schema: "public", Table: "pgfs_test_matched",
+		GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"},
+		Columns: []string{"id", "name"}, DbTypes: map[string]string{"id": "int4", "name": "text"}}
+	cat := &catalogDB{dbconn: pool, tableMap: map[string]*Table{tbl.ID: tbl}}
+	conf.Configuration().Database.TableCacheTTL = ""
+
+	readBuffered := func() (int, int, error) {
+		features, count, err := cat.TableFeaturesMatched(ctx, tbl.ID, &QueryParam{Crs: 4326, Precision: -1, Limit: 100, Columns: []string{"name"}})
+		return count, len(features), err
+	}
+	readStream := func() (int, int, error) {
+		numFeatures := 0
+		count, err := cat.TableFeaturesEachMatched(ctx, tbl.ID, &QueryParam{Crs: 4326, Precision: -1, Limit: 100, Columns: []string{"name"}},
+			func(feature string) error {
+				numFeatures++
+				return nil
+			})
+		return count, numFeatures, err
+	}
+	for _, isolation := range []string{"repeatable read", "read committed"} {
+		conf.Configuration().Database.ReadIsolation = isolation
+		//-- a timeout streams the features with a cursor
+		for _, timeout := range []string{"", "10s"} {
+			conf.Configuration().Database.IdleInTransactionTimeout = timeout
+			for name, read := range map[string]func() (int, int, error){"buffered": readBuffered, "stream": readStream} {
+				count, numFeatures, err := read()
+				if err != nil {
+					t.Fatalf("Error reading %v features (%v, timeout %q): %v", name, isolation, timeout, err)
+				}
+				expected := count
+				if isolation == "read committed" {
+					expected = count + 1
+				}
+				if numFeatures != expected {
+					t.Errorf("%v features (%v, timeout %q): read %v with numberMatched %v, expected %v",
+						name, isolation, timeout, numFeatures, count, expected)
+				}
+			}
+		}
+	}
+}
+
+// editTestTable creates a table whose triggers record the changes made to it,
+// and returns a function to drop it.
+// It requires a PostGIS database, given by the DATABASE_URL environment variable
+func editTestTable(t *testing.T) (*pgxpool.Pool, *catalogDB, *Table, func()) {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, dbURL)
+	if err != nil {
+		t.Fatalf("Error connecting to database: %v", err)
+	}
+	for _, sql := range []string{
+		"DROP TABLE IF EXISTS public.pgfs_test_edit, public.pgfs_test_edit_log",
+		"CREATE TABLE public.pgfs_test_edit_log (op text)",
+		"CREATE TABLE public.pgfs_test_edit (id integer PRIMARY KEY, name text, seq serial, geom geometry(Point, 4326))",
+		"INSERT INTO public.pgfs_test_edit (id, name, geom) SELECT i, 'a', ST_MakePoint(i, i) FROM generate_series(1, 3) AS i",
+		`CREATE OR REPLACE FUNCTION public.pgfs_test_edit_log() RETURNS trigger AS $$
+		BEGIN
+			INSERT INTO public.pgfs_test_edit_log VALUES (TG_OP);
+			RETURN COALESCE(NEW, OLD);
+		END $$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER pgfs_test_edit_log BEFORE INSERT OR UPDATE OR DELETE ON public.pgfs_test_edit
+			FOR EACH ROW EXECUTE PROCEDURE public.pgfs_test_edit_log()`,
+	} {
+		if _, err := pool.Exec(ctx, sql); err != nil {
+			pool.Close()
+			t.Fatalf("Error running %v: %v", sql, err)
+		}
+	}
+	drop := func() {
+		pool.Exec(ctx, "DROP TABLE public.pgfs_test_edit, public.pgfs_test_edit_log") //nolint:errcheck
+		pool.Exec(ctx, "DROP FUNCTION public.pgfs_test_edit_log()")                   //nolint:errcheck
+		pool.Close()
+	}
+	tbl := &Table{ID: "public.pgfs_test_edit", Schema: "public", Table: "pgfs_test_edit",
+		GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"},
+		Columns: []string{"id", "name", "seq"}, DbTypes: map[string]string{"id": "int4", "name": "text", "seq": "int4"}}
+	cat := &catalogDB{dbconn: pool, tableMap: map[string]*Table{tbl.ID: tbl}}
+	return pool, cat, tbl, drop
+}
+
+// checkEditTestTable checks the number of rows of the edit test table,
+// the number of changes recorded by its triggers, and the next value of its sequence
+func checkEditTestTable(t *testing.T, pool *pgxpool.Pool, numRows int, numChanges int, nextSeq int) {
+	var rows, changes, seq int
+	err := pool.QueryRow(context.Background(),
+		"SELECT (SELECT count(*) FROM public.pgfs_test_edit), (SELECT count(*) FROM public.pgfs_test_edit_log), "+
+			"(SELECT last_value + 1 FROM public.pgfs_test_edit_seq_seq)").Scan(&rows, &changes, &seq)
+	if err != nil {
+		t.Fatalf("Error reading edit test table: %v", err)
+	}
+	if rows != numRows || changes != numChanges || seq != nextSeq {
+		t.Errorf("Edit test table has %v rows, %v changes and next sequence %v, expected %v, %v and %v",
+			rows, changes, seq, numRows, numChanges, nextSeq)
+	}
+}
+
+// TestDeleteTableFeatureDryRun checks that a dry run of a deletion
+// only reads the table, so that triggers are not fired
+func TestDeleteTableFeatureDryRun(t *testing.T) {
+	pool, cat, tbl, drop := editTestTable(t)
+	defer drop()
+	ctx := context.Background()
+	for id, expected := range map[string]bool{"1": true, "99": false} {
+		isDeletable, err := cat.DeleteTableFeature(ctx, tbl.ID, id, true)
+		if err != nil {
+			t.Fatalf("Error checking deletion of feature %v: %v", id, err)
+		}
+		if isDeletable != expected {
+			t.Errorf("Dry run of deleting feature %v is %v, expected %v", id, isDeletable, expected)
+		}
+	}
+	checkEditTestTable(t, pool, 3, 0, 4)
+
+	isDeleted, err := cat.DeleteTableFeature(ctx, tbl.ID, "1", false)
+	if err != nil || !isDeleted {
+		t.Fatalf("Feature should be deleted: %v", err)
+	}
+	checkEditTestTable(t, pool, 2, 1, 4)
+}
+
+// TestUpsertTableFeaturesDryRun checks that a dry run of an upsert
+// only reads the table, and reports the counts of the upsert
+func TestUpsertTableFeaturesDryRun(t *testing.T) {
+	pool, cat, tbl, drop := editTestTable(t)
+	defer drop()
+	ctx := context.Background()
+	features := []*FeatureEdit{
+		{ID: "1", Properties: map[string]interface{}{"name": "b"}},
+		{ID: "5", Geometry: `{"type":"Point","coordinates":[5,5]}`},
+		{ID: "5", Properties: map[string]interface{}{"name": "c"}},
+	}
+	expected := &UpsertCounts{Inserted: 1, Updated: 2, Deleted: 2}
+	counts, err := cat.UpsertTableFeatures(ctx, tbl.ID, features, true, true)
+	if err != nil {
+		t.Fatalf("Error checking upsert: %v", err)
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Dry run of upsert counts %+v, expected %+v", counts, expected)
+	}
+	checkEditTestTable(t, pool, 3, 0, 4)
+
+	//-- invalid values are reported as for the upsert
+	invalid := []*FeatureEdit{{ID: "1", Properties: map[string]interface{}{"seq": "x"}}}
+	if _, err := cat.UpsertTableFeatures(ctx, tbl.ID, invalid, false, true); !IsInvalidDataError(err) {
+		t.Errorf("Dry run of upsert should report invalid value: %v", err)
+	}
+
+	counts, err = cat.UpsertTableFeatures(ctx, tbl.ID, features, true, false)
+	if err != nil {
+		t.Fatalf("Error running upsert: %v", err)
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Upsert counts %+v, expected %+v", counts, expected)
+	}
+}
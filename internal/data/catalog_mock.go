@@ -15,9 +15,16 @@ package data
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v4"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -25,6 +32,16 @@ type CatalogMock struct {
 	TableDefs    []*Table
 	tableData    map[string][]*featureMock
 	FunctionDefs []*Function
+	// PingErr is returned by Ping, to simulate database failure
+	PingErr error
+	// Pool is returned by PoolStats, to simulate a connection pool
+	Pool *PoolStats
+	// LastModified is returned by TableLastModified, to simulate a timestamp column
+	LastModified *time.Time
+	// BeforeFetch is called by TableFeaturesMatched and TableFeaturesEachMatched
+	// between the count and the features,
+	// to simulate a concurrent change
+	BeforeFetch func()
 }
 
 var instance CatalogMock
@@ -42,9 +59,9 @@ func newCatalogMock() CatalogMock {
 	propNames := []string{"prop_a", "prop_b", "prop_c", "prop_d"}
 	types := map[string]string{
 		"prop_a": "text",
-		"prop_b": "int",
+		"prop_b": "int4",
 		"prop_c": "text",
-		"prop_d": "int",
+		"prop_d": "int4",
 	}
 	jtypes := []string{"string", "number", "string", "number"}
 	colDesc := []string{"Property A", "Property B", "Property C", "Property D"}
@@ -55,6 +72,7 @@ func newCatalogMock() CatalogMock {
 		Description: "This dataset contains mock data about A (9 points)",
 		Extent:      Extent{Minx: -120, Miny: 40, Maxx: -74, Maxy: 50},
 		Srid:        4326,
+		IDColumns:   []string{"id"},
 		Columns:     propNames,
 		DbTypes:     types,
 		JSONTypes:   jtypes,
@@ -67,10 +85,13 @@ func newCatalogMock() CatalogMock {
 		Description: "This dataset contains mock data about B (100 points)",
 		Extent:      Extent{Minx: -75, Miny: 45, Maxx: -74, Maxy: 46},
 		Srid:        4326,
+		IDColumns:   []string{"id"},
 		Columns:     propNames,
 		DbTypes:     types,
 		JSONTypes:   jtypes,
 		ColDesc:     colDesc,
+		// mock B is editable, so it has a geometry column to write to
+		GeometryColumn: "geom",
 	}
 
 	layerC := &Table{
@@ -79,6 +100,7 @@ func newCatalogMock() CatalogMock {
 		Description: "This dataset contains mock data about C (10000 points)",
 		Extent:      Extent{Minx: -120, Miny: 40, Maxx: -74, Maxy: 60},
 		Srid:        4326,
+		IDColumns:   []string{"id"},
 		Columns:     propNames,
 		DbTypes:     types,
 		JSONTypes:   jtypes,
@@ -162,10 +184,35 @@ func newCatalogMock() CatalogMock {
 		GeometryColumn: "",
 		IDColumn:       "",
 	}
+	funRequired := &Function{
+		ID:          "fun_required",
+		Schema:      "postgisftw",
+		Name:        "fun_required",
+		Description: "Function with a required parameter",
+		InNames:     []string{"in_param1", "in_param2"},
+		InDbTypes:   []string{"int", "text"},
+		InTypeMap: map[string]string{
+			"in_param1": "int",
+			"in_param2": "text",
+		},
+		InDefaults:   []string{"", "aa"},
+		NumNoDefault: 1,
+		OutNames:     []string{"out_param1"},
+		OutDbTypes:   []string{"text"},
+		OutJSONTypes: []string{"string"},
+		Types: map[string]string{
+			"in_param1":  "int",
+			"in_param2":  "text",
+			"out_param1": "text",
+		},
+		GeometryColumn: "",
+		IDColumn:       "",
+	}
 	funDefs := []*Function{
 		funA,
 		funB,
 		funNoParam,
+		funRequired,
 	}
 	catMock := CatalogMock{
 		TableDefs:    tables,
@@ -183,11 +230,23 @@ func (cat *CatalogMock) Close() {
 	// this is a no-op
 }
 
+func (cat *CatalogMock) Ping(ctx context.Context) error {
+	return cat.PingErr
+}
+
+func (cat *CatalogMock) PoolStats() *PoolStats {
+	return cat.Pool
+}
+
 func (cat *CatalogMock) Tables() ([]*Table, error) {
 	return cat.TableDefs, nil
 }
 
-func (cat *CatalogMock) TableReload(name string) {
+func (cat *CatalogMock) TableReload(name string, force bool) {
+	// no-op for mock data
+}
+
+func (cat *CatalogMock) InvalidateTables() {
 	// no-op for mock data
 }
 
@@ -202,19 +261,57 @@ func (cat *CatalogMock) TableByName(name string) (*Table, error) {
 }
 
 func (cat *CatalogMock) TableFeatures(ctx context.Context, name string, param *QueryParam) ([]string, error) {
+	features, err := cat.tableFeatures(ctx, name, param)
+	if features == nil || param.Cluster != nil || param.Aggregate != nil {
+		return features, err
+	}
+	return truncateFeatures(features, name, param), err
+}
+
+// tableFeatures returns the features of a query, without truncating them,
+// since streamed features are not limited
+func (cat *CatalogMock) tableFeatures(ctx context.Context, name string, param *QueryParam) ([]string, error) {
 	features, ok := cat.tableData[name]
 	if !ok {
 		// table not found - indicated by nil value returned
 		return nil, nil
 	}
-	featFilt := doFilter(features, param.Filter)
+	return cat.featuresJSON(ctx, name, features, param), nil
+}
+
+// featuresJSON returns the JSON of the features of a query
+func (cat *CatalogMock) featuresJSON(ctx context.Context, name string, features []*featureMock, param *QueryParam) []string {
+	featFilt := doFilter(features, appendFilter(param.Filter, tenantFilterFrom(ctx)))
 	featuresLim := doLimit(featFilt, param.Limit, param.Offset)
+	if param.Cluster != nil {
+		return clustersToJSON(featuresLim)
+	}
+	if param.Aggregate != nil {
+		return []string{aggregateToJSON(featFilt, param.Aggregate.MaxFeatures)}
+	}
 	// handle empty property list
 	propNames := cat.TableDefs[0].Columns
-	if len(param.Columns) > 0 {
+	if param.Columns != nil {
 		propNames = param.Columns
 	}
-	return featuresToJSON(featuresLim, propNames), nil
+	tbl, _ := cat.TableByName(name)
+	return featuresToJSON(featuresLim, tbl, propNames, param)
+}
+
+func (cat *CatalogMock) TableFeaturesEach(ctx context.Context, name string, param *QueryParam, fn func(feature string) error) error {
+	features, err := cat.tableFeatures(ctx, name, param)
+	if err != nil {
+		return err
+	}
+	if features == nil {
+		return fmt.Errorf(errMsgTableNotFound, name)
+	}
+	for _, feature := range features {
+		if err := fn(feature); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (cat *CatalogMock) TableFeature(ctx context.Context, name string, id string, param *QueryParam) (string, error) {
@@ -223,23 +320,196 @@ func (cat *CatalogMock) TableFeature(ctx context.Context, name string, id string
 		// table not found - indicated by empty value returned
 		return "", nil
 	}
-	index, err := strconv.Atoi(id)
-	if err != nil {
-		// a malformed int is treated as feature not found
-		return "", nil
-	}
-
-	// TODO: return not found if index out of range
-	if index < 0 || index >= len(features) {
+	index := indexOfFeature(features, id)
+	if index < 0 || !isFilterMatches(features[index], appendFilter(nil, tenantFilterFrom(ctx))) {
 		return "", nil
 	}
 	// handle empty property list
 	propNames := cat.TableDefs[0].Columns
-	if len(param.Columns) > 0 {
+	if param.Columns != nil {
 		propNames = param.Columns
 	}
 
-	return features[index].toJSON(propNames), nil
+	tbl, _ := cat.TableByName(name)
+	return features[index].toJSON(tbl, propNames, param), nil
+}
+
+func (cat *CatalogMock) TableLastModified(ctx context.Context, name string, column string, param *QueryParam) (*time.Time, error) {
+	if _, ok := cat.tableData[name]; !ok {
+		return nil, fmt.Errorf(errMsgTableNotFound, name)
+	}
+	return cat.LastModified, nil
+}
+
+func (cat *CatalogMock) TableFeatureCount(ctx context.Context, name string, param *QueryParam) (int, error) {
+	features, ok := cat.tableData[name]
+	if !ok {
+		return 0, fmt.Errorf(errMsgTableNotFound, name)
+	}
+	return len(doFilter(features, appendFilter(param.Filter, tenantFilterFrom(ctx)))), nil
+}
+
+// TableFeaturesMatched reads the count and the features from the table data at the start,
+// as a repeatable read transaction does, so changes made by BeforeFetch are not seen.
+// With read committed isolation the features are read again after BeforeFetch
+func (cat *CatalogMock) TableFeaturesMatched(ctx context.Context, name string, param *QueryParam) ([]string, int, error) {
+	features, ok := cat.tableData[name]
+	if !ok {
+		return nil, 0, nil
+	}
+	count := len(doFilter(features, appendFilter(param.Filter, tenantFilterFrom(ctx))))
+	if cat.BeforeFetch != nil {
+		cat.BeforeFetch()
+	}
+	if readIsoLevel() == pgx.ReadCommitted {
+		features = cat.tableData[name]
+	}
+	return truncateFeatures(cat.featuresJSON(ctx, name, features, param), name, param), count, nil
+}
+
+// TableFeaturesEachMatched reads the count and the features as TableFeaturesMatched does,
+// but does not truncate the features, since they are streamed
+func (cat *CatalogMock) TableFeaturesEachMatched(ctx context.Context, name string, param *QueryParam, fn func(feature string) error) (int, error) {
+	features, ok := cat.tableData[name]
+	if !ok {
+		return 0, fmt.Errorf(errMsgTableNotFound, name)
+	}
+	count := len(doFilter(features, appendFilter(param.Filter, tenantFilterFrom(ctx))))
+	if cat.BeforeFetch != nil {
+		cat.BeforeFetch()
+	}
+	if readIsoLevel() == pgx.ReadCommitted {
+		features = cat.tableData[name]
+	}
+	for _, feature := range cat.featuresJSON(ctx, name, features, param) {
+		if err := fn(feature); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (cat *CatalogMock) TableEstimatedCounts(ctx context.Context, names []string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for _, name := range names {
+		if features, ok := cat.tableData[name]; ok {
+			counts[name] = int64(len(features))
+		}
+	}
+	return counts, nil
+}
+
+func (cat *CatalogMock) TableFacets(ctx context.Context, name string, column string, param *QueryParam) ([]*Facet, error) {
+	features, ok := cat.tableData[name]
+	if !ok {
+		return nil, fmt.Errorf(errMsgTableNotFound, name)
+	}
+	//-- as in the database, the query of a SQL collection requires its arguments
+	if tbl, _ := cat.TableByName(name); tbl != nil && len(param.SqlArgs) != len(tbl.SqlParameters) {
+		return nil, fmt.Errorf("SQL collection %v has %v parameters, but %v arguments", name, len(tbl.SqlParameters), len(param.SqlArgs))
+	}
+	counts := map[interface{}]int64{}
+	for _, feature := range doFilter(features, appendFilter(param.Filter, tenantFilterFrom(ctx))) {
+		val, err := feature.getProperty(column)
+		if err != nil {
+			return nil, err
+		}
+		counts[val]++
+	}
+	facets := []*Facet{}
+	for val, count := range counts {
+		facets = append(facets, &Facet{Value: val, Count: count})
+	}
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return fmt.Sprint(facets[i].Value) < fmt.Sprint(facets[j].Value)
+	})
+	if param.Limit > 0 && len(facets) > param.Limit {
+		facets = facets[:param.Limit]
+	}
+	return facets, nil
+}
+
+func (cat *CatalogMock) DeleteTableFeature(ctx context.Context, name string, id string, dryRun bool) (bool, error) {
+	features, ok := cat.tableData[name]
+	if !ok {
+		return false, nil
+	}
+	index := indexOfFeature(features, id)
+	if index < 0 || !isFilterMatches(features[index], appendFilter(nil, tenantFilterFrom(ctx))) {
+		return false, nil
+	}
+	if !dryRun {
+		cat.tableData[name] = append(features[:index:index], features[index+1:]...)
+	}
+	return true, nil
+}
+
+func (cat *CatalogMock) UpsertTableFeatures(ctx context.Context, name string, features []*FeatureEdit, replace bool, dryRun bool) (*UpsertCounts, error) {
+	tableFeatures, ok := cat.tableData[name]
+	if !ok {
+		return nil, nil
+	}
+	tenantFilter := appendFilter(nil, tenantFilterFrom(ctx))
+	//-- changes are made to copies, so they can be discarded
+	result := make([]*featureMock, len(tableFeatures))
+	for i, feat := range tableFeatures {
+		featCopy := *feat
+		result[i] = &featCopy
+	}
+	counts := &UpsertCounts{}
+	ids := make(map[string]bool)
+	for _, edit := range features {
+		ids[edit.ID] = true
+		feat := &featureMock{ID: edit.ID}
+		index := indexOfFeature(result, edit.ID)
+		if index >= 0 {
+			if !isFilterMatches(result[index], tenantFilter) {
+				continue
+			}
+			feat = result[index]
+		}
+		feat.Geom = edit.Geometry
+		for prop, val := range edit.Properties {
+			if err := feat.setProperty(prop, val); err != nil {
+				return nil, err
+			}
+		}
+		if index >= 0 {
+			counts.Updated++
+		} else {
+			result = append(result, feat)
+			counts.Inserted++
+		}
+	}
+	if replace {
+		var kept []*featureMock
+		for _, feat := range result {
+			if ids[feat.ID] || !isFilterMatches(feat, tenantFilter) {
+				kept = append(kept, feat)
+			} else {
+				counts.Deleted++
+			}
+		}
+		result = kept
+	}
+	if !dryRun {
+		cat.tableData[name] = result
+	}
+	return counts, nil
+}
+
+// indexOfFeature finds the index of the feature with given id
+// It returns -1 if not found
+func indexOfFeature(features []*featureMock, id string) int {
+	for i, feat := range features {
+		if feat.ID == id {
+			return i
+		}
+	}
+	return -1
 }
 
 func (cat *CatalogMock) Functions() ([]*Function, error) {
@@ -296,20 +566,110 @@ type featureMock struct {
 	PropB int
 	PropC string
 	PropD int
+	// GeomGML is the geometry as a JSON string containing GML
+	GeomGML string
+	// GeomWKT is the geometry as a JSON string containing WKT
+	GeomWKT string
+	// X and Y are the point coordinates, for WKB output and computed properties
+	X, Y float64
 }
 
 func makeFeatureMockPoint(id int, x float64, y float64) *featureMock {
 	geomFmt := `{"type": "Point","coordinates": [ %v, %v ]  }`
 	geomStr := fmt.Sprintf(geomFmt, x, y)
 
+	gmlFmt := `"<gml:Point srsName=\"EPSG:4326\"><gml:pos>%v %v</gml:pos></gml:Point>"`
+	gmlStr := fmt.Sprintf(gmlFmt, x, y)
+
+	wktStr := strconv.Quote(fmt.Sprintf("POINT(%v %v)", x, y))
+
 	idstr := strconv.Itoa(id)
-	feat := featureMock{idstr, geomStr, "propA", id, "propC", id % 10}
+	feat := featureMock{idstr, geomStr, "propA", id, "propC", id % 10, gmlStr, wktStr, x, y}
 	return &feat
 }
 
-func (fm *featureMock) toJSON(propNames []string) string {
-	props := fm.extractProperties(propNames)
-	return makeFeatureJSON(fm.ID, fm.Geom, props)
+func (fm *featureMock) toJSON(tbl *Table, propNames []string, param *QueryParam) string {
+	props := fm.extractProperties(removeComputed(propNames, param.Computed))
+	//-- properties are output with the aliases of their columns
+	for col, alias := range tbl.PropertyAliases {
+		if val, ok := props[col]; ok {
+			delete(props, col)
+			props[alias] = val
+		}
+	}
+	for _, comp := range param.Computed {
+		props[comp.Name] = fm.computedValue(comp)
+	}
+	geom := fm.Geom
+	round := newCoordRounding(param)
+	switch param.GeomFormat {
+	case GeomFormatGML:
+		geom = fm.GeomGML
+	case GeomFormatWKT:
+		geom = fm.GeomWKT
+	case GeomFormatWKBHex, GeomFormatEWKB:
+		geom = fm.geomWKBHex(param.GeomFormat == GeomFormatEWKB)
+	}
+	return makeFeatureJSON(fm.ID, round.apply(geom), props)
+}
+
+// removeComputed removes the names of computed properties from a list of property names
+func removeComputed(propNames []string, computed []ComputedProperty) []string {
+	if len(computed) == 0 {
+		return propNames
+	}
+	isComputed := make(map[string]bool)
+	for _, comp := range computed {
+		isComputed[comp.Name] = true
+	}
+	var names []string
+	for _, name := range propNames {
+		if !isComputed[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// computedValue is the value of a computed property of the point geometry.
+// The mock only computes the coordinates, and the area and length (which are zero)
+func (fm *featureMock) computedValue(comp ComputedProperty) interface{} {
+	switch strings.ToLower(comp.Function.Name) {
+	case "st_x":
+		return fm.X
+	case "st_y":
+		return fm.Y
+	case "st_area", "st_length", "st_perimeter":
+		return 0
+	}
+	return nil
+}
+
+// geomWKBHex is the point geometry as a JSON string containing hex-encoded
+// little-endian WKB, or EWKB with the SRID
+func (fm *featureMock) geomWKBHex(isEWKB bool) string {
+	buf := []byte{1}
+	if isEWKB {
+		buf = append(buf, 1, 0, 0, 0x20)
+		buf = appendUint32LE(buf, SRID_4326)
+	} else {
+		buf = append(buf, 1, 0, 0, 0)
+	}
+	buf = appendUint64LE(buf, math.Float64bits(fm.X))
+	buf = appendUint64LE(buf, math.Float64bits(fm.Y))
+	return strconv.Quote(hex.EncodeToString(buf))
+}
+
+func appendUint32LE(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint64LE(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
 }
 
 func (fm *featureMock) extractProperties(propNames []string) map[string]interface{} {
@@ -341,6 +701,30 @@ func (fm *featureMock) getProperty(name string) (interface{}, error) {
 	return nil, fmt.Errorf("Unknown property: %v", name)
 }
 
+// setProperty sets a property from a JSON value
+func (fm *featureMock) setProperty(name string, val interface{}) error {
+	text := fmt.Sprintf("%v", val)
+	switch name {
+	case "prop_a":
+		fm.PropA = text
+	case "prop_c":
+		fm.PropC = text
+	case "prop_b", "prop_d":
+		num, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("Invalid value for property %v: %v", name, val)
+		}
+		if name == "prop_b" {
+			fm.PropB = num
+		} else {
+			fm.PropD = num
+		}
+	default:
+		return fmt.Errorf("Unknown property: %v", name)
+	}
+	return nil
+}
+
 func doFilter(features []*featureMock, filter []*PropertyFilter) []*featureMock {
 	var result []*featureMock
 	for _, feat := range features {
@@ -376,11 +760,36 @@ func doLimit(features []*featureMock, limit int, offset int) []*featureMock {
 	return features[start:end]
 }
 
-func featuresToJSON(features []*featureMock, propNames []string) []string {
+// aggregateToJSON outputs the features as a single feature
+// with a MultiPoint geometry and the count of features aggregated
+func aggregateToJSON(features []*featureMock, maxFeatures int) string {
+	if maxFeatures > 0 && len(features) > maxFeatures {
+		features = features[:maxFeatures]
+	}
+	coords := make([]string, len(features))
+	for i, feature := range features {
+		coords[i] = fmt.Sprintf("[%v,%v]", feature.X, feature.Y)
+	}
+	geom := fmt.Sprintf(`{"type": "MultiPoint","coordinates": [%v]}`, strings.Join(coords, ","))
+	props := map[string]interface{}{ClusterCountColumn: len(features)}
+	return makeFeatureJSON("", geom, props)
+}
+
+// clustersToJSON outputs each feature as a cluster of one feature
+func clustersToJSON(features []*featureMock) []string {
+	clusters := make([]string, len(features))
+	for i, feature := range features {
+		props := map[string]interface{}{ClusterCountColumn: 1}
+		clusters[i] = makeFeatureJSON("", feature.Geom, props)
+	}
+	return clusters
+}
+
+func featuresToJSON(features []*featureMock, tbl *Table, propNames []string, param *QueryParam) []string {
 	n := len(features)
 	featJSON := make([]string, n)
 	for i := 0; i < n; i++ {
-		featJSON[i] = features[i].toJSON(propNames)
+		featJSON[i] = features[i].toJSON(tbl, propNames, param)
 	}
 	return featJSON
 }
@@ -2,6 +2,7 @@ package data
 
 import (
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -23,6 +24,15 @@ import (
 
 const forceTextTSVECTOR = "tsvector"
 
+// pgTimeTypes are the date and time types, which are written as ISO 8601 strings
+var pgTimeTypes = map[string]bool{
+	"timestamp":   true,
+	"timestamptz": true,
+	"date":        true,
+	"time":        true,
+	"timetz":      true,
+}
+
 const sqlTables = `SELECT
 	Format('%s.%s', n.nspname, c.relname) AS id,
 	n.nspname AS schema,
@@ -31,7 +41,20 @@ const sqlTables = `SELECT
 	a.attname AS geometry_column,
 	postgis_typmod_srid(a.atttypmod) AS srid,
 	postgis_typmod_type(a.atttypmod) AS geometry_type,
-	coalesce(ia.attname, '') AS id_column,
+	coalesce((
+		SELECT array_agg(ka.attname::text ORDER BY array_position(i.indkey::int2[], ka.attnum))
+		FROM pg_index i
+		JOIN pg_attribute ka ON (ka.attrelid = c.oid AND ka.attnum = ANY(i.indkey))
+		WHERE i.indrelid = c.oid AND i.indisprimary
+	), ARRAY[]::text[]) AS id_columns,
+	coalesce((
+		SELECT array_agg(ua.attname::text)
+		FROM pg_index ui
+		JOIN pg_attribute ua ON (ua.attrelid = c.oid AND ua.attnum = ui.indkey[0])
+		WHERE ui.indrelid = c.oid AND ui.indisunique AND ui.indnatts = 1
+		AND ui.indpred IS NULL AND ui.indexprs IS NULL
+	), ARRAY[]::text[]) AS unique_columns,
+	c.relkind IN ('v', 'm') AS is_view,
 	(
 		SELECT array_agg(ARRAY[sa.attname, st.typname, coalesce(da.description,''), sa.attnum::text]::text[] ORDER BY sa.attnum)
 		FROM pg_attribute sa
@@ -47,16 +70,23 @@ JOIN pg_namespace n ON (c.relnamespace = n.oid)
 JOIN pg_attribute a ON (a.attrelid = c.oid)
 JOIN pg_type t ON (a.atttypid = t.oid)
 LEFT JOIN pg_description d ON (c.oid = d.objoid AND d.objsubid = 0)
-LEFT JOIN pg_index i ON (c.oid = i.indrelid AND i.indisprimary
-AND i.indnatts = 1)
-LEFT JOIN pg_attribute ia ON (ia.attrelid = i.indexrelid)
-LEFT JOIN pg_type it ON (ia.atttypid = it.oid AND it.typname in ('int2', 'int4', 'int8'))
 WHERE c.relkind IN ('r', 'v', 'm', 'p', 'f')
 AND t.typname IN ('geometry', 'geography')
 AND has_table_privilege(c.oid, 'select')
 AND postgis_typmod_srid(a.atttypmod) > 0
 ORDER BY id
 `
+
+// sqlTableEstimatedCounts is the number of rows of tables estimated by the planner statistics.
+// Tables which have never been analyzed have reltuples -1 (in Postgres 14 and later),
+// and are omitted
+const sqlTableEstimatedCounts = `SELECT n.nspname, c.relname, c.reltuples::bigint
+FROM pg_class c
+JOIN pg_namespace n ON (c.relnamespace = n.oid)
+WHERE (n.nspname, c.relname) IN (SELECT * FROM unnest($1::text[], $2::text[]))
+AND c.reltuples >= 0
+`
+
 const sqlFunctionsTemplate = `WITH
 proargs AS (
 	SELECT p.oid,
@@ -112,46 +142,303 @@ func quotedList(names []string) string {
 //const sqlFmtExtentEst = `WITH ext AS (SELECT ST_Transform(ST_SetSRID(ST_EstimatedExtent('%s', '%s', '%s'), %d), 4326) AS geom)
 //      SELECT ST_XMin(ext.geom) AS xmin, ST_YMin(ext.geom) AS ymin, ST_XMax(ext.geom) AS xmax, ST_YMax(ext.geom) AS ymax FROM ext;`
 
-const sqlFmtExtentEst = `SELECT ST_XMin(ext.geom) AS xmin, ST_YMin(ext.geom) AS ymin, ST_XMax(ext.geom) AS xmax, ST_YMax(ext.geom) AS ymax
-FROM ( SELECT ST_Transform(ST_SetSRID(ST_EstimatedExtent('%s', '%s', '%s'), %d), 4326) AS geom ) AS ext;`
+// The extent queries provide the extent in 4326, and in the storage coordinate system
+const sqlFmtExtentEst = `SELECT ST_XMin(ext.geom) AS xmin, ST_YMin(ext.geom) AS ymin, ST_XMax(ext.geom) AS xmax, ST_YMax(ext.geom) AS ymax,
+ST_XMin(ext.native) AS native_xmin, ST_YMin(ext.native) AS native_ymin, ST_XMax(ext.native) AS native_xmax, ST_YMax(ext.native) AS native_ymax
+FROM ( SELECT ST_Transform(ST_SetSRID(est.box, %d), 4326) AS geom, est.box AS native
+FROM ( SELECT ST_EstimatedExtent('%s', '%s', '%s') AS box ) AS est ) AS ext;`
 
 func sqlExtentEstimated(tbl *Table) string {
-	return fmt.Sprintf(sqlFmtExtentEst, tbl.Schema, tbl.Table, tbl.GeometryColumn, tbl.Srid)
+	return fmt.Sprintf(sqlFmtExtentEst, tbl.Srid, tbl.Schema, tbl.Table, tbl.GeometryColumn)
 }
 
-const sqlFmtExtentExact = `SELECT ST_XMin(ext.geom) AS xmin, ST_YMin(ext.geom) AS ymin, ST_XMax(ext.geom) AS xmax, ST_YMax(ext.geom) AS ymax
-FROM (SELECT coalesce( ST_Transform(ST_SetSRID(ST_Extent("%s"), %d), 4326),	ST_MakeEnvelope(-180, -90, 180, 90, 4326)) AS geom FROM "%s"."%s" ) AS ext;`
+const sqlFmtExtentExact = `SELECT ST_XMin(ext.geom) AS xmin, ST_YMin(ext.geom) AS ymin, ST_XMax(ext.geom) AS xmax, ST_YMax(ext.geom) AS ymax,
+ST_XMin(ext.native) AS native_xmin, ST_YMin(ext.native) AS native_ymin, ST_XMax(ext.native) AS native_xmax, ST_YMax(ext.native) AS native_ymax
+FROM (SELECT coalesce( ST_Transform(ST_SetSRID(box.box, %d), 4326),	ST_MakeEnvelope(-180, -90, 180, 90, 4326)) AS geom, box.box AS native
+FROM (SELECT ST_Extent("%s") AS box FROM "%s"."%s") AS box ) AS ext;`
 
 func sqlExtentExact(tbl *Table) string {
-	return fmt.Sprintf(sqlFmtExtentExact, tbl.GeometryColumn, tbl.Srid, tbl.Schema, tbl.Table)
+	return fmt.Sprintf(sqlFmtExtentExact, tbl.Srid, tbl.GeometryColumn, tbl.Schema, tbl.Table)
 }
 
-const sqlFmtFeatures = "SELECT %v %v FROM \"%s\".\"%s\" %v %v %v %s;"
+const sqlFmtFeatures = "SELECT %v%v %v FROM %v %v %v %v %s;"
 
-func sqlFeatures(tbl *Table, param *QueryParam) (string, []interface{}) {
+func sqlFeatures(tbl *Table, param *QueryParam, tenant *PropertyFilter) (string, []interface{}) {
+	if param.Cluster != nil {
+		return sqlClusterFeatures(tbl, param, tenant)
+	}
+	if param.Aggregate != nil {
+		return sqlAggregateFeatures(tbl, param, tenant)
+	}
 	geomCol := sqlGeomCol(tbl.GeometryColumn, tbl.Srid, param)
-	propCols := sqlColList(param.Columns, tbl.DbTypes, true)
-	bboxFilter := sqlBBoxFilter(tbl.GeometryColumn, tbl.Srid, param.Bbox, param.BboxCrs)
-	attrFilter, attrVals := sqlAttrFilter(param.Filter)
-	cqlFilter := sqlCqlFilter(param.FilterSql)
-	sqlWhere := sqlWhere(bboxFilter, attrFilter, cqlFilter)
+	propCols := sqlPropCols(tbl, param) + sqlGeomOmittedCol(tbl.GeometryColumn, param)
+	if isRowIDSynthesized(tbl, param) {
+		propCols += ", " + sqlRowIDColFor(tbl)
+	}
+	sqlFrom, sqlWhere, attrVals := sqlFeaturesSource(tbl, param, tenant)
+	sqlFrom += sqlGeomLimitFrom(tbl.GeometryColumn, param)
 	sqlGroupBy := sqlGroupBy(param.GroupBy)
-	sqlOrderBy := sqlOrderBy(param.SortBy)
+	sqlOrderBy := sqlOrderBy(param.SortBy, tbl.GeometryColumn, tbl.Srid)
+	if len(param.SortBy) == 0 {
+		sqlOrderBy = sqlDefaultOrderBy(param.DefaultOrder)
+	} else if tiebreaker := sqlOrderByTiebreaker(param.SortBy, param.DefaultOrder); tiebreaker != "" {
+		sqlOrderBy = strings.TrimRight(sqlOrderBy, " ") + tiebreaker
+	}
 	sqlLimitOffset := sqlLimitOffset(param.Limit, param.Offset)
-	sql := fmt.Sprintf(sqlFmtFeatures, geomCol, propCols, tbl.Schema, tbl.Table, sqlWhere, sqlGroupBy, sqlOrderBy, sqlLimitOffset)
+	sqlDistinct := ""
+	if param.Distinct {
+		sqlDistinct = "DISTINCT "
+		geomCol = sqlNullGeomCol(param)
+	}
+	sql := fmt.Sprintf(sqlFmtFeatures, sqlDistinct, geomCol, propCols, sqlFrom, sqlWhere, sqlGroupBy, sqlOrderBy, sqlLimitOffset)
 	return sql, attrVals
 }
 
+const sqlFmtClusterFeatures = `SELECT %v, count(*) AS "%v" FROM (SELECT "%v" AS _geom, ST_ClusterDBSCAN("%v", %v, %v) OVER () AS _cluster_id, row_number() OVER () AS _row_num FROM %v %v) AS _clusters GROUP BY COALESCE(_cluster_id, -_row_num) %v %s;`
+
+// sqlClusterFeatures clusters the features selected by the filters.
+// Features which are not in a cluster (noise) are grouped by their row number,
+// so that they are output as clusters of one feature
+func sqlClusterFeatures(tbl *Table, param *QueryParam, tenant *PropertyFilter) (string, []interface{}) {
+	geomCol := sqlGeomExprCol("ST_Centroid(ST_Collect(_geom))", tbl.Srid, param)
+	sqlFrom, sqlWhere, attrVals := sqlFeaturesSource(tbl, param, tenant)
+	sqlOrderBy := sqlOrderBy(param.SortBy, "", SRID_UNKNOWN)
+	sqlLimitOffset := sqlLimitOffset(param.Limit, param.Offset)
+	distance := strconv.FormatFloat(param.Cluster.Distance, 'f', -1, 64)
+	sql := fmt.Sprintf(sqlFmtClusterFeatures, geomCol, ClusterCountColumn, tbl.GeometryColumn, tbl.GeometryColumn, distance, param.Cluster.MinPoints, sqlFrom, sqlWhere, sqlOrderBy, sqlLimitOffset)
+	return sql, attrVals
+}
+
+const sqlFmtAggregateFeatures = `SELECT %v, count(*) AS "%v" FROM (SELECT %v AS _geom FROM %v %v %v) AS _aggregate;`
+
+// sqlAggregateFeatures aggregates the geometry of the features selected by the filters
+// into a single feature.
+// The input features are limited to the aggregate MaxFeatures, to bound the memory used
+func sqlAggregateFeatures(tbl *Table, param *QueryParam, tenant *PropertyFilter) (string, []interface{}) {
+	geomCol := sqlGeomExprCol(fmt.Sprintf("%v(_geom)", param.Aggregate.Function), tbl.Srid, param)
+	sqlFrom, sqlWhere, attrVals := sqlFeaturesSource(tbl, param, tenant)
+	sqlLimit := ""
+	if param.Aggregate.MaxFeatures > 0 {
+		sqlLimit = fmt.Sprintf("LIMIT %v", param.Aggregate.MaxFeatures)
+	}
+	sql := fmt.Sprintf(sqlFmtAggregateFeatures, geomCol, ClusterCountColumn, sqlGeomSource(tbl.GeometryColumn, param), sqlFrom, sqlWhere, sqlLimit)
+	return sql, attrVals
+}
+
+const sqlFmtLastModified = `SELECT max("%v")::timestamptz FROM %v %v;`
+
+// sqlLastModified queries the latest value of a timestamp column
+// for the rows selected by the features query filters
+func sqlLastModified(tbl *Table, column string, param *QueryParam, tenant *PropertyFilter) (string, []interface{}) {
+	sqlFrom, sqlWhere, attrVals := sqlFeaturesSource(tbl, param, tenant)
+	sql := fmt.Sprintf(sqlFmtLastModified, column, sqlFrom, sqlWhere)
+	return sql, attrVals
+}
+
+const sqlFmtFeatureCount = `SELECT count(*) FROM %v %v;`
+
+// sqlFeatureCount queries the number of rows selected by the features query filters
+func sqlFeatureCount(tbl *Table, param *QueryParam, tenant *PropertyFilter) (string, []interface{}) {
+	sqlFrom, sqlWhere, attrVals := sqlFeaturesSource(tbl, param, tenant)
+	sql := fmt.Sprintf(sqlFmtFeatureCount, sqlFrom, sqlWhere)
+	return sql, attrVals
+}
+
+const sqlFmtFacets = `SELECT "%v", count(*) FROM %v %v GROUP BY 1 ORDER BY 2 DESC, 1%v;`
+
+// sqlFacets queries the distinct values of a column and their feature counts
+// for the rows selected by the features query filters.
+// Values with equal counts are ordered by value, so the values returned are deterministic
+func sqlFacets(tbl *Table, column string, param *QueryParam, tenant *PropertyFilter) (string, []interface{}) {
+	sqlFrom, sqlWhere, attrVals := sqlFeaturesSource(tbl, param, tenant)
+	sql := fmt.Sprintf(sqlFmtFacets, column, sqlFrom, sqlWhere, sqlLimitOffset(param.Limit, 0))
+	return sql, attrVals
+}
+
+const sqlFmtInvalidCount = `SELECT count(*) FROM %v%v;`
+
+// sqlInvalidCount queries the number of rows selected by the features query filters
+// which have invalid geometry
+func sqlInvalidCount(tbl *Table, param *QueryParam, tenant *PropertyFilter) (string, []interface{}) {
+	sqlFrom, sqlWhere, attrVals := sqlFeaturesSource(tbl, param, tenant)
+	invalidCond := fmt.Sprintf("NOT ST_IsValid(%v)", strconv.Quote(tbl.GeometryColumn))
+	if sqlWhere == "" {
+		sqlWhere = " WHERE " + invalidCond
+	} else {
+		sqlWhere += " AND " + invalidCond
+	}
+	sql := fmt.Sprintf(sqlFmtInvalidCount, sqlFrom, sqlWhere)
+	return sql, attrVals
+}
+
+// sqlFeaturesSource is the FROM source and the WHERE clause for the filters
+// of a features query, with the SQL arg values for them.
+// Views and SQL collections cannot use TABLESAMPLE, so they are sampled by a filter
+func sqlFeaturesSource(tbl *Table, param *QueryParam, tenant *PropertyFilter) (string, string, []interface{}) {
+	bboxFilter := sqlBBoxFilter(tbl.GeometryColumn, tbl.Srid, param.Bbox.Expand(param.BboxBuffer), param.BboxCrs)
+	attrFilter, attrVals := sqlAttrFilter(appendFilter(param.Filter, tenant), sqlCqlArgs(param))
+	geomFilter, attrVals := sqlGeomFilter(tbl.GeometryColumn, tbl.Srid, param.FilterGeom, attrVals)
+	var timeFilter string
+	if param.TimeEndColumn != "" {
+		timeFilter, attrVals = sqlTimeRangeFilter(param.TimeColumn, param.TimeEndColumn, param.Datetime, attrVals)
+	} else {
+		timeFilter, attrVals = sqlTimeFilter(param.TimeColumn, param.Datetime, attrVals)
+	}
+	cqlFilter := sqlCqlFilter(param.FilterSql)
+	validFilter := sqlValidFilter(tbl.GeometryColumn, param)
+	emptyFilter := sqlEmptyFilter(tbl.GeometryColumn, param)
+	geomTypeFilter := sqlGeomTypeFilter(tbl.GeometryColumn, param.GeomType)
+	sampleFilter := ""
+	sqlSample := ""
+	if tbl.Sql != "" || tbl.IsView {
+		sampleFilter = sqlSampleFilter(param.Sample)
+	} else {
+		sqlSample = sqlTableSample(param.Sample)
+	}
+	//-- the conditions which can use an index (spatial, then temporal and attribute)
+	//-- are first, and the conditions computed from the geometry of each row are last.
+	//-- Postgres orders conditions by their estimated cost, so this is mainly for equal costs
+	sqlWhere := sqlWhere(bboxFilter, geomFilter, timeFilter, attrFilter, cqlFilter, geomTypeFilter, validFilter, emptyFilter, sampleFilter)
+	sqlFrom := sqlTableFrom(tbl, len(attrVals)) + sqlSample
+	return sqlFrom, sqlWhere, append(attrVals, param.SqlArgs...)
+}
+
+// sqlTableFrom is the FROM source for a table.
+// A SQL collection is a subselect of its query,
+// with the parameters bound to the SQL args following the given number of args
+func sqlTableFrom(tbl *Table, numArgs int) string {
+	if tbl.Sql == "" {
+		return fmt.Sprintf(`"%s"."%s"`, tbl.Schema, tbl.Table)
+	}
+	sql := sqlBindParameters(tbl.Sql, tbl.SqlParameters, func(i int, p SqlParameter) string {
+		return fmt.Sprintf("$%v::%v", numArgs+i+1, sqlParamTypes[p.Type])
+	})
+	return fmt.Sprintf("(%v) AS _sql", sql)
+}
+
+// sqlParamTypes are the Postgres types of the SQL collection parameter types
+var sqlParamTypes = map[string]string{
+	SqlParamTypeText:      "text",
+	SqlParamTypeInt:       "bigint",
+	SqlParamTypeFloat:     "double precision",
+	SqlParamTypeBool:      "boolean",
+	SqlParamTypeDate:      "date",
+	SqlParamTypeTimestamp: "timestamptz",
+}
+
+// reSqlPlaceholder matches a :name placeholder, but not a :: cast
+var reSqlPlaceholder = regexp.MustCompile(`(^|[^:]):([A-Za-z_][A-Za-z0-9_]*)`)
+
+// sqlBindParameters replaces the placeholders for parameters in a query.
+// Placeholders which are not the name of a parameter are left unchanged
+func sqlBindParameters(sql string, params []SqlParameter, bind func(i int, p SqlParameter) string) string {
+	index := make(map[string]int)
+	for i, p := range params {
+		index[p.Name] = i
+	}
+	return reSqlPlaceholder.ReplaceAllStringFunc(sql, func(match string) string {
+		sub := reSqlPlaceholder.FindStringSubmatch(match)
+		i, ok := index[sub[2]]
+		if !ok {
+			return match
+		}
+		return sub[1] + bind(i, params[i])
+	})
+}
+
+const sqlFmtDescribeSqlCollection = `SELECT * FROM (%v) AS _sql LIMIT 0`
+
+// sqlDescribeSqlCollection queries no rows of a SQL collection query,
+// to provide its columns
+func sqlDescribeSqlCollection(tbl *Table) string {
+	sql := sqlBindParameters(tbl.Sql, tbl.SqlParameters, func(i int, p SqlParameter) string {
+		return "NULL::" + sqlParamTypes[p.Type]
+	})
+	return fmt.Sprintf(sqlFmtDescribeSqlCollection, sql)
+}
+
+const sqlFmtSampleFilter = ` random() < %v `
+
+// sqlSampleFilter samples a percentage of the rows.
+// It is equivalent to TABLESAMPLE BERNOULLI, for sources which do not support it
+func sqlSampleFilter(pct float64) string {
+	if pct <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(sqlFmtSampleFilter, strconv.FormatFloat(pct/100, 'f', -1, 64))
+}
+
+const sqlFmtTableSample = " TABLESAMPLE BERNOULLI (%v)"
+
+// sqlTableSample samples a percentage of the table rows.
+// Sampling is done before the WHERE clause filters are applied
+func sqlTableSample(pct float64) string {
+	if pct <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(sqlFmtTableSample, strconv.FormatFloat(pct, 'f', -1, 64))
+}
+
+// sqlRowIDCol is the column used to synthesize feature ids for tables with no primary key
+const sqlRowIDCol = "ctid::text AS _row_id"
+
+// sqlRowNumberIDCol synthesizes feature ids for views and SQL collections, which have no ctid.
+// The row number identifies a feature only within a response
+const sqlRowNumberIDCol = "(row_number() OVER ())::text AS _row_id"
+
+// sqlRowIDColFor is the synthesized row id column for a table
+func sqlRowIDColFor(tbl *Table) string {
+	if tbl.IsView || tbl.Sql != "" {
+		return sqlRowNumberIDCol
+	}
+	return sqlRowIDCol
+}
+
+// isRowIDSynthesized indicates whether a features query provides a synthesized row id.
+// Grouped, distinct, clustered and aggregated queries do not have a row identity, so no id is provided for them
+func isRowIDSynthesized(tbl *Table, param *QueryParam) bool {
+	return !tbl.SupportsFeatureID() && len(param.GroupBy) == 0 && !param.Distinct && param.Cluster == nil && param.Aggregate == nil
+}
+
+// sqlPropCols is the list of the property columns of a features query,
+// with a leading comma.
+// Computed properties are selected by their expression
+func sqlPropCols(tbl *Table, param *QueryParam) string {
+	if len(param.Computed) == 0 {
+		return sqlColList(param.Columns, tbl.DbTypes, param.PropPrecision, true)
+	}
+	computed := make(map[string]*ComputedProperty)
+	for i := range param.Computed {
+		computed[param.Computed[i].Name] = &param.Computed[i]
+	}
+	var cols []string
+	for _, name := range param.Columns {
+		if comp, ok := computed[name]; ok {
+			cols = append(cols, comp.sqlExpr())
+		} else {
+			cols = append(cols, sqlColList([]string{name}, tbl.DbTypes, param.PropPrecision, false))
+		}
+	}
+	return ", " + strings.Join(cols, ",")
+}
+
 // sqlColList creates a comma-separated column list, or blank if no columns
 // If addLeadingComma is true, a leading comma is added, for use when the target SQL has columns defined before
-func sqlColList(names []string, dbtypes map[string]string, addLeadingComma bool) string {
+func sqlColList(names []string, dbtypes map[string]string, precision int, addLeadingComma bool) string {
 	if len(names) == 0 {
 		return ""
 	}
 
 	var cols []string
 	for _, col := range names {
-		colExpr := sqlColExpr(col, dbtypes[col])
+		dbtype, isCol := dbtypes[col]
+		colExpr := sqlColExpr(col, dbtype)
+		if precision >= 0 && isRoundableType(dbtype) {
+			colExpr = sqlRoundExpr(col, dbtype, precision)
+		}
+		if !isCol && strings.Contains(col, PropertyPathSeparator) {
+			colExpr = sqlPropertyPathExpr(col)
+		}
 		cols = append(cols, colExpr)
 	}
 	colsStr := strings.Join(cols, ",")
@@ -161,6 +448,42 @@ func sqlColList(names []string, dbtypes map[string]string, addLeadingComma bool)
 	return colsStr
 }
 
+// sqlPropertyPathExpr creates an expression extracting the text value of a key in a JSON column,
+// aliased to the path (since the key name may occur in more than one path)
+func sqlPropertyPathExpr(path string) string {
+	return fmt.Sprintf("%s AS %s", sqlPropertyPathValue(path), strconv.Quote(path))
+}
+
+// sqlPropertyPathValue creates an expression extracting the text value of a key in a JSON column
+func sqlPropertyPathValue(path string) string {
+	colName, keys := SplitPropertyPath(path)
+	expr := strconv.Quote(colName)
+	for i, key := range keys {
+		op := "->"
+		if i == len(keys)-1 {
+			op = "->>"
+		}
+		expr += op + "'" + strings.Replace(key, "'", "''", -1) + "'"
+	}
+	return expr
+}
+
+// sqlRoundExpr rounds a column to a number of decimal places.
+// Rounding is done as numeric, so floating point values are cast back to their type,
+// to write them as JSON numbers rather than numeric values (which may be strings)
+func sqlRoundExpr(col string, dbtype string, precision int) string {
+	expr := fmt.Sprintf("round(%s::numeric, %v)", strconv.Quote(col), precision)
+	if dbtype == PGTypeNumeric {
+		return expr
+	}
+	return fmt.Sprintf("%s::%s", expr, dbtype)
+}
+
+// isRoundableType tests if a column type has values which can be rounded to a precision
+func isRoundableType(dbtype string) bool {
+	return strings.HasPrefix(dbtype, "float") || dbtype == PGTypeNumeric
+}
+
 // makeSQLColExpr casts a column to text if type is unknown to PGX
 func sqlColExpr(name string, dbtype string) string {
 
@@ -172,6 +495,12 @@ func sqlColExpr(name string, dbtype string) string {
 		return fmt.Sprintf("%s::text", name)
 	}
 
+	// the JSON encoding of a time value is in ISO 8601 format,
+	// whereas the text encoding depends on the session DateStyle
+	if pgTimeTypes[dbtype] {
+		return fmt.Sprintf("to_json(%s) #>> '{}' AS %s", name, name)
+	}
+
 	// for properties that will be treated as a string in the JSON response,
 	// cast to text.  This allows displaying data types that pgx
 	// does not support out of the box, as long as it can be cast to text.
@@ -182,15 +511,198 @@ func sqlColExpr(name string, dbtype string) string {
 	return name
 }
 
-const sqlFmtFeature = "SELECT %v %v FROM \"%s\".\"%s\" WHERE \"%v\" = $1 LIMIT 1"
+const sqlFmtFeature = "SELECT %v %v FROM %v WHERE %v LIMIT 1"
 
-func sqlFeature(tbl *Table, param *QueryParam) string {
+// sqlFeature queries a feature by id.
+// The id values and tenant are the first SQL args, followed by the SqlArgs
+func sqlFeature(tbl *Table, param *QueryParam, tenant *PropertyFilter) string {
 	geomCol := sqlGeomCol(tbl.GeometryColumn, tbl.Srid, param)
-	propCols := sqlColList(param.Columns, tbl.DbTypes, true)
-	sql := fmt.Sprintf(sqlFmtFeature, geomCol, propCols, tbl.Schema, tbl.Table, tbl.IDColumn)
+	propCols := sqlPropCols(tbl, param) + sqlGeomOmittedCol(tbl.GeometryColumn, param)
+	numArgs := len(tbl.IDColumns)
+	if tenant != nil {
+		numArgs++
+	}
+	sqlFrom := sqlTableFrom(tbl, numArgs) + sqlGeomLimitFrom(tbl.GeometryColumn, param)
+	sql := fmt.Sprintf(sqlFmtFeature, geomCol, propCols, sqlFrom, sqlFeatureCondition(tbl, tenant))
 	return sql
 }
 
+const sqlFmtDeleteFeature = "DELETE FROM \"%s\".\"%s\" WHERE %v"
+
+func sqlDeleteFeature(tbl *Table, tenant *PropertyFilter) string {
+	return fmt.Sprintf(sqlFmtDeleteFeature, tbl.Schema, tbl.Table, sqlFeatureCondition(tbl, tenant))
+}
+
+const sqlFmtFeatureExists = "SELECT EXISTS (SELECT 1 FROM \"%s\".\"%s\" WHERE %v)"
+
+// sqlFeatureExists creates a query testing whether a feature exists,
+// with the same SQL args as sqlDeleteFeature
+func sqlFeatureExists(tbl *Table, tenant *PropertyFilter) string {
+	return fmt.Sprintf(sqlFmtFeatureExists, tbl.Schema, tbl.Table, sqlFeatureCondition(tbl, tenant))
+}
+
+// sqlTablePrivileges creates a query testing whether the current user
+// has all the given privileges on the table named by SQL arg $1
+func sqlTablePrivileges(privileges ...string) string {
+	conds := make([]string, len(privileges))
+	for i, priv := range privileges {
+		conds[i] = fmt.Sprintf("has_table_privilege($1::text, '%v')", priv)
+	}
+	return "SELECT " + strings.Join(conds, " AND ")
+}
+
+// sqlTableName is the qualified name of a table, as a SQL arg value
+func sqlTableName(tbl *Table) string {
+	return strconv.Quote(tbl.Schema) + "." + strconv.Quote(tbl.Table)
+}
+
+// sqlUpsertFeature creates a statement to insert a feature, or update it if its key exists.
+// The column values are populated from the JSON record in SQL arg $1,
+// so they are converted to the column types by the database.
+// The GeoJSON geometry (if written) is SQL arg $2.
+// An update is restricted to the tenant, whose value is the following SQL arg.
+// The statement returns true if the feature was inserted
+func sqlUpsertFeature(tbl *Table, cols []string, hasGeom bool, tenant *PropertyFilter) string {
+	var colNames, vals, sets []string
+	for _, col := range cols {
+		colNames = append(colNames, strconv.Quote(col))
+		vals = append(vals, "r."+strconv.Quote(col))
+	}
+	argIndex := 2
+	if hasGeom {
+		geomCol := strconv.Quote(tbl.GeometryColumn)
+		colNames = append(colNames, geomCol)
+		vals = append(vals, sqlUpsertGeom(tbl))
+		argIndex++
+	}
+	for _, col := range colNames {
+		sets = append(sets, fmt.Sprintf("%v = EXCLUDED.%v", col, col))
+	}
+	sql := fmt.Sprintf("INSERT INTO \"%s\".\"%s\" (%v) SELECT %v FROM json_populate_record(NULL::\"%s\".\"%s\", $1::json) r ON CONFLICT (%v) DO UPDATE SET %v",
+		tbl.Schema, tbl.Table, strings.Join(colNames, ", "), strings.Join(vals, ", "),
+		tbl.Schema, tbl.Table, sqlQuotedList(tbl.IDColumns), strings.Join(sets, ", "))
+	if tenant != nil {
+		sql += fmt.Sprintf(" WHERE \"%s\".\"%s\".\"%v\" = $%v", tbl.Schema, tbl.Table, tenant.Name, argIndex)
+	}
+	return sql + " RETURNING (xmax = 0) AS inserted"
+}
+
+// sqlUpsertGeom is the geometry of an upserted feature,
+// converted from the GeoJSON in SQL arg $2
+func sqlUpsertGeom(tbl *Table) string {
+	return transformToOutCrs("ST_SetSRID(ST_GeomFromGeoJSON($2::text), 4326)", SRID_4326, tbl.Srid)
+}
+
+const sqlFmtUpsertFeatureCheck = `SELECT EXISTS (SELECT 1 FROM "%s"."%s" AS _t WHERE %v), %v, %v FROM json_populate_record(NULL::"%s"."%s", $1::json) r`
+
+// sqlUpsertFeatureCheck creates a query checking the upsert of a feature without writing it,
+// with the same SQL args as sqlUpsertFeature.
+// The column values and the geometry are converted as for the upsert,
+// so that invalid values are reported in the same way.
+// The query returns whether the feature exists,
+// whether it belongs to the tenant (if any), and whether it has a geometry
+func sqlUpsertFeatureCheck(tbl *Table, hasGeom bool, tenant *PropertyFilter) string {
+	keyCond := sqlKeyCondition(tbl, "r")
+	argIndex := 2
+	geomCheck := "false"
+	if hasGeom {
+		geomCheck = fmt.Sprintf("(%v) IS NOT NULL", sqlUpsertGeom(tbl))
+		argIndex++
+	}
+	tenantCheck := "true"
+	if tenant != nil {
+		tenantCheck = fmt.Sprintf("EXISTS (SELECT 1 FROM \"%s\".\"%s\" AS _t WHERE %v AND _t.\"%v\" = $%v)",
+			tbl.Schema, tbl.Table, keyCond, tenant.Name, argIndex)
+	}
+	return fmt.Sprintf(sqlFmtUpsertFeatureCheck, tbl.Schema, tbl.Table, keyCond, tenantCheck, geomCheck, tbl.Schema, tbl.Table)
+}
+
+const sqlFmtDeleteOtherFeatures = `DELETE FROM "%s"."%s" AS _t WHERE %v`
+
+// sqlDeleteOtherFeatures creates a statement to delete the features
+// whose keys are not in the JSON array of key records in SQL arg $1,
+// restricted to the tenant (if any) in SQL arg $2.
+// The keys are converted to the column types by the database,
+// so they match the stored values however they are written
+func sqlDeleteOtherFeatures(tbl *Table, tenant *PropertyFilter) string {
+	return fmt.Sprintf(sqlFmtDeleteOtherFeatures, tbl.Schema, tbl.Table, sqlOtherFeaturesCondition(tbl, tenant))
+}
+
+const sqlFmtCountOtherFeatures = `SELECT count(*) FROM "%s"."%s" AS _t WHERE %v`
+
+// sqlCountOtherFeatures creates a query counting the features
+// which sqlDeleteOtherFeatures deletes, with the same SQL args
+func sqlCountOtherFeatures(tbl *Table, tenant *PropertyFilter) string {
+	return fmt.Sprintf(sqlFmtCountOtherFeatures, tbl.Schema, tbl.Table, sqlOtherFeaturesCondition(tbl, tenant))
+}
+
+// sqlOtherFeaturesCondition creates a condition matching the features (aliased _t)
+// whose keys are not in the JSON array of key records in SQL arg $1,
+// restricted to the tenant (if any) in SQL arg $2
+func sqlOtherFeaturesCondition(tbl *Table, tenant *PropertyFilter) string {
+	cond := fmt.Sprintf("NOT EXISTS (SELECT 1 FROM json_populate_recordset(NULL::\"%s\".\"%s\", $1::json) r WHERE %v)",
+		tbl.Schema, tbl.Table, sqlKeyCondition(tbl, "r"))
+	if tenant != nil {
+		cond += fmt.Sprintf(" AND _t.\"%v\" = $2", tenant.Name)
+	}
+	return cond
+}
+
+// sqlKeyCondition creates a condition matching the key columns
+// of a record with those of a feature (aliased _t)
+func sqlKeyCondition(tbl *Table, record string) string {
+	var conds []string
+	for _, col := range tbl.IDColumns {
+		conds = append(conds, fmt.Sprintf("%[1]v.%[2]v = _t.%[2]v", record, strconv.Quote(col)))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// sqlQuotedList is a list of quoted column names
+func sqlQuotedList(cols []string) string {
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = strconv.Quote(col)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// sqlFeatureCondition creates a condition matching a feature id,
+// restricted to the tenant (if any).
+// The tenant value is the SQL arg following the id values
+func sqlFeatureCondition(tbl *Table, tenant *PropertyFilter) string {
+	cond := sqlIDCondition(tbl.IDColumns)
+	if tenant != nil {
+		cond += fmt.Sprintf(" AND \"%v\" = $%v", tenant.Name, len(tbl.IDColumns)+1)
+	}
+	return cond
+}
+
+// appendFilter returns a new filter list with a filter appended (if not nil)
+func appendFilter(filters []*PropertyFilter, filter *PropertyFilter) []*PropertyFilter {
+	if filter == nil {
+		return filters
+	}
+	result := make([]*PropertyFilter, 0, len(filters)+1)
+	result = append(result, filters...)
+	return append(result, filter)
+}
+
+// sqlIDCondition creates a condition matching the id columns to SQL args $1, $2, ...
+func sqlIDCondition(idCols []string) string {
+	var conds []string
+	for i, col := range idCols {
+		conds = append(conds, fmt.Sprintf("\"%v\" = $%v", col, i+1))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// sqlCqlArgs starts the SQL arg values with the values of the CQL filter parameters.
+// The values are copied so that appending to them does not change the query params
+func sqlCqlArgs(param *QueryParam) []interface{} {
+	return append([]interface{}(nil), param.FilterArgs...)
+}
+
 func sqlCqlFilter(sql string) string {
 	//log.Debug("SQL = " + sql)
 	if len(sql) == 0 {
@@ -199,16 +711,12 @@ func sqlCqlFilter(sql string) string {
 	return "(" + sql + ")"
 }
 
-func sqlWhere(cond1 string, cond2 string, cond3 string) string {
+func sqlWhere(conds ...string) string {
 	var condList []string
-	if len(cond1) > 0 {
-		condList = append(condList, cond1)
-	}
-	if len(cond2) > 0 {
-		condList = append(condList, cond2)
-	}
-	if len(cond3) > 0 {
-		condList = append(condList, cond3)
+	for _, cond := range conds {
+		if len(cond) > 0 {
+			condList = append(condList, cond)
+		}
 	}
 	where := strings.Join(condList, " AND ")
 	if len(where) > 0 {
@@ -217,13 +725,14 @@ func sqlWhere(cond1 string, cond2 string, cond3 string) string {
 	return where
 }
 
-func sqlAttrFilter(filterConds []*PropertyFilter) (string, []interface{}) {
-	var vals []interface{}
+// sqlAttrFilter creates the conditions for the attribute filters.
+// The filter values are appended to the SQL arg values as parameters
+func sqlAttrFilter(filterConds []*PropertyFilter, vals []interface{}) (string, []interface{}) {
 	var exprItems []string
-	for i, cond := range filterConds {
-		sqlCond := fmt.Sprintf("\"%v\" = $%v", cond.Name, i+1)
-		exprItems = append(exprItems, sqlCond)
+	for _, cond := range filterConds {
 		vals = append(vals, cond.Value)
+		sqlCond := fmt.Sprintf("\"%v\" = $%v", cond.Name, len(vals))
+		exprItems = append(exprItems, sqlCond)
 	}
 	sql := strings.Join(exprItems, " AND ")
 	return sql, vals
@@ -236,6 +745,14 @@ func sqlBBoxFilter(geomCol string, srcSRID int, bbox *Extent, bboxSRID int) stri
 	if bbox == nil {
 		return ""
 	}
+	//-- a geographic bbox crossing the antimeridian is split into boxes on either side
+	if bboxSRID == SRID_4326 && bbox.IsAntimeridianCrossing() {
+		west := &Extent{Minx: bbox.Minx, Miny: bbox.Miny, Maxx: 180, Maxy: bbox.Maxy}
+		east := &Extent{Minx: -180, Miny: bbox.Miny, Maxx: bbox.Maxx, Maxy: bbox.Maxy}
+		return fmt.Sprintf(" (%v OR %v) ",
+			sqlBBoxFilter(geomCol, srcSRID, west, bboxSRID),
+			sqlBBoxFilter(geomCol, srcSRID, east, bboxSRID))
+	}
 	if srcSRID == bboxSRID {
 		return fmt.Sprintf(sqlFmtBBoxGeoFilter, geomCol,
 			bbox.Minx, bbox.Miny, bbox.Maxx, bbox.Maxy, bboxSRID)
@@ -246,16 +763,264 @@ func sqlBBoxFilter(geomCol string, srcSRID int, bbox *Extent, bboxSRID int) stri
 		srcSRID)
 }
 
+var sqlGeomFilterFunctions = map[string]string{
+	GeometryFilterOpIntersects: "ST_Intersects",
+	GeometryFilterOpWithin:     "ST_Within",
+	GeometryFilterOpContains:   "ST_Contains",
+}
+
+const sqlFmtGeomFilter = ` %v("%v", %v) `
+
+// sqlGeomFilter creates a spatial filter condition for a filter geometry.
+// The geometry is appended to the SQL arg values as a parameter
+func sqlGeomFilter(geomCol string, srcSRID int, filter *GeometryFilter, vals []interface{}) (string, []interface{}) {
+	if filter == nil {
+		return "", vals
+	}
+	vals = append(vals, filter.Geom)
+	geomExpr := fmt.Sprintf("ST_GeomFromText($%v::text, %v)", len(vals), filter.Srid)
+	if filter.IsGeoJSON {
+		geomExpr = fmt.Sprintf("ST_SetSRID(ST_GeomFromGeoJSON($%v::text), %v)", len(vals), filter.Srid)
+	}
+	//-- transform filter geometry to src CRS so spatial index is used
+	if srcSRID != filter.Srid {
+		geomExpr = fmt.Sprintf("ST_Transform(%v, %v)", geomExpr, srcSRID)
+	}
+	sql := fmt.Sprintf(sqlFmtGeomFilter, sqlGeomFilterFunctions[filter.Op], geomCol, geomExpr)
+	return sql, vals
+}
+
+const sqlFmtTimeCond = `"%v" %v $%v::timestamptz`
+
+// sqlTimeFilter creates a condition for a time instant or interval on a temporal column.
+// The times are appended to the SQL arg values as parameters
+func sqlTimeFilter(timeCol string, interval *TimeInterval, vals []interface{}) (string, []interface{}) {
+	if timeCol == "" || interval == nil {
+		return "", vals
+	}
+	if interval.IsInstant() {
+		vals = append(vals, *interval.Start)
+		return " " + fmt.Sprintf(sqlFmtTimeCond, timeCol, "=", len(vals)) + " ", vals
+	}
+	var conds []string
+	if interval.Start != nil {
+		vals = append(vals, *interval.Start)
+		conds = append(conds, fmt.Sprintf(sqlFmtTimeCond, timeCol, ">=", len(vals)))
+	}
+	if interval.End != nil {
+		vals = append(vals, *interval.End)
+		conds = append(conds, fmt.Sprintf(sqlFmtTimeCond, timeCol, "<=", len(vals)))
+	}
+	if len(conds) == 0 {
+		return "", vals
+	}
+	return " " + strings.Join(conds, " AND ") + " ", vals
+}
+
+const sqlFmtTimeRangeCond = `("%v" IS NULL OR "%v" %v $%v::timestamptz)`
+
+// sqlTimeRangeFilter creates a condition for the time ranges on a pair of temporal columns
+// which overlap a time instant or interval.
+// A NULL start or end column value is an open end of the range
+func sqlTimeRangeFilter(startCol string, endCol string, interval *TimeInterval, vals []interface{}) (string, []interface{}) {
+	if startCol == "" || interval == nil {
+		return "", vals
+	}
+	var conds []string
+	if interval.End != nil {
+		vals = append(vals, *interval.End)
+		conds = append(conds, fmt.Sprintf(sqlFmtTimeRangeCond, startCol, startCol, "<=", len(vals)))
+	}
+	if interval.Start != nil {
+		vals = append(vals, *interval.Start)
+		conds = append(conds, fmt.Sprintf(sqlFmtTimeRangeCond, endCol, endCol, ">=", len(vals)))
+	}
+	if len(conds) == 0 {
+		return "", vals
+	}
+	return " " + strings.Join(conds, " AND ") + " ", vals
+}
+
 const sqlFmtGeomCol = `ST_AsGeoJSON( %v %v ) AS _geojson`
 
+// GML 3 is output with short SRS names (EPSG:nnnn) and the gml namespace prefix.
+// It is converted to a JSON string so it can be embedded in the feature JSON
+const sqlFmtGeomColGML = `to_json(ST_AsGML(3, %v, %v, 0, 'gml'))::text AS _gml`
+
+// sqlFmtGeomColEncodings are the geometry columns for the string geometry encodings.
+// WKB and EWKB are hex-encoded
+var sqlFmtGeomColEncodings = map[string]string{
+	GeomFormatWKT:    `to_json(ST_AsText( %v %v ))::text AS _geojson`,
+	GeomFormatWKBHex: `to_json(encode(ST_AsBinary( (%v)::geometry ), 'hex'))::text AS _geojson`,
+	GeomFormatEWKB:   `to_json(encode(ST_AsEWKB( (%v)::geometry ), 'hex'))::text AS _geojson`,
+}
+
+// sqlGMLPrecisionDefault is the ST_AsGML default decimal digits
+const sqlGMLPrecisionDefault = 15
+
+// sqlPrecisionFull is the encoder precision for coordinates which are reduced as they are read,
+// so that they are not rounded first
+const sqlPrecisionFull = 15
+
 func sqlGeomCol(geomCol string, sourceSRID int, param *QueryParam) string {
+	if isGeomLimited(geomCol, param) {
+		geomExpr := sqlGeomLimitPoints(sqlGeomLimitedCol, sqlGeomEmptyNull(sqlGeomLimitedCol, param), param)
+		return sqlGeomExprCol(geomExpr, sourceSRID, param)
+	}
+	return sqlGeomExprCol(sqlGeomEmptyNull(sqlGeomSource(geomCol, param), param), sourceSRID, param)
+}
+
+const sqlFmtGeomEmptyNull = `CASE WHEN ST_IsEmpty(%[1]v) THEN NULL ELSE %[1]v END`
+
+// sqlGeomEmptyNull outputs empty geometry (such as GEOMETRYCOLLECTION EMPTY) as null,
+// if EmptyGeometry is EmptyGeometryNull
+func sqlGeomEmptyNull(geomExpr string, param *QueryParam) string {
+	if param.EmptyGeometry != EmptyGeometryNull {
+		return geomExpr
+	}
+	return fmt.Sprintf(sqlFmtGeomEmptyNull, geomExpr)
+}
+
+// sqlGeomLimitedCol is the geometry source column provided by sqlGeomLimitFrom
+const sqlGeomLimitedCol = "_geom"
+
+// sqlFmtGeomLimitFrom joins the geometry source expression of each row,
+// since limiting the points refers to it several times.
+// OFFSET 0 keeps the subquery from being flattened into the query,
+// which would evaluate the expression (such as ST_MakeValid) for each reference
+const sqlFmtGeomLimitFrom = ` CROSS JOIN LATERAL (SELECT %v AS _geom OFFSET 0) AS _geom_source`
+
+// sqlFmtGeomSimplify simplifies geometry with more than a number of points.
+// The tolerance is the size of the geometry extent divided by the number of points,
+// which approximately reduces it to that number of points.
+// Collapsed geometry is preserved, so that small features are not lost
+const sqlFmtGeomSimplify = `CASE WHEN ST_NPoints(%[1]v) > %[2]v THEN ST_Simplify(%[1]v, greatest(ST_XMax(%[1]v) - ST_XMin(%[1]v), ST_YMax(%[1]v) - ST_YMin(%[1]v)) / %[2]v, true) ELSE %[3]v END`
+
+const sqlFmtGeomOmitComplex = `CASE WHEN ST_NPoints(%[1]v) > %[2]v THEN NULL ELSE %[3]v END`
+
+// sqlFmtGeomOmittedCol indicates whether the geometry of a feature is omitted
+const sqlFmtGeomOmittedCol = `, ST_NPoints(_geom) > %v AS _geom_omitted`
+
+// isGeomLimited tests if the points of the feature geometry are limited.
+// Distinct and grouped features have no geometry of their own
+func isGeomLimited(geomCol string, param *QueryParam) bool {
+	return param.MaxGeomPoints > 0 && geomCol != "" && !param.Distinct && len(param.GroupBy) == 0
+}
+
+// isGeomOmittable tests if complex feature geometry is omitted,
+// in which case the features have the GeometryOmittedColumn property
+func isGeomOmittable(geomCol string, param *QueryParam) bool {
+	return isGeomLimited(geomCol, param) && param.OmitComplexGeom
+}
+
+// sqlGeomLimitFrom is the join of the geometry source of a features query
+// if its points are limited, or empty otherwise
+func sqlGeomLimitFrom(geomCol string, param *QueryParam) string {
+	if !isGeomLimited(geomCol, param) {
+		return ""
+	}
+	return fmt.Sprintf(sqlFmtGeomLimitFrom, sqlGeomSource(geomCol, param))
+}
+
+// sqlGeomOmittedCol is the column for the GeometryOmittedColumn property
+// if complex geometry is omitted, or empty otherwise
+func sqlGeomOmittedCol(geomCol string, param *QueryParam) string {
+	if !isGeomOmittable(geomCol, param) {
+		return ""
+	}
+	return fmt.Sprintf(sqlFmtGeomOmittedCol, param.MaxGeomPoints)
+}
+
+// sqlGeomLimitPoints simplifies or omits geometry with more than MaxGeomPoints,
+// so that very complex geometry does not make responses too large.
+// Geometry within the limit is output as the given expression
+func sqlGeomLimitPoints(geomExpr string, withinExpr string, param *QueryParam) string {
+	if param.OmitComplexGeom {
+		return fmt.Sprintf(sqlFmtGeomOmitComplex, geomExpr, param.MaxGeomPoints, withinExpr)
+	}
+	return fmt.Sprintf(sqlFmtGeomSimplify, geomExpr, param.MaxGeomPoints, withinExpr)
+}
+
+// sqlGeomSource is the expression for the geometry column of a table.
+// Invalid geometry is repaired if MakeValid is set
+func sqlGeomSource(geomCol string, param *QueryParam) string {
 	geomColSafe := strconv.Quote(geomCol)
-	geomExpr := applyTransform(param.TransformFuns, geomColSafe)
+	if param.MakeValid {
+		return fmt.Sprintf("ST_MakeValid(%v)", geomColSafe)
+	}
+	return geomColSafe
+}
+
+// sqlValidFilter omits rows whose geometry is empty after it is repaired.
+// Rows with no geometry are kept
+func sqlValidFilter(geomCol string, param *QueryParam) string {
+	if !param.MakeValid || !param.DropInvalid || geomCol == "" {
+		return ""
+	}
+	return fmt.Sprintf("NOT COALESCE(ST_IsEmpty(ST_MakeValid(%v)), false)", strconv.Quote(geomCol))
+}
+
+// sqlEmptyFilter omits rows with empty geometry, if EmptyGeometry is EmptyGeometryExclude.
+// Rows with no geometry are kept
+func sqlEmptyFilter(geomCol string, param *QueryParam) string {
+	if param.EmptyGeometry != EmptyGeometryExclude || geomCol == "" {
+		return ""
+	}
+	return fmt.Sprintf("NOT COALESCE(ST_IsEmpty(%v), false)", strconv.Quote(geomCol))
+}
+
+// sqlGeomTypeFilter selects rows with a geometry type.
+// ST_GeometryType is used since it does not depend on the coordinate dimensions.
+// The type is one of the geometryTypes, so it does not need to be quoted
+func sqlGeomTypeFilter(geomCol string, geomType string) string {
+	if geomType == "" || geomCol == "" {
+		return ""
+	}
+	return fmt.Sprintf("ST_GeometryType(%v) = 'ST_%v'", strconv.Quote(geomCol), geomType)
+}
+
+// sqlGeomExprCol is the output geometry column for a geometry expression.
+// The geometry is transformed to the output CRS before it is encoded,
+// so the precision rounds coordinates in the units of the output CRS.
+// If no precision is given the encoding default is used.
+// Forcing 2D drops the Z and M ordinates, so they are not encoded at all
+func sqlGeomExprCol(geomColExpr string, sourceSRID int, param *QueryParam) string {
+	geomExpr := applyTransform(param.TransformFuns, geomColExpr, sourceSRID)
 	geomOutExpr := transformToOutCrs(geomExpr, sourceSRID, param.Crs)
-	sql := fmt.Sprintf(sqlFmtGeomCol, geomOutExpr, sqlPrecisionArg(param.Precision))
+	if param.FlipAxes {
+		geomOutExpr = fmt.Sprintf("ST_FlipCoordinates(%v)", geomOutExpr)
+	}
+	if param.Dimension == Dimension2D {
+		geomOutExpr = fmt.Sprintf("ST_Force2D(%v)", geomOutExpr)
+	}
+	precision := param.Precision
+	if newCoordRounding(param) != nil {
+		precision = sqlPrecisionFull
+	}
+	if param.GeomFormat == GeomFormatGML {
+		if precision < 0 {
+			precision = sqlGMLPrecisionDefault
+		}
+		return fmt.Sprintf(sqlFmtGeomColGML, geomOutExpr, precision)
+	}
+	if param.GeomFormat == GeomFormatWKT {
+		return fmt.Sprintf(sqlFmtGeomColEncodings[GeomFormatWKT], geomOutExpr, sqlPrecisionArg(precision))
+	}
+	if sqlFmt, ok := sqlFmtGeomColEncodings[param.GeomFormat]; ok {
+		return fmt.Sprintf(sqlFmt, geomOutExpr)
+	}
+	sql := fmt.Sprintf(sqlFmtGeomCol, geomOutExpr, sqlPrecisionArg(precision))
 	return sql
 }
 
+// sqlNullGeomCol is a NULL geometry column, for queries which do not return geometry
+func sqlNullGeomCol(param *QueryParam) string {
+	if param.GeomFormat == GeomFormatGML {
+		return "NULL::text AS _gml"
+	}
+	return "NULL::text AS _geojson"
+}
+
 func transformToOutCrs(geomExpr string, sourceSRID, outSRID int) string {
 	if sourceSRID == outSRID {
 		return geomExpr
@@ -272,20 +1037,92 @@ func sqlPrecisionArg(precision int) string {
 	return sqlPrecision
 }
 
-const sqlFmtOrderBy = `ORDER BY "%v" %v`
+const sqlFmtOrderBy = `"%v" %v %v`
 
-func sqlOrderBy(ordering []Sorting) string {
+const sqlFmtOrderByExpr = `%v %v %v`
+
+const sqlFmtOrderByDistance = `"%v" <-> %v %v %v`
+
+// sqlOrderBy creates the ORDER BY clause, with the orderings in sequence.
+// Ordering by distance from a point uses the KNN operator on the geometry column,
+// so that a spatial index can be used
+func sqlOrderBy(ordering []Sorting, geomCol string, srid int) string {
 	if len(ordering) <= 0 {
 		return ""
 	}
-	// TODO: support more than one ordering
-	col := ordering[0].Name
+	terms := make([]string, len(ordering))
+	for i, sorting := range ordering {
+		terms[i] = sqlOrderByTerm(sorting, geomCol, srid)
+	}
+	return "ORDER BY " + strings.Join(terms, ", ")
+}
+
+// sqlOrderByTerm creates the ORDER BY expression for a single ordering
+func sqlOrderByTerm(sorting Sorting, geomCol string, srid int) string {
 	dir := ""
-	if ordering[0].IsDesc {
+	if sorting.IsDesc {
 		dir = "DESC"
 	}
-	sql := fmt.Sprintf(sqlFmtOrderBy, col, dir)
-	return sql
+	if pt := sorting.Point; pt != nil && geomCol != "" {
+		return fmt.Sprintf(sqlFmtOrderByDistance, geomCol, sqlPoint(pt, srid), dir, sorting.Nulls)
+	}
+	if sorting.IsPath {
+		expr := "(" + sqlPropertyPathValue(sorting.Name) + ")"
+		if sorting.Cast != "" {
+			expr += "::" + sorting.Cast
+		}
+		return fmt.Sprintf(sqlFmtOrderByExpr, expr, dir, sorting.Nulls)
+	}
+	return fmt.Sprintf(sqlFmtOrderBy, sorting.Name, dir, sorting.Nulls)
+}
+
+// sqlDefaultOrderBy orders by a list of columns, such as the id columns
+func sqlDefaultOrderBy(cols []string) string {
+	if len(cols) <= 0 {
+		return ""
+	}
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = strconv.Quote(col)
+	}
+	return "ORDER BY " + strings.Join(quoted, ", ")
+}
+
+// sqlOrderByTiebreaker adds the default order columns after a sort order,
+// so that features with equal sort values are in a consistent order.
+// Columns already in the sort order are not repeated
+func sqlOrderByTiebreaker(ordering []Sorting, cols []string) string {
+	if len(ordering) <= 0 {
+		return ""
+	}
+	sortCols := make(map[string]bool)
+	for _, sorting := range ordering {
+		if !sorting.IsPath && sorting.Point == nil {
+			sortCols[sorting.Name] = true
+		}
+	}
+	var quoted []string
+	for _, col := range cols {
+		if !sortCols[col] {
+			quoted = append(quoted, strconv.Quote(col))
+		}
+	}
+	//-- sorting by a single id column is already a total order
+	if len(quoted) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(quoted, ", ")
+}
+
+const sqlFmtPoint = `ST_SetSRID(ST_MakePoint(%v, %v), 4326)`
+
+// sqlPoint is a geographic point transformed to a coordinate system
+func sqlPoint(pt *Point, srid int) string {
+	sql := fmt.Sprintf(sqlFmtPoint, strconv.FormatFloat(pt.X, 'f', -1, 64), strconv.FormatFloat(pt.Y, 'f', -1, 64))
+	if srid == SRID_4326 {
+		return sql
+	}
+	return fmt.Sprintf("ST_Transform(%v, %v)", sql, srid)
 }
 
 const sqlFmtGroupBy = `GROUP BY "%v"`
@@ -313,11 +1150,18 @@ func sqlLimitOffset(limit int, offset int) string {
 	return sqlLim + sqlOff
 }
 
-func applyTransform(funs []TransformFunction, expr string) string {
+// applyTransform applies the transform functions to a geometry expression.
+// Metric functions are computed in a projected CRS
+// if the source CRS is geographic
+func applyTransform(funs []TransformFunction, expr string, sourceSRID int) string {
 	if funs == nil {
 		return expr
 	}
 	for _, fun := range funs {
+		if fun.IsMetric && IsGeographicSrid(sourceSRID) {
+			expr = fun.applyMetric(expr, sourceSRID)
+			continue
+		}
 		expr = fun.apply(expr)
 	}
 	return expr
@@ -326,14 +1170,16 @@ func applyTransform(funs []TransformFunction, expr string) string {
 const sqlFmtGeomFunction = "SELECT %s %s FROM \"%s\".\"%s\"( %v ) %v %v %s;"
 
 func sqlGeomFunction(fn *Function, args map[string]string, propCols []string, param *QueryParam) (string, []interface{}) {
-	sqlArgs, argVals := sqlFunctionArgs(fn, args)
+	sqlArgs, argVals := sqlFunctionArgs(fn, args, sqlCqlArgs(param))
 	sqlGeomCol := sqlGeomCol(fn.GeometryColumn, SRID_UNKNOWN, param)
-	sqlPropCols := sqlColList(propCols, fn.Types, true)
+	sqlPropCols := sqlColList(propCols, fn.Types, param.PropPrecision, true)
 	//-- SRS of function output is unknown, so have to assume 4326
-	bboxFilter := sqlBBoxFilter(fn.GeometryColumn, SRID_4326, param.Bbox, param.BboxCrs)
+	bboxFilter := sqlBBoxFilter(fn.GeometryColumn, SRID_4326, param.Bbox.Expand(param.BboxBuffer), param.BboxCrs)
+	geomFilter, argVals := sqlGeomFilter(fn.GeometryColumn, SRID_4326, param.FilterGeom, argVals)
+	geomTypeFilter := sqlGeomTypeFilter(fn.GeometryColumn, param.GeomType)
 	cqlFilter := sqlCqlFilter(param.FilterSql)
-	sqlWhere := sqlWhere(bboxFilter, cqlFilter, "")
-	sqlOrderBy := sqlOrderBy(param.SortBy)
+	sqlWhere := sqlWhere(bboxFilter, geomFilter, geomTypeFilter, cqlFilter)
+	sqlOrderBy := sqlOrderBy(param.SortBy, fn.GeometryColumn, SRID_4326)
 	sqlLimitOffset := sqlLimitOffset(param.Limit, param.Offset)
 	sql := fmt.Sprintf(sqlFmtGeomFunction, sqlGeomCol, sqlPropCols, fn.Schema, fn.Name, sqlArgs, sqlWhere, sqlOrderBy, sqlLimitOffset)
 	return sql, argVals
@@ -342,25 +1188,24 @@ func sqlGeomFunction(fn *Function, args map[string]string, propCols []string, pa
 const sqlFmtFunction = "SELECT %v FROM \"%s\".\"%s\"( %v ) %v %v %s;"
 
 func sqlFunction(fn *Function, args map[string]string, propCols []string, param *QueryParam) (string, []interface{}) {
-	sqlArgs, argVals := sqlFunctionArgs(fn, args)
-	sqlPropCols := sqlColList(propCols, fn.Types, false)
+	sqlArgs, argVals := sqlFunctionArgs(fn, args, sqlCqlArgs(param))
+	sqlPropCols := sqlColList(propCols, fn.Types, param.PropPrecision, false)
 	cqlFilter := sqlCqlFilter(param.FilterSql)
 	sqlWhere := sqlWhere(cqlFilter, "", "")
-	sqlOrderBy := sqlOrderBy(param.SortBy)
+	sqlOrderBy := sqlOrderBy(param.SortBy, "", SRID_UNKNOWN)
 	sqlLimitOffset := sqlLimitOffset(param.Limit, param.Offset)
 	sql := fmt.Sprintf(sqlFmtFunction, sqlPropCols, fn.Schema, fn.Name, sqlArgs, sqlWhere, sqlOrderBy, sqlLimitOffset)
 	return sql, argVals
 }
 
-func sqlFunctionArgs(fn *Function, argValues map[string]string) (string, []interface{}) {
-	var vals []interface{}
+// sqlFunctionArgs creates the function arguments.
+// The argument values are appended to the SQL arg values as parameters
+func sqlFunctionArgs(fn *Function, argValues map[string]string, vals []interface{}) (string, []interface{}) {
 	var argItems []string
-	i := 1
 	for argName := range argValues {
-		argItem := fmt.Sprintf("%v => $%v", argName, i)
-		argItems = append(argItems, argItem)
-		i++
 		vals = append(vals, argValues[argName])
+		argItem := fmt.Sprintf("%v => $%v", argName, len(vals))
+		argItems = append(argItems, argItem)
 	}
 	sql := strings.Join(argItems, ",")
 	return sql, vals
@@ -0,0 +1,732 @@
+package data
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CrunchyData/pg_featureserv/internal/conf"
+)
+
+func TestSQLIDCondition(t *testing.T) {
+	checkSQL(t, sqlIDCondition([]string{"id"}), "\"id\" = $1")
+	checkSQL(t, sqlIDCondition([]string{"k1", "k2"}), "\"k1\" = $1 AND \"k2\" = $2")
+}
+
+func TestSQLDeleteFeature(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "link", IDColumns: []string{"k1", "k2"}}
+	checkSQL(t, sqlDeleteFeature(tbl, nil), "DELETE FROM \"public\".\"link\" WHERE \"k1\" = $1 AND \"k2\" = $2")
+}
+
+func TestSQLFeatureExists(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "link", IDColumns: []string{"k1", "k2"}}
+	checkSQL(t, sqlFeatureExists(tbl, &PropertyFilter{Name: "org", Value: "a"}),
+		"SELECT EXISTS (SELECT 1 FROM \"public\".\"link\" WHERE \"k1\" = $1 AND \"k2\" = $2 AND \"org\" = $3)")
+	checkSQL(t, sqlTablePrivileges("INSERT", "UPDATE"),
+		"SELECT has_table_privilege($1::text, 'INSERT') AND has_table_privilege($1::text, 'UPDATE')")
+	checkSQL(t, sqlTableName(tbl), "\"public\".\"link\"")
+}
+
+func TestSQLUpsertFeature(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 3005, IDColumns: []string{"id"}}
+	checkSQL(t, sqlUpsertFeature(tbl, []string{"id", "name"}, true, nil),
+		"INSERT INTO \"public\".\"pts\" (\"id\", \"name\", \"geom\") "+
+			"SELECT r.\"id\", r.\"name\", ST_Transform( (ST_SetSRID(ST_GeomFromGeoJSON($2::text), 4326))::geometry, 3005) "+
+			"FROM json_populate_record(NULL::\"public\".\"pts\", $1::json) r "+
+			"ON CONFLICT (\"id\") DO UPDATE SET \"id\" = EXCLUDED.\"id\", \"name\" = EXCLUDED.\"name\", \"geom\" = EXCLUDED.\"geom\" "+
+			"RETURNING (xmax = 0) AS inserted")
+	//-- updates are restricted to the tenant
+	tenant := &PropertyFilter{Name: "org", Value: "a"}
+	checkSQL(t, sqlUpsertFeature(tbl, []string{"id", "org"}, false, tenant),
+		"INSERT INTO \"public\".\"pts\" (\"id\", \"org\") SELECT r.\"id\", r.\"org\" "+
+			"FROM json_populate_record(NULL::\"public\".\"pts\", $1::json) r "+
+			"ON CONFLICT (\"id\") DO UPDATE SET \"id\" = EXCLUDED.\"id\", \"org\" = EXCLUDED.\"org\" "+
+			"WHERE \"public\".\"pts\".\"org\" = $2 RETURNING (xmax = 0) AS inserted")
+}
+
+func TestSQLUpsertFeatureCheck(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"}}
+	checkSQL(t, sqlUpsertFeatureCheck(tbl, true, &PropertyFilter{Name: "org", Value: "a"}),
+		"SELECT EXISTS (SELECT 1 FROM \"public\".\"pts\" AS _t WHERE r.\"id\" = _t.\"id\"), "+
+			"EXISTS (SELECT 1 FROM \"public\".\"pts\" AS _t WHERE r.\"id\" = _t.\"id\" AND _t.\"org\" = $3), "+
+			"(ST_SetSRID(ST_GeomFromGeoJSON($2::text), 4326)) IS NOT NULL "+
+			"FROM json_populate_record(NULL::\"public\".\"pts\", $1::json) r")
+	checkSQL(t, sqlUpsertFeatureCheck(tbl, false, nil),
+		"SELECT EXISTS (SELECT 1 FROM \"public\".\"pts\" AS _t WHERE r.\"id\" = _t.\"id\"), true, false "+
+			"FROM json_populate_record(NULL::\"public\".\"pts\", $1::json) r")
+}
+
+func TestSQLDeleteOtherFeatures(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "link", IDColumns: []string{"k1", "k2"}}
+	checkSQL(t, sqlDeleteOtherFeatures(tbl, &PropertyFilter{Name: "org", Value: "a"}),
+		"DELETE FROM \"public\".\"link\" AS _t WHERE NOT EXISTS (SELECT 1 FROM json_populate_recordset(NULL::\"public\".\"link\", $1::json) r "+
+			"WHERE r.\"k1\" = _t.\"k1\" AND r.\"k2\" = _t.\"k2\") AND _t.\"org\" = $2")
+	checkSQL(t, sqlCountOtherFeatures(tbl, nil),
+		"SELECT count(*) FROM \"public\".\"link\" AS _t WHERE NOT EXISTS (SELECT 1 FROM json_populate_recordset(NULL::\"public\".\"link\", $1::json) r "+
+			"WHERE r.\"k1\" = _t.\"k1\" AND r.\"k2\" = _t.\"k2\")")
+}
+
+func TestSQLFeaturesRowID(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326}
+	param := &QueryParam{Columns: []string{"name"}, Crs: 4326}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	if !strings.Contains(sql, ", "+sqlRowIDCol+" FROM") {
+		t.Errorf("Features query should include row id column: %v", sql)
+	}
+	param.GroupBy = []string{"name"}
+	sql, _ = sqlFeatures(tbl, param, nil)
+	if strings.Contains(sql, sqlRowIDCol) {
+		t.Errorf("Grouped features query should not include row id column: %v", sql)
+	}
+	tbl.IDColumns = []string{"id"}
+	param.GroupBy = nil
+	sql, _ = sqlFeatures(tbl, param, nil)
+	if strings.Contains(sql, sqlRowIDCol) {
+		t.Errorf("Features query for table with key should not include row id column: %v", sql)
+	}
+}
+
+func TestSQLFeaturesRowIDView(t *testing.T) {
+	//-- views have no ctid, so the row number is used
+	tbl := &Table{Schema: "public", Table: "pts_view", GeometryColumn: "geom", Srid: 4326, IsView: true}
+	param := &QueryParam{Columns: []string{"name"}, Crs: 4326, Precision: -1, PropPrecision: -1, Limit: 10}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( \"geom\"  ) AS _geojson , \"name\"::text, (row_number() OVER ())::text AS _row_id FROM \"public\".\"pts_view\"     LIMIT 10;")
+	if strings.Contains(sql, "ctid") {
+		t.Errorf("Features query for a view should not use ctid: %v", sql)
+	}
+}
+
+func TestSQLFeaturesSample(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"}}
+	param := &QueryParam{Crs: 4326, Sample: 2.5, Bbox: &Extent{Minx: 0, Miny: 0, Maxx: 1, Maxy: 1}, BboxCrs: 4326}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	if !strings.Contains(sql, "FROM \"public\".\"pts\" TABLESAMPLE BERNOULLI (2.5)  WHERE ") {
+		t.Errorf("Features query should sample the table before filtering: %v", sql)
+	}
+	param.Sample = 0
+	sql, _ = sqlFeatures(tbl, param, nil)
+	if strings.Contains(sql, "TABLESAMPLE") {
+		t.Errorf("Features query should not sample the table: %v", sql)
+	}
+	//-- views do not support TABLESAMPLE, so are sampled by a filter
+	tbl.IsView = true
+	param.Sample = 2.5
+	sql, _ = sqlFeatures(tbl, param, nil)
+	if strings.Contains(sql, "TABLESAMPLE") || !strings.Contains(sql, "random() < 0.025") {
+		t.Errorf("Features query should sample the view by a filter: %v", sql)
+	}
+}
+
+func TestSQLFeaturesDefaultOrder(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"a", "b"}}
+	param := &QueryParam{Crs: 4326, Limit: 10, Offset: 20, DefaultOrder: tbl.IDColumns}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	if !strings.Contains(sql, "ORDER BY \"a\", \"b\"  LIMIT 10 OFFSET 20") {
+		t.Errorf("Features query should be ordered by id columns: %v", sql)
+	}
+	//-- a requested order is followed by the default order
+	param.SortBy = []Sorting{{Name: "name"}}
+	sql, _ = sqlFeatures(tbl, param, nil)
+	if !strings.Contains(sql, "ORDER BY \"name\", \"a\", \"b\"  LIMIT 10 OFFSET 20") {
+		t.Errorf("Features query should be ordered by sortby then id columns: %v", sql)
+	}
+	param.DefaultOrder = nil
+	sql, _ = sqlFeatures(tbl, param, nil)
+	if strings.Contains(sql, "\"a\", \"b\"") {
+		t.Errorf("Features query should be ordered by sortby only: %v", sql)
+	}
+}
+
+// Pages of features sorted by a column with duplicate values
+// are ordered by the id columns as well, so that they do not overlap
+func TestSQLFeaturesSortTiebreaker(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"}}
+	param := &QueryParam{Crs: 4326, Limit: 5, Offset: 5, DefaultOrder: tbl.IDColumns,
+		SortBy: []Sorting{{Name: "category", IsDesc: true, Nulls: "NULLS LAST"}}}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	if !strings.Contains(sql, "ORDER BY \"category\" DESC NULLS LAST, \"id\"  LIMIT 5 OFFSET 5") {
+		t.Errorf("Features query should be ordered by sortby then id: %v", sql)
+	}
+	//-- an id sort order is already unique
+	param.SortBy = []Sorting{{Name: "id", IsDesc: true}}
+	sql, _ = sqlFeatures(tbl, param, nil)
+	if !strings.Contains(sql, "ORDER BY \"id\" DESC   LIMIT 5 OFFSET 5") {
+		t.Errorf("Features query should be ordered by id only: %v", sql)
+	}
+	//-- a composite key is completed by the other id columns
+	checkSQL(t, sqlOrderByTiebreaker([]Sorting{{Name: "k2"}}, []string{"k1", "k2"}), ", \"k1\"")
+	checkSQL(t, sqlOrderByTiebreaker([]Sorting{{Name: "attrs.k1", IsPath: true}}, []string{"k1"}), ", \"k1\"")
+	checkSQL(t, sqlOrderByTiebreaker([]Sorting{{Name: "name"}, {Name: "k2"}}, []string{"k1", "k2"}), ", \"k1\"")
+}
+
+func TestSQLFeaturesFilterOrder(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	param := &QueryParam{Crs: 4326, Precision: -1,
+		Bbox: &Extent{Minx: 0, Miny: 0, Maxx: 1, Maxy: 1}, BboxCrs: 4326,
+		TimeColumn: "t", Datetime: &TimeInterval{Start: &start},
+		Filter:    []*PropertyFilter{{Name: "name", Value: "a"}},
+		FilterSql: "\"pop\" > 1 OR \"pop\" IS NULL",
+		GeomType:  "Polygon",
+	}
+	sql, args := sqlFeatures(tbl, param, nil)
+	//-- the spatial condition is first, and is on the column so the spatial index can be used
+	where := " WHERE  ST_Intersects(\"geom\", ST_MakeEnvelope(0, 0, 1, 1, 4326))  AND  \"t\" >= $2::timestamptz  AND \"name\" = $1" +
+		" AND (\"pop\" > 1 OR \"pop\" IS NULL) AND ST_GeometryType(\"geom\") = 'ST_Polygon' "
+	if !strings.Contains(sql, where) {
+		t.Errorf("Features query conditions should be in index order:\n  expected: %v\n  actual:   %v", where, sql)
+	}
+	if len(args) != 2 {
+		t.Errorf("Features query should have 2 args: %v", args)
+	}
+}
+
+func TestSQLFeaturesFilterArgs(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326}
+	param := &QueryParam{Crs: 4326, Precision: -1,
+		Filter:     []*PropertyFilter{{Name: "name", Value: "a"}},
+		FilterSql:  "ST_Intersects(\"geom\",ST_GeomFromText($1::text,4326))",
+		FilterArgs: []interface{}{"POINT(0 0)"},
+	}
+	sql, args := sqlFeatures(tbl, param, nil)
+	//-- the CQL filter parameters are numbered first
+	where := " WHERE \"name\" = $2 AND (ST_Intersects(\"geom\",ST_GeomFromText($1::text,4326))) "
+	if !strings.Contains(sql, where) {
+		t.Errorf("Features query should number the CQL parameters first:\n  expected: %v\n  actual:   %v", where, sql)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"POINT(0 0)", "a"}) {
+		t.Errorf("Features query args should start with the CQL args: %v", args)
+	}
+	if len(param.FilterArgs) != 1 {
+		t.Errorf("Features query should not change the CQL args: %v", param.FilterArgs)
+	}
+	fn := &Function{Schema: "public", Name: "fn", GeometryColumn: "geom"}
+	sql, args = sqlGeomFunction(fn, map[string]string{"n": "1"}, nil, param)
+	if !strings.Contains(sql, "( n => $2 )") || !reflect.DeepEqual(args, []interface{}{"POINT(0 0)", "1"}) {
+		t.Errorf("Function query should number the arguments after the CQL args: %v %v", sql, args)
+	}
+}
+
+func TestSQLFeaturesDistinct(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326}
+	param := &QueryParam{Columns: []string{"region"}, Crs: 4326, Distinct: true}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	if !strings.HasPrefix(sql, "SELECT DISTINCT NULL::text AS _geojson , \"region\"::text FROM") {
+		t.Errorf("Distinct features query should select distinct properties with no geometry: %v", sql)
+	}
+	if strings.Contains(sql, sqlRowIDCol) {
+		t.Errorf("Distinct features query should not include row id column: %v", sql)
+	}
+}
+
+func TestSQLFeaturesCluster(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"}}
+	param := &QueryParam{Crs: 4326, Precision: -1, Limit: 10, Cluster: &Cluster{Distance: 0.5, MinPoints: 3},
+		Bbox: &Extent{Minx: 0, Miny: 0, Maxx: 1, Maxy: 1}, BboxCrs: 4326}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	if !strings.HasPrefix(sql, "SELECT ST_AsGeoJSON( ST_Centroid(ST_Collect(_geom))  ) AS _geojson, count(*) AS \"count\" FROM") {
+		t.Errorf("Cluster query should select cluster centroid and count: %v", sql)
+	}
+	if !strings.Contains(sql, "ST_ClusterDBSCAN(\"geom\", 0.5, 3) OVER ()") {
+		t.Errorf("Cluster query should use DBSCAN clustering: %v", sql)
+	}
+	if !strings.Contains(sql, "FROM \"public\".\"pts\"  WHERE  ST_Intersects(") {
+		t.Errorf("Cluster query should only cluster features in the bbox: %v", sql)
+	}
+	if !strings.Contains(sql, "GROUP BY COALESCE(_cluster_id, -_row_num)   LIMIT 10") {
+		t.Errorf("Cluster query should group by cluster: %v", sql)
+	}
+}
+
+func TestSQLFeaturesAggregate(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "parcels", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"}}
+	param := &QueryParam{Crs: 4326, Precision: -1, Limit: 10, Aggregate: &Aggregate{Function: AggregateUnion, MaxFeatures: 1000},
+		Filter: []*PropertyFilter{{Name: "zone", Value: "R1"}}}
+	sql, args := sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( ST_Union(_geom)  ) AS _geojson, count(*) AS \"count\" FROM (SELECT \"geom\" AS _geom FROM \"public\".\"parcels\"  WHERE \"zone\" = $1 LIMIT 1000) AS _aggregate;")
+	if !reflect.DeepEqual(args, []interface{}{"R1"}) {
+		t.Errorf("Aggregate query args should be the filter values: %v", args)
+	}
+	if len(featuresIDColIndexes(tbl, param)) != 0 {
+		t.Errorf("Aggregate query should not have an id column")
+	}
+}
+
+func TestSQLFeaturesMakeValid(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "parcels", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"}}
+	param := &QueryParam{Crs: 4326, Precision: -1, Limit: 10, MakeValid: true}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( ST_MakeValid(\"geom\")  ) AS _geojson  FROM \"public\".\"parcels\"     LIMIT 10;")
+
+	param.DropInvalid = true
+	sql, _ = sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( ST_MakeValid(\"geom\")  ) AS _geojson  FROM \"public\".\"parcels\"  WHERE NOT COALESCE(ST_IsEmpty(ST_MakeValid(\"geom\")), false)    LIMIT 10;")
+
+	sql, _ = sqlInvalidCount(tbl, &QueryParam{Crs: 4326, MakeValid: true}, nil)
+	checkSQL(t, sql, "SELECT count(*) FROM \"public\".\"parcels\" WHERE NOT ST_IsValid(\"geom\");")
+}
+
+func TestSQLFeaturesEmptyGeometry(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "parcels", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"}}
+	param := &QueryParam{Crs: 4326, Precision: -1, Limit: 10, EmptyGeometry: EmptyGeometryKeep}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( \"geom\"  ) AS _geojson  FROM \"public\".\"parcels\"     LIMIT 10;")
+
+	param.EmptyGeometry = EmptyGeometryNull
+	sql, _ = sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( CASE WHEN ST_IsEmpty(\"geom\") THEN NULL ELSE \"geom\" END  ) AS _geojson  FROM \"public\".\"parcels\"     LIMIT 10;")
+
+	param.EmptyGeometry = EmptyGeometryExclude
+	sql, _ = sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( \"geom\"  ) AS _geojson  FROM \"public\".\"parcels\"  WHERE NOT COALESCE(ST_IsEmpty(\"geom\"), false)    LIMIT 10;")
+}
+
+func TestSQLFeaturesDimension2D(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "peaks", GeometryColumn: "geom", GeometryType: "PointZ", Srid: 4326, IDColumns: []string{"id"}}
+	param := &QueryParam{Crs: 4326, Precision: 3, Limit: 10}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( \"geom\" ,3 ) AS _geojson  FROM \"public\".\"peaks\"     LIMIT 10;")
+
+	//-- the Z ordinate is dropped before encoding, for all geometry formats
+	param.Dimension = Dimension2D
+	sql, _ = sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( ST_Force2D(\"geom\") ,3 ) AS _geojson  FROM \"public\".\"peaks\"     LIMIT 10;")
+
+	param.GeomFormat = GeomFormatWKT
+	sql, _ = sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT to_json(ST_AsText( ST_Force2D(\"geom\") ,3 ))::text AS _geojson  FROM \"public\".\"peaks\"     LIMIT 10;")
+}
+
+func TestSQLLastModified(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326}
+	param := &QueryParam{Crs: 4326, Limit: 10, Filter: []*PropertyFilter{{Name: "name", Value: "a"}}}
+	sql, vals := sqlLastModified(tbl, "updated_at", param, nil)
+	checkSQL(t, sql, "SELECT max(\"updated_at\")::timestamptz FROM \"public\".\"pts\"  WHERE \"name\" = $1;")
+	if !reflect.DeepEqual(vals, []interface{}{"a"}) {
+		t.Errorf("Last modified query should have filter values: %v", vals)
+	}
+}
+
+func TestSQLFeatureCount(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326}
+	param := &QueryParam{Crs: 4326, Limit: 10, Offset: 20, Filter: []*PropertyFilter{{Name: "name", Value: "a"}}}
+	sql, vals := sqlFeatureCount(tbl, param, nil)
+	checkSQL(t, sql, "SELECT count(*) FROM \"public\".\"pts\"  WHERE \"name\" = $1;")
+	if !reflect.DeepEqual(vals, []interface{}{"a"}) {
+		t.Errorf("Feature count query should have filter values: %v", vals)
+	}
+}
+
+// The count is of the features selected by all the query conditions,
+// so it matches the features query
+func TestSQLFeatureCountFilters(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	param := &QueryParam{Crs: 4326, Precision: -1, Limit: 10, Offset: 20,
+		Bbox: &Extent{Minx: 0, Miny: 0, Maxx: 1, Maxy: 1}, BboxCrs: 4326,
+		TimeColumn: "t", Datetime: &TimeInterval{Start: &start},
+		Filter:    []*PropertyFilter{{Name: "name", Value: "a"}},
+		FilterSql: "\"pop\" > 1",
+		GeomType:  "Point",
+	}
+	sql, vals := sqlFeatureCount(tbl, param, &PropertyFilter{Name: "org", Value: "acme"})
+	checkSQL(t, sql, "SELECT count(*) FROM \"public\".\"pts\"  WHERE  ST_Intersects(\"geom\", ST_MakeEnvelope(0, 0, 1, 1, 4326))"+
+		"  AND  \"t\" >= $3::timestamptz  AND \"name\" = $1 AND \"org\" = $2 AND (\"pop\" > 1) AND ST_GeometryType(\"geom\") = 'ST_Point';")
+	featuresSQL, featuresVals := sqlFeatures(tbl, param, &PropertyFilter{Name: "org", Value: "acme"})
+	where := sql[strings.Index(sql, " WHERE ") : len(sql)-1]
+	if !strings.Contains(featuresSQL, where) {
+		t.Errorf("Feature count conditions should be those of the features query: %v", featuresSQL)
+	}
+	if !reflect.DeepEqual(vals, featuresVals) {
+		t.Errorf("Feature count query should have the features query values: %v", vals)
+	}
+}
+
+func TestSQLFacets(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326}
+	param := &QueryParam{Crs: 4326, Limit: 100, Filter: []*PropertyFilter{{Name: "name", Value: "a"}}}
+	sql, vals := sqlFacets(tbl, "region", param, nil)
+	checkSQL(t, sql, "SELECT \"region\", count(*) FROM \"public\".\"pts\"  WHERE \"name\" = $1 GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT 100;")
+	if !reflect.DeepEqual(vals, []interface{}{"a"}) {
+		t.Errorf("Facets query should have filter values: %v", vals)
+	}
+}
+
+func TestSQLFeaturesSqlCollection(t *testing.T) {
+	tbl := &Table{ID: "busy_stops", Table: "busy_stops", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"},
+		Sql:           "SELECT id, geom, count FROM stops WHERE count >= :min_count AND day = :day::date",
+		SqlParameters: []SqlParameter{{Name: "min_count", Type: SqlParamTypeInt}, {Name: "day", Type: SqlParamTypeText}}}
+	param := &QueryParam{Crs: 4326, Limit: 10, Columns: []string{"count"},
+		Filter: []*PropertyFilter{{Name: "count", Value: "5"}}, SqlArgs: []interface{}{int64(3), "2024-01-01"}}
+	sql, vals := sqlFeatures(tbl, param, nil)
+	if !strings.Contains(sql, "FROM (SELECT id, geom, count FROM stops WHERE count >= $2::bigint AND day = $3::text::date) AS _sql  WHERE \"count\" = $1") {
+		t.Errorf("SQL collection query should bind parameters after the filter values: %v", sql)
+	}
+	if !reflect.DeepEqual(vals, []interface{}{"5", int64(3), "2024-01-01"}) {
+		t.Errorf("SQL collection query should have filter and parameter values: %v", vals)
+	}
+	param = &QueryParam{Crs: 4326, Limit: 10, Sample: 10, SqlArgs: []interface{}{int64(3), "2024-01-01"}}
+	sql, _ = sqlFeatures(tbl, param, nil)
+	if !strings.Contains(sql, "WHERE  random() < 0.1") || strings.Contains(sql, "TABLESAMPLE") {
+		t.Errorf("SQL collection query should sample by a filter: %v", sql)
+	}
+	sql = sqlFeature(tbl, param, nil)
+	if !strings.Contains(sql, "FROM (SELECT id, geom, count FROM stops WHERE count >= $2::bigint") {
+		t.Errorf("SQL collection feature query should bind parameters after the id: %v", sql)
+	}
+	checkSQL(t, sqlDescribeSqlCollection(tbl),
+		"SELECT * FROM (SELECT id, geom, count FROM stops WHERE count >= NULL::bigint AND day = NULL::text::date) AS _sql LIMIT 0")
+}
+
+func TestSQLGeomColFlipAxes(t *testing.T) {
+	param := &QueryParam{Crs: 4258, Precision: -1, FlipAxes: true}
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( ST_FlipCoordinates(ST_Transform( (\"geom\")::geometry, 4258))  ) AS _geojson")
+}
+
+func TestSQLGeomColPrecisionTransform(t *testing.T) {
+	param := &QueryParam{Crs: 3857, Precision: 2}
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( ST_Transform( (\"geom\")::geometry, 3857) ,2 ) AS _geojson")
+	//-- the precision rounds after any transform functions are applied
+	param.TransformFuns = []TransformFunction{{Name: "ST_Centroid"}}
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( ST_Transform( (ST_Centroid( \"geom\" ))::geometry, 3857) ,2 ) AS _geojson")
+	param.TransformFuns = nil
+	param.Precision = 0
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( ST_Transform( (\"geom\")::geometry, 3857) ,0 ) AS _geojson")
+	param.Precision = -1
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( ST_Transform( (\"geom\")::geometry, 3857)  ) AS _geojson")
+	//-- no transform is needed for the source CRS
+	param.Crs = 4326
+	param.Precision = 2
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( \"geom\" ,2 ) AS _geojson")
+}
+
+func TestSQLGeomColPrecisionMode(t *testing.T) {
+	//-- coordinates reduced as they are read are encoded at full precision
+	param := &QueryParam{Crs: 4326, Precision: 2, PrecisionMode: PrecisionModeTruncate}
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( \"geom\" ,15 ) AS _geojson")
+	param.PrecisionMode = PrecisionModeRound
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( \"geom\" ,2 ) AS _geojson")
+}
+
+func TestSQLGeomColMaxPoints(t *testing.T) {
+	param := &QueryParam{Crs: 4326, Precision: -1, MaxGeomPoints: 1000}
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( CASE WHEN ST_NPoints(_geom) > 1000 THEN ST_Simplify(_geom, "+
+			"greatest(ST_XMax(_geom) - ST_XMin(_geom), ST_YMax(_geom) - ST_YMin(_geom)) / 1000, true) "+
+			"ELSE _geom END  ) AS _geojson")
+	param.OmitComplexGeom = true
+	param.EmptyGeometry = EmptyGeometryNull
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( CASE WHEN ST_NPoints(_geom) > 1000 THEN NULL ELSE CASE WHEN ST_IsEmpty(_geom) THEN NULL ELSE _geom END END  ) AS _geojson")
+	param.MaxGeomPoints = 0
+	param.MakeValid = true
+	param.EmptyGeometry = ""
+	checkSQL(t, sqlGeomCol("geom", 4326, param), "ST_AsGeoJSON( ST_MakeValid(\"geom\")  ) AS _geojson")
+}
+
+func TestSQLFeaturesMaxPoints(t *testing.T) {
+	//-- the repaired geometry is computed once, and omitted geometry is indicated by a property
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326}
+	param := &QueryParam{Columns: []string{"name"}, Crs: 4326, Precision: -1, PropPrecision: -1, Limit: 10,
+		MaxGeomPoints: 1000, OmitComplexGeom: true, MakeValid: true}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	checkSQL(t, sql, "SELECT ST_AsGeoJSON( CASE WHEN ST_NPoints(_geom) > 1000 THEN NULL ELSE _geom END  ) AS _geojson , "+
+		"\"name\"::text, ST_NPoints(_geom) > 1000 AS _geom_omitted, "+sqlRowIDCol+" FROM \"public\".\"pts\" "+
+		"CROSS JOIN LATERAL (SELECT ST_MakeValid(\"geom\") AS _geom OFFSET 0) AS _geom_source     LIMIT 10;")
+	if names := tbl.FeatureOutputNames(param); !reflect.DeepEqual(names, []string{"name", GeometryOmittedColumn}) {
+		t.Errorf("property names should include the omitted geometry property: %v", names)
+	}
+	//-- the row id column follows the omitted geometry column
+	if indexes := featuresIDColIndexes(tbl, param); !reflect.DeepEqual(indexes, []int{2}) {
+		t.Errorf("row id column index: %v", indexes)
+	}
+	param.Distinct = true
+	sql, _ = sqlFeatures(tbl, param, nil)
+	if strings.Contains(sql, "_geom") {
+		t.Errorf("Distinct features query should not limit geometry: %v", sql)
+	}
+	if names := tbl.FeatureOutputNames(param); !reflect.DeepEqual(names, []string{"name"}) {
+		t.Errorf("distinct features should not have the omitted geometry property: %v", names)
+	}
+}
+
+func TestSQLGeomColMetricTransform(t *testing.T) {
+	param := &QueryParam{Crs: 4326, Precision: -1}
+	param.TransformFuns = []TransformFunction{{Name: "ST_Buffer", Arg: []string{"100"}, IsMetric: true}}
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( ST_Transform( ST_Buffer( ST_Transform( (\"geom\")::geometry, _ST_BestSRID( (\"geom\")::geography ) ), 100 ), 4326 )  ) AS _geojson")
+	param.TransformFuns[0].MetricSrid = 3857
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"ST_AsGeoJSON( ST_Transform( ST_Buffer( ST_Transform( (\"geom\")::geometry, 3857 ), 100 ), 4326 )  ) AS _geojson")
+	//-- a projected source CRS is already metric
+	param.Crs = 3005
+	checkSQL(t, sqlGeomCol("geom", 3005, param),
+		"ST_AsGeoJSON( ST_Buffer( \"geom\", 100 )  ) AS _geojson")
+}
+
+func TestSQLOrderBy(t *testing.T) {
+	checkSQL(t, sqlOrderBy([]Sorting{{Name: "name", IsDesc: true}}, "geom", 4326), "ORDER BY \"name\" DESC ")
+	checkSQL(t, sqlOrderBy([]Sorting{{Name: "name", Nulls: NullsLast}}, "geom", 4326), "ORDER BY \"name\"  NULLS LAST")
+	checkSQL(t, sqlOrderBy([]Sorting{{Name: "attrs.priority", IsPath: true}}, "geom", 4326), "ORDER BY (\"attrs\"->>'priority')  ")
+	checkSQL(t, sqlOrderBy([]Sorting{{Name: "attrs.a.b", IsPath: true, Cast: "integer", IsDesc: true}}, "geom", 4326),
+		"ORDER BY (\"attrs\"->'a'->>'b')::integer DESC ")
+	checkSQL(t, sqlOrderBy([]Sorting{{Name: "name", IsDesc: true}, {Name: "attrs.priority", IsPath: true, Nulls: NullsFirst}}, "geom", 4326),
+		"ORDER BY \"name\" DESC , (\"attrs\"->>'priority')  NULLS FIRST")
+	pt := &Point{X: -123.1, Y: 49.25}
+	checkSQL(t, sqlOrderBy([]Sorting{{Name: "distance", Point: pt}}, "geom", 4326),
+		"ORDER BY \"geom\" <-> ST_SetSRID(ST_MakePoint(-123.1, 49.25), 4326)  ")
+	checkSQL(t, sqlOrderBy([]Sorting{{Name: "distance", Point: pt}}, "geom", 3005),
+		"ORDER BY \"geom\" <-> ST_Transform(ST_SetSRID(ST_MakePoint(-123.1, 49.25), 4326), 3005)  ")
+}
+
+func TestSQLGeomColGML(t *testing.T) {
+	param := &QueryParam{Crs: 3857, Precision: -1, GeomFormat: GeomFormatGML}
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"to_json(ST_AsGML(3, ST_Transform( (\"geom\")::geometry, 3857), 15, 0, 'gml'))::text AS _gml")
+	param.Precision = 2
+	checkSQL(t, sqlGeomCol("geom", 3857, param),
+		"to_json(ST_AsGML(3, \"geom\", 2, 0, 'gml'))::text AS _gml")
+}
+
+func TestSQLGeomColEncodings(t *testing.T) {
+	param := &QueryParam{Crs: 4326, Precision: 3, GeomFormat: GeomFormatWKT}
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"to_json(ST_AsText( \"geom\" ,3 ))::text AS _geojson")
+	param.GeomFormat = GeomFormatWKBHex
+	checkSQL(t, sqlGeomCol("geom", 4326, param),
+		"to_json(encode(ST_AsBinary( (\"geom\")::geometry ), 'hex'))::text AS _geojson")
+	param.GeomFormat = GeomFormatEWKB
+	checkSQL(t, sqlGeomCol("geom", 3857, param),
+		"to_json(encode(ST_AsEWKB( (ST_Transform( (\"geom\")::geometry, 4326))::geometry ), 'hex'))::text AS _geojson")
+}
+
+func TestSQLColListPropertyPath(t *testing.T) {
+	dbtypes := map[string]string{"name": "text", "attrs": "jsonb", "a.b": "text"}
+	checkSQL(t, sqlColList([]string{"name", "attrs.color"}, dbtypes, -1, false),
+		"\"name\"::text,\"attrs\"->>'color' AS \"attrs.color\"")
+	checkSQL(t, sqlColList([]string{"attrs.style.color"}, dbtypes, -1, false),
+		"\"attrs\"->'style'->>'color' AS \"attrs.style.color\"")
+	checkSQL(t, sqlColList([]string{"attrs.it's"}, dbtypes, -1, false),
+		"\"attrs\"->>'it''s' AS \"attrs.it's\"")
+	// column names containing the separator are not paths
+	checkSQL(t, sqlColList([]string{"a.b"}, dbtypes, -1, false), "\"a.b\"::text")
+}
+
+func TestSQLColListPrecision(t *testing.T) {
+	dbtypes := map[string]string{"name": "text", "id": "int4", "area": "float8", "len": "float4", "pop": "numeric"}
+	//-- floating point columns are rounded to their own type, so they are not numeric values
+	checkSQL(t, sqlColList([]string{"name", "id", "area", "len", "pop"}, dbtypes, 2, false),
+		"\"name\"::text,\"id\",round(\"area\"::numeric, 2)::float8,round(\"len\"::numeric, 2)::float4,round(\"pop\"::numeric, 2)")
+	checkSQL(t, sqlColList([]string{"area"}, dbtypes, -1, false), "\"area\"")
+}
+
+func TestSQLColListTypes(t *testing.T) {
+	savedNumeric := conf.Configuration().Database.NumericAsString
+	defer func() {
+		conf.Configuration().Database.NumericAsString = savedNumeric
+	}()
+	dbtypes := map[string]string{"id": "int8", "ok": "bool", "t": "timestamptz", "d": "date", "pop": "numeric", "doc": "tsvector"}
+	conf.Configuration().Database.NumericAsString = false
+	checkSQL(t, sqlColList([]string{"id", "ok", "t", "d", "pop", "doc"}, dbtypes, -1, false),
+		"\"id\",\"ok\",to_json(\"t\") #>> '{}' AS \"t\",to_json(\"d\") #>> '{}' AS \"d\",\"pop\",\"doc\"::text")
+	conf.Configuration().Database.NumericAsString = true
+	checkSQL(t, sqlColList([]string{"pop"}, dbtypes, -1, false), "\"pop\"::text")
+	checkSQL(t, sqlColList([]string{"pop"}, dbtypes, 1, false), "round(\"pop\"::numeric, 1)")
+}
+
+func TestSQLPropColsComputed(t *testing.T) {
+	tbl := &Table{DbTypes: map[string]string{"name": "text", "id": "int4"}}
+	param := &QueryParam{
+		Columns:       []string{"name", "area", "buf"},
+		PropPrecision: -1,
+		Computed: []ComputedProperty{
+			{Name: "area", Column: "geom", Function: TransformFunction{Name: "ST_Area"}},
+			{Name: "buf", Column: "geom", Function: TransformFunction{Name: "ST_Buffer", Arg: []string{"10"}}},
+		},
+	}
+	checkSQL(t, sqlPropCols(tbl, param),
+		", \"name\"::text,ST_Area( \"geom\" ) AS \"area\",ST_Buffer( \"geom\", 10 ) AS \"buf\"")
+}
+
+func TestSQLBBoxFilterAntimeridian(t *testing.T) {
+	//-- Pacific-spanning bbox includes features east and west of the antimeridian
+	bbox := &Extent{Minx: 170, Miny: -20, Maxx: -170, Maxy: 10}
+	checkSQL(t, sqlBBoxFilter("geom", 4326, bbox, 4326),
+		" ( ST_Intersects(\"geom\", ST_MakeEnvelope(170, -20, 180, 10, 4326))  OR  ST_Intersects(\"geom\", ST_MakeEnvelope(-180, -20, -170, 10, 4326)) ) ")
+	checkSQL(t, sqlBBoxFilter("geom", 3857, bbox, 4326),
+		" ( ST_Intersects(\"geom\", ST_Transform( ST_MakeEnvelope(170, -20, 180, 10, 4326), 3857))  OR  ST_Intersects(\"geom\", ST_Transform( ST_MakeEnvelope(-180, -20, -170, 10, 4326), 3857)) ) ")
+	//-- non-crossing bbox is unaffected
+	bbox = &Extent{Minx: -170, Miny: -20, Maxx: 170, Maxy: 10}
+	checkSQL(t, sqlBBoxFilter("geom", 4326, bbox, 4326),
+		" ST_Intersects(\"geom\", ST_MakeEnvelope(-170, -20, 170, 10, 4326)) ")
+}
+
+func TestSQLFeaturesBboxBuffer(t *testing.T) {
+	tbl := &Table{Schema: "public", Table: "pts", GeometryColumn: "geom", Srid: 4326, IDColumns: []string{"id"}}
+	param := &QueryParam{Crs: 4326, Limit: 10, Bbox: &Extent{Minx: 0, Miny: 0, Maxx: 1, Maxy: 1}, BboxCrs: 4326, BboxBuffer: 0.5}
+	sql, _ := sqlFeatures(tbl, param, nil)
+	if !strings.Contains(sql, "ST_MakeEnvelope(-0.5, -0.5, 1.5, 1.5, 4326)") {
+		t.Errorf("Bbox should be expanded by the buffer: %v", sql)
+	}
+	if param.Bbox.Minx != 0 {
+		t.Errorf("Bbox parameter should not be modified: %v", param.Bbox)
+	}
+}
+
+func TestSQLTimeFilter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	sql, vals := sqlTimeFilter("obs_time", &TimeInterval{Start: &start, End: &end}, []interface{}{"a"})
+	checkSQL(t, sql, " \"obs_time\" >= $2::timestamptz AND \"obs_time\" <= $3::timestamptz ")
+	if len(vals) != 3 || vals[1] != start || vals[2] != end {
+		t.Errorf("Time filter should append time args: %v", vals)
+	}
+	sql, _ = sqlTimeFilter("obs_time", &TimeInterval{Start: &start, End: &start}, nil)
+	checkSQL(t, sql, " \"obs_time\" = $1::timestamptz ")
+	sql, _ = sqlTimeFilter("obs_time", &TimeInterval{End: &end}, nil)
+	checkSQL(t, sql, " \"obs_time\" <= $1::timestamptz ")
+	//-- no filter if collection has no time column
+	sql, vals = sqlTimeFilter("", &TimeInterval{Start: &start}, nil)
+	checkSQL(t, sql, "")
+	if len(vals) != 0 {
+		t.Errorf("Time filter without column should not add args: %v", vals)
+	}
+}
+
+func TestSQLTimeRangeFilter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	sql, vals := sqlTimeRangeFilter("valid_from", "valid_to", &TimeInterval{Start: &start, End: &end}, []interface{}{"a"})
+	checkSQL(t, sql, " (\"valid_from\" IS NULL OR \"valid_from\" <= $2::timestamptz) AND (\"valid_to\" IS NULL OR \"valid_to\" >= $3::timestamptz) ")
+	if len(vals) != 3 || vals[1] != end || vals[2] != start {
+		t.Errorf("Time range filter should append time args: %v", vals)
+	}
+	//-- an instant is within the range
+	sql, _ = sqlTimeRangeFilter("valid_from", "valid_to", &TimeInterval{Start: &start, End: &start}, nil)
+	checkSQL(t, sql, " (\"valid_from\" IS NULL OR \"valid_from\" <= $1::timestamptz) AND (\"valid_to\" IS NULL OR \"valid_to\" >= $2::timestamptz) ")
+	sql, _ = sqlTimeRangeFilter("valid_from", "valid_to", &TimeInterval{Start: &start}, nil)
+	checkSQL(t, sql, " (\"valid_to\" IS NULL OR \"valid_to\" >= $1::timestamptz) ")
+
+	tbl := &Table{ID: "obs", Table: "obs", Schema: "public", GeometryColumn: "geom", Srid: 4326}
+	param := &QueryParam{Datetime: &TimeInterval{Start: &start}, TimeColumn: "valid_from", TimeEndColumn: "valid_to"}
+	_, sqlWhere, _ := sqlFeaturesSource(tbl, param, nil)
+	if !strings.Contains(sqlWhere, "\"valid_to\" >= $1::timestamptz") {
+		t.Errorf("Features source should filter by the time range: %v", sqlWhere)
+	}
+}
+
+func TestSQLGeomFilter(t *testing.T) {
+	filter := &GeometryFilter{Op: GeometryFilterOpWithin, Geom: "POINT(1 2)", Srid: 4326}
+	sql, vals := sqlGeomFilter("geom", 4326, filter, []interface{}{"a"})
+	checkSQL(t, sql, " ST_Within(\"geom\", ST_GeomFromText($2::text, 4326)) ")
+	if len(vals) != 2 || vals[1] != "POINT(1 2)" {
+		t.Errorf("Geometry filter should append geometry arg: %v", vals)
+	}
+	filter = &GeometryFilter{Op: GeometryFilterOpIntersects, Geom: "{}", IsGeoJSON: true, Srid: 4326}
+	sql, _ = sqlGeomFilter("geom", 3005, filter, nil)
+	checkSQL(t, sql, " ST_Intersects(\"geom\", ST_Transform(ST_SetSRID(ST_GeomFromGeoJSON($1::text), 4326), 3005)) ")
+}
+
+func TestSQLGeomTypeFilter(t *testing.T) {
+	checkSQL(t, sqlGeomTypeFilter("geom", "Polygon"), "ST_GeometryType(\"geom\") = 'ST_Polygon'")
+	checkSQL(t, sqlGeomTypeFilter("geom", ""), "")
+	checkSQL(t, sqlGeomTypeFilter("", "Polygon"), "")
+
+	tbl := &Table{Schema: "public", Table: "t", GeometryColumn: "geom", Srid: 4326}
+	sql, _ := sqlFeatures(tbl, &QueryParam{GeomType: "MultiPoint", Limit: -1}, nil)
+	if !strings.Contains(sql, "WHERE ST_GeometryType(\"geom\") = 'ST_MultiPoint'") {
+		t.Errorf("features query should filter by geometry type: %v", sql)
+	}
+}
+
+func TestIsGeometryMixed(t *testing.T) {
+	for geomType, isMixed := range map[string]bool{
+		"GEOMETRY": true, "GEOMETRYZ": true, "GeometryCollection": true,
+		"POLYGON": false, "MultiLineStringZ": false, "": false,
+	} {
+		tbl := &Table{GeometryType: geomType}
+		if tbl.IsGeometryMixed() != isMixed {
+			t.Errorf("IsGeometryMixed(%v) should be %v", geomType, isMixed)
+		}
+	}
+}
+
+func TestOutputNamesUnique(t *testing.T) {
+	tbl := &Table{PropertyAliases: map[string]string{"name": "label"}}
+	names := tbl.OutputNames([]string{"name", "attrs.color", "style.color", "attrs.size", "label2.x"})
+	expected := []string{"label", "attrs.color", "style.color", "size", "x"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("output names: expected %v, actual %v", expected, names)
+	}
+	//-- a path named the same as a column is named by its path
+	names = PropertyNames([]string{"color", "attrs.color"})
+	if !reflect.DeepEqual(names, []string{"color", "attrs.color"}) {
+		t.Errorf("property names should be unique: %v", names)
+	}
+}
+
+func TestFeatureIDArgs(t *testing.T) {
+	single := &Table{IDColumns: []string{"id"}}
+	checkIDArgs(t, single, "12", []interface{}{"12"}, true)
+	checkIDArgs(t, single, "1,2", []interface{}{"1,2"}, true)
+
+	composite := &Table{IDColumns: []string{"k1", "k2"}}
+	checkIDArgs(t, composite, "1,2", []interface{}{"1", "2"}, true)
+	checkIDArgs(t, composite, "1", nil, false)
+	checkIDArgs(t, composite, "1,2,3", nil, false)
+	checkIDArgs(t, composite, "a%2Cb,c%252C", []interface{}{"a,b", "c%2C"}, true)
+
+	checkIDArgs(t, &Table{}, "1", nil, false)
+}
+
+func TestFeatureIDEscaped(t *testing.T) {
+	keyVals := []string{"a,b", "50%", "c"}
+	id := FeatureID(keyVals)
+	if id != "a%2Cb,50%25,c" {
+		t.Errorf("feature id of %v: %v", keyVals, id)
+	}
+	if split := SplitFeatureID(id, 3); !reflect.DeepEqual(split, keyVals) {
+		t.Errorf("feature id %v: expected %v, actual %v", id, keyVals, split)
+	}
+	if id := FeatureID([]string{"a,b"}); id != "a,b" {
+		t.Errorf("single key feature id should not be escaped: %v", id)
+	}
+}
+
+func checkSQL(t *testing.T, actual string, expected string) {
+	t.Helper()
+	if actual != expected {
+		t.Errorf("SQL mismatch\n  expected: %v\n  actual:   %v", expected, actual)
+	}
+}
+
+func checkIDArgs(t *testing.T, tbl *Table, id string, expected []interface{}, expectedValid bool) {
+	t.Helper()
+	args, isValid := featureIDArgs(tbl, id)
+	if isValid != expectedValid || !reflect.DeepEqual(args, expected) {
+		t.Errorf("feature id %v: expected %v %v, actual %v %v", id, expected, expectedValid, args, isValid)
+	}
+}
@@ -0,0 +1,232 @@
+package service
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/CrunchyData/pg_featureserv/internal/api"
+	"github.com/CrunchyData/pg_featureserv/internal/conf"
+	"github.com/CrunchyData/pg_featureserv/internal/data"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	headerAPIKey        = "X-API-Key"
+	headerAuthorization = "Authorization"
+	bearerPrefix        = "Bearer "
+)
+
+type contextKey string
+
+const contextKeyTenant contextKey = "tenant"
+
+// jwtKey is the key for verifying JWT signatures
+var jwtKey interface{}
+
+// pathsPublic are always accessible without an API key
+var pathsPublic = map[string]bool{
+	"healthz": true,
+	"readyz":  true,
+}
+
+// pathsMetadata are accessible without an API key if metadata is configured to be public
+var pathsMetadata = map[string]bool{
+	"":            true,
+	"home":        true,
+	"index":       true,
+	"api":         true,
+	"conformance": true,
+}
+
+// pathsAdmin are administrative requests, which require the admin key instead of an API key
+var pathsAdmin = map[string]bool{
+	"refresh": true,
+}
+
+// apiKeyMiddleware rejects requests which do not provide a valid API key,
+// if API keys are configured
+func apiKeyMiddleware(basePath string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			confAuth := conf.Configuration().Auth
+			//-- administrative requests are authorized by their handler, with the admin key
+			if len(confAuth.ApiKeys) == 0 || isPublicPath(basePath, r.URL.Path, confAuth.PublicMetadata) ||
+				isAdminPath(basePath, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !isValidAPIKey(requestAPIKey(r), confAuth.ApiKeys) {
+				log.Debugf("Request rejected: %v", api.ErrMsgUnauthorized)
+				http.Error(w, api.Message(api.RequestedLang(r), api.ErrMsgUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestAPIKey is the API key of a request, from the header or the query parameter
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get(headerAPIKey); key != "" {
+		return key
+	}
+	return r.URL.Query().Get(api.ParamApiKey)
+}
+
+// isPublicPath tests if a request path is accessible without an API key.
+// The path name is compared without the base path and any format extension
+func isPublicPath(basePath string, urlPath string, isMetadataPublic bool) bool {
+	name := pathName(basePath, urlPath)
+	if pathsPublic[name] {
+		return true
+	}
+	return isMetadataPublic && pathsMetadata[name]
+}
+
+// isAdminPath tests if a request path is an administrative request
+func isAdminPath(basePath string, urlPath string) bool {
+	return pathsAdmin[pathName(basePath, urlPath)]
+}
+
+func pathName(basePath string, urlPath string) string {
+	name := strings.Trim(strings.TrimPrefix(urlPath, basePath), "/")
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// isAdminRequest tests if a request provides the configured admin key
+func isAdminRequest(r *http.Request) bool {
+	adminKey := conf.Configuration().Auth.AdminKey
+	return adminKey != "" && isValidAPIKey(requestAPIKey(r), []string{adminKey})
+}
+
+// isValidAPIKey tests if a key matches one of the allowed keys.
+// Key hashes are compared in constant time, to avoid leaking key contents or lengths
+func isValidAPIKey(key string, keys []string) bool {
+	if key == "" {
+		return false
+	}
+	keyHash := sha256.Sum256([]byte(key))
+	isValid := 0
+	for _, k := range keys {
+		kHash := sha256.Sum256([]byte(k))
+		isValid |= subtle.ConstantTimeCompare(keyHash[:], kHash[:])
+	}
+	return isValid == 1
+}
+
+// initAuth loads the configured JWT verification key (if any)
+func initAuth() {
+	confAuth := conf.Configuration().Auth
+	jwtKey = nil
+	switch confAuth.JwtAlgorithm {
+	case "":
+		return
+	case jwt.SigningMethodHS256.Alg():
+		jwtKey = []byte(confAuth.JwtKey)
+	case jwt.SigningMethodRS256.Alg():
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(confAuth.JwtKey))
+		if err != nil {
+			log.Fatalf("Invalid JwtKey: %v", err)
+		}
+		jwtKey = key
+	default:
+		log.Fatalf("Unsupported JwtAlgorithm: %v", confAuth.JwtAlgorithm)
+	}
+	log.Infof("JWT authorization enabled (%v)", confAuth.JwtAlgorithm)
+}
+
+// jwtMiddleware rejects requests which do not provide a valid JWT,
+// if JWT authorization is configured.
+// The tenant claim of the token is added to the request context
+func jwtMiddleware(basePath string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			confAuth := conf.Configuration().Auth
+			if jwtKey == nil || isPublicPath(basePath, r.URL.Path, confAuth.PublicMetadata) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			claims, err := parseToken(r.Header.Get(headerAuthorization))
+			if err != nil {
+				log.Debugf("Request rejected: %v: %v", api.ErrMsgInvalidToken, err)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, api.Message(api.RequestedLang(r), api.ErrMsgInvalidToken), http.StatusUnauthorized)
+				return
+			}
+			tenant := ""
+			if val, ok := claims[confAuth.TenantClaim]; ok && val != nil {
+				tenant = fmt.Sprintf("%v", val)
+			}
+			ctx := context.WithValue(r.Context(), contextKeyTenant, tenant)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// parseToken verifies a bearer token and returns its claims.
+// The token must be signed with the configured algorithm
+func parseToken(authHeader string) (jwt.MapClaims, error) {
+	if !strings.HasPrefix(authHeader, bearerPrefix) {
+		return nil, fmt.Errorf("no bearer token")
+	}
+	tokenStr := strings.TrimSpace(strings.TrimPrefix(authHeader, bearerPrefix))
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != conf.Configuration().Auth.JwtAlgorithm {
+			return nil, fmt.Errorf("unexpected signing algorithm: %v", token.Method.Alg())
+		}
+		return jwtKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// isCollectionHidden tests if a collection is hidden because it has no tenant column
+func isCollectionHidden(name string) bool {
+	return jwtKey != nil && conf.Configuration().Auth.HideNonTenantCollections &&
+		conf.Configuration().CollectionConfig(name).TenantColumn == ""
+}
+
+// tenantContext provides the context for accessing collection data.
+// For a collection with a tenant column, data access is restricted
+// to the rows of the request tenant
+func tenantContext(r *http.Request, name string) (context.Context, *appError) {
+	ctx := r.Context()
+	if jwtKey == nil {
+		return ctx, nil
+	}
+	if isCollectionHidden(name) {
+		return ctx, appErrorNotFoundFmt(nil, api.ErrMsgCollectionNotFound, name)
+	}
+	tenantCol := conf.Configuration().CollectionConfig(name).TenantColumn
+	if tenantCol == "" {
+		return ctx, nil
+	}
+	tenant, _ := ctx.Value(contextKeyTenant).(string)
+	if tenant == "" {
+		return ctx, appErrorMsg(nil, api.ErrMsgNoTenantClaim, http.StatusForbidden)
+	}
+	return data.WithTenantFilter(ctx, &data.PropertyFilter{Name: tenantCol, Value: tenant}), nil
+}
@@ -0,0 +1,303 @@
+package service
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/CrunchyData/pg_featureserv/internal/api"
+	"github.com/CrunchyData/pg_featureserv/internal/conf"
+)
+
+const (
+	headerCacheControl    = "Cache-Control"
+	headerLastModified    = "Last-Modified"
+	headerIfModifiedSince = "If-Modified-Since"
+)
+
+// responses is the shared cache of collection data responses
+var responses *responseCache
+
+// responseCache is an LRU cache of serialized responses,
+// limited by number of entries and total size
+type responseCache struct {
+	lock       sync.Mutex
+	maxEntries int
+	maxBytes   int
+	size       int
+	entries    map[string]*list.Element
+	lru        *list.List
+	hits       int64
+	misses     int64
+}
+
+type cacheEntry struct {
+	key string
+	// collection is the name of the collection the response is for
+	collection string
+	// header holds the response headers set by the handler
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// initCache creates the response cache using the configured limits
+func initCache() {
+	confCache := conf.Configuration().Cache
+	responses = newResponseCache(confCache.MaxEntries, confCache.MaxSizeMB*1024*1024)
+}
+
+func newResponseCache(maxEntries int, maxBytes int) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// get returns the unexpired entry for a key, if any
+func (c *responseCache) get(key string, now time.Time) (*cacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if ok {
+		entry := elem.Value.(*cacheEntry)
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			c.hits++
+			return entry, true
+		}
+		c.remove(elem)
+	}
+	c.misses++
+	return nil, false
+}
+
+// put adds an entry, evicting the least recently used entries
+// if the cache limits are exceeded
+func (c *responseCache) put(entry *cacheEntry) {
+	if len(entry.body) > c.maxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += len(entry.body)
+	for c.lru.Len() > c.maxEntries || c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.body)
+}
+
+// purge removes the entries for a collection
+func (c *responseCache) purge(collection string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*cacheEntry).collection == collection {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// purgeCache removes the cached responses for a collection,
+// so that reads after its features are changed are not stale.
+// Other service instances keep their cached responses until they expire
+func purgeCache(collection string) {
+	if responses != nil {
+		responses.purge(collection)
+	}
+}
+
+// stats returns the number of entries, their total size, and the hit and miss counts
+func (c *responseCache) stats() (int, int, int64, int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len(), c.size, c.hits, c.misses
+}
+
+// cacheTTL is the time responses for a collection are cached for.
+// A collection setting of less than zero disables caching it
+func cacheTTL(name string) time.Duration {
+	ttlSec := conf.Configuration().Cache.TTLSec
+	collTTLSec := conf.Configuration().CollectionConfig(name).CacheTTLSec
+	if collTTLSec != 0 {
+		ttlSec = collTTLSec
+	}
+	if ttlSec <= 0 {
+		return 0
+	}
+	return time.Duration(ttlSec) * time.Second
+}
+
+// isCacheable tests if a request can use the shared cache.
+// Requests with authorization are not cached, to avoid leaking tenant data
+func isCacheable(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if r.Header.Get(headerAuthorization) != "" {
+		return false
+	}
+	//-- partial responses are not cached
+	if r.Header.Get(headerRange) != "" {
+		return false
+	}
+	_, hasTenant := r.Context().Value(contextKeyTenant).(string)
+	return !hasTenant
+}
+
+// cacheKey is the full request URL and the negotiated format.
+// The URL base is included since responses contain links
+func cacheKey(r *http.Request) string {
+	return serveURLBase(r) + r.URL.RequestURI() + "|" + api.RequestedFormat(r)
+}
+
+// cached wraps a collection data handler to use the response cache
+func cached(handler func(http.ResponseWriter, *http.Request) *appError) func(http.ResponseWriter, *http.Request) *appError {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		name := getRequestVar(routeVarID, r)
+		ttl := cacheTTL(name)
+		if responses == nil || ttl <= 0 || !isCacheable(r) {
+			return handler(w, r)
+		}
+		key := cacheKey(r)
+		if entry, ok := responses.get(key, time.Now()); ok {
+			return writeCached(w, r, entry)
+		}
+		headerBefore := w.Header().Clone()
+		rec := &cacheRecorder{ResponseWriter: w, ttl: ttl, maxBytes: responses.maxBytes}
+		e := handler(rec, r)
+		if e == nil && rec.status == http.StatusOK && !rec.isTooLarge {
+			responses.put(&cacheEntry{
+				key:        key,
+				collection: name,
+				header:     handlerHeader(headerBefore, w.Header()),
+				body:       rec.body.Bytes(),
+				expires:    time.Now().Add(ttl),
+			})
+		}
+		return e
+	}
+}
+
+// handlerHeader returns the response headers set by a handler.
+// Headers set before the handler (such as CORS headers) depend on the request,
+// so they are not cached.
+// The cache lifetime and content length are set when a cached response is written
+func handlerHeader(before http.Header, after http.Header) http.Header {
+	header := make(http.Header)
+	for name, vals := range after {
+		if name == headerCacheControl || name == "Content-Length" || reflect.DeepEqual(before[name], vals) {
+			continue
+		}
+		header[name] = append([]string(nil), vals...)
+	}
+	return header
+}
+
+// writeCached writes a cached response with the headers of the original response.
+// Conditional requests are answered as by the original handler
+func writeCached(w http.ResponseWriter, r *http.Request, entry *cacheEntry) *appError {
+	for name, vals := range entry.header {
+		w.Header()[name] = append([]string(nil), vals...)
+	}
+	w.Header().Set(headerCacheControl, fmt.Sprintf("max-age=%d", int(time.Until(entry.expires).Seconds())))
+	//-- exports with an ETag support conditional and range requests
+	if w.Header().Get(headerETag) != "" {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(entry.body))
+		return nil
+	}
+	if lastModified, err := http.ParseTime(w.Header().Get(headerLastModified)); err == nil && isNotModifiedSince(r, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	return writeResponse(w, w.Header().Get("Content-Type"), entry.body)
+}
+
+// cacheRecorder writes a response and records it for caching.
+// Responses larger than the cache size are not recorded
+type cacheRecorder struct {
+	http.ResponseWriter
+	ttl        time.Duration
+	maxBytes   int
+	status     int
+	body       bytes.Buffer
+	isTooLarge bool
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	rec.status = status
+	if status == http.StatusOK {
+		rec.Header().Set(headerCacheControl, fmt.Sprintf("max-age=%d", int(rec.ttl.Seconds())))
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.isTooLarge {
+		if rec.body.Len()+len(b) > rec.maxBytes {
+			rec.isTooLarge = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *cacheRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// handleMetrics reports service metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) *appError {
+	var entries, size int
+	var hits, misses int64
+	if responses != nil {
+		entries, size, hits, misses = responses.stats()
+	}
+	var buf bytes.Buffer
+	writeMetric(&buf, "pg_featureserv_cache_hits_total", "counter", "Responses served from the cache", hits)
+	writeMetric(&buf, "pg_featureserv_cache_misses_total", "counter", "Cacheable responses not found in the cache", misses)
+	writeMetric(&buf, "pg_featureserv_cache_entries", "gauge", "Responses in the cache", int64(entries))
+	writeMetric(&buf, "pg_featureserv_cache_size_bytes", "gauge", "Total size of the responses in the cache", int64(size))
+	return writeText(w, api.ContentTypeMetrics, buf.Bytes())
+}
+
+func writeMetric(buf *bytes.Buffer, name string, metricType string, help string, val int64) {
+	fmt.Fprintf(buf, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, metricType, name, val)
+}
@@ -0,0 +1,219 @@
+package service
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/CrunchyData/pg_featureserv/internal/conf"
+)
+
+const (
+	headerOrigin           = "Origin"
+	headerRequestMethod    = "Access-Control-Request-Method"
+	headerRequestHeaders   = "Access-Control-Request-Headers"
+	headerAllowOrigin      = "Access-Control-Allow-Origin"
+	headerAllowMethods     = "Access-Control-Allow-Methods"
+	headerAllowHeaders     = "Access-Control-Allow-Headers"
+	headerAllowCredentials = "Access-Control-Allow-Credentials"
+	headerMaxAge           = "Access-Control-Max-Age"
+	corsWildcard           = "*"
+)
+
+// corsDefaultMethods are the methods allowed by a policy which does not specify any
+var corsDefaultMethods = []string{http.MethodGet, http.MethodHead}
+
+// corsPolicies are the configured CORS policies.
+// The CORSOrigins setting provides a policy for all paths
+func corsPolicies() []conf.Cors {
+	var policies []conf.Cors
+	policies = append(policies, conf.Configuration().Cors...)
+	if origins := conf.Configuration().Server.CORSOrigins; origins != "" {
+		policies = append(policies, conf.Cors{
+			AllowedOrigins: []string{origins},
+			AllowedMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete},
+		})
+	}
+	return policies
+}
+
+// corsHandler adds CORS headers to responses for requests allowed by a CORS policy.
+// Preflight requests are answered directly, so they do not
+// require authorization or access the database.
+// If no policy allows a request, no CORS headers are added
+// and browsers will refuse cross-origin access
+func corsHandler(basePath string, next http.Handler) http.Handler {
+	policies := corsPolicies()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(headerOrigin)
+		isPreflight := r.Method == http.MethodOptions && r.Header.Get(headerRequestMethod) != ""
+		if origin == "" || len(policies) == 0 {
+			if isPreflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", headerOrigin)
+		policy := findCorsPolicy(policies, basePath, r.URL.Path, origin)
+		if isPreflight {
+			if policy != nil {
+				writeCorsPreflight(w, r, policy, origin)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if policy != nil && isCorsMethodAllowed(policy, r.Method) {
+			writeCorsOrigin(w, policy, origin)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// findCorsPolicy returns the first policy which applies to a request path and allows the origin
+func findCorsPolicy(policies []conf.Cors, basePath string, urlPath string, origin string) *conf.Cors {
+	for i := range policies {
+		policy := &policies[i]
+		if isCorsPathMatch(policy.Paths, basePath, urlPath) && isCorsOriginAllowed(policy.AllowedOrigins, origin) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// isCorsPathMatch tests if a request path matches one of the path patterns.
+// Patterns are relative to the base path, and match paths with or without a format extension.
+// A policy with no patterns matches all paths
+func isCorsPathMatch(patterns []string, basePath string, urlPath string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	name := "/" + strings.Trim(strings.TrimPrefix(urlPath, strings.TrimRight(basePath, "/")), "/")
+	nameNoExt := strings.TrimSuffix(name, path.Ext(name))
+	for _, pattern := range patterns {
+		if isMatch, _ := path.Match(pattern, name); isMatch {
+			return true
+		}
+		if isMatch, _ := path.Match(pattern, nameNoExt); isMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// isCorsOriginAllowed tests if an origin matches one of the allowed origins,
+// which may contain * wildcards (e.g. https://*.example.com)
+func isCorsOriginAllowed(allowed []string, origin string) bool {
+	for _, pattern := range allowed {
+		if pattern == corsWildcard {
+			return true
+		}
+		if isMatch, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); isMatch {
+			return true
+		}
+	}
+	return false
+}
+
+func corsMethods(policy *conf.Cors) []string {
+	if len(policy.AllowedMethods) == 0 {
+		return corsDefaultMethods
+	}
+	return policy.AllowedMethods
+}
+
+func isCorsMethodAllowed(policy *conf.Cors, method string) bool {
+	// preflight requests are always answered
+	if method == http.MethodOptions {
+		return true
+	}
+	for _, m := range corsMethods(policy) {
+		if m == corsWildcard || strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCorsOrigin sets the allowed origin of a response.
+// Credentialed requests are not allowed to use a wildcard origin,
+// so the request origin is returned for them.
+// A policy allowing credentials has explicit origins (which is checked
+// when the configuration is loaded), so only those origins are returned
+func writeCorsOrigin(w http.ResponseWriter, policy *conf.Cors, origin string) {
+	allowOrigin := origin
+	if !policy.AllowCredentials && isWildcard(policy.AllowedOrigins) {
+		allowOrigin = corsWildcard
+	}
+	w.Header().Set(headerAllowOrigin, allowOrigin)
+	if policy.AllowCredentials {
+		w.Header().Set(headerAllowCredentials, "true")
+	}
+}
+
+func writeCorsPreflight(w http.ResponseWriter, r *http.Request, policy *conf.Cors, origin string) {
+	if !isCorsMethodAllowed(policy, r.Header.Get(headerRequestMethod)) {
+		return
+	}
+	headers, ok := corsAllowedHeaders(policy.AllowedHeaders, r.Header.Get(headerRequestHeaders))
+	if !ok {
+		return
+	}
+	writeCorsOrigin(w, policy, origin)
+	w.Header().Set(headerAllowMethods, strings.ToUpper(strings.Join(corsMethods(policy), ", ")))
+	if headers != "" {
+		w.Header().Set(headerAllowHeaders, headers)
+	}
+	if policy.MaxAgeSec > 0 {
+		w.Header().Set(headerMaxAge, strconv.Itoa(policy.MaxAgeSec))
+	}
+}
+
+// corsAllowedHeaders returns the requested headers, if they are all allowed
+func corsAllowedHeaders(allowed []string, requested string) (string, bool) {
+	if strings.TrimSpace(requested) == "" {
+		return "", true
+	}
+	if isWildcard(allowed) {
+		return requested, true
+	}
+	for _, name := range strings.Split(requested, ",") {
+		if !containsFold(allowed, strings.TrimSpace(name)) {
+			return "", false
+		}
+	}
+	return requested, true
+}
+
+func isWildcard(names []string) bool {
+	for _, name := range names {
+		if name == corsWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -16,20 +16,69 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/CrunchyData/pg_featureserv/internal/api"
 	"github.com/CrunchyData/pg_featureserv/internal/conf"
 	"github.com/CrunchyData/pg_featureserv/internal/data"
 	"github.com/CrunchyData/pg_featureserv/internal/ui"
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	routeVarID        = "id"
 	routeVarFeatureID = "fid"
+	routeVarColumn    = "column"
+	routeVarValue     = "value"
+)
+
+// headerTotalCount is the number of features selected by an items request
+const headerTotalCount = "X-Total-Count"
+
+// headerFeaturesTruncated flags a response whose features were cut off
+// at the ResponseMaxFeatures limit
+const headerFeaturesTruncated = "X-Features-Truncated"
+
+// headerContentDisposition sets the file name of a downloaded response (RFC 6266)
+const headerContentDisposition = "Content-Disposition"
+
+// Download dispositions
+const (
+	dispositionInline     = "inline"
+	dispositionAttachment = "attachment"
+)
+
+// downloadTimeFormat is the format of the {timestamp} in download file names
+const downloadTimeFormat = "20060102T150405Z"
+
+// Headers for Range requests of exports (RFC 7233)
+const (
+	headerAcceptRanges = "Accept-Ranges"
+	headerRange        = "Range"
+	headerETag         = "ETag"
+)
+
+// Prefer request header (RFC 7240) for the response to edit requests
+const (
+	headerPrefer            = "Prefer"
+	headerPreferenceApplied = "Preference-Applied"
+
+	preferReturn               = "return"
+	preferReturnMinimal        = "minimal"
+	preferReturnRepresentation = "representation"
 )
 
 func initRouter(basePath string) *mux.Router {
@@ -37,6 +86,10 @@ func initRouter(basePath string) *mux.Router {
 		StrictSlash(true).
 		PathPrefix("/" + strings.TrimRight(strings.TrimLeft(basePath, "/"), "/")).
 		Subrouter()
+	router.Use(tracingMiddleware)
+	router.Use(rateLimitMiddleware(basePath))
+	router.Use(apiKeyMiddleware(basePath))
+	router.Use(jwtMiddleware(basePath))
 
 	addRoute(router, "/", handleRoot)
 	addRoute(router, "/home{.fmt}", handleRoot)
@@ -46,6 +99,11 @@ func initRouter(basePath string) *mux.Router {
 	addRoute(router, "/api", handleAPI)
 	addRoute(router, "/api.{fmt}", handleAPI)
 
+	addRoute(router, "/healthz", handleHealth)
+	addRoute(router, "/readyz", handleReady)
+	addRoute(router, "/metrics", handleMetrics)
+	addRouteMethod(router, "/refresh", handleRefresh, http.MethodPost)
+
 	addRoute(router, "/conformance", handleConformance)
 	addRoute(router, "/conformance.{fmt}", handleConformance)
 
@@ -55,11 +113,26 @@ func initRouter(basePath string) *mux.Router {
 	addRoute(router, "/collections/{id}", handleCollection)
 	addRoute(router, "/collections/{id}.{fmt}", handleCollection)
 
-	addRoute(router, "/collections/{id}/items", handleCollectionItems)
-	addRoute(router, "/collections/{id}/items.{fmt}", handleCollectionItems)
+	addRoute(router, "/collections/{id}/queryables", handleCollectionQueryables)
+	addRoute(router, "/collections/{id}/queryables.{fmt}", handleCollectionQueryables)
 
-	addRoute(router, "/collections/{id}/items/{fid}", handleItem)
-	addRoute(router, "/collections/{id}/items/{fid}.{fmt}", handleItem)
+	addRoute(router, "/collections/{id}/facets", handleCollectionFacets)
+	addRoute(router, "/collections/{id}/facets.{fmt}", handleCollectionFacets)
+
+	addRouteMethod(router, "/collections/{id}/items", handleUpsertItems, http.MethodPut)
+	addRouteMethod(router, "/collections/{id}/items.{fmt}", handleUpsertItems, http.MethodPut)
+	addRoute(router, "/collections/{id}/items", cached(handleCollectionItems))
+	addRoute(router, "/collections/{id}/items.{fmt}", cached(handleCollectionItems))
+
+	addRouteMethod(router, "/collections/{id}/search", handleSearchItems, http.MethodPost)
+	addRouteMethod(router, "/collections/{id}/search.{fmt}", handleSearchItems, http.MethodPost)
+
+	addRouteMethod(router, "/collections/{id}/items/{fid}", handleDeleteItem, http.MethodDelete)
+	addRouteMethod(router, "/collections/{id}/items/{fid}.{fmt}", handleDeleteItem, http.MethodDelete)
+	addRoute(router, "/collections/{id}/items/{fid}", cached(handleItem))
+	addRoute(router, "/collections/{id}/items/{fid}.{fmt}", cached(handleItem))
+
+	addRoute(router, "/collections/{id}/lookup/{column}/{value}", cached(handleItemLookup))
 
 	addRoute(router, "/functions", handleFunctions)
 	addRoute(router, "/functions.{fmt}", handleFunctions)
@@ -77,6 +150,12 @@ func addRoute(router *mux.Router, path string, handler func(http.ResponseWriter,
 	router.Handle(path, appHandler(handler))
 }
 
+// addRouteMethod adds a route which only matches the given HTTP method.
+// It must be added before any route for the same path accepting all methods.
+func addRouteMethod(router *mux.Router, path string, handler func(http.ResponseWriter, *http.Request) *appError, method string) {
+	router.Handle(path, appHandler(handler)).Methods(method)
+}
+
 //nolint:unused
 func handleRootJSON(w http.ResponseWriter, r *http.Request) *appError {
 	return doRoot(w, r, api.FormatJSON)
@@ -92,7 +171,7 @@ func doRoot(w http.ResponseWriter, r *http.Request, format string) *appError {
 	urlBase := serveURLBase(r)
 
 	// --- create content
-	content := api.NewRootInfo(&conf.Configuration)
+	content := api.NewRootInfo(conf.Configuration())
 
 	switch format {
 	case api.FormatHTML:
@@ -102,28 +181,33 @@ func doRoot(w http.ResponseWriter, r *http.Request, format string) *appError {
 
 		return writeHTML(w, content, context, ui.PageHome())
 	default:
-		content.Links = linksRoot(urlBase)
+		content.Links = linksRoot(urlBase, api.RequestedLang(r))
 		return writeJSON(w, api.ContentTypeJSON, content)
 	}
 }
 
-func linksRoot(urlBase string) []*api.Link {
+func linksRoot(urlBase string, lang string) []*api.Link {
+	titleDoc := api.Message(lang, api.TitleDocument)
 	var links []*api.Link
-	links = append(links, linkSelf(urlBase, api.RootPageName, api.TitleDocument))
-	links = append(links, linkAlt(urlBase, api.RootPageName, api.TitleDocument))
+	links = append(links, &api.Link{
+		Href: urlPath(urlBase, api.RootPageName),
+		Rel:  api.RelSelf, Type: api.ContentTypeJSON, Title: titleDoc + api.Message(lang, api.TitleAsJSON)})
+	links = append(links, &api.Link{
+		Href: urlPathFormat(urlBase, api.RootPageName, api.FormatHTML),
+		Rel:  api.RelAlt, Type: api.ContentTypeHTML, Title: titleDoc + api.Message(lang, api.TitleAsHTML)})
 
 	links = append(links, &api.Link{
 		Href: urlPath(urlBase, api.TagAPI),
-		Rel:  api.RelServiceDesc, Type: api.ContentTypeOpenAPI, Title: "API definition"})
+		Rel:  api.RelServiceDesc, Type: api.ContentTypeOpenAPI, Title: api.Message(lang, api.TitleAPIDefinition)})
 	links = append(links, &api.Link{
 		Href: urlPath(urlBase, api.TagConformance),
-		Rel:  api.RelConformance, Type: api.ContentTypeJSON, Title: "OGC API conformance classes implemented by this server"})
+		Rel:  api.RelConformance, Type: api.ContentTypeJSON, Title: api.Message(lang, api.TitleConformance)})
 	links = append(links, &api.Link{
 		Href: urlPath(urlBase, api.TagCollections),
-		Rel:  api.RelData, Type: api.ContentTypeJSON, Title: "collections"})
+		Rel:  api.RelData, Type: api.ContentTypeJSON, Title: api.Message(lang, api.TitleCollections)})
 	links = append(links, &api.Link{
 		Href: urlPath(urlBase, api.TagFunctions),
-		Rel:  api.RelFunctions, Type: api.ContentTypeJSON, Title: "functions"})
+		Rel:  api.RelFunctions, Type: api.ContentTypeJSON, Title: api.Message(lang, api.TitleFunctionsList)})
 
 	return links
 }
@@ -148,13 +232,41 @@ func handleCollections(w http.ResponseWriter, r *http.Request) *appError {
 	format := api.RequestedFormat(r)
 	urlBase := serveURLBase(r)
 
-	colls, err := catalogInstance.Tables()
+	tables, err := catalogInstance.Tables()
 	if err != nil {
 		return appErrorInternal(err, api.ErrMsgLoadCollections)
 	}
+	//--- filter by category, if requested
+	category := strings.TrimSpace(r.URL.Query().Get(api.ParamCategory))
+	var colls []*data.Table
+	categories := make(map[string]bool)
+	for _, tbl := range tables {
+		if isCollectionHidden(tbl.ID) {
+			continue
+		}
+		tblCategory := conf.Configuration().CollectionCategory(tbl.ID)
+		if tblCategory != "" {
+			categories[tblCategory] = true
+		}
+		if category == "" || strings.EqualFold(category, tblCategory) {
+			colls = append(colls, tbl)
+		}
+	}
 
 	content := api.NewCollectionsInfo(colls)
+	//--- list all categories, so a client can offer them for selection
+	for cat := range categories {
+		content.Categories = append(content.Categories, cat)
+	}
+	sort.Strings(content.Categories)
+	//--- add estimated feature counts, if requested (opt-in since it queries the database)
+	if _, ok := r.URL.Query()[api.ParamItemCount]; ok {
+		if err := addCollectionCounts(r.Context(), content); err != nil {
+			return appErrorInternal(err, api.ErrMsgLoadCollections)
+		}
+	}
 	for _, coll := range content.Collections {
+		coll.Category = conf.Configuration().CollectionCategory(coll.Name)
 		switch format {
 		case api.FormatHTML:
 			addCollectionURLs(coll, urlBase)
@@ -214,9 +326,37 @@ func linksCollection(name string, urlBase string, isSummary bool) []*api.Link {
 		Type:  api.ContentTypeGeoJSON,
 		Title: api.TitleFeatuuresGeoJSON})
 
+	links = append(links, &api.Link{
+		Href:  urlPath(urlBase, api.PathCollectionQueryables(name)),
+		Rel:   api.RelQueryables,
+		Type:  api.ContentTypeSchemaJSON,
+		Title: api.TitleQueryables})
+
 	return links
 }
 
+// addCollectionCounts sets the estimated item count of each collection
+// which has one, and the total of them
+func addCollectionCounts(ctx context.Context, content *api.CollectionsInfo) error {
+	names := make([]string, len(content.Collections))
+	for i, coll := range content.Collections {
+		names[i] = coll.Name
+	}
+	counts, err := catalogInstance.TableEstimatedCounts(ctx, names)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, coll := range content.Collections {
+		if count, ok := counts[coll.Name]; ok {
+			coll.ItemCount = &count
+			total += count
+		}
+	}
+	content.ItemCount = &total
+	return nil
+}
+
 func handleCollection(w http.ResponseWriter, r *http.Request) *appError {
 	format := api.RequestedFormat(r)
 	urlBase := serveURLBase(r)
@@ -224,13 +364,16 @@ func handleCollection(w http.ResponseWriter, r *http.Request) *appError {
 	name := getRequestVar(routeVarID, r)
 
 	tbl, err := catalogInstance.TableByName(name)
-	if tbl == nil && err == nil {
+	if (tbl == nil && err == nil) || isCollectionHidden(name) {
 		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
 	}
-	catalogInstance.TableReload(name)
+	_, refreshExtent := r.URL.Query()[api.ParamRefreshExtent]
+	catalogInstance.TableReload(name, refreshExtent)
 	content := api.NewCollectionInfo(tbl)
+	content.Category = conf.Configuration().CollectionCategory(name)
 	content.GeometryType = &tbl.GeometryType
-	content.Properties = api.TableProperties(tbl)
+	content.GeometryMixed = tbl.IsGeometryMixed()
+	content.Properties = api.TableProperties(tbl, toNameSet(conf.Configuration().CollectionConfig(name).DeniedColumns))
 
 	// --- encoding
 	switch format {
@@ -245,7 +388,7 @@ func handleCollection(w http.ResponseWriter, r *http.Request) *appError {
 		context.URLItemsJSON = urlPathFormat(urlBase, pathItems, api.FormatJSON)
 		context.Title = tbl.Title
 		context.Table = tbl
-		context.IDColumn = tbl.IDColumn
+		context.IDColumn = idColumnLabel(tbl)
 
 		return writeHTML(w, content, context, ui.PageCollection())
 	default:
@@ -254,6 +397,91 @@ func handleCollection(w http.ResponseWriter, r *http.Request) *appError {
 	}
 }
 
+// handleCollectionQueryables provides the JSON Schema of the properties of a collection
+// which can be used in CQL filters and property query parameters
+func handleCollectionQueryables(w http.ResponseWriter, r *http.Request) *appError {
+	urlBase := serveURLBase(r)
+	name := getRequestVar(routeVarID, r)
+
+	tbl, err := catalogInstance.TableByName(name)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgCollectionAccess, name)
+	}
+	if tbl == nil || isCollectionHidden(name) {
+		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
+	}
+	denied := toNameSet(conf.Configuration().CollectionConfig(name).DeniedColumns)
+	content := api.NewQueryables(tbl, urlPath(urlBase, api.PathCollectionQueryables(name)), denied)
+	return writeJSON(w, api.ContentTypeSchemaJSON, content)
+}
+
+// setTimeColumns sets the temporal columns of a collection filtered by the datetime parameter
+func setTimeColumns(param *data.QueryParam, name string) {
+	coll := conf.Configuration().CollectionConfig(name)
+	param.TimeColumn = coll.DatetimeColumn
+	param.TimeEndColumn = coll.DatetimeEndColumn
+}
+
+// handleCollectionFacets provides the distinct values of a property of a collection
+// with their feature counts, for the features selected by the filter query parameters
+func handleCollectionFacets(w http.ResponseWriter, r *http.Request) *appError {
+	name := getRequestVar(routeVarID, r)
+	tbl, err := catalogInstance.TableByName(name)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgCollectionAccess, name)
+	}
+	if tbl == nil || isCollectionHidden(name) {
+		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
+	}
+	paging := conf.Configuration().CollectionPaging(name)
+	reqParam, err := parseRequestParams(r, paging, append(tbl.ParamNames(), api.ParamProperty))
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	reqParam.Aliases = tbl.AliasColumns()
+	property := resolveAlias(reqParam.Values[api.ParamProperty], reqParam.Aliases)
+	if property == "" {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgMissingParameter, api.ParamProperty))
+	}
+	denied := toNameSet(conf.Configuration().CollectionConfig(name).DeniedColumns)
+	reqParam.Denied = denied
+	columns := allowedColumns(tbl.Columns, denied)
+	//-- the geometry column is not one of the table columns
+	if !toNameSet(columns)[property] {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgFacetProperty, property))
+	}
+	delete(reqParam.Values, api.ParamProperty)
+
+	param, err := createQueryParams(&reqParam, columns, tbl.DbTypes, tbl.Srid)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	param.SqlArgs, err = parseSqlArgs(reqParam.Values, tbl.SqlParameters)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	param.Filter, err = parseFilter(reqParam.Values, tbl.DbTypes, denied, reqParam.Aliases)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	setTimeColumns(param, name)
+	setGeometryRepair(param, name)
+	param.Limit = -1
+	if paging.FacetsMax > 0 {
+		param.Limit = paging.FacetsMax
+	}
+
+	ctx, errTenant := tenantContext(r, name)
+	if errTenant != nil {
+		return errTenant
+	}
+	facets, err := catalogInstance.TableFacets(ctx, name, property, param)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+	}
+	return writeJSON(w, api.ContentTypeJSON, api.NewFacetValues(facets))
+}
+
 func handleCollectionItems(w http.ResponseWriter, r *http.Request) *appError {
 	// TODO: determine content from request header?
 	format := api.RequestedFormat(r)
@@ -262,11 +490,6 @@ func handleCollectionItems(w http.ResponseWriter, r *http.Request) *appError {
 
 	//--- extract request parameters
 	name := getRequestVar(routeVarID, r)
-	reqParam, err := parseRequestParams(r)
-	if err != nil {
-		return appErrorMsg(err, err.Error(), http.StatusBadRequest)
-	}
-
 	tbl, err1 := catalogInstance.TableByName(name)
 	if err1 != nil {
 		return appErrorInternalFmt(err1, api.ErrMsgCollectionAccess, name)
@@ -274,23 +497,230 @@ func handleCollectionItems(w http.ResponseWriter, r *http.Request) *appError {
 	if tbl == nil {
 		return appErrorNotFoundFmt(err1, api.ErrMsgCollectionNotFound, name)
 	}
-	param, err := createQueryParams(&reqParam, tbl.Columns, tbl.Srid)
+	paging := conf.Configuration().CollectionPaging(name)
+	if format == api.FormatGeoPackage {
+		if !conf.Configuration().GeoPackage.Enabled {
+			return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgFormatNotEnabled, format))
+		}
+		//-- a GeoPackage file contains up to the maximum features, not a page
+		paging.LimitDefault = conf.Configuration().GeoPackage.MaxFeatures
+		paging.LimitMax = conf.Configuration().GeoPackage.MaxFeatures
+	}
+	reqParam, err := parseRequestParams(r, paging, tbl.ParamNames())
+	if err != nil {
+		return appErrorMsg(err, err.Error(), http.StatusBadRequest)
+	}
+	reqParam.Properties, err = expandPropertyGroups(reqParam.Properties, conf.Configuration().CollectionConfig(name).PropertyGroups)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	reqParam.Aliases = tbl.AliasColumns()
+	denied := toNameSet(conf.Configuration().CollectionConfig(name).DeniedColumns)
+	reqParam.Denied = denied
+	param, err := createQueryParams(&reqParam, allowedColumns(tbl.Columns, denied), tbl.DbTypes, tbl.Srid)
 	if err != nil {
 		return appErrorBadRequest(err, err.Error())
 	}
-	param.Filter = parseFilter(reqParam.Values, tbl.DbTypes)
+	err = setComputedProperties(param, reqParam.Computed, tbl, allowedColumns(tbl.Columns, denied))
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	param.SqlArgs, err = parseSqlArgs(reqParam.Values, tbl.SqlParameters)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	param.Filter, err = parseFilter(reqParam.Values, tbl.DbTypes, denied, reqParam.Aliases)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	setTimeColumns(param, name)
+	setGeometryRepair(param, name)
+	setDefaultOrder(param, tbl, name)
 
-	ctx := r.Context()
+	ctx, errTenant := tenantContext(r, name)
+	if errTenant != nil {
+		return errTenant
+	}
+	isBinary := format == api.FormatFlatGeobuf || format == api.FormatGeoPackage
+	if param.Distinct && (format == api.FormatGML || isBinary) {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgDistinctFormat, format))
+	}
+	if param.Cluster != nil && isBinary {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgClusterFormat, format))
+	}
+	if param.Aggregate != nil && isBinary {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgAggregateFormat, format))
+	}
+	if param.GeomFormat != data.GeomFormatGeoJSON && (format == api.FormatGML || isBinary) {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgGeomFormat, format))
+	}
+	if errHits := checkResultTypeHits(&reqParam, format); errHits != nil {
+		return errHits
+	}
+	if format != api.FormatHTML {
+		setContentDisposition(w, name, format, time.Now())
+		isNotModified, errMod := checkLastModified(ctx, w, r, name, param)
+		if errMod != nil {
+			return errMod
+		}
+		if isNotModified {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+		if r.Method == http.MethodHead {
+			return writeItemsHead(ctx, w, r, name, param, format)
+		}
+	}
 	switch format {
 	case api.FormatJSON:
+		if param.Distinct && isPlainJSONRequested(r) {
+			return writeItemsDistinctJSON(ctx, w, name, param)
+		}
+		if reqParam.IsHits {
+			return writeItemsHits(ctx, w, name, param, urlBase)
+		}
+		if reqParam.NoEnvelope {
+			return writeItemsArray(ctx, w, name, param, urlBase)
+		}
 		return writeItemsJSON(ctx, w, name, param, urlBase)
 	case api.FormatHTML:
-		return writeItemsHTML(w, tbl, name, query, urlBase)
+		return writeItemsHTML(w, tbl, name, param, query, urlBase)
+	case api.FormatGML:
+		param.GeomFormat = data.GeomFormatGML
+		return writeItemsGML(ctx, w, r, tbl, name, param, urlBase)
+	case api.FormatFlatGeobuf:
+		return writeItemsFlatGeobuf(ctx, w, tbl, name, param)
+	case api.FormatCSV:
+		if param.GeomFormat == data.GeomFormatGeoJSON {
+			param.GeomFormat = data.GeomFormatWKT
+		}
+		return writeItemsCSV(ctx, w, r, tbl, name, param)
+	case api.FormatGeoPackage:
+		param.GeomFormat = data.GeomFormatWKBHex
+		_, isLimited := reqParam.Values[api.ParamLimit]
+		return writeItemsGeoPackage(ctx, w, r, tbl, name, param, isLimited)
 	}
 	return nil
 }
 
-func writeItemsHTML(w http.ResponseWriter, tbl *data.Table, name string, query string, urlBase string) *appError {
+// setContentDisposition sets the Content-Disposition header of an items response
+// to the configured disposition of the format, with the file name from the Filename template.
+// Error responses do not have the header
+func setContentDisposition(w http.ResponseWriter, name string, format string, now time.Time) {
+	download := conf.Configuration().Download
+	disposition := download.Disposition[format]
+	if disposition != dispositionInline && disposition != dispositionAttachment {
+		return
+	}
+	filename := strings.NewReplacer(
+		"{collection}", name,
+		"{timestamp}", now.UTC().Format(downloadTimeFormat),
+	).Replace(download.Filename)
+	if filename == "" {
+		filename = name
+	}
+	//-- quotes and path separators are not allowed in the file name
+	filename = strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r == '/' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, filename)
+	w.Header().Set(headerContentDisposition, fmt.Sprintf(`%v; filename="%v.%v"`, disposition, filename, format))
+}
+
+// setGeometryRepair sets the repair of invalid feature geometry configured for a collection,
+// the limit on the number of geometry points,
+// and the handling of empty geometry and the coordinate dimension (if not set by the request)
+func setGeometryRepair(param *data.QueryParam, name string) {
+	coll := conf.Configuration().CollectionConfig(name)
+	param.MakeValid = coll.MakeValid
+	param.DropInvalid = coll.DropInvalid
+	param.MaxGeomPoints = coll.MaxGeometryPoints
+	param.OmitComplexGeom = coll.OmitComplexGeometry
+	if param.EmptyGeometry == "" {
+		param.EmptyGeometry = strings.ToLower(strings.TrimSpace(coll.EmptyGeometry))
+	}
+	if param.Dimension == 0 {
+		param.Dimension = coll.Dimension
+	}
+}
+
+// setDefaultOrder orders features by the collection id columns
+// if no sort order is requested, or after the requested sort order unless SortTiebreaker is off,
+// so that pages of features do not overlap.
+// Distinct and grouped features can not be ordered by columns they do not contain
+func setDefaultOrder(param *data.QueryParam, tbl *data.Table, name string) {
+	if conf.Configuration().CollectionConfig(name).UnorderedPaging {
+		return
+	}
+	if param.Distinct || len(param.GroupBy) > 0 {
+		return
+	}
+	if len(param.SortBy) > 0 && !conf.Configuration().Paging.SortTiebreaker {
+		return
+	}
+	param.DefaultOrder = tbl.IDColumns
+}
+
+// checkLastModified sets the Last-Modified header of an items response
+// to the latest time in the collection UpdatedColumn for the query features.
+// It returns true if the features have not been modified since the If-Modified-Since time.
+// Sampled responses vary between requests, so they have no modification time
+func checkLastModified(ctx context.Context, w http.ResponseWriter, r *http.Request, name string, param *data.QueryParam) (bool, *appError) {
+	column := conf.Configuration().CollectionConfig(name).UpdatedColumn
+	if column == "" || param.Sample > 0 {
+		return false, nil
+	}
+	lastModified, err := catalogInstance.TableLastModified(ctx, name, column, param)
+	if err != nil {
+		return false, appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+	}
+	if lastModified == nil {
+		return false, nil
+	}
+	w.Header().Set(headerLastModified, lastModified.UTC().Format(http.TimeFormat))
+	return isNotModifiedSince(r, *lastModified), nil
+}
+
+// isNotModifiedSince tests if a modification time is not after the request If-Modified-Since time.
+// HTTP times have a resolution of seconds
+func isNotModifiedSince(r *http.Request, lastModified time.Time) bool {
+	since, err := http.ParseTime(r.Header.Get(headerIfModifiedSince))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// writeItemsHead writes the headers of an items response,
+// with the number of features selected by the filters.
+// No features are read
+func writeItemsHead(ctx context.Context, w http.ResponseWriter, r *http.Request, name string, param *data.QueryParam, format string) *appError {
+	count, err := catalogInstance.TableFeatureCount(ctx, name, param)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+	}
+	contentType := featuresContentType(param)
+	switch {
+	case format == api.FormatGML:
+		contentType = api.ContentTypeGML
+	case format == api.FormatFlatGeobuf:
+		contentType = api.ContentTypeFlatGeobuf
+	case format == api.FormatCSV:
+		contentType = api.ContentTypeCSV
+	case format == api.FormatGeoPackage:
+		contentType = api.ContentTypeGeoPackage
+	case param.Distinct && isPlainJSONRequested(r):
+		contentType = api.ContentTypeJSON
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set(headerTotalCount, strconv.Itoa(count))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func writeItemsHTML(w http.ResponseWriter, tbl *data.Table, name string, param *data.QueryParam, query string, urlBase string) *appError {
 
 	pathItems := api.PathCollectionItems(name)
 	// --- encoding
@@ -302,28 +732,400 @@ func writeItemsHTML(w http.ResponseWriter, tbl *data.Table, name string, query s
 	context.URLJSON = urlPathFormatQuery(urlBase, pathItems, api.FormatJSON, query)
 	context.Group = "Collections"
 	context.Title = tbl.Title
-	context.IDColumn = tbl.IDColumn
+	context.IDColumn = idColumnLabel(tbl)
 	context.ShowFeatureLink = true
+	context.MapDisabled = conf.Configuration().CollectionConfig(name).MapDisabled
+	context.AttributeTable = isNonSpatialQuery(tbl, param)
 
 	// features are not needed for items page (page queries for them)
 	return writeHTML(w, nil, context, ui.PageItems())
 }
 
+// isNonSpatialQuery tests if a query returns features with no geometry to map,
+// since they are from a SQL collection with no geometry column,
+// or are distinct or grouped property values
+func isNonSpatialQuery(tbl *data.Table, param *data.QueryParam) bool {
+	isSqlNoGeom := tbl.Sql != "" && tbl.GeometryColumn == ""
+	return isSqlNoGeom || param.Distinct || param.GroupBy != nil
+}
+
 func writeItemsJSON(ctx context.Context, w http.ResponseWriter, name string, param *data.QueryParam, urlBase string) *appError {
-	//--- query features data
-	features, err := catalogInstance.TableFeatures(ctx, name, param)
+	if conf.Configuration().Paging.StreamGeoJSON {
+		return writeItemsJSONStream(ctx, w, name, param, urlBase)
+	}
+	//--- query features data, with the number matched if it is configured
+	var features []string
+	var matched *uint
+	var err error
+	if isMatchedCounted(param) {
+		var count int
+		features, count, err = catalogInstance.TableFeaturesMatched(ctx, name, param)
+		numMatched := uint(count)
+		matched = &numMatched
+	} else {
+		features, err = catalogInstance.TableFeatures(ctx, name, param)
+	}
 	if err != nil {
 		return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
 	}
 	if features == nil {
 		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
 	}
+	setTruncatedHeader(w, param)
 
 	//--- assemble resonse
 	content := api.NewFeatureCollectionInfo(features)
+	content.NumberMatched = matched
+	content.Links = linksItems(name, urlBase)
+	content.Truncated = param.Truncated
+
+	return writeJSON(w, featuresContentType(param), content)
+}
+
+// isMatchedCounted tests if the features of a query are counted for numberMatched.
+// Counting requires another query, so it can be disabled by the NumberMatched configuration.
+// Clusters, aggregates and groups are not features of the collection
+func isMatchedCounted(param *data.QueryParam) bool {
+	if !conf.Configuration().Paging.NumberMatched {
+		return false
+	}
+	return param.Cluster == nil && param.Aggregate == nil && param.GroupBy == nil
+}
+
+// writeItemsJSONStream writes a feature collection as the features are read,
+// so the response size is not limited by memory.
+// Once a feature is written the response status can not be changed,
+// so later errors reading features are only logged
+func writeItemsJSONStream(ctx context.Context, w http.ResponseWriter, name string, param *data.QueryParam, urlBase string) *appError {
+	w.Header().Set("Content-Type", featuresContentType(param))
+	gw := api.NewGeoJSONWriter(w, linksItems(name, urlBase))
+	var err error
+	if isMatchedCounted(param) {
+		var count int
+		count, err = catalogInstance.TableFeaturesEachMatched(ctx, name, param, gw.WriteFeature)
+		gw.SetNumberMatched(uint(count))
+	} else {
+		err = catalogInstance.TableFeaturesEach(ctx, name, param, gw.WriteFeature)
+	}
+	if err != nil {
+		if !gw.IsStarted() {
+			return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+		}
+		abortStream("GeoJSON", name, err)
+		return nil
+	}
+	if err := gw.Close(); err != nil {
+		log.Debugf("Error writing response: %v", err)
+	}
+	return nil
+}
+
+// writeItemsArray writes features as a bare JSON array, with no FeatureCollection members.
+// The links of the collection are provided in the Link header instead
+func writeItemsArray(ctx context.Context, w http.ResponseWriter, name string, param *data.QueryParam, urlBase string) *appError {
+	w.Header().Set("Link", api.LinkHeader(linksItems(name, urlBase)))
+	w.Header().Set("Content-Type", api.ContentTypeJSON)
+	if !conf.Configuration().Paging.StreamGeoJSON {
+		features, err := catalogInstance.TableFeatures(ctx, name, param)
+		if err != nil {
+			return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+		}
+		if features == nil {
+			return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
+		}
+		setTruncatedHeader(w, param)
+		return writeFeatureArray(w, features)
+	}
+	gw := api.NewGeoJSONArrayWriter(w)
+	err := catalogInstance.TableFeaturesEach(ctx, name, param, gw.WriteFeature)
+	if err != nil {
+		if !gw.IsStarted() {
+			return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+		}
+		abortStream("GeoJSON", name, err)
+		return nil
+	}
+	if err := gw.Close(); err != nil {
+		log.Debugf("Error writing response: %v", err)
+	}
+	return nil
+}
+
+// writeFeatureArray writes the JSON of features as a bare array
+func writeFeatureArray(w http.ResponseWriter, features []string) *appError {
+	gw := api.NewGeoJSONArrayWriter(w)
+	for _, feat := range features {
+		if err := gw.WriteFeature(feat); err != nil {
+			log.Debugf("Error writing response: %v", err)
+			return nil
+		}
+	}
+	if err := gw.Close(); err != nil {
+		log.Debugf("Error writing response: %v", err)
+	}
+	return nil
+}
+
+// setTruncatedHeader sets the header flagging a truncated response,
+// if the features read were truncated
+func setTruncatedHeader(w http.ResponseWriter, param *data.QueryParam) {
+	if param.Truncated {
+		w.Header().Set(headerFeaturesTruncated, "true")
+	}
+}
+
+// checkResultTypeHits checks that a resultType=hits request is for features as JSON.
+// Only features are counted, so distinct values, clusters and aggregates are not supported
+func checkResultTypeHits(param *api.RequestParam, format string) *appError {
+	if !param.IsHits {
+		return nil
+	}
+	conflict := ""
+	switch {
+	case format != api.FormatJSON && format != api.FormatHTML:
+		conflict = format
+	case param.Distinct:
+		conflict = api.ParamDistinct
+	case param.Cluster != nil:
+		conflict = api.ParamCluster
+	case param.Aggregate != nil:
+		conflict = api.ParamAggregate
+	case param.NoEnvelope:
+		conflict = api.ParamEnvelope
+	}
+	if conflict != "" {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgResultTypeHits, conflict))
+	}
+	return nil
+}
+
+// writeItemsHits writes a feature collection with no features,
+// with the number of features selected by the filters
+func writeItemsHits(ctx context.Context, w http.ResponseWriter, name string, param *data.QueryParam, urlBase string) *appError {
+	count, err := catalogInstance.TableFeatureCount(ctx, name, param)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+	}
+	content := api.NewFeatureCollectionInfo([]string{})
+	matched := uint(count)
+	content.NumberMatched = &matched
 	content.Links = linksItems(name, urlBase)
+	return writeJSON(w, featuresContentType(param), content)
+}
+
+// featuresContentType is the content type of a features response.
+// Features with a string geometry encoding are not GeoJSON
+func featuresContentType(param *data.QueryParam) string {
+	if param.GeomFormat != data.GeomFormatGeoJSON {
+		return api.ContentTypeJSON
+	}
+	return api.ContentTypeGeoJSON
+}
+
+// isPlainJSONRequested tests if a request accepts JSON, but not GeoJSON
+func isPlainJSONRequested(r *http.Request) bool {
+	hdrAccept := r.Header.Get("Accept")
+	return strings.Contains(hdrAccept, api.ContentTypeJSON) && !strings.Contains(hdrAccept, api.ContentTypeGeoJSON)
+}
+
+// writeItemsDistinctJSON writes the properties of distinct features as a JSON array
+func writeItemsDistinctJSON(ctx context.Context, w http.ResponseWriter, name string, param *data.QueryParam) *appError {
+	features, err := catalogInstance.TableFeatures(ctx, name, param)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+	}
+	if features == nil {
+		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
+	}
+	setTruncatedHeader(w, param)
+	values := make([]json.RawMessage, len(features))
+	for i, feature := range features {
+		var feat struct {
+			Properties json.RawMessage `json:"properties"`
+		}
+		if err := json.Unmarshal([]byte(feature), &feat); err != nil {
+			return appErrorInternalFmt(err, api.ErrMsgEncoding)
+		}
+		values[i] = feat.Properties
+	}
+	return writeJSON(w, api.ContentTypeJSON, values)
+}
+
+func writeItemsGML(ctx context.Context, w http.ResponseWriter, r *http.Request, tbl *data.Table, name string, param *data.QueryParam, urlBase string) *appError {
+	//--- query features data
+	features, err := catalogInstance.TableFeatures(ctx, name, param)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+	}
+	if features == nil {
+		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
+	}
+	setTruncatedHeader(w, param)
+
+	//--- feature elements are in a namespace for the collection
+	nsURL := urlBase + api.PathCollection(name)
+	encodedContent, err := api.FeatureCollectionGML(name, gmlGeometryName(tbl), features, nsURL)
+	if err != nil {
+		log.Printf("GML encoding error: %v", err.Error())
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	return writeRanges(w, r, api.ContentTypeGML, encodedContent)
+}
+
+// writeItemsFlatGeobuf streams features as FlatGeobuf as they are read.
+// Once the header is written the response status can not be changed,
+// so errors reading features are only logged
+func writeItemsFlatGeobuf(ctx context.Context, w http.ResponseWriter, tbl *data.Table, name string, param *data.QueryParam) *appError {
+	fw := api.NewFlatGeobufWriter(w, name, tbl, param.Columns, param.Crs)
+	w.Header().Set("Content-Type", api.ContentTypeFlatGeobuf)
+	//-- a streamed response cannot provide ranges
+	w.Header().Set(headerAcceptRanges, "none")
+	w.WriteHeader(http.StatusOK)
+	if err := fw.WriteHeader(); err != nil {
+		log.Warnf("Error writing FlatGeobuf header: %v", err)
+		return nil
+	}
+	err := catalogInstance.TableFeaturesEach(ctx, name, param, fw.WriteFeature)
+	if err != nil {
+		abortStream("FlatGeobuf", name, err)
+	}
+	return nil
+}
+
+// abortStream logs an error which ended a streamed response after it was started,
+// and aborts the response.
+// The status can not be changed, so the connection is closed without
+// ending the response, which the client sees as an incomplete transfer
+// rather than a valid response missing the remaining features.
+// A transaction ended by the idle timeout is reported as a client reading too slowly
+func abortStream(format string, name string, err error) {
+	if data.IsIdleTransactionTimeout(err) {
+		log.Warnf("Stopped writing %v features for %v: idle in transaction timeout (client is reading too slowly)", format, name)
+	} else {
+		log.Warnf("Error writing %v features for %v: %v", format, name, err)
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// writeItemsCSV writes features as CSV, with the geometry as WKT
+// (or another string geometry encoding).
+// The field delimiter and NULL value text are configurable
+func writeItemsCSV(ctx context.Context, w http.ResponseWriter, r *http.Request, tbl *data.Table, name string, param *data.QueryParam) *appError {
+	delimiter, err := csvDelimiter(conf.Configuration().Csv.Delimiter)
+	if err != nil {
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	features, err := catalogInstance.TableFeatures(ctx, name, param)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+	}
+	if features == nil {
+		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
+	}
+	setTruncatedHeader(w, param)
+	opts := api.CSVOptions{Delimiter: delimiter, NullValue: conf.Configuration().Csv.NullValue}
+	encodedContent, err := api.FeatureCollectionCSV(gmlGeometryName(tbl), tbl.FeatureOutputNames(param), features, opts)
+	if err != nil {
+		log.Printf("CSV encoding error: %v", err.Error())
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	return writeRanges(w, r, api.ContentTypeCSV, encodedContent)
+}
+
+// writeItemsGeoPackage writes features as a GeoPackage file.
+// The file is built in a temporary file, since SQLite pages are written out of order.
+// Unless a limit is requested, a query selecting more than
+// the maximum features is an error rather than a truncated file
+func writeItemsGeoPackage(ctx context.Context, w http.ResponseWriter, r *http.Request, tbl *data.Table, name string, param *data.QueryParam, isLimited bool) *appError {
+	if !isLimited {
+		count, err := catalogInstance.TableFeatureCount(ctx, name, param)
+		if err != nil {
+			return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+		}
+		if count-param.Offset > param.Limit {
+			return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgGeoPackageMaxFeatures, param.Limit))
+		}
+	}
+	file, err := ioutil.TempFile("", "pg_featureserv-*.gpkg")
+	if err != nil {
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	tableName := tbl.Table
+	if tableName == "" {
+		tableName = name
+	}
+	gw := api.NewGeoPackageWriter(file, tableName, tbl, param.Columns, param.Crs)
+	err = catalogInstance.TableFeaturesEach(ctx, name, param, gw.WriteFeature)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+	}
+	if err := gw.Close(); err != nil {
+		log.Printf("GeoPackage encoding error: %v", err.Error())
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	hash := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	if _, err := io.Copy(hash, file); err != nil {
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	serveRanges(w, r, api.ContentTypeGeoPackage, hash.Sum(nil), file)
+	return nil
+}
+
+// writeRanges writes an export response which is encoded in memory,
+// supporting Range requests so that interrupted downloads can be resumed
+func writeRanges(w http.ResponseWriter, r *http.Request, contype string, encodedContent []byte) *appError {
+	hash := sha256.Sum256(encodedContent)
+	serveRanges(w, r, contype, hash[:], bytes.NewReader(encodedContent))
+	return nil
+}
+
+// serveRanges serves export content with support for Range requests.
+// The ETag is a hash of the content, so a resumed request (with If-Range)
+// receives the full content if the data has changed since it started
+func serveRanges(w http.ResponseWriter, r *http.Request, contype string, hash []byte, content io.ReadSeeker) {
+	w.Header().Set("Content-Type", contype)
+	w.Header().Set(headerETag, `"`+hex.EncodeToString(hash[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// csvDelimiters are the named values of the Csv Delimiter setting
+var csvDelimiters = map[string]rune{
+	"comma":     ',',
+	"semicolon": ';',
+	"tab":       '\t',
+}
+
+// csvDelimiter returns the field delimiter for a Csv Delimiter setting
+func csvDelimiter(setting string) (rune, error) {
+	if setting == "" {
+		return ',', nil
+	}
+	if delim, ok := csvDelimiters[strings.ToLower(setting)]; ok {
+		return delim, nil
+	}
+	runes := []rune(setting)
+	//-- quotes and line breaks cannot be used as delimiters
+	if len(runes) != 1 || strings.ContainsRune("\"\r\n", runes[0]) {
+		return 0, fmt.Errorf("Invalid Csv Delimiter: %v", setting)
+	}
+	return runes[0], nil
+}
 
-	return writeJSON(w, api.ContentTypeGeoJSON, content)
+// gmlGeometryName is the GML element name for feature geometry
+func gmlGeometryName(tbl *data.Table) string {
+	if tbl.GeometryColumn == "" {
+		return "geometry"
+	}
+	return tbl.GeometryColumn
 }
 
 func linksItems(name string, urlBase string) []*api.Link {
@@ -345,11 +1147,6 @@ func handleItem(w http.ResponseWriter, r *http.Request) *appError {
 	//--- extract request parameters
 	name := getRequestVar(routeVarID, r)
 	fid := getRequestVar(routeVarFeatureID, r)
-	reqParam, err := parseRequestParams(r)
-	if err != nil {
-		return appErrorMsg(err, err.Error(), http.StatusBadRequest)
-	}
-
 	tbl, err1 := catalogInstance.TableByName(name)
 	if err1 != nil {
 		return appErrorInternalFmt(err1, api.ErrMsgCollectionAccess, name)
@@ -357,10 +1154,39 @@ func handleItem(w http.ResponseWriter, r *http.Request) *appError {
 	if tbl == nil {
 		return appErrorNotFoundFmt(err1, api.ErrMsgCollectionNotFound, name)
 	}
-	param, errQuery := createQueryParams(&reqParam, tbl.Columns, tbl.Srid)
+	reqParam, err := parseRequestParams(r, conf.Configuration().CollectionPaging(name), tbl.ParamNames())
+	if err != nil {
+		return appErrorMsg(err, err.Error(), http.StatusBadRequest)
+	}
+	sqlArgs, err := parseSqlArgs(reqParam.Values, tbl.SqlParameters)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	reqParam.Properties, err = expandPropertyGroups(reqParam.Properties, conf.Configuration().CollectionConfig(name).PropertyGroups)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	reqParam.Aliases = tbl.AliasColumns()
+	if !tbl.SupportsFeatureID() {
+		return appErrorNotFoundFmt(nil, api.ErrMsgFeatureIDNotSupported, name)
+	}
+	ctx, errTenant := tenantContext(r, name)
+	if errTenant != nil {
+		return errTenant
+	}
+	// clustering and aggregation apply only to collection items
+	reqParam.Cluster = nil
+	reqParam.Aggregate = nil
+	denied := toNameSet(conf.Configuration().CollectionConfig(name).DeniedColumns)
+	reqParam.Denied = denied
+	param, errQuery := createQueryParams(&reqParam, allowedColumns(tbl.Columns, denied), tbl.DbTypes, tbl.Srid)
+	if errQuery == nil {
+		errQuery = setComputedProperties(param, reqParam.Computed, tbl, allowedColumns(tbl.Columns, denied))
+	}
 
 	if errQuery == nil {
-		ctx := r.Context()
+		param.SqlArgs = sqlArgs
+		setGeometryRepair(param, name)
 		switch format {
 		case api.FormatJSON:
 			return writeItemJSON(ctx, w, name, fid, param, urlBase)
@@ -370,10 +1196,80 @@ func handleItem(w http.ResponseWriter, r *http.Request) *appError {
 			return nil
 		}
 	} else {
-		return appErrorInternalFmt(errQuery, api.ErrMsgInvalidQuery)
+		return appErrorBadRequest(errQuery, errQuery.Error())
 	}
 }
 
+// handleItemLookup provides the single feature of a collection
+// which has a value of one of its configured lookup columns.
+// The response is always GeoJSON, since the value may contain a dot
+func handleItemLookup(w http.ResponseWriter, r *http.Request) *appError {
+	name := getRequestVar(routeVarID, r)
+	column := getRequestVar(routeVarColumn, r)
+	value := getRequestVar(routeVarValue, r)
+	tbl, err := catalogInstance.TableByName(name)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgCollectionAccess, name)
+	}
+	if tbl == nil {
+		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
+	}
+	coll := conf.Configuration().CollectionConfig(name)
+	if !toNameSet(coll.LookupColumns)[column] || !toNameSet(tbl.Columns)[column] {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgLookupColumn, column))
+	}
+	reqParam, err := parseRequestParams(r, conf.Configuration().CollectionPaging(name), tbl.ParamNames())
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	reqParam.Properties, err = expandPropertyGroups(reqParam.Properties, coll.PropertyGroups)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	reqParam.Aliases = tbl.AliasColumns()
+	ctx, errTenant := tenantContext(r, name)
+	if errTenant != nil {
+		return errTenant
+	}
+	// the response is a single feature
+	reqParam.Cluster = nil
+	reqParam.Aggregate = nil
+	reqParam.GroupBy = nil
+	reqParam.Distinct = false
+	denied := toNameSet(coll.DeniedColumns)
+	reqParam.Denied = denied
+	param, err := createQueryParams(&reqParam, allowedColumns(tbl.Columns, denied), tbl.DbTypes, tbl.Srid)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	err = setComputedProperties(param, reqParam.Computed, tbl, allowedColumns(tbl.Columns, denied))
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	param.SqlArgs, err = parseSqlArgs(reqParam.Values, tbl.SqlParameters)
+	if err != nil {
+		return appErrorBadRequest(err, err.Error())
+	}
+	param.Filter = []*data.PropertyFilter{{Name: column, Value: value}}
+	setGeometryRepair(param, name)
+	//-- query for two features, to check that the value is unique
+	param.Limit = 2
+	param.Offset = 0
+
+	features, err := catalogInstance.TableFeatures(ctx, name, param)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgDataReadError, name)
+	}
+	if len(features) == 0 {
+		return appErrorNotFoundFmt(nil, api.ErrMsgFeatureNotFound, value)
+	}
+	if len(features) > 1 {
+		return appErrorMsg(nil, fmt.Sprintf(api.ErrMsgLookupNotUnique, value), http.StatusConflict)
+	}
+	writeResponse(w, featuresContentType(param), []byte(features[0]))
+	return nil
+}
+
 func writeItemHTML(w http.ResponseWriter, tbl *data.Table, name string, fid string, query string, urlBase string) *appError {
 	//--- query data for request
 
@@ -388,7 +1284,8 @@ func writeItemHTML(w http.ResponseWriter, tbl *data.Table, name string, fid stri
 	context.Group = "Collections"
 	context.Title = tbl.Title
 	context.FeatureID = fid
-	context.IDColumn = tbl.IDColumn
+	context.IDColumn = idColumnLabel(tbl)
+	context.MapDisabled = conf.Configuration().CollectionConfig(name).MapDisabled
 
 	// feature is not needed for item page (page queries for them)
 	return writeHTML(w, nil, context, ui.PageItem())
@@ -409,10 +1306,412 @@ func writeItemJSON(ctx context.Context, w http.ResponseWriter, name string, fid
 	// for now can't add links to feature JSON
 	//content.Links = linksItems(name, urlBase, api.FormatJSON)
 	encodedContent := []byte(feature)
-	writeResponse(w, api.ContentTypeGeoJSON, encodedContent)
+	writeResponse(w, featuresContentType(param), encodedContent)
 	return nil
 }
 
+func handleDeleteItem(w http.ResponseWriter, r *http.Request) *appError {
+	name := getRequestVar(routeVarID, r)
+	fid := getRequestVar(routeVarFeatureID, r)
+	_, dryRun := r.URL.Query()[api.ParamDryRun]
+
+	tbl, err := catalogInstance.TableByName(name)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgCollectionAccess, name)
+	}
+	if tbl == nil {
+		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
+	}
+	ctx, errTenant := tenantContext(r, name)
+	if errTenant != nil {
+		return errTenant
+	}
+	if errEdit := checkTableEditable(w, tbl); errEdit != nil {
+		return errEdit
+	}
+
+	isDeleted, err := catalogInstance.DeleteTableFeature(ctx, name, fid, dryRun)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgDataDeleteError, name)
+	}
+	if !isDeleted {
+		return appErrorNotFoundFmt(nil, api.ErrMsgFeatureNotFound, fid)
+	}
+	if !dryRun {
+		purgeCache(name)
+	}
+	//-- a deleted feature has no representation, so only minimal can be applied
+	if requestPreferReturn(r) == preferReturnMinimal {
+		setPreferenceApplied(w, preferReturnMinimal)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleUpsertItems inserts or updates the features of a collection by id
+// from a GeoJSON feature collection, in a single transaction.
+// In replace mode the features which are not in the collection are deleted
+func handleUpsertItems(w http.ResponseWriter, r *http.Request) *appError {
+	name := getRequestVar(routeVarID, r)
+	_, dryRun := r.URL.Query()[api.ParamDryRun]
+
+	tbl, err := catalogInstance.TableByName(name)
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgCollectionAccess, name)
+	}
+	if tbl == nil {
+		return appErrorNotFoundFmt(err, api.ErrMsgCollectionNotFound, name)
+	}
+	ctx, errTenant := tenantContext(r, name)
+	if errTenant != nil {
+		return errTenant
+	}
+	if errEdit := checkTableEditable(w, tbl); errEdit != nil {
+		return errEdit
+	}
+	mode := strings.ToLower(strings.TrimSpace(r.URL.Query().Get(api.ParamMode)))
+	if mode != "" && mode != api.ModeMerge && mode != api.ModeReplace {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgInvalidParameterValue, api.ParamMode, mode))
+	}
+	content, errBody := readRequestBody(w, r)
+	if errBody != nil {
+		return errBody
+	}
+	denied := toNameSet(conf.Configuration().CollectionConfig(name).DeniedColumns)
+	features, err := parseFeatureEdits(content, tbl, allowedColumns(tbl.Columns, denied))
+	if err != nil {
+		return appErrorBadRequest(err, fmt.Sprintf(api.ErrMsgInvalidFeatures, err.Error()))
+	}
+
+	counts, err := catalogInstance.UpsertTableFeatures(ctx, name, features, mode == api.ModeReplace, dryRun)
+	if err != nil {
+		//-- values the database cannot store are a client error
+		if data.IsInvalidDataError(err) {
+			return appErrorBadRequest(err, fmt.Sprintf(api.ErrMsgDataWriteError, name))
+		}
+		return appErrorInternalFmt(err, api.ErrMsgDataWriteError, name)
+	}
+	if counts == nil {
+		return appErrorNotFoundFmt(nil, api.ErrMsgCollectionNotFound, name)
+	}
+	if !dryRun {
+		purgeCache(name)
+	}
+	if requestPreferReturn(r) == preferReturnMinimal {
+		setPreferenceApplied(w, preferReturnMinimal)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	summary := api.UpsertSummary{Inserted: counts.Inserted, Updated: counts.Updated, Deleted: counts.Deleted}
+	return writeJSON(w, api.ContentTypeJSON, summary)
+}
+
+// handleSearchItems queries the features of a collection
+// with parameters given in a JSON request body,
+// for queries (such as complex filters) which are too long for a URL.
+// The body parameters replace any query parameters of the same name,
+// and the request is handled as the equivalent GET request
+func handleSearchItems(w http.ResponseWriter, r *http.Request) *appError {
+	content, errBody := readRequestBody(w, r)
+	if errBody != nil {
+		return errBody
+	}
+	values, err := parseSearchBody(bytes.NewReader(content))
+	if err != nil {
+		return appErrorBadRequest(err, fmt.Sprintf(api.ErrMsgInvalidSearch, err))
+	}
+	query := r.URL.Query()
+	for name, val := range values {
+		query.Set(name, val)
+	}
+	r.URL.RawQuery = query.Encode()
+	return handleCollectionItems(w, r)
+}
+
+// parseSearchBody converts the members of a JSON search request to query parameter values.
+// A filter object is CQL2 JSON.
+// Lists of properties and sort properties may be JSON arrays
+func parseSearchBody(body io.Reader) (map[string]string, error) {
+	var search map[string]json.RawMessage
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	if err := dec.Decode(&search); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for name, raw := range search {
+		if string(raw) == "null" {
+			continue
+		}
+		var err error
+		switch name {
+		case api.ParamBbox:
+			var coords []json.Number
+			err = json.Unmarshal(raw, &coords)
+			vals := make([]string, len(coords))
+			for i, coord := range coords {
+				vals[i] = coord.String()
+			}
+			values[name] = strings.Join(vals, ",")
+		case api.ParamLimit, api.ParamOffset:
+			var num json.Number
+			err = json.Unmarshal(raw, &num)
+			values[name] = num.String()
+		case api.ParamDatetime, api.ParamFilterLang:
+			var val string
+			err = json.Unmarshal(raw, &val)
+			values[name] = val
+		case api.ParamFilter:
+			var val string
+			if json.Unmarshal(raw, &val) == nil {
+				values[name] = val
+				continue
+			}
+			var filter map[string]interface{}
+			err = json.Unmarshal(raw, &filter)
+			values[name] = string(raw)
+			if _, ok := search[api.ParamFilterLang]; !ok {
+				values[api.ParamFilterLang] = api.FilterLangJSON
+			}
+		case api.ParamProperties, api.ParamSortBy:
+			var val string
+			if json.Unmarshal(raw, &val) == nil {
+				values[name] = val
+				continue
+			}
+			var vals []string
+			err = json.Unmarshal(raw, &vals)
+			values[name] = strings.Join(vals, ",")
+		default:
+			return nil, fmt.Errorf("unknown member %v", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %v", name)
+		}
+	}
+	return values, nil
+}
+
+// readRequestBody reads the body of a feature edit or search request.
+// The body is limited to the maximum size, and must be received within the body timeout.
+// The timeout is a deadline for reading the connection, so no read is left running
+// after the handler returns
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, *appError) {
+	maxBytes := conf.Configuration().Server.WriteMaxBodyBytes
+	timeoutSec := conf.Configuration().Server.WriteBodyTimeoutSec
+
+	body := r.Body
+	if maxBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
+	if timeoutSec > 0 {
+		setReadDeadline(r, time.Now().Add(time.Duration(timeoutSec)*time.Second))
+	}
+	content, err := ioutil.ReadAll(body)
+	if err == nil {
+		if timeoutSec > 0 {
+			setReadDeadline(r, time.Time{})
+		}
+		return content, nil
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		//-- the rest of the body is not drained, so the connection cannot be reused
+		w.Header().Set("Connection", "close")
+		return nil, appErrorMsg(err, fmt.Sprintf(api.ErrMsgBodyTimeout, timeoutSec), http.StatusRequestTimeout)
+	}
+	//-- the limited body fails to read once more than the maximum size is received
+	if maxBytes > 0 && int64(len(content)) >= maxBytes {
+		return nil, appErrorMsg(err, fmt.Sprintf(api.ErrMsgBodyTooLarge, maxBytes), http.StatusRequestEntityTooLarge)
+	}
+	return nil, appErrorBadRequest(err, err.Error())
+}
+
+// jsonErrorLocation adds the line and column of a JSON parse error to the error.
+// Errors without an offset in the content are returned unchanged
+func jsonErrorLocation(content []byte, err error) error {
+	var offset int64
+	switch jsonErr := err.(type) {
+	case *json.SyntaxError:
+		offset = jsonErr.Offset
+	case *json.UnmarshalTypeError:
+		offset = jsonErr.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	//-- the offset is just after the byte where the error was found
+	line, col := 1, 1
+	for _, b := range content[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	if col > 1 {
+		col--
+	}
+	return fmt.Errorf("%v (line %v, column %v)", err, line, col)
+}
+
+// parseFeatureEdits reads the features to write from a GeoJSON feature collection.
+// Each feature must have a unique id, and its properties must be columns of the table
+func parseFeatureEdits(content []byte, tbl *data.Table, columns []string) ([]*data.FeatureEdit, error) {
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Type       string                 `json:"type"`
+			ID         interface{}            `json:"id"`
+			Geometry   json.RawMessage        `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	//-- numbers are passed to the database as they are written
+	dec.UseNumber()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, jsonErrorLocation(content, err)
+	}
+	if fc.Type != api.GeoJSONFeatureCollection {
+		return nil, fmt.Errorf("type is not %v", api.GeoJSONFeatureCollection)
+	}
+	isColumn := toNameSet(columns)
+	isID := make(map[string]bool)
+	edits := make([]*data.FeatureEdit, 0, len(fc.Features))
+	for i, feat := range fc.Features {
+		if feat.Type != api.GeoJSONFeature {
+			return nil, fmt.Errorf("feature %v type is not %v", i, api.GeoJSONFeature)
+		}
+		var id string
+		switch val := feat.ID.(type) {
+		case string:
+			id = val
+		case json.Number:
+			id = val.String()
+		}
+		if id == "" {
+			return nil, fmt.Errorf("feature %v has no id", i)
+		}
+		if isID[id] {
+			return nil, fmt.Errorf("duplicate feature id %v", id)
+		}
+		isID[id] = true
+		for prop := range feat.Properties {
+			if !isColumn[prop] {
+				return nil, fmt.Errorf("feature %v property is not a column: %v", id, prop)
+			}
+		}
+		geom := strings.TrimSpace(string(feat.Geometry))
+		if geom == "null" {
+			geom = ""
+		}
+		if geom != "" && (!strings.HasPrefix(geom, "{") || tbl.GeometryColumn == "") {
+			return nil, fmt.Errorf("feature %v geometry is invalid", id)
+		}
+		edits = append(edits, &data.FeatureEdit{ID: id, Geometry: geom, Properties: feat.Properties})
+	}
+	return edits, nil
+}
+
+// requestPreferReturn provides the return preference of an edit request.
+// It is representation if the request has no valid return preference
+func requestPreferReturn(r *http.Request) string {
+	for _, hdr := range r.Header[headerPrefer] {
+		for _, pref := range strings.Split(hdr, ",") {
+			//-- ignore preference parameters
+			token := strings.TrimSpace(strings.SplitN(pref, ";", 2)[0])
+			nameVal := strings.SplitN(token, "=", 2)
+			if len(nameVal) < 2 || !strings.EqualFold(strings.TrimSpace(nameVal[0]), preferReturn) {
+				continue
+			}
+			val := strings.ToLower(strings.Trim(strings.TrimSpace(nameVal[1]), "\""))
+			if val == preferReturnMinimal || val == preferReturnRepresentation {
+				return val
+			}
+		}
+	}
+	return preferReturnRepresentation
+}
+
+// setPreferenceApplied reports the return preference used for a response
+func setPreferenceApplied(w http.ResponseWriter, val string) {
+	w.Header().Set(headerPreferenceApplied, preferReturn+"="+val)
+}
+
+// checkTableEditable determines whether a table allows its features to be modified.
+// Editing must be enabled in the collection configuration,
+// and the table must be a base table with a primary key
+// (or an id column with a unique index).
+func checkTableEditable(w http.ResponseWriter, tbl *data.Table) *appError {
+	if !conf.Configuration().CollectionConfig(tbl.ID).Editable {
+		w.Header().Set("Allow", http.MethodGet)
+		return appErrorMsg(nil, fmt.Sprintf(api.ErrMsgCollectionNotEditable, tbl.ID), http.StatusMethodNotAllowed)
+	}
+	if tbl.IsView {
+		return appErrorMsg(nil, fmt.Sprintf(api.ErrMsgCollectionIsView, tbl.ID), http.StatusConflict)
+	}
+	if !tbl.SupportsFeatureID() {
+		return appErrorMsg(nil, fmt.Sprintf(api.ErrMsgCollectionNoKey, tbl.ID), http.StatusConflict)
+	}
+	if tbl.IDNotUnique {
+		return appErrorMsg(nil, fmt.Sprintf(api.ErrMsgCollectionIDNotUnique, tbl.ID), http.StatusConflict)
+	}
+	return nil
+}
+
+// idColumnLabel provides the id column name(s) of a table for display
+func idColumnLabel(tbl *data.Table) string {
+	return strings.Join(tbl.IDColumns, data.FeatureIDSeparator)
+}
+
+// handleHealth reports service liveness. It does not access the database
+func handleHealth(w http.ResponseWriter, r *http.Request) *appError {
+	return writeJSON(w, api.ContentTypeJSON, api.HealthStatus{Status: api.HealthStatusOK})
+}
+
+// handleRefresh discards the cached collection metadata,
+// so that schema changes are picked up without waiting for the TableCacheTTL.
+// It is only enabled if an admin key is configured, and requires that key
+func handleRefresh(w http.ResponseWriter, r *http.Request) *appError {
+	if conf.Configuration().Auth.AdminKey == "" {
+		return appErrorNotFoundFmt(nil, api.ErrMsgAdminNotEnabled, "refresh")
+	}
+	if !isAdminRequest(r) {
+		return appErrorMsg(nil, api.ErrMsgUnauthorized, http.StatusUnauthorized)
+	}
+	catalogInstance.InvalidateTables()
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleReady reports service readiness, by checking the database is available
+func handleReady(w http.ResponseWriter, r *http.Request) *appError {
+	timeout := time.Duration(conf.Configuration().Server.ReadyTimeoutSec) * time.Second
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	err := catalogInstance.Ping(ctx)
+	if err != nil {
+		log.Warnf("Readiness check failed: %v", err)
+		w.Header().Set("Content-Type", api.ContentTypeJSON)
+		writeError(w, api.ErrCodeServiceUnavailable, err.Error(), http.StatusServiceUnavailable)
+		return nil
+	}
+	content := api.HealthStatus{Status: api.HealthStatusOK}
+	if stats := catalogInstance.PoolStats(); stats != nil {
+		content.Pool = &api.PoolStatus{
+			MaxConns:      stats.MaxConns,
+			TotalConns:    stats.TotalConns,
+			AcquiredConns: stats.AcquiredConns,
+			IdleConns:     stats.IdleConns,
+		}
+	}
+	return writeJSON(w, api.ContentTypeJSON, content)
+}
+
 func handleConformance(w http.ResponseWriter, r *http.Request) *appError {
 	// TODO: determine content from request header?
 	format := api.RequestedFormat(r)
@@ -446,6 +1745,8 @@ func handleAPI(w http.ResponseWriter, r *http.Request) *appError {
 		context.URLJSON = urlPathFormat(urlBase, api.TagAPI, api.FormatJSON)
 
 		return writeHTML(w, content, context, ui.PageAPI())
+	case api.FormatYAML:
+		return writeYAML(w, api.ContentTypeOpenAPIYAML, content)
 	default:
 		return writeJSON(w, api.ContentTypeJSON, content)
 	}
@@ -461,12 +1762,11 @@ func handleFunctions(w http.ResponseWriter, r *http.Request) *appError {
 	}
 	content := api.NewFunctionsInfo(fns)
 	for _, fn := range content.Functions {
-		isGeomFun := fn.Function.IsGeometryFunction()
 		switch format {
 		case api.FormatHTML:
-			addFunctionURLs(fn, urlBase, isGeomFun)
+			addFunctionURLs(fn, urlBase)
 		default:
-			fn.Links = linksFunction(fn.Function.ID, urlBase, true, isGeomFun)
+			fn.Links = linksFunction(fn.Function.ID, urlBase, true, fn.Function.IsGeometryFunction())
 		}
 	}
 
@@ -490,25 +1790,16 @@ func linksFunctions(urlBase string) []*api.Link {
 	return links
 }
 
-func addFunctionURLs(content *api.FunctionSummary, urlBase string, isGeomFun bool) {
+func addFunctionURLs(content *api.FunctionSummary, urlBase string) {
 	name := content.Name
 	path := api.PathFunction(name)
 	pathItems := api.PathFunctionItems(name)
 	content.URLMetadataJSON = urlPathFormat(urlBase, path, api.FormatJSON)
 	content.URLMetadataHTML = urlPathFormat(urlBase, path, api.FormatHTML)
-	// there is no HTML view for non-spatial (for now)
-	content.URLItemsHTML = urlIfExists(isGeomFun, urlPathFormat(urlBase, pathItems, api.FormatHTML))
+	content.URLItemsHTML = urlPathFormat(urlBase, pathItems, api.FormatHTML)
 	content.URLItemsJSON = urlPathFormat(urlBase, pathItems, api.FormatJSON)
 }
 
-// urlIfExists returns the url, or blank if the document does not exist
-func urlIfExists(isExists bool, url string) string {
-	if isExists {
-		return url
-	}
-	return ""
-}
-
 func linksFunction(id string, urlBase string, isSummary bool, isGeomFun bool) []*api.Link {
 	path := api.PathFunction(id)
 	pathItems := api.PathFunctionItems(id)
@@ -562,8 +1853,7 @@ func handleFunction(w http.ResponseWriter, r *http.Request) *appError {
 		context.URLFunctions = urlPathFormat(urlBase, api.TagFunctions, api.FormatHTML)
 		context.URLFunction = urlPathFormat(urlBase, api.PathFunction(name), api.FormatHTML)
 		context.URLJSON = urlPathFormat(urlBase, api.PathFunction(name), api.FormatJSON)
-		// there is no HTML view for non-spatial (for now)
-		context.URLItems = urlIfExists(isGeomFun, urlPathFormat(urlBase, pathItems, api.FormatHTML))
+		context.URLItems = urlPathFormat(urlBase, pathItems, api.FormatHTML)
 		context.URLItemsJSON = urlPathFormat(urlBase, pathItems, api.FormatJSON)
 		context.Title = fn.ID
 		context.Function = fn
@@ -583,28 +1873,47 @@ func handleFunctionItems(w http.ResponseWriter, r *http.Request) *appError {
 
 	//--- extract request parameters
 	name := data.FunctionQualifiedId(getRequestVar(routeVarID, r))
-	reqParam, err := parseRequestParams(r)
-	if err != nil {
-		return appErrorMsg(err, err.Error(), http.StatusBadRequest)
-	}
 	query := api.URLQuery(r.URL)
 
 	fn, err := catalogInstance.FunctionByName(name)
-	if fn == nil && err == nil {
+	if err != nil {
+		return appErrorInternalFmt(err, api.ErrMsgFunctionAccess, name)
+	}
+	if fn == nil {
 		return appErrorNotFoundFmt(err, api.ErrMsgFunctionNotFound, name)
 	}
-	param, err := createQueryParams(&reqParam, fn.OutNames, data.SRID_4326)
+	reqParam, err := parseRequestParams(r, conf.Configuration().Paging, fn.InNames)
+	if err != nil {
+		return appErrorMsg(err, err.Error(), http.StatusBadRequest)
+	}
+	// clustering and aggregation apply only to collection items
+	reqParam.Cluster = nil
+	reqParam.Aggregate = nil
+	param, err := createQueryParams(&reqParam, fn.OutNames, fn.Types, data.SRID_4326)
 	if err != nil {
 		return appErrorBadRequest(err, err.Error())
 	}
+	//-- function features have no computed properties
+	if len(reqParam.Computed) > 0 {
+		msg := fmt.Sprintf(api.ErrMsgInvalidParameterValue, api.ParamProperties, reqParam.Computed[0].Name)
+		return appErrorBadRequest(nil, msg)
+	}
+	if !fn.IsGeometryFunction() && isDistanceSorting(param.SortBy) {
+		return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgInvalidParameterValue, api.ParamSortBy, api.OrderByDistance))
+	}
 	fnArgs := restrict(reqParam.Values, fn.InNames)
+	for _, argName := range fn.RequiredInNames() {
+		if _, ok := fnArgs[argName]; !ok {
+			return appErrorBadRequest(nil, fmt.Sprintf(api.ErrMsgMissingParameter, argName))
+		}
+	}
 	//log.Debugf("Function request args: %v ", fnArgs)
 
 	ctx := r.Context()
 	switch format {
 	case api.FormatJSON:
 		if fn.IsGeometryFunction() {
-			return writeFunItemsGeoJSON(ctx, w, name, fnArgs, param, urlBase)
+			return writeFunItemsGeoJSON(ctx, w, name, fnArgs, param, urlBase, reqParam.NoEnvelope)
 		}
 		return writeFunItemsJSON(ctx, w, name, fnArgs, param)
 	case api.FormatHTML:
@@ -637,12 +1946,14 @@ func writeFunItemsHTML(w http.ResponseWriter, name string, query string, urlBase
 	context.Title = fn.ID
 	context.Function = fn
 	context.IDColumn = data.FunctionIDColumnName
+	// non-spatial function results are shown as a table
+	context.AttributeTable = !fn.IsGeometryFunction()
 
 	// features are not needed for items page (page queries for them)
 	return writeHTML(w, nil, context, ui.PageFunctionItems())
 }
 
-func writeFunItemsGeoJSON(ctx context.Context, w http.ResponseWriter, name string, args map[string]string, param *data.QueryParam, urlBase string) *appError {
+func writeFunItemsGeoJSON(ctx context.Context, w http.ResponseWriter, name string, args map[string]string, param *data.QueryParam, urlBase string, isBare bool) *appError {
 	//--- query features data
 	features, err := catalogInstance.FunctionFeatures(ctx, name, args, param)
 	if err != nil {
@@ -651,12 +1962,19 @@ func writeFunItemsGeoJSON(ctx context.Context, w http.ResponseWriter, name strin
 	if features == nil {
 		return appErrorNotFoundFmt(err, api.ErrMsgNoDataRead, name)
 	}
+	setTruncatedHeader(w, param)
+	if isBare {
+		w.Header().Set("Link", api.LinkHeader(linksItems(name, urlBase)))
+		w.Header().Set("Content-Type", api.ContentTypeJSON)
+		return writeFeatureArray(w, features)
+	}
 
 	//--- assemble resonse
 	content := api.NewFeatureCollectionInfo(features)
 	content.Links = linksItems(name, urlBase)
+	content.Truncated = param.Truncated
 
-	return writeJSON(w, api.ContentTypeGeoJSON, content)
+	return writeJSON(w, featuresContentType(param), content)
 }
 
 func writeFunItemsJSON(ctx context.Context, w http.ResponseWriter, name string, args map[string]string, param *data.QueryParam) *appError {
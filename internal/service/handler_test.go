@@ -14,21 +14,38 @@ package service
 */
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/CrunchyData/pg_featureserv/internal/api"
 	"github.com/CrunchyData/pg_featureserv/internal/conf"
 	"github.com/CrunchyData/pg_featureserv/internal/data"
+	"github.com/CrunchyData/pg_featureserv/internal/tracing"
+	"github.com/golang-jwt/jwt"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/spf13/viper"
 )
 
 // Define a FeatureCollection structure for parsing test data
@@ -65,7 +82,7 @@ func TestMain(m *testing.M) {
 
 func setup(path string) {
 	router = initRouter(path)
-	conf.Configuration = conf.Config{
+	conf.SetConfiguration(conf.Config{
 		Server: conf.Server{
 			HttpHost:   "0.0.0.0",
 			HttpPort:   9000,
@@ -76,16 +93,34 @@ func setup(path string) {
 				"ST_Centroid",
 				"ST_PointOnSurface",
 			},
+			TransformMaxFunctions: 3,
+			TransformMaxArgs:      2,
 		},
 		Paging: conf.Paging{
-			LimitDefault: 10,
-			LimitMax:     1000,
+			LimitDefault:  10,
+			LimitMax:      1000,
+			StreamGeoJSON: true,
+			NumberMatched: true,
 		},
 		Metadata: conf.Metadata{
 			Title:       "test",
 			Description: "test",
 		},
-	}
+		Collections: []conf.Collection{
+			{
+				Id:       "mock_b",
+				Editable: true,
+			},
+		},
+		Download: conf.Download{
+			Disposition: map[string]string{
+				api.FormatJSON:       dispositionInline,
+				api.FormatCSV:        dispositionAttachment,
+				api.FormatGeoPackage: dispositionAttachment,
+			},
+			Filename: "{collection}",
+		},
+	})
 }
 
 func TestRoot(t *testing.T) {
@@ -110,6 +145,578 @@ func TestRoot(t *testing.T) {
 	*/
 }
 
+func TestForwardedPrefix(t *testing.T) {
+	conf.Configuration().Server.UrlBase = ""
+	defer func() {
+		conf.Configuration().Server.UrlBase = urlBase
+	}()
+	doRequestForwarded := func(url string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", basePath+url, nil)
+		for name, val := range headers {
+			req.Header.Set(name, val)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		equals(t, http.StatusOK, rr.Code, "status")
+		return rr
+	}
+	headers := map[string]string{
+		"X-Forwarded-Host":   "example.com",
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Prefix": "/gis/features/",
+	}
+	extBase := "https://example.com/gis/features" + basePath
+
+	var root api.RootInfo
+	json.Unmarshal(readBody(doRequestForwarded("/", headers)), &root)
+	checkLink(t, root.Links[0], api.RelSelf, api.ContentTypeJSON, extBase+"/"+api.RootPageName)
+	checkLink(t, root.Links[4], api.RelData, api.ContentTypeJSON, extBase+"/collections")
+
+	var coll api.CollectionInfo
+	json.Unmarshal(readBody(doRequestForwarded("/collections/mock_a", headers)), &coll)
+	checkLink(t, coll.Links[0], api.RelSelf, api.ContentTypeJSON, extBase+"/collections/mock_a")
+
+	var items FeatureCollection
+	json.Unmarshal(readBody(doRequestForwarded("/collections/mock_a/items", headers)), &items)
+	checkLink(t, items.Links[0], api.RelSelf, api.ContentTypeJSON, extBase+"/collections/mock_a/items")
+
+	// the standard Forwarded header also uses the prefix
+	headers = map[string]string{
+		"Forwarded":          "host=example.org;proto=https",
+		"X-Forwarded-Prefix": "/gis",
+	}
+	json.Unmarshal(readBody(doRequestForwarded("/", headers)), &root)
+	checkLink(t, root.Links[0], api.RelSelf, api.ContentTypeJSON, "https://example.org/gis"+basePath+"/"+api.RootPageName)
+}
+
+func TestHealth(t *testing.T) {
+	rr := doRequest(t, "/healthz")
+	equals(t, api.ContentTypeJSON, rr.Header().Get("Content-Type"), "Content-Type")
+	var v api.HealthStatus
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, api.HealthStatusOK, v.Status, "status")
+}
+
+func TestReady(t *testing.T) {
+	doRequest(t, "/readyz")
+}
+
+func TestReadyPoolStats(t *testing.T) {
+	catalogMock.Pool = &data.PoolStats{MaxConns: 4, TotalConns: 2, AcquiredConns: 1, IdleConns: 1}
+	defer func() { catalogMock.Pool = nil }()
+
+	rr := doRequest(t, "/readyz")
+	var v api.HealthStatus
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, api.HealthStatusOK, v.Status, "status")
+	assert(t, v.Pool != nil, "pool stats should be reported")
+	equals(t, int32(4), v.Pool.MaxConns, "maxConns")
+	equals(t, int32(1), v.Pool.AcquiredConns, "acquiredConns")
+}
+
+func TestReadyDatabaseUnavailable(t *testing.T) {
+	catalogMock.PingErr = errors.New("database unreachable")
+	defer func() { catalogMock.PingErr = nil }()
+
+	rr := doRequestStatus(t, "/readyz", http.StatusServiceUnavailable)
+	equals(t, api.ContentTypeJSON, rr.Header().Get("Content-Type"), "Content-Type")
+	assert(t, strings.Contains(rr.Body.String(), "database unreachable"), "response should describe failure")
+	// liveness does not depend on the database
+	doRequest(t, "/healthz")
+}
+
+func TestRateLimit(t *testing.T) {
+	conf.Configuration().RateLimit = conf.RateLimit{RequestsPerSec: 0.5, Burst: 2, TrustedProxies: []string{"10.0.0.0/8"}}
+	defer func() { conf.Configuration().RateLimit = conf.RateLimit{} }()
+
+	doRateLimitRequest(t, "/collections", "203.0.113.1", http.StatusOK)
+	doRateLimitRequest(t, "/collections", "203.0.113.1, 10.0.0.1", http.StatusOK)
+	rr := doRateLimitRequest(t, "/collections", "203.0.113.1", http.StatusTooManyRequests)
+	equals(t, "2", rr.Header().Get("Retry-After"), "Retry-After")
+	// other clients and exempt paths are not limited
+	doRateLimitRequest(t, "/collections", "203.0.113.2", http.StatusOK)
+	doRateLimitRequest(t, "/healthz", "203.0.113.1", http.StatusOK)
+	doRateLimitRequest(t, "/metrics", "203.0.113.1", http.StatusOK)
+	// a client can not avoid the limit with a forged address before the proxy address
+	doRateLimitRequest(t, "/collections", "198.51.100.1, 203.0.113.1", http.StatusTooManyRequests)
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	isAllowed, _ := limiter.allow("a", 1, 1, now)
+	assert(t, isAllowed, "first request should be allowed")
+	isAllowed, wait := limiter.allow("a", 1, 1, now.Add(500*time.Millisecond))
+	assert(t, !isAllowed, "request over the rate should not be allowed")
+	equals(t, 500*time.Millisecond, wait, "wait for token")
+	isAllowed, _ = limiter.allow("a", 1, 1, now.Add(1500*time.Millisecond))
+	assert(t, isAllowed, "request should be allowed once the bucket refills")
+
+	req, _ := http.NewRequest("GET", "/collections?api_key=key1", nil)
+	req.RemoteAddr = "10.0.0.5:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	proxies := []string{"10.0.0.5"}
+	equals(t, "key:key1", rateLimitKey(req, []string{"key1"}, proxies), "API key is the client key")
+	equals(t, "ip:203.0.113.1", rateLimitKey(req, []string{"key2"}, proxies), "invalid API key is not the client key")
+	equals(t, "ip:203.0.113.1", rateLimitKey(req, nil, proxies), "API keys not configured")
+	//-- the forwarded address is only used from a trusted proxy
+	equals(t, "ip:10.0.0.5", rateLimitKey(req, nil, nil), "untrusted proxy")
+	equals(t, "ip:10.0.0.5", rateLimitKey(req, nil, []string{"10.1.0.0/16"}), "proxy not in range")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.1, 10.0.0.6")
+	equals(t, "ip:203.0.113.1", rateLimitKey(req, nil, []string{"10.0.0.0/24"}), "last untrusted address")
+}
+
+func TestTracing(t *testing.T) {
+	var exported []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exported, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer collector.Close()
+	tracing.Init(collector.URL, 1, "pg_featureserv")
+
+	req, _ := http.NewRequest("GET", basePath+"/collections/mock_a/items", nil)
+	req.Header.Set(tracing.HeaderTraceparent, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code, "status")
+	// shutdown exports the pending spans
+	tracing.Shutdown()
+
+	var traces struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Kind         int    `json:"kind"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	errUnMarsh := json.Unmarshal(exported, &traces)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 1, len(traces.ResourceSpans), "resourceSpans")
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	equals(t, 1, len(spans), "spans")
+	equals(t, "0af7651916cd43dd8448eb211c80319c", spans[0].TraceID, "span traceId")
+	equals(t, "b7ad6b7169203331", spans[0].ParentSpanID, "span parentSpanId")
+	equals(t, "GET "+basePath+"/collections/{id}/items", spans[0].Name, "span name")
+	equals(t, tracing.KindServer, spans[0].Kind, "span kind")
+
+	// when tracing is disabled no spans are recorded
+	_, span := tracing.StartSpan(req.Context(), "query", tracing.KindClient)
+	assert(t, span == nil, "span should be nil when tracing is disabled")
+}
+
+func doRateLimitRequest(t *testing.T, url string, forwardedFor string, statusExpected int) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", basePath+url, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, statusExpected, rr.Code, "status for "+url)
+	return rr
+}
+
+func TestRefresh(t *testing.T) {
+	defer func() { conf.Configuration().Auth = conf.Auth{} }()
+
+	// disabled unless an admin key is configured
+	doRequestMethodStatus(t, http.MethodPost, "/refresh", http.StatusNotFound)
+
+	conf.Configuration().Auth = conf.Auth{AdminKey: "admin"}
+	doRequestMethodStatus(t, http.MethodPost, "/refresh", http.StatusUnauthorized)
+	doRequestMethodStatus(t, http.MethodPost, "/refresh?api_key=wrong", http.StatusUnauthorized)
+	doRequestMethodStatus(t, http.MethodPost, "/refresh?api_key=admin", http.StatusNoContent)
+	doRequestStatus(t, "/refresh", http.StatusMethodNotAllowed)
+
+	// API keys do not allow administrative requests
+	conf.Configuration().Auth = conf.Auth{ApiKeys: []string{"key1"}, AdminKey: "admin"}
+	doRequestMethodStatus(t, http.MethodPost, "/refresh?api_key=key1", http.StatusUnauthorized)
+	req, _ := http.NewRequest(http.MethodPost, basePath+"/refresh", nil)
+	req.Header.Set("X-API-Key", "admin")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusNoContent, rr.Code, "status with admin key header")
+}
+
+func TestAPIYAML(t *testing.T) {
+	rr := doRequest(t, "/api?f=yaml")
+	equals(t, api.ContentTypeOpenAPIYAML, rr.Header().Get("Content-Type"), "content type")
+	body := string(readBody(rr))
+	assert(t, strings.Contains(body, "\nopenapi: 3.0.0\n"), "openapi version as YAML")
+	assert(t, strings.Contains(body, "/collections/{collectionId}/items:"), "paths as YAML")
+
+	rr = doRequest(t, "/api.yaml")
+	equals(t, api.ContentTypeOpenAPIYAML, rr.Header().Get("Content-Type"), "content type for .yaml")
+
+	req, _ := http.NewRequest("GET", basePath+"/api", nil)
+	req.Header.Set("Accept", "application/vnd.oai.openapi;format=yaml")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code, "status")
+	equals(t, api.ContentTypeOpenAPIYAML, rr.Header().Get("Content-Type"), "content type for Accept")
+
+	//-- JSON remains the default
+	rr = doRequest(t, "/api")
+	equals(t, api.ContentTypeJSON, rr.Header().Get("Content-Type"), "default content type")
+	var v map[string]interface{}
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+}
+
+func TestAPIKey(t *testing.T) {
+	conf.Configuration().Auth = conf.Auth{ApiKeys: []string{"key1", "key2"}, PublicMetadata: true}
+	defer func() { conf.Configuration().Auth = conf.Auth{} }()
+
+	doRequestStatus(t, "/collections", http.StatusUnauthorized)
+	doRequestStatus(t, "/collections/mock_a/items?api_key=wrong", http.StatusUnauthorized)
+	doRequest(t, "/collections/mock_a/items?api_key=key2")
+
+	req, _ := http.NewRequest("GET", basePath+"/collections/mock_a/items", nil)
+	req.Header.Set("X-API-Key", "key1")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code, "status with API key header")
+
+	// public paths
+	doRequest(t, "/")
+	doRequest(t, "/index.html")
+	doRequest(t, "/api")
+	doRequest(t, "/conformance")
+	doRequest(t, "/healthz")
+
+	conf.Configuration().Auth.PublicMetadata = false
+	doRequestStatus(t, "/", http.StatusUnauthorized)
+	doRequestStatus(t, "/api.json", http.StatusUnauthorized)
+	doRequest(t, "/readyz")
+}
+
+func TestTenantFilter(t *testing.T) {
+	confSaved := *conf.Configuration()
+	defer func() {
+		conf.SetConfiguration(confSaved)
+		initAuth()
+	}()
+	conf.Configuration().Auth = conf.Auth{JwtAlgorithm: "HS256", JwtKey: "secret", TenantClaim: "tenant", PublicMetadata: true}
+	conf.Configuration().Collections = []conf.Collection{{Id: "mock_c", TenantColumn: "prop_d"}}
+	initAuth()
+
+	doRequestStatus(t, "/collections/mock_c/items", http.StatusUnauthorized)
+
+	token := makeToken(t, "secret", jwt.MapClaims{"tenant": 3})
+	rr := doRequestToken(t, "/collections/mock_c/items?limit=20", token, http.StatusOK)
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 20, len(v.Features), "# features")
+	for _, feat := range v.Features {
+		equals(t, 3.0, feat.Props["prop_d"], "feature tenant property")
+	}
+	// query parameters cannot override the tenant filter
+	rr = doRequestToken(t, "/collections/mock_c/items?prop_d=4", token, http.StatusOK)
+	json.Unmarshal(readBody(rr), &v) //nolint:errcheck
+	equals(t, 0, len(v.Features), "# features for other tenant")
+
+	doRequestToken(t, "/collections/mock_c/items/3", token, http.StatusOK)
+	doRequestToken(t, "/collections/mock_c/items/4", token, http.StatusNotFound)
+
+	// token without tenant claim
+	doRequestToken(t, "/collections/mock_c/items", makeToken(t, "secret", jwt.MapClaims{}), http.StatusForbidden)
+	// token with invalid signature
+	doRequestToken(t, "/collections/mock_c/items", makeToken(t, "wrong", jwt.MapClaims{"tenant": 3}), http.StatusUnauthorized)
+
+	// collections without tenant column are served unfiltered or hidden
+	doRequestToken(t, "/collections/mock_a/items", token, http.StatusOK)
+	conf.Configuration().Auth.HideNonTenantCollections = true
+	doRequestToken(t, "/collections/mock_a/items", token, http.StatusNotFound)
+	doRequestToken(t, "/collections/mock_a", token, http.StatusNotFound)
+	rr = doRequestToken(t, "/collections", token, http.StatusOK)
+	var vc api.CollectionsInfo
+	errUnMarsh = json.Unmarshal(readBody(rr), &vc)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 1, len(vc.Collections), "# collections")
+	equals(t, "mock_c", vc.Collections[0].Name, "collection name")
+}
+
+func makeToken(t *testing.T, key string, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestCORS(t *testing.T) {
+	conf.Configuration().Cors = []conf.Cors{
+		{
+			Paths:            []string{"/collections/*/items", "/collections/*/items/*"},
+			AllowedOrigins:   []string{"https://app.example.com"},
+			AllowedMethods:   []string{"GET"},
+			AllowedHeaders:   []string{"Authorization"},
+			AllowCredentials: true,
+			MaxAgeSec:        600,
+		},
+		{
+			Paths:          []string{"/collections"},
+			AllowedOrigins: []string{"*"},
+		},
+	}
+	defer func() { conf.Configuration().Cors = nil }()
+	handler := corsHandler(basePath, router)
+
+	rr := doRequestCORS(t, handler, "GET", "/collections/mock_a/items.json", "https://app.example.com", nil)
+	equals(t, http.StatusOK, rr.Code, "status")
+	equals(t, "https://app.example.com", rr.Header().Get(headerAllowOrigin), "allowed origin")
+	equals(t, "true", rr.Header().Get(headerAllowCredentials), "allow credentials")
+
+	rr = doRequestCORS(t, handler, "GET", "/collections/mock_a/items/1", "https://other.example.com", nil)
+	equals(t, "", rr.Header().Get(headerAllowOrigin), "origin not allowed")
+
+	rr = doRequestCORS(t, handler, "GET", "/collections/mock_a", "https://app.example.com", nil)
+	equals(t, "", rr.Header().Get(headerAllowOrigin), "path not allowed")
+
+	// a wildcard origin without credentials
+	rr = doRequestCORS(t, handler, "GET", "/collections.json", "https://other.example.com", nil)
+	equals(t, "*", rr.Header().Get(headerAllowOrigin), "wildcard origin")
+	equals(t, "", rr.Header().Get(headerAllowCredentials), "no credentials")
+
+	// preflight requests are answered without calling the handlers
+	preflight := map[string]string{headerRequestMethod: "GET", headerRequestHeaders: "authorization"}
+	rr = doRequestCORS(t, handler, "OPTIONS", "/collections/missing/items", "https://app.example.com", preflight)
+	equals(t, http.StatusNoContent, rr.Code, "preflight status")
+	equals(t, "https://app.example.com", rr.Header().Get(headerAllowOrigin), "preflight origin")
+	equals(t, "GET", rr.Header().Get(headerAllowMethods), "preflight methods")
+	equals(t, "authorization", rr.Header().Get(headerAllowHeaders), "preflight headers")
+	equals(t, "600", rr.Header().Get(headerMaxAge), "preflight max age")
+
+	preflight[headerRequestMethod] = "DELETE"
+	rr = doRequestCORS(t, handler, "OPTIONS", "/collections/mock_a/items/1", "https://app.example.com", preflight)
+	equals(t, http.StatusNoContent, rr.Code, "preflight status")
+	equals(t, "", rr.Header().Get(headerAllowOrigin), "preflight method not allowed")
+}
+
+func TestCORSDefault(t *testing.T) {
+	handler := corsHandler(basePath, router)
+	rr := doRequestCORS(t, handler, "GET", "/collections", "https://app.example.com", nil)
+	equals(t, http.StatusOK, rr.Code, "status")
+	equals(t, "", rr.Header().Get(headerAllowOrigin), "no CORS by default")
+}
+
+func doRequestCORS(t *testing.T, handler http.Handler, method string, url string, origin string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, basePath+url, nil)
+	req.Header.Set(headerOrigin, origin)
+	for name, val := range headers {
+		req.Header.Set(name, val)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	ver, err := tlsMinVersion("")
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, uint16(tls.VersionTLS12), ver, "default version")
+	ver, err = tlsMinVersion("1.3")
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, uint16(tls.VersionTLS13), ver, "version 1.3")
+	_, err = tlsMinVersion("2.0")
+	assert(t, err != nil, "invalid version should be an error")
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:9000/collections?limit=1", nil)
+	rr := httptest.NewRecorder()
+	httpsRedirectHandler(9001).ServeHTTP(rr, req)
+	equals(t, http.StatusMovedPermanently, rr.Code, "status")
+	equals(t, "https://localhost:9001/collections?limit=1", rr.Header().Get("Location"), "redirect location")
+
+	rr = httptest.NewRecorder()
+	httpsRedirectHandler(443).ServeHTTP(rr, req)
+	equals(t, "https://localhost/collections?limit=1", rr.Header().Get("Location"), "redirect location default port")
+}
+
+func TestCertificateReloadError(t *testing.T) {
+	_, err := newCertificateLoader("missing.crt", "missing.key")
+	assert(t, err != nil, "missing certificate should be an error")
+
+	// a failed reload keeps the current certificate
+	cert := &tls.Certificate{}
+	loader := &certificateLoader{certFile: "missing.crt", keyFile: "missing.key", cert: cert}
+	assert(t, loader.load() != nil, "missing certificate should be an error")
+	current, _ := loader.getCertificate(nil)
+	assert(t, current == cert, "certificate should be kept")
+}
+
+func TestSetDefaultOrder(t *testing.T) {
+	collsSaved := conf.Configuration().Collections
+	tiebreakerSaved := conf.Configuration().Paging.SortTiebreaker
+	defer func() {
+		conf.Configuration().Collections = collsSaved
+		conf.Configuration().Paging.SortTiebreaker = tiebreakerSaved
+	}()
+	tbl := catalogMock.TableDefs[0]
+
+	param := &data.QueryParam{}
+	setDefaultOrder(param, tbl, tbl.ID)
+	equals(t, tbl.IDColumns, param.DefaultOrder, "default order by id")
+
+	conf.Configuration().Paging.SortTiebreaker = true
+	param = &data.QueryParam{SortBy: []data.Sorting{{Name: "prop_a"}}}
+	setDefaultOrder(param, tbl, tbl.ID)
+	equals(t, tbl.IDColumns, param.DefaultOrder, "id tiebreaker with sortby")
+
+	conf.Configuration().Paging.SortTiebreaker = false
+	param = &data.QueryParam{SortBy: []data.Sorting{{Name: "prop_a"}}}
+	setDefaultOrder(param, tbl, tbl.ID)
+	equals(t, 0, len(param.DefaultOrder), "no tiebreaker with sortby if disabled")
+
+	param = &data.QueryParam{Distinct: true}
+	setDefaultOrder(param, tbl, tbl.ID)
+	equals(t, 0, len(param.DefaultOrder), "no default order with distinct")
+
+	conf.Configuration().Collections = []conf.Collection{{Id: tbl.ID, UnorderedPaging: true}}
+	param = &data.QueryParam{}
+	setDefaultOrder(param, tbl, tbl.ID)
+	equals(t, 0, len(param.DefaultOrder), "no default order for unordered collection")
+}
+
+func TestEmptyGeometry(t *testing.T) {
+	collsSaved := conf.Configuration().Collections
+	defer func() { conf.Configuration().Collections = collsSaved }()
+	tbl := catalogMock.TableDefs[0]
+
+	mode, err := parseEmptyGeometry(api.NameValMap{api.ParamEmptyGeom: "Exclude"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, data.EmptyGeometryExclude, mode, "empty-geometry")
+	_, err = parseEmptyGeometry(api.NameValMap{api.ParamEmptyGeom: "drop"})
+	assert(t, err != nil, "unknown empty-geometry value")
+	doRequestStatus(t, "/collections/mock_a/items?empty-geometry=drop", http.StatusBadRequest)
+	doRequest(t, "/collections/mock_a/items?empty-geometry=null")
+
+	//-- the request parameter overrides the collection configuration
+	conf.Configuration().Collections = []conf.Collection{{Id: tbl.ID, EmptyGeometry: "null"}}
+	param := &data.QueryParam{}
+	setGeometryRepair(param, tbl.ID)
+	equals(t, data.EmptyGeometryNull, param.EmptyGeometry, "configured empty geometry")
+	param = &data.QueryParam{EmptyGeometry: data.EmptyGeometryKeep}
+	setGeometryRepair(param, tbl.ID)
+	equals(t, data.EmptyGeometryKeep, param.EmptyGeometry, "requested empty geometry")
+}
+
+func TestDimension(t *testing.T) {
+	collsSaved := conf.Configuration().Collections
+	defer func() { conf.Configuration().Collections = collsSaved }()
+	tbl := catalogMock.TableDefs[0]
+
+	dim, err := parseDimension(api.NameValMap{api.ParamDimension: "2"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, data.Dimension2D, dim, "dimension")
+	dim, err = parseDimension(api.NameValMap{})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, 0, dim, "default dimension")
+	_, err = parseDimension(api.NameValMap{api.ParamDimension: "3"})
+	assert(t, err != nil, "unsupported dimension")
+	doRequestStatus(t, "/collections/mock_a/items?dimension=xyz", http.StatusBadRequest)
+	doRequest(t, "/collections/mock_a/items?dimension=2")
+
+	conf.Configuration().Collections = []conf.Collection{{Id: tbl.ID, Dimension: 2}}
+	param := &data.QueryParam{}
+	setGeometryRepair(param, tbl.ID)
+	equals(t, data.Dimension2D, param.Dimension, "configured dimension")
+}
+
+func TestParseTransformMetric(t *testing.T) {
+	defer initTransforms(conf.Configuration().Server.TransformFunctions, nil)
+	initTransforms([]string{"ST_Buffer", "ST_Centroid"}, []string{"ST_Buffer"})
+
+	funs, err := parseTransform(api.NameValMap{api.ParamTransform: "buffer,100|centroid"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, 2, len(funs), "# functions")
+	equals(t, true, funs[0].IsMetric, "buffer is metric")
+	equals(t, false, funs[1].IsMetric, "centroid is not metric")
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer func() {
+		setup(basePath)
+		Initialize()
+	}()
+	dir, _ := ioutil.TempDir("", "pg_featureserv")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.toml")
+	config := `[Server]
+HttpPort = 9999
+TransformFunctions = [ "ST_Buffer" ]
+[Paging]
+LimitMax = 5
+`
+	ioutil.WriteFile(file, []byte(config), 0644)
+	viper.SetConfigFile(file)
+
+	reloadConfig()
+	equals(t, 5, conf.Configuration().Paging.LimitMax, "LimitMax reloaded")
+	equals(t, 9000, conf.Configuration().Server.HttpPort, "HttpPort requires restart")
+	equals(t, "ST_Buffer", actualFunctionName("buffer"), "transforms reloaded")
+	equals(t, "", actualFunctionName("centroid"), "transforms reloaded")
+
+	// a config file which cannot be read keeps the current configuration
+	viper.SetConfigFile(filepath.Join(dir, "missing.toml"))
+	reloadConfig()
+	equals(t, 5, conf.Configuration().Paging.LimitMax, "LimitMax kept")
+
+	// a CORS policy allowing credentials for all origins is rejected
+	config = `[Paging]
+LimitMax = 7
+[[Cors]]
+AllowedOrigins = [ "*" ]
+AllowCredentials = true
+`
+	ioutil.WriteFile(file, []byte(config), 0644)
+	viper.SetConfigFile(file)
+	reloadConfig()
+	equals(t, 5, conf.Configuration().Paging.LimitMax, "LimitMax kept for invalid CORS policy")
+	equals(t, 0, len(conf.Configuration().Cors), "CORS policy rejected")
+}
+
+func doRequestToken(t *testing.T, url string, token string, statusExpected int) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", basePath+url, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != statusExpected {
+		t.Errorf("handler returned wrong status code for %v: got %v want %v", url, rr.Code, statusExpected)
+	}
+	return rr
+}
+
+func TestLang(t *testing.T) {
+	rr := doRequestStatus(t, "/collections/mock_a/items?limit=x&lang=fr", http.StatusBadRequest)
+	equals(t, "Valeur invalide pour le paramètre limit : x\n", rr.Body.String(), "localized error")
+
+	// unsupported languages fall back to English
+	rr = doRequestStatus(t, "/collections/mock_a/items?limit=x&lang=xx", http.StatusBadRequest)
+	equals(t, "Invalid value for parameter limit: x\n", rr.Body.String(), "default error")
+
+	req, _ := http.NewRequest("GET", basePath+"/collections/missing/items", nil)
+	req.Header.Set("Accept-Language", "de;q=0.9, fr-CA;q=0.8, en;q=0.5")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusNotFound, rr.Code, "status")
+	equals(t, "Collection introuvable : missing\n", rr.Body.String(), "Accept-Language error")
+
+	rr = doRequest(t, "/?lang=fr")
+	var v api.RootInfo
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, "Ce document en JSON", v.Links[0].Title, "localized link title")
+	equals(t, "Définition de l'API", v.Links[2].Title, "localized link title")
+}
+
 func TestCollectionsResponse(t *testing.T) {
 	path := "/collections"
 	resp := doRequest(t, path)
@@ -127,6 +734,59 @@ func TestCollectionsResponse(t *testing.T) {
 	checkCollection(t, v.Collections[2], "mock_c", "Mock C")
 }
 
+func TestCollectionsCategory(t *testing.T) {
+	collsSaved := conf.Configuration().Collections
+	defer func() { conf.Configuration().Collections = collsSaved }()
+	conf.Configuration().Collections = []conf.Collection{{Id: "mock_a", Category: "roads"}}
+	conf.Configuration().Metadata.DefaultCategory = "other"
+	defer func() { conf.Configuration().Metadata.DefaultCategory = "" }()
+
+	var v api.CollectionsInfo
+	rr := doRequest(t, "/collections")
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, []string{"other", "roads"}, v.Categories, "categories")
+	equals(t, "roads", v.Collections[0].Category, "mock_a category")
+	equals(t, "other", v.Collections[1].Category, "mock_b category")
+
+	rr = doRequest(t, "/collections?category=Roads")
+	v = api.CollectionsInfo{}
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 1, len(v.Collections), "# collections in category")
+	checkCollection(t, v.Collections[0], "mock_a", "Mock A")
+
+	rr = doRequest(t, "/collections?category=other")
+	v = api.CollectionsInfo{}
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 2, len(v.Collections), "# collections in default category")
+
+	var c api.CollectionInfo
+	rr = doRequest(t, "/collections/mock_a")
+	errUnMarsh = json.Unmarshal(readBody(rr), &c)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, "roads", c.Category, "collection category")
+}
+
+func TestCollectionsItemCount(t *testing.T) {
+	var v api.CollectionsInfo
+	rr := doRequest(t, "/collections")
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	assert(t, v.ItemCount == nil, "total item count should be omitted")
+	assert(t, v.Collections[0].ItemCount == nil, "item count should be omitted")
+
+	v = api.CollectionsInfo{}
+	rr = doRequest(t, "/collections?item-count")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, int64(9), *v.Collections[0].ItemCount, "mock_a item count")
+	equals(t, int64(100), *v.Collections[1].ItemCount, "mock_b item count")
+	equals(t, int64(10000), *v.Collections[2].ItemCount, "mock_c item count")
+	equals(t, int64(10109), *v.ItemCount, "total item count")
+}
+
 func TestCollectionResponse(t *testing.T) {
 	path := "/collections/mock_a"
 	resp := doRequest(t, path)
@@ -150,9 +810,157 @@ func TestCollectionResponse(t *testing.T) {
 		equals(t, tbl.ColDesc[i], v.Properties[i].Description, "Properties[].Description")
 	}
 
+	equals(t, "http://www.opengis.net/def/crs/EPSG/0/4326", v.StorageCrs, "StorageCrs")
+	equals(t, []string{api.CrsURICRS84}, v.Crs, "Crs")
+	equals(t, api.CrsURICRS84, v.Extent.Spatial.Crs, "extent crs")
+	equals(t, []float64{-120, 40, -74, 50}, v.Extent.Spatial.Extent, "extent bbox")
+	equals(t, "", v.Extent.Spatial.StorageCrs, "no storage extent crs for 4326")
+
 	checkLink(t, v.Links[0], api.RelSelf, api.ContentTypeJSON, urlBase+path)
 	checkLink(t, v.Links[1], api.RelAlt, api.ContentTypeHTML, urlBase+path+".html")
 	checkLink(t, v.Links[2], api.RelItems, api.ContentTypeGeoJSON, urlBase+path+"/items")
+	checkLink(t, v.Links[3], api.RelQueryables, api.ContentTypeSchemaJSON, urlBase+path+"/queryables")
+}
+
+func TestCollectionStorageExtent(t *testing.T) {
+	tbl := catalogMock.TableDefs[0]
+	tbl.Srid = 3857
+	tbl.StorageExtent = &data.Extent{Minx: -13358338.9, Miny: 4865942.3, Maxx: -8237642.3, Maxy: 6446275.8}
+	defer func() {
+		tbl.Srid = 4326
+		tbl.StorageExtent = nil
+	}()
+	var v api.CollectionInfo
+	errUnMarsh := json.Unmarshal(readBody(doRequest(t, "/collections/mock_a")), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, api.CrsURICRS84, v.Extent.Spatial.Crs, "extent crs")
+	equals(t, api.CrsURI(3857), v.Extent.Spatial.StorageCrs, "storage extent crs")
+	equals(t, []float64{-13358338.9, 4865942.3, -8237642.3, 6446275.8}, v.Extent.Spatial.StorageExtent, "storage extent bbox")
+}
+
+func TestQueryablesResponse(t *testing.T) {
+	path := "/collections/mock_a/queryables"
+	resp := doRequest(t, path)
+	equals(t, api.ContentTypeSchemaJSON, resp.Header().Get("Content-Type"), "Content-Type")
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	var v api.Queryables
+	errUnMarsh := json.Unmarshal(body, &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, api.JSONSchemaDraft, v.Schema, "$schema")
+	equals(t, urlBase+path, v.ID, "$id")
+	equals(t, "object", v.Type, "type")
+	equals(t, 4, len(v.Properties), "# properties")
+	equals(t, "string", v.Properties["prop_a"].Type, "prop_a type")
+	equals(t, "integer", v.Properties["prop_b"].Type, "prop_b type")
+	equals(t, "Property B", v.Properties["prop_b"].Description, "prop_b description")
+
+	doRequestStatus(t, "/collections/missing/queryables", http.StatusNotFound)
+}
+
+func TestQueryablesTypes(t *testing.T) {
+	tbl := &data.Table{
+		Title:          "Roads",
+		GeometryColumn: "geom",
+		GeometryType:   "MultiLineStringZ",
+		IDColumns:      []string{"gid"},
+		Columns:        []string{"gid", "name", "length", "opened", "updated", "attrs", "tags"},
+		DbTypes: map[string]string{
+			"gid": "int4", "name": "text", "length": "float8", "opened": "date",
+			"updated": "timestamptz", "attrs": "jsonb", "tags": "_text",
+		},
+		JSONTypes: []string{"number", "string", "number", "string", "string", "json", "string[]"},
+		ColDesc:   []string{"", "", "", "", "", "", ""},
+	}
+	v := api.NewQueryables(tbl, "http://test/collections/roads/queryables", nil)
+	equals(t, 6, len(v.Properties), "# properties")
+	equals(t, "geometry-multilinestring", v.Properties["geom"].Format, "geom format")
+	equals(t, api.QueryableRoleGeometry, v.Properties["geom"].Role, "geom role")
+	equals(t, api.QueryableRoleID, v.Properties["gid"].Role, "gid role")
+	equals(t, "number", v.Properties["length"].Type, "length type")
+	equals(t, "date", v.Properties["opened"].Format, "opened format")
+	equals(t, "date-time", v.Properties["updated"].Format, "updated format")
+	assert(t, v.Properties["attrs"] == nil, "JSON column should not be queryable")
+	assert(t, v.Properties["tags"] == nil, "array column should not be queryable")
+}
+
+func TestCrsParam(t *testing.T) {
+	defer api.InitCrs(nil)
+	uri3857 := "http://www.opengis.net/def/crs/EPSG/0/3857"
+	//-- with no configured coordinate systems any SRID is supported
+	api.InitCrs(nil)
+	doRequest(t, "/collections/mock_a/items/2?crs=3857")
+	doRequest(t, "/collections/mock_a/items/2?crs="+url.QueryEscape(uri3857))
+	doRequest(t, "/collections/mock_a/items?bbox-crs=3005&crs="+url.QueryEscape(api.CrsURICRS84))
+	doRequestStatus(t, "/collections/mock_a/items?crs=x", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?crs=-1", http.StatusBadRequest)
+
+	api.InitCrs([]conf.Crs{{Uri: uri3857, Srid: 3857}, {Uri: "", Srid: 2000}})
+	doRequest(t, "/collections/mock_a/items?crs="+url.QueryEscape(uri3857))
+	doRequest(t, "/collections/mock_a/items?crs=3857&bbox-crs=4326")
+	doRequestStatus(t, "/collections/mock_a/items?crs=3005", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?bbox=0,0,1,1&bbox-crs=3005", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?filter-crs="+url.QueryEscape("http://www.opengis.net/def/crs/EPSG/0/3005"), http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?crs=2000", http.StatusBadRequest)
+
+	//-- the collection coordinate systems are the configured ones
+	var coll api.CollectionInfo
+	json.Unmarshal(readBody(doRequest(t, "/collections/mock_a")), &coll) //nolint:errcheck
+	equals(t, []string{api.CrsURICRS84, uri3857}, coll.Crs, "collection crs")
+}
+
+func TestPrecisionMode(t *testing.T) {
+	defer initPrecisionMode(data.PrecisionModeRound)
+	// the mock does not round coordinates itself, as the database encoder does
+	full := itemCoordinates(t, "/collections/mock_a/items/2")
+
+	initPrecisionMode("Truncate")
+	coords := itemCoordinates(t, "/collections/mock_a/items/2?precision=1")
+	assert(t, maxDecimalDigits(coords) <= 1, fmt.Sprintf("truncated coordinates should have 1 decimal place: %v", coords))
+	for i, c := range coords {
+		val, _ := c.Float64()
+		fullVal, _ := full[i].Float64()
+		equals(t, math.Trunc(fullVal*10)/10, val, "truncated coordinate")
+	}
+	//-- the precision mode applies only if a precision is requested
+	equals(t, full, itemCoordinates(t, "/collections/mock_a/items/2"), "full precision")
+
+	initPrecisionMode("halfup")
+	coords = itemCoordinates(t, "/collections/mock_a/items/2?precision=1")
+	for i, c := range coords {
+		val, _ := c.Float64()
+		fullVal, _ := full[i].Float64()
+		equals(t, math.Round(fullVal*10)/10, val, "half up coordinate")
+	}
+
+	initPrecisionMode("nearest")
+	equals(t, data.PrecisionModeRound, precisionMode(), "unknown mode uses encoder rounding")
+}
+
+// itemCoordinates returns the point coordinates of a feature, as their JSON text
+func itemCoordinates(t *testing.T, path string) []json.Number {
+	resp := doRequest(t, path)
+	var feature struct {
+		Geometry struct {
+			Coordinates []json.Number `json:"coordinates"`
+		} `json:"geometry"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	errUnMarsh := dec.Decode(&feature)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	return feature.Geometry.Coordinates
+}
+
+func maxDecimalDigits(coords []json.Number) int {
+	digits := 0
+	for _, c := range coords {
+		if i := strings.Index(c.String(), "."); i >= 0 && len(c.String())-i-1 > digits {
+			digits = len(c.String()) - i - 1
+		}
+	}
+	return digits
 }
 
 func TestCollectionItemsResponse(t *testing.T) {
@@ -164,107 +972,1130 @@ func TestCollectionItemsResponse(t *testing.T) {
 	errUnMarsh := json.Unmarshal(body, &v)
 	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
 
-	equals(t, 9, len(v.Features), "# features")
-	checkLink(t, v.Links[0], api.RelSelf, api.ContentTypeJSON, urlBase+path)
-	checkLink(t, v.Links[1], api.RelAlt, api.ContentTypeHTML, urlBase+path+".html")
-}
+	equals(t, 9, len(v.Features), "# features")
+	checkLink(t, v.Links[0], api.RelSelf, api.ContentTypeJSON, urlBase+path)
+	checkLink(t, v.Links[1], api.RelAlt, api.ContentTypeHTML, urlBase+path+".html")
+}
+
+func TestFilterB(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items?prop_b=1")
+
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, 1, len(v.Features), "# features")
+}
+
+func TestFilterD(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_c/items?prop_d=1")
+
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, 10, len(v.Features), "# features")
+}
+
+func TestFilterBD(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_c/items?prop_b=2&prop_d=2")
+
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, 1, len(v.Features), "# features")
+}
+
+func TestFilterBDNone(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_c/items?prop_b=1&prop_d=2")
+
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, 0, len(v.Features), "# features")
+}
+
+func TestSortBy(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items?sortby=prop_b")
+
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, 9, len(v.Features), "# features")
+}
+
+func TestSortByDesc(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items?sortby=-prop_b")
+
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, 9, len(v.Features), "# features")
+}
+
+func TestSortByAsc(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items?sortby=+prop_b")
+
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, 9, len(v.Features), "# features")
+}
+
+func TestSortByNulls(t *testing.T) {
+	sorting, err := parseOrderBy(api.NameValMap{api.ParamOrderBy: "name:A:nullslast"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "name", Nulls: data.NullsLast}}, sorting, "orderby nullslast")
+
+	sorting, err = parseOrderBy(api.NameValMap{api.ParamOrderBy: "name:d"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "name", IsDesc: true}}, sorting, "orderby without nulls")
+
+	sorting, err = parseSortBy(api.NameValMap{api.ParamSortBy: "-name:nullsfirst"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "name", IsDesc: true, Nulls: data.NullsFirst}}, sorting, "sortby nullsfirst")
+
+	doRequestStatus(t, "/collections/mock_a/items?orderby=prop_b:a:nullsmiddle", http.StatusBadRequest)
+	doRequest(t, "/collections/mock_a/items?orderby=prop_b:d:nullslast")
+}
+
+func TestSortByMultiple(t *testing.T) {
+	sorting, err := parseSortBy(api.NameValMap{api.ParamSortBy: "-prop_b,+prop_a:nullsfirst,prop_c"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{
+		{Name: "prop_b", IsDesc: true},
+		{Name: "prop_a", Nulls: data.NullsFirst},
+		{Name: "prop_c"},
+	}, sorting, "sortby list")
+
+	_, err = parseSortBy(api.NameValMap{api.ParamSortBy: "prop_a,,prop_b"})
+	assert(t, err != nil, "empty sort property")
+
+	//-- orderby takes precedence over sortby
+	param, err := parseRequestParams(httptest.NewRequest("GET", "/collections/mock_a/items?sortby=-prop_b&orderby=prop_a:d", nil), conf.Configuration().Paging, nil)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "prop_a", IsDesc: true}}, param.SortBy, "orderby precedence")
+
+	doRequest(t, "/collections/mock_a/items?sortby=-prop_b,prop_a")
+}
+
+func TestSortByPath(t *testing.T) {
+	sorting, err := parseOrderBy(api.NameValMap{api.ParamOrderBy: "attrs.priority::int:D"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "attrs.priority", IsDesc: true, Cast: "integer"}}, sorting, "orderby path with cast")
+
+	sorting, err = parseSortBy(api.NameValMap{api.ParamSortBy: "-attrs.priority::float:nullslast"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "attrs.priority", IsDesc: true, Nulls: data.NullsLast, Cast: "double precision"}}, sorting, "sortby path with cast")
+
+	_, err = parseOrderBy(api.NameValMap{api.ParamOrderBy: "attrs.priority::regclass"})
+	assert(t, err != nil, "cast not allowed")
+
+	colNames := []string{"name", "attrs"}
+	colTypes := map[string]string{"name": "text", "attrs": "jsonb"}
+	query, err := createQueryParams(&api.RequestParam{SortBy: []data.Sorting{{Name: "attrs.priority", Cast: "integer"}}}, colNames, colTypes, 4326)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "attrs.priority", IsPath: true, Cast: "integer"}}, query.SortBy, "path sorting")
+
+	query, err = createQueryParams(&api.RequestParam{SortBy: []data.Sorting{{Name: "name"}}}, colNames, colTypes, 4326)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "name"}}, query.SortBy, "column sorting")
+
+	_, err = createQueryParams(&api.RequestParam{SortBy: []data.Sorting{{Name: "name.key"}}}, colNames, colTypes, 4326)
+	assert(t, err != nil, "path into a non-JSON column")
+	_, err = createQueryParams(&api.RequestParam{SortBy: []data.Sorting{{Name: "name", Cast: "integer"}}}, colNames, colTypes, 4326)
+	assert(t, err != nil, "cast of a column")
+
+	//-- JSON keys keep their case, and column names match case-insensitively
+	sorting, err = parseSortBy(api.NameValMap{api.ParamSortBy: "-ATTRS.someKey::INT:NULLSLAST"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "ATTRS.someKey", IsDesc: true, Nulls: data.NullsLast, Cast: "integer"}}, sorting, "sortby path case")
+	query, err = createQueryParams(&api.RequestParam{SortBy: sorting}, colNames, colTypes, 4326)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, "attrs.someKey", query.SortBy[0].Name, "path column case")
+	query, err = createQueryParams(&api.RequestParam{SortBy: []data.Sorting{{Name: "NAME"}}}, colNames, colTypes, 4326)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, "name", query.SortBy[0].Name, "column case")
+}
+
+func TestSample(t *testing.T) {
+	sample, err := parseSample(api.NameValMap{api.ParamSample: "5"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, 5.0, sample, "sample")
+
+	doRequestStatus(t, "/collections/mock_a/items?sample=0", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?sample=101", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?sample=abc", http.StatusBadRequest)
+	doRequest(t, "/collections/mock_a/items?sample=0.5&limit=3")
+}
+
+func TestGeomType(t *testing.T) {
+	geomType, err := parseGeomType(api.NameValMap{api.ParamGeomType: "POLYGON"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, "Polygon", geomType, "geomtype")
+	geomType, err = parseGeomType(api.NameValMap{api.ParamGeomType: "multilinestring"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, "MultiLineString", geomType, "geomtype lower case")
+
+	doRequestStatus(t, "/collections/mock_a/items?geomtype=circle", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?geomtype=ST_Point", http.StatusBadRequest)
+	doRequest(t, "/collections/mock_a/items?geomtype=point")
+
+	//-- collection metadata shows a mixed geometry type
+	tbl := catalogMock.TableDefs[0]
+	geomTypeSaved := tbl.GeometryType
+	defer func() { tbl.GeometryType = geomTypeSaved }()
+	tbl.GeometryType = "GEOMETRY"
+	var v map[string]interface{}
+	errUnMarsh := json.Unmarshal(readBody(doRequest(t, "/collections/mock_a")), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, true, v["geometrymixed"], "geometrymixed")
+}
+
+func TestBboxBuffer(t *testing.T) {
+	dist, err := parseBboxBuffer(api.NameValMap{api.ParamBboxBuffer: "0.001"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, 0.001, dist, "bbox-buffer")
+
+	doRequestStatus(t, "/collections/mock_a/items?bbox=0,0,1,1&bbox-buffer=-1", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?bbox=0,0,1,1&bbox-buffer=abc", http.StatusBadRequest)
+	doRequest(t, "/collections/mock_a/items?bbox=0,0,1,1&bbox-buffer=0.5")
+}
+
+func TestTile(t *testing.T) {
+	ext, err := parseTile(api.NameValMap{api.ParamTile: "0/0/0"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, data.Extent{Minx: -data.WebMercatorMax, Miny: -data.WebMercatorMax, Maxx: data.WebMercatorMax, Maxy: data.WebMercatorMax}, *ext, "tile 0/0/0")
+	ext, err = parseTile(api.NameValMap{api.ParamTile: "1/1/0"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, data.Extent{Minx: 0, Miny: 0, Maxx: data.WebMercatorMax, Maxy: data.WebMercatorMax}, *ext, "tile 1/1/0")
+
+	param, err := parseRequestParams(httptest.NewRequest("GET", "/collections/mock_a/items?tile=1/0/1", nil), conf.Configuration().Paging, nil)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, data.SRID_3857, param.BboxCrs, "tile bbox-crs")
+	equals(t, -data.WebMercatorMax, param.Bbox.Minx, "tile minx")
+	equals(t, -data.WebMercatorMax, param.Bbox.Miny, "tile miny")
+
+	doRequest(t, "/collections/mock_a/items?tile=2/1/1")
+	for _, tile := range []string{"abc", "1/2", "1/2/0", "1/0/2", "-1/0/0", "31/0/0", "1/0/0/0"} {
+		doRequestStatus(t, "/collections/mock_a/items?tile="+tile, http.StatusBadRequest)
+	}
+	rr := doRequestStatus(t, "/collections/mock_a/items?tile=0/0/0&bbox=0,0,1,1", http.StatusBadRequest)
+	equals(t, fmt.Sprintf(api.ErrMsgTileConflict, api.ParamBbox)+"\n", rr.Body.String(), "error message")
+	doRequestStatus(t, "/collections/mock_a/items?tile=0/0/0&bbox-crs=4326", http.StatusBadRequest)
+}
+
+func TestBboxMaxArea(t *testing.T) {
+	conf.Configuration().Server.BboxMaxArea = 100
+	conf.Configuration().Server.BboxMaxAreaProjected = 1e10
+	defer func() {
+		conf.Configuration().Server.BboxMaxArea = 0
+		conf.Configuration().Server.BboxMaxAreaProjected = 0
+	}()
+
+	doRequest(t, "/collections/mock_a/items?bbox=0,0,10,10")
+	rr := doRequestStatus(t, "/collections/mock_a/items?bbox=-180,-90,180,90", http.StatusBadRequest)
+	equals(t, fmt.Sprintf(api.ErrMsgBboxMaxArea, 100)+"\n", rr.Body.String(), "error message")
+	// the buffer is included in the area
+	doRequestStatus(t, "/collections/mock_a/items?bbox=0,0,10,10&bbox-buffer=1", http.StatusBadRequest)
+	// the antimeridian crossing bbox is 20 degrees wide
+	doRequestStatus(t, "/collections/mock_a/items?bbox=170,0,-170,10", http.StatusBadRequest)
+	// projected bbox-crs area is in CRS units
+	doRequest(t, "/collections/mock_a/items?bbox=0,0,50000,50000&bbox-crs=3857")
+	doRequestStatus(t, "/collections/mock_a/items?bbox=0,0,500000,500000&bbox-crs=3857", http.StatusBadRequest)
+	// an inverted bbox has the area of the bbox with the corners swapped
+	doRequestStatus(t, "/collections/mock_a/items?bbox=500000,500000,0,0&bbox-crs=3857", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?bbox=0,10,20,-10", http.StatusBadRequest)
+	doRequestStatus(t, "/functions/fun_a/items?bbox=-180,-90,180,90", http.StatusBadRequest)
+}
+
+func TestSortByDistance(t *testing.T) {
+	pt, err := parsePoint(api.NameValMap{api.ParamPoint: "-123.1, 49.25"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, &data.Point{X: -123.1, Y: 49.25}, pt, "point")
+
+	rr := doRequestStatus(t, "/collections/mock_a/items?sortby=distance", http.StatusBadRequest)
+	equals(t, api.ErrMsgDistanceNoPoint+"\n", rr.Body.String(), "error message")
+	doRequestStatus(t, "/collections/mock_a/items?sortby=distance&point=200,0", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?sortby=distance&point=1", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?sortby=distance&point=1,2&groupby=prop_a", http.StatusBadRequest)
+	doRequest(t, "/collections/mock_a/items?sortby=distance&point=-123.1,49.25&limit=10")
+	doRequest(t, "/collections/mock_a/items?orderby=distance&point=-123.1,49.25&limit=10")
+
+	//-- a column named distance is sorted by its value
+	point := &data.Point{X: 1, Y: 2}
+	query, err := createQueryParams(&api.RequestParam{SortBy: []data.Sorting{{Name: "distance", Point: point}}},
+		[]string{"name", "distance"}, nil, 4326)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []data.Sorting{{Name: "distance"}}, query.SortBy, "distance column sorting")
+	query, err = createQueryParams(&api.RequestParam{SortBy: []data.Sorting{{Name: "distance", Point: point}}},
+		[]string{"name"}, nil, 4326)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, point, query.SortBy[0].Point, "distance keyword sorting")
+}
+
+func TestDistinct(t *testing.T) {
+	doRequestStatus(t, "/collections/mock_a/items?distinct=true", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?distinct=maybe&properties=prop_a", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?distinct=true&properties=prop_a&sortby=prop_b", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items.gml?distinct=true&properties=prop_a", http.StatusBadRequest)
+
+	rr := doRequest(t, "/collections/mock_a/items?distinct=true&properties=prop_a&sortby=prop_a&limit=3")
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 3, len(v.Features), "# features")
+
+	//-- a non-geo format returns an array of property values
+	req, _ := http.NewRequest("GET", basePath+"/collections/mock_a/items?distinct=true&properties=prop_a&limit=3", nil)
+	req.Header.Set("Accept", api.ContentTypeJSON)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code, "status")
+	var vals []map[string]interface{}
+	errUnMarsh = json.Unmarshal(readBody(rr), &vals)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 3, len(vals), "# values")
+	_, ok := vals[0]["prop_a"]
+	assert(t, ok, "values should contain prop_a")
+}
+
+func TestAcceptFormat(t *testing.T) {
+	cases := map[string]string{
+		api.ContentTypeJSON: api.ContentTypeGeoJSON,
+		api.ContentTypeGeoJSON + ", " + api.ContentTypeJSON:       api.ContentTypeGeoJSON,
+		"application/json, text/html;q=0.5":                       api.ContentTypeGeoJSON,
+		"application/json, text/csv":                              api.ContentTypeCSV,
+		"text/csv;q=0.5, application/json":                        api.ContentTypeGeoJSON,
+		"application/geo+json;q=0.9, text/csv;q=0.8, */*;q=0.1":   api.ContentTypeGeoJSON,
+		"text/html,application/xhtml+xml,application/xml;q=0.9":   api.ContentTypeHTML,
+		"application/flatgeobuf;q=0, application/json;q=0.1":      api.ContentTypeGeoJSON,
+		"application/gml+xml;version=3.2, application/json;q=0.5": api.ContentTypeGML,
+	}
+	for accept, contentType := range cases {
+		req, _ := http.NewRequest("GET", basePath+"/collections/mock_a/items?limit=1", nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		equals(t, http.StatusOK, rr.Code, "status for "+accept)
+		assert(t, strings.HasPrefix(rr.Header().Get("Content-Type"), contentType),
+			fmt.Sprintf("Accept %v: Content-Type %v", accept, rr.Header().Get("Content-Type")))
+	}
+}
+
+func TestCluster(t *testing.T) {
+	doRequestStatus(t, "/collections/mock_a/items?cluster=0", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?cluster=10,0", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?cluster=10,2,3", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?cluster=10&groupby=prop_a", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?cluster=10&sortby=prop_a", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items.fgb?cluster=10", http.StatusBadRequest)
+
+	rr := doRequest(t, "/collections/mock_a/items?cluster=10,2&sortby=-count&limit=3")
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 3, len(v.Features), "# features")
+	equals(t, 1, len(v.Features[0].Props), "# properties")
+	equals(t, 1.0, v.Features[0].Props[data.ClusterCountColumn], "count property")
+
+	// clustering does not apply to single features
+	doRequest(t, "/collections/mock_a/items/1?cluster=10")
+}
+
+func TestAggregate(t *testing.T) {
+	doRequestStatus(t, "/collections/mock_a/items?aggregate=extent", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?aggregate=collect&cluster=10", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?aggregate=collect&groupby=prop_a", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?aggregate=collect&sortby=prop_a", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items.fgb?aggregate=collect", http.StatusBadRequest)
+
+	rr := doRequest(t, "/collections/mock_a/items?aggregate=collect")
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 1, len(v.Features), "# features")
+	equals(t, "", v.Features[0].ID, "feature id")
+	equals(t, 1, len(v.Features[0].Props), "# properties")
+	equals(t, 9.0, v.Features[0].Props[data.ClusterCountColumn], "count property")
+
+	// the filter limits the aggregated features
+	rr = doRequest(t, "/collections/mock_a/items?aggregate=union&prop_b=1")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 1.0, v.Features[0].Props[data.ClusterCountColumn], "filtered count property")
+
+	conf.Configuration().Paging.AggregateMaxFeatures = 5
+	defer func() { conf.Configuration().Paging.AggregateMaxFeatures = 0 }()
+	rr = doRequest(t, "/collections/mock_a/items?aggregate=collect")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 5.0, v.Features[0].Props[data.ClusterCountColumn], "limited count property")
+}
+
+func TestPretty(t *testing.T) {
+	compact := readBody(doRequest(t, "/collections/mock_a/items?limit=2"))
+	assert(t, !strings.Contains(string(compact), "\n"), "default response should be compact")
+
+	pretty := readBody(doRequest(t, "/collections/mock_a/items?limit=2&pretty=true"))
+	assert(t, strings.Contains(string(pretty), "\n  \"features\": ["), "pretty response should be indented")
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(pretty, &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 2, len(v.Features), "# features")
+
+	pretty = readBody(doRequest(t, "/collections/mock_a/items/1?pretty"))
+	assert(t, strings.Contains(string(pretty), "\n  \"id\": \"1\""), "pretty feature should be indented")
+	compact = readBody(doRequest(t, "/collections/mock_a/items/1?pretty=false"))
+	assert(t, !strings.Contains(string(compact), "\n"), "pretty=false response should be compact")
+
+	// other formats are not changed
+	equals(t, readBody(doRequest(t, "/collections/mock_a/items.fgb")),
+		readBody(doRequest(t, "/collections/mock_a/items.fgb?pretty")), "FlatGeobuf response")
+}
+
+func TestFacets(t *testing.T) {
+	doRequestStatus(t, "/collections/mock_a/facets", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/facets?property=geom", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/missing/facets?property=prop_a", http.StatusNotFound)
+
+	var v []api.FacetValue
+	rr := doRequest(t, "/collections/mock_a/facets?property=prop_a")
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, []api.FacetValue{{Value: "propA", Count: 9}}, v, "facets")
+
+	// the filters select the features counted
+	rr = doRequest(t, "/collections/mock_a/facets?property=prop_a&prop_b=1")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, []api.FacetValue{{Value: "propA", Count: 1}}, v, "filtered facets")
+
+	conf.Configuration().Paging.FacetsMax = 3
+	defer func() { conf.Configuration().Paging.FacetsMax = 0 }()
+	rr = doRequest(t, "/collections/mock_a/facets?property=prop_d")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, []api.FacetValue{{Value: 1.0, Count: 1}, {Value: 2.0, Count: 1}, {Value: 3.0, Count: 1}}, v, "limited facets")
+}
+
+// TestFacetsSqlCollection tests that facets of a SQL collection are queried with its parameters
+func TestFacetsSqlCollection(t *testing.T) {
+	tbl := catalogMock.TableDefs[0]
+	defer func() {
+		tbl.Sql = ""
+		tbl.SqlParameters = nil
+	}()
+	tbl.Sql = "SELECT * FROM mock_a WHERE prop_b >= $1 AND prop_a = $2"
+	tbl.SqlParameters = []data.SqlParameter{
+		{Name: "min_b", Type: data.SqlParamTypeInt, Default: "0"},
+		{Name: "name", Type: data.SqlParamTypeText},
+	}
+	var v []api.FacetValue
+	rr := doRequest(t, "/collections/mock_a/facets?property=prop_a&name=propA")
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, []api.FacetValue{{Value: "propA", Count: 9}}, v, "SQL collection facets")
+
+	doRequestStatus(t, "/collections/mock_a/facets?property=prop_a", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/facets?property=prop_a&name=propA&min_b=x", http.StatusBadRequest)
+}
+
+func TestItemsCSV(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items.csv?limit=2&properties=prop_a,prop_b")
+	equals(t, api.ContentTypeCSV, rr.Header().Get("Content-Type"), "Content-Type")
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, 3, len(records), "# records")
+	equals(t, []string{"id", "prop_a", "prop_b", "geometry"}, records[0], "header")
+	equals(t, []string{"1", "propA", "1", "POINT(-120 40)"}, records[1], "record")
+
+	conf.Configuration().Csv.Delimiter = "semicolon"
+	defer func() { conf.Configuration().Csv.Delimiter = "" }()
+	rr = doRequest(t, "/collections/mock_a/items?f=csv&limit=1&properties=prop_a,prop_b")
+	reader := csv.NewReader(rr.Body)
+	reader.Comma = ';'
+	records, err = reader.ReadAll()
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []string{"1", "propA", "1", "POINT(-120 40)"}, records[1], "semicolon record")
+
+	conf.Configuration().Csv.Delimiter = "\"\""
+	doRequestStatus(t, "/collections/mock_a/items.csv", http.StatusInternalServerError)
+}
+
+// TestItemsRange tests that buffered exports support Range requests
+func TestItemsRange(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items.csv?limit=2&properties=prop_a")
+	full := rr.Body.String()
+	equals(t, "bytes", rr.Header().Get(headerAcceptRanges), "Accept-Ranges")
+	etag := rr.Header().Get(headerETag)
+	assert(t, etag != "", "ETag should be set")
+
+	req, _ := http.NewRequest("GET", basePath+"/collections/mock_a/items.csv?limit=2&properties=prop_a", nil)
+	req.Header.Set(headerRange, "bytes=3-")
+	req.Header.Set("If-Range", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusPartialContent, rr.Code, "status")
+	equals(t, full[3:], rr.Body.String(), "partial content")
+
+	//-- a changed ETag provides the full content
+	req.Header.Set("If-Range", `"changed"`)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusOK, rr.Code, "status for changed content")
+	equals(t, full, rr.Body.String(), "full content")
+
+	rr = doRequest(t, "/collections/mock_a/items.fgb?limit=2")
+	equals(t, "none", rr.Header().Get(headerAcceptRanges), "Accept-Ranges for streamed export")
+}
+
+func TestRequestID(t *testing.T) {
+	rr := doRequest(t, "/collections")
+	generated := rr.Header().Get(headerRequestID)
+	equals(t, 16, len(generated), "generated request id length")
+
+	req, _ := http.NewRequest("GET", basePath+"/collections", nil)
+	req.Header.Set(headerRequestID, "abc-123")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, "abc-123", rr.Header().Get(headerRequestID), "provided request id")
+
+	//-- ids which are unsafe to log are replaced
+	req.Header.Set(headerRequestID, "abc\n123")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert(t, rr.Header().Get(headerRequestID) != "abc\n123", "unsafe request id should be replaced")
+}
+
+func TestItemsGeoPackage(t *testing.T) {
+	saved := conf.Configuration().GeoPackage
+	defer func() { conf.Configuration().GeoPackage = saved }()
+
+	conf.Configuration().GeoPackage = conf.GeoPackage{Enabled: false, MaxFeatures: 100}
+	doRequestStatus(t, "/collections/mock_a/items.gpkg", http.StatusBadRequest)
+
+	conf.Configuration().GeoPackage = conf.GeoPackage{Enabled: true, MaxFeatures: 100}
+	rr := doRequest(t, "/collections/mock_a/items?f=gpkg")
+	equals(t, api.ContentTypeGeoPackage, rr.Header().Get("Content-Type"), "Content-Type")
+	equals(t, `attachment; filename="mock_a.gpkg"`, rr.Header().Get("Content-Disposition"), "Content-Disposition")
+	equals(t, "bytes", rr.Header().Get(headerAcceptRanges), "Accept-Ranges")
+	body := readBody(rr)
+	assert(t, bytes.HasPrefix(body, []byte("SQLite format 3\x00")), "GeoPackage should be an SQLite file")
+	equals(t, 0, len(body)%4096, "file size is a multiple of the page size")
+
+	doRequestStatus(t, "/collections/mock_a/items.gpkg?distinct=true&properties=prop_a", http.StatusBadRequest)
+
+	//-- more than the maximum features is an error unless a limit is requested
+	conf.Configuration().GeoPackage = conf.GeoPackage{Enabled: true, MaxFeatures: 5}
+	doRequestStatus(t, "/collections/mock_a/items.gpkg", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items.gpkg?limit=5", http.StatusOK)
+}
+
+func TestFeatureCollectionCSVNull(t *testing.T) {
+	features := []string{`{"type":"Feature","id":"1","geometry":null,"properties":{"name":null,"code":"a;b"}}`}
+	content, err := api.FeatureCollectionCSV("geom", []string{"name", "code"}, features, api.CSVOptions{Delimiter: ';', NullValue: "NULL"})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, "id;name;code;geom\n1;NULL;\"a;b\";\n", string(content), "CSV content")
+}
+
+func TestCsvDelimiter(t *testing.T) {
+	for setting, expected := range map[string]rune{"": ',', "comma": ',', "Semicolon": ';', "tab": '\t', "|": '|'} {
+		delim, err := csvDelimiter(setting)
+		assert(t, err == nil, fmt.Sprintf("%v", err))
+		equals(t, expected, delim, "delimiter for "+setting)
+	}
+	_, err := csvDelimiter("||")
+	assert(t, err != nil, "multiple character delimiter should be invalid")
+}
+
+func TestItemsHead(t *testing.T) {
+	rr := doRequestMethodStatus(t, http.MethodHead, "/collections/mock_a/items?limit=2", http.StatusOK)
+	equals(t, "9", rr.Header().Get(headerTotalCount), "total count header")
+	equals(t, api.ContentTypeGeoJSON, rr.Header().Get("Content-Type"), "Content-Type")
+	equals(t, 0, rr.Body.Len(), "body length")
+
+	// filters are applied as for GET
+	rr = doRequestMethodStatus(t, http.MethodHead, "/collections/mock_a/items.gml?prop_b=1", http.StatusOK)
+	equals(t, "1", rr.Header().Get(headerTotalCount), "filtered total count header")
+	equals(t, api.ContentTypeGML, rr.Header().Get("Content-Type"), "Content-Type")
+
+	doRequestMethodStatus(t, http.MethodHead, "/collections/mock_a/items?limit=x", http.StatusBadRequest)
+	doRequestMethodStatus(t, http.MethodHead, "/collections/missing/items", http.StatusNotFound)
+}
+
+func TestLastModified(t *testing.T) {
+	lastModified := time.Date(2024, 3, 1, 12, 30, 15, 500, time.UTC)
+	catalogMock.LastModified = &lastModified
+	conf.Configuration().Collections = append(conf.Configuration().Collections, conf.Collection{Id: "mock_a", UpdatedColumn: "updated_at"})
+	defer func() {
+		catalogMock.LastModified = nil
+		setup(basePath)
+	}()
+	doRequestModified := func(since string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", basePath+"/collections/mock_a/items", nil)
+		if since != "" {
+			req.Header.Set(headerIfModifiedSince, since)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := doRequestModified("")
+	equals(t, http.StatusOK, rr.Code, "status")
+	equals(t, "Fri, 01 Mar 2024 12:30:15 GMT", rr.Header().Get(headerLastModified), "Last-Modified")
+
+	rr = doRequestModified("Fri, 01 Mar 2024 12:30:15 GMT")
+	equals(t, http.StatusNotModified, rr.Code, "status")
+	equals(t, 0, rr.Body.Len(), "body length")
+
+	rr = doRequestModified("Fri, 01 Mar 2024 12:00:00 GMT")
+	equals(t, http.StatusOK, rr.Code, "status")
+
+	// collections with no UpdatedColumn have no modification time
+	rr = doRequest(t, "/collections/mock_b/items")
+	equals(t, "", rr.Header().Get(headerLastModified), "Last-Modified")
+}
+
+func TestGeomFormat(t *testing.T) {
+	doRequestStatus(t, "/collections/mock_a/items?geometry-format=wkx", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items.gml?geometry-format=wkt", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items.fgb?geometry-format=ewkb", http.StatusBadRequest)
+
+	rr := doRequest(t, "/collections/mock_a/items?geometry-format=wkt&limit=1")
+	equals(t, api.ContentTypeJSON, rr.Header().Get("Content-Type"), "Content-Type")
+	var v struct {
+		Features []struct {
+			Geom string `json:"geometry"`
+		} `json:"features"`
+	}
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, "POINT(-120 40)", v.Features[0].Geom, "WKT geometry")
+
+	rr = doRequest(t, "/collections/mock_a/items/1?geometry-format=wkb-hex")
+	equals(t, api.ContentTypeJSON, rr.Header().Get("Content-Type"), "Content-Type")
+
+	rr = doRequest(t, "/collections/mock_a/items?geometry-format=geojson&limit=1")
+	equals(t, api.ContentTypeGeoJSON, rr.Header().Get("Content-Type"), "Content-Type")
+}
+
+func TestLimit(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items?limit=3")
+
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, 3, len(v.Features), "# features")
+	equals(t, "1", v.Features[0].ID, "feature 1 id")
+	equals(t, "2", v.Features[1].ID, "feature 2 id")
+	equals(t, "3", v.Features[2].ID, "feature 3 id")
+}
+
+func TestLimitZero(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items?limit=0")
+
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+
+	equals(t, "FeatureCollection", v.Type, "type FeatureCollection")
+	equals(t, 0, len(v.Features), "# features")
+}
+
+func TestNumberMatchedConsistent(t *testing.T) {
+	pagingSaved := conf.Configuration().Paging
+	dbSaved := conf.Configuration().Database
+	defer func() {
+		conf.Configuration().Paging = pagingSaved
+		conf.Configuration().Database = dbSaved
+		catalogMock.BeforeFetch = nil
+	}()
+
+	//-- a feature is inserted between the count and the features query.
+	//-- The mock emulates the snapshots of the isolation levels,
+	//-- so this checks how the handlers use the count, not the database transaction
+	//-- (which is tested by TestFeaturesMatchedSnapshot in the data package)
+	ctx := context.Background()
+	catalogMock.BeforeFetch = func() {
+		edits := []*data.FeatureEdit{{ID: "100", Geometry: `{"type":"Point","coordinates":[1,2]}`}}
+		_, err := catalogMock.UpsertTableFeatures(ctx, "mock_a", edits, false, false)
+		assert(t, err == nil, fmt.Sprintf("%v", err))
+	}
+	readItems := func() FeatureCollection {
+		defer catalogMock.DeleteTableFeature(ctx, "mock_a", "100", false) //nolint:errcheck
+		var v FeatureCollection
+		errUnMarsh := json.Unmarshal(readBody(doRequest(t, "/collections/mock_a/items?limit=20")), &v)
+		assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+		return v
+	}
+
+	//-- streamed and buffered responses are counted the same way
+	for _, stream := range []bool{true, false} {
+		conf.Configuration().Paging.StreamGeoJSON = stream
+		msg := fmt.Sprintf(" (stream = %v)", stream)
+
+		conf.Configuration().Database.ReadIsolation = "repeatable read"
+		v := readItems()
+		equals(t, uint(9), v.NumberMatched, "numberMatched"+msg)
+		equals(t, 9, len(v.Features), "# features read in the count snapshot"+msg)
+
+		//-- read committed statements see the insert
+		conf.Configuration().Database.ReadIsolation = "read committed"
+		v = readItems()
+		equals(t, uint(9), v.NumberMatched, "numberMatched"+msg)
+		equals(t, 10, len(v.Features), "# features read after the insert"+msg)
+	}
+
+	//-- numberMatched is not provided for aggregated features
+	catalogMock.BeforeFetch = nil
+	body := readBody(doRequest(t, "/collections/mock_a/items?cluster=10,2"))
+	assert(t, !strings.Contains(string(body), `"numberMatched"`), "no numberMatched for clusters")
+}
+
+func TestNumberMatchedDisabled(t *testing.T) {
+	pagingSaved := conf.Configuration().Paging
+	defer func() { conf.Configuration().Paging = pagingSaved }()
+	conf.Configuration().Paging.NumberMatched = false
+
+	for _, stream := range []bool{true, false} {
+		conf.Configuration().Paging.StreamGeoJSON = stream
+		body := readBody(doRequest(t, "/collections/mock_a/items"))
+		assert(t, !strings.Contains(string(body), `"numberMatched"`), fmt.Sprintf("no numberMatched when disabled (stream = %v)", stream))
+	}
+}
+
+func TestResultTypeHits(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items?resultType=hits&limit=3")
+	body := readBody(rr)
+	var v FeatureCollection
+	errUnMarsh := json.Unmarshal(body, &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 0, len(v.Features), "# features")
+	equals(t, uint(9), v.NumberMatched, "numberMatched")
+	equals(t, uint(0), v.NumberReturned, "numberReturned")
+	assert(t, strings.Contains(string(body), `"features":[]`), "empty features array")
+
+	rr = doRequest(t, "/collections/mock_a/items?resulttype=results&limit=3")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 3, len(v.Features), "# features for results")
 
-func TestFilterB(t *testing.T) {
-	rr := doRequest(t, "/collections/mock_a/items?prop_b=1")
+	doRequestStatus(t, "/collections/mock_a/items?resultType=count", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items.csv?resultType=hits", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?resultType=hits&properties=prop_a&distinct=true", http.StatusBadRequest)
+}
 
+// numberMatched is the number of features selected by the filters, not the collection size
+func TestResultTypeHitsFiltered(t *testing.T) {
+	for _, filter := range []string{"prop_b=3", "prop_a=propA", "prop_a=none"} {
+		var hits, results FeatureCollection
+		rr := doRequest(t, "/collections/mock_a/items?resultType=hits&limit=1&"+filter)
+		errUnMarsh := json.Unmarshal(readBody(rr), &hits)
+		assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+		rr = doRequest(t, "/collections/mock_a/items?limit=100&"+filter)
+		errUnMarsh = json.Unmarshal(readBody(rr), &results)
+		assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+		equals(t, uint(len(results.Features)), hits.NumberMatched, "numberMatched for "+filter)
+	}
 	var v FeatureCollection
+	rr := doRequest(t, "/collections/mock_a/items?resultType=hits&prop_b=3")
 	errUnMarsh := json.Unmarshal(readBody(rr), &v)
 	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, uint(1), v.NumberMatched, "numberMatched with property filter")
+}
 
-	equals(t, 1, len(v.Features), "# features")
+func TestLimitInvalid(t *testing.T) {
+	doRequestStatus(t, "/collections/mock_a/items?limit=x", http.StatusBadRequest)
 }
 
-func TestFilterD(t *testing.T) {
-	rr := doRequest(t, "/collections/mock_c/items?prop_d=1")
+func TestLimitCollection(t *testing.T) {
+	collsSaved := conf.Configuration().Collections
+	defer func() { conf.Configuration().Collections = collsSaved }()
+	conf.Configuration().Collections = []conf.Collection{{Id: "mock_a", LimitDefault: 2, LimitMax: 4}}
 
 	var v FeatureCollection
+	rr := doRequest(t, "/collections/mock_a/items")
 	errUnMarsh := json.Unmarshal(readBody(rr), &v)
 	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 2, len(v.Features), "# features with collection default limit")
 
-	equals(t, 10, len(v.Features), "# features")
+	rr = doRequest(t, "/collections/mock_a/items?limit=100&offset=1")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 4, len(v.Features), "# features with collection max limit")
+	equals(t, "2", v.Features[0].ID, "feature 2 id")
+
+	// other collections use the global limits
+	rr = doRequest(t, "/collections/mock_b/items?limit=5")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 5, len(v.Features), "# features with global limits")
 }
 
-func TestFilterBD(t *testing.T) {
-	rr := doRequest(t, "/collections/mock_c/items?prop_b=2&prop_d=2")
+func TestResponseMaxFeatures(t *testing.T) {
+	pagingSaved := conf.Configuration().Paging
+	defer func() { conf.Configuration().Paging = pagingSaved }()
+	conf.Configuration().Paging.ResponseMaxFeatures = 3
+	conf.Configuration().Paging.StreamGeoJSON = false
 
+	rr := doRequest(t, "/collections/mock_a/items?limit=5")
+	equals(t, "true", rr.Header().Get(headerFeaturesTruncated), "truncated header")
+	body := readBody(rr)
 	var v FeatureCollection
-	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	errUnMarsh := json.Unmarshal(body, &v)
 	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
-
-	equals(t, 1, len(v.Features), "# features")
+	equals(t, 3, len(v.Features), "# features capped")
+	assert(t, strings.Contains(string(body), `"truncated":true`), "truncated flag")
+
+	rr = doRequest(t, "/collections/mock_a/items.csv?limit=5")
+	equals(t, "true", rr.Header().Get(headerFeaturesTruncated), "truncated header for CSV")
+
+	rr = doRequest(t, "/collections/mock_a/items?limit=3")
+	equals(t, "", rr.Header().Get(headerFeaturesTruncated), "no truncated header within maximum")
+	assert(t, !strings.Contains(string(readBody(rr)), `"truncated"`), "no truncated flag within maximum")
+
+	//-- streamed features are not truncated
+	conf.Configuration().Paging.StreamGeoJSON = true
+	rr = doRequest(t, "/collections/mock_a/items?limit=5")
+	equals(t, "", rr.Header().Get(headerFeaturesTruncated), "no truncated header for stream")
+	var vs FeatureCollection
+	errUnMarsh = json.Unmarshal(readBody(rr), &vs)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 5, len(vs.Features), "# features streamed")
 }
 
-func TestFilterBDNone(t *testing.T) {
-	rr := doRequest(t, "/collections/mock_c/items?prop_b=1&prop_d=2")
-
+func TestItemsJSONStream(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items?limit=3")
+	equals(t, api.ContentTypeGeoJSON, rr.Header().Get("Content-Type"), "Content-Type")
+	body := readBody(rr)
 	var v FeatureCollection
-	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	errUnMarsh := json.Unmarshal(body, &v)
 	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 3, len(v.Features), "# features")
+	equals(t, "1", v.Features[0].ID, "first feature id")
+	assert(t, strings.Contains(string(body), `"numberReturned":3`), "numberReturned")
+	equals(t, uint(9), v.NumberMatched, "numberMatched of stream")
+	assert(t, strings.Contains(string(body), `"links":[`), "links")
 
-	equals(t, 0, len(v.Features), "# features")
+	rr = doRequest(t, "/collections/mock_a/items?limit=0")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 0, len(v.Features), "# features for empty stream")
 }
 
-func TestSortBy(t *testing.T) {
-	rr := doRequest(t, "/collections/mock_a/items?sortby=prop_b")
+func TestItemsNoEnvelope(t *testing.T) {
+	for _, stream := range []bool{true, false} {
+		conf.Configuration().Paging.StreamGeoJSON = stream
+		rr := doRequest(t, "/collections/mock_a/items?limit=3&envelope=false")
+		equals(t, api.ContentTypeJSON, rr.Header().Get("Content-Type"), "Content-Type")
+		assert(t, strings.Contains(rr.Header().Get("Link"), `rel="self"`), "Link header")
+		var feats []Feature
+		errUnMarsh := json.Unmarshal(readBody(rr), &feats)
+		assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+		equals(t, 3, len(feats), "# features")
+		equals(t, "1", feats[0].ID, "first feature id")
+	}
+	conf.Configuration().Paging.StreamGeoJSON = true
 
-	var v FeatureCollection
-	errUnMarsh := json.Unmarshal(readBody(rr), &v)
-	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	rr := doRequest(t, "/collections/mock_a/items?limit=0&envelope=false")
+	equals(t, "[]", string(readBody(rr)), "empty array")
+	doRequestStatus(t, "/collections/mock_a/items?envelope=abc", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?envelope=false&resultType=hits", http.StatusBadRequest)
+}
 
-	equals(t, 9, len(v.Features), "# features")
+func TestContentDisposition(t *testing.T) {
+	downloadSaved := conf.Configuration().Download
+	defer func() { conf.Configuration().Download = downloadSaved }()
+
+	rr := doRequest(t, "/collections/mock_a/items")
+	equals(t, `inline; filename="mock_a.json"`, rr.Header().Get(headerContentDisposition), "JSON is inline")
+	rr = doRequest(t, "/collections/mock_a/items.csv")
+	equals(t, `attachment; filename="mock_a.csv"`, rr.Header().Get(headerContentDisposition), "CSV is attachment")
+	rr = doRequest(t, "/collections/mock_a/items.gml")
+	equals(t, "", rr.Header().Get(headerContentDisposition), "no disposition configured")
+	//-- an error after the header is set is not a download
+	handler := appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		setContentDisposition(w, "mock_a", api.FormatCSV, time.Now())
+		return appErrorInternal(nil, api.ErrMsgEncoding)
+	})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/collections/mock_a/items.csv", nil))
+	equals(t, http.StatusInternalServerError, rr.Code, "error status")
+	equals(t, "", rr.Header().Get(headerContentDisposition), "error is not a download")
+
+	conf.Configuration().Download.Filename = "{collection}-{timestamp}"
+	w := httptest.NewRecorder()
+	setContentDisposition(w, "my/coll", api.FormatCSV, time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC))
+	equals(t, `attachment; filename="my_coll-20240506T070809Z.csv"`, w.Header().Get(headerContentDisposition), "filename template")
 }
 
-func TestSortByDesc(t *testing.T) {
-	rr := doRequest(t, "/collections/mock_a/items?sortby=-prop_b")
+func TestItemsGML(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items.gml?limit=2&properties=prop_a,prop_b")
+	equals(t, api.ContentTypeGML, rr.Header().Get("Content-Type"), "Content-Type")
+	body := rr.Body.String()
+	assert(t, strings.HasPrefix(body, "<?xml"), "response should be XML")
+	assert(t, strings.Contains(body, `xmlns:gml="`+api.NamespaceGML+`"`), "response should declare GML namespace")
+	equals(t, 2, strings.Count(body, "<gml:featureMember>"), "# feature members")
+	assert(t, strings.Contains(body, `<pgfs:mock_a gml:id="mock_a.1">`), "response should contain feature element with id")
+	assert(t, strings.Contains(body, "<pgfs:prop_b>1</pgfs:prop_b>"), "response should contain property element")
+	assert(t, strings.Contains(body, `<gml:Point srsName="EPSG:4326">`), "response should contain GML geometry")
+
+	rr = doRequest(t, "/collections/mock_a/items?f=gml")
+	equals(t, api.ContentTypeGML, rr.Header().Get("Content-Type"), "Content-Type for f=gml")
+}
 
-	var v FeatureCollection
-	errUnMarsh := json.Unmarshal(readBody(rr), &v)
-	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+func TestItemsFlatGeobuf(t *testing.T) {
+	rr := doRequest(t, "/collections/mock_a/items.fgb?limit=3&properties=prop_a,prop_b")
+	equals(t, api.ContentTypeFlatGeobuf, rr.Header().Get("Content-Type"), "Content-Type")
+	body := readBody(rr)
+	equals(t, []byte("fgb\x03fgb\x00"), body[:8], "signature")
+
+	//--- header has the collection name and column schema
+	headerBuf, rest := readSizePrefixed(body[8:])
+	header := fbTable(headerBuf)
+	equals(t, "mock_a", string(header.ByteVector(fbField(header, 0)+header.Pos)), "header name")
+	equals(t, 2, header.VectorLen(fbField(header, 7)), "# columns")
+
+	//--- features follow the header
+	var features [][]byte
+	for len(rest) > 0 {
+		var feat []byte
+		feat, rest = readSizePrefixed(rest)
+		features = append(features, feat)
+	}
+	equals(t, 3, len(features), "# features")
+	feat := fbTable(features[0])
+	geom := flatbuffers.Table{Bytes: feat.Bytes, Pos: feat.Indirect(fbField(feat, 0) + feat.Pos)}
+	equals(t, 2, geom.VectorLen(fbField(geom, 1)), "# ordinates")
+	xy := geom.Vector(fbField(geom, 1))
+	assert(t, flatbuffers.GetFloat64(geom.Bytes[xy:]) != 0, "x ordinate should be set")
+	//--- properties are column index and value pairs
+	props := feat.ByteVector(fbField(feat, 1) + feat.Pos)
+	equals(t, []byte{0, 0, 5, 0, 0, 0, 'p', 'r', 'o', 'p', 'A', 1, 0, 1, 0, 0, 0}, props, "properties")
+}
 
-	equals(t, 9, len(v.Features), "# features")
+func readSizePrefixed(buf []byte) ([]byte, []byte) {
+	size := binary.LittleEndian.Uint32(buf)
+	return buf[4 : 4+size], buf[4+size:]
 }
 
-func TestSortByAsc(t *testing.T) {
-	rr := doRequest(t, "/collections/mock_a/items?sortby=+prop_b")
+func fbTable(buf []byte) flatbuffers.Table {
+	return flatbuffers.Table{Bytes: buf, Pos: flatbuffers.GetUOffsetT(buf)}
+}
 
-	var v FeatureCollection
-	errUnMarsh := json.Unmarshal(readBody(rr), &v)
-	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+// fbField returns the offset of a flatbuffer table field
+func fbField(tab flatbuffers.Table, slot int) flatbuffers.UOffsetT {
+	return flatbuffers.UOffsetT(tab.Offset(flatbuffers.VOffsetT(4 + 2*slot)))
+}
 
-	equals(t, 9, len(v.Features), "# features")
+func TestParseDatetime(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	checkDatetime(t, now, "now", "2024-03-10T12:00:00Z", "2024-03-10T12:00:00Z")
+	checkDatetime(t, now, "now-P1D/now", "2024-03-09T12:00:00Z", "2024-03-10T12:00:00Z")
+	checkDatetime(t, now, "NOW-P1M2DT1H30M/now+PT90S", "2024-02-08T10:30:00Z", "2024-03-10T12:01:30Z")
+	checkDatetime(t, now, "2024-01-01/..", "2024-01-01T00:00:00Z", "")
+	checkDatetime(t, now, "../2024-01-01T10:00:00Z", "", "2024-01-01T10:00:00Z")
+
+	for _, val := range []string{"now-P", "now-PT", "now-1D", "now*P1D", "yesterday", "now/now-P1D", "..", "a/b/c"} {
+		_, err := parseDatetime(api.NameValMap{api.ParamDatetime: val}, now)
+		assert(t, err != nil, "datetime should be invalid: "+val)
+	}
+	doRequestStatus(t, "/collections/mock_a/items?datetime=now-PXD", http.StatusBadRequest)
+	doRequest(t, "/collections/mock_a/items?datetime=now-P1W/now")
 }
 
-func TestLimit(t *testing.T) {
-	rr := doRequest(t, "/collections/mock_a/items?limit=3")
+func checkDatetime(t *testing.T, now time.Time, val string, start string, end string) {
+	t.Helper()
+	interval, err := parseDatetime(api.NameValMap{api.ParamDatetime: val}, now)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, start, formatTime(interval.Start), "start of "+val)
+	equals(t, end, formatTime(interval.End), "end of "+val)
+}
 
-	var v FeatureCollection
-	errUnMarsh := json.Unmarshal(readBody(rr), &v)
-	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
 
-	equals(t, 3, len(v.Features), "# features")
-	equals(t, "1", v.Features[0].ID, "feature 1 id")
-	equals(t, "2", v.Features[1].ID, "feature 2 id")
-	equals(t, "3", v.Features[2].ID, "feature 3 id")
+func TestAxisOrder(t *testing.T) {
+	conf.Configuration().Server.AuthoritativeAxisOrderSrids = []int{4258, 4326}
+	defer func() { conf.Configuration().Server.AuthoritativeAxisOrderSrids = nil }()
+
+	assert(t, !isAuthoritativeAxisOrder(4326), "default CRS should be lon/lat")
+	assert(t, isAuthoritativeAxisOrder(4258), "configured CRS should use authoritative order")
+	assert(t, !isAuthoritativeAxisOrder(3857), "unconfigured CRS should be x/y")
+
+	r := httptest.NewRequest("GET", "/collections/mock_a/items?crs=4258&bbox=50,1,60,2&bbox-crs=4258", nil)
+	param, err := parseRequestParams(r, conf.Configuration().Paging, nil)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	assert(t, param.FlipAxes, "output should be flipped")
+	equals(t, data.Extent{Minx: 1, Miny: 50, Maxx: 2, Maxy: 60}, *param.Bbox, "bbox in x/y order")
 }
 
-func TestLimitZero(t *testing.T) {
-	rr := doRequest(t, "/collections/mock_a/items?limit=0")
+func TestResponseCache(t *testing.T) {
+	cacheSaved := conf.Configuration().Cache
+	defer func() {
+		conf.Configuration().Cache = cacheSaved
+		initCache()
+	}()
+	conf.Configuration().Cache = conf.Cache{TTLSec: 60, MaxEntries: 2, MaxSizeMB: 1}
+	initCache()
 
-	var v FeatureCollection
-	errUnMarsh := json.Unmarshal(readBody(rr), &v)
-	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	rr := doRequest(t, "/collections/mock_a/items?limit=2")
+	equals(t, "max-age=60", rr.Header().Get("Cache-Control"), "Cache-Control")
+	rrCached := doRequest(t, "/collections/mock_a/items?limit=2")
+	equals(t, rr.Body.String(), rrCached.Body.String(), "cached response")
+	equals(t, api.ContentTypeGeoJSON, rrCached.Header().Get("Content-Type"), "cached Content-Type")
+	entries, _, hits, misses := responses.stats()
+	equals(t, 1, entries, "# cache entries")
+	equals(t, int64(1), hits, "# cache hits")
+	equals(t, int64(1), misses, "# cache misses")
+
+	// least recently used entries are evicted
+	doRequest(t, "/collections/mock_a/items?limit=3")
+	doRequest(t, "/collections/mock_a/items?limit=4")
+	entries, _, _, _ = responses.stats()
+	equals(t, 2, entries, "# cache entries after eviction")
+
+	// requests with authorization bypass the cache
+	rr = doRequestToken(t, "/collections/mock_a/items?limit=2", "token", http.StatusOK)
+	equals(t, "", rr.Header().Get("Cache-Control"), "Cache-Control with authorization")
+
+	rr = doRequest(t, "/metrics")
+	assert(t, strings.Contains(rr.Body.String(), "pg_featureserv_cache_hits_total 1\n"), "metrics should report cache hits")
+}
 
-	equals(t, "FeatureCollection", v.Type, "type FeatureCollection")
-	equals(t, 0, len(v.Features), "# features")
+func TestResponseCacheHeaders(t *testing.T) {
+	cacheSaved := conf.Configuration().Cache
+	defer func() {
+		conf.Configuration().Cache = cacheSaved
+		initCache()
+	}()
+	conf.Configuration().Cache = conf.Cache{TTLSec: 60, MaxEntries: 10, MaxSizeMB: 1}
+	initCache()
+
+	// cached responses have the headers set by the handler
+	for _, path := range []string{"/collections/mock_a/items?limit=2", "/collections/mock_a/items.csv?limit=2"} {
+		rr := doRequest(t, path)
+		rrCached := doRequest(t, path)
+		for _, name := range []string{"Content-Type", "Link", headerContentDisposition, headerETag, headerAcceptRanges} {
+			equals(t, rr.Header().Get(name), rrCached.Header().Get(name), "cached header "+name+" for "+path)
+		}
+		equals(t, rr.Body.String(), rrCached.Body.String(), "cached response for "+path)
+	}
+	_, _, hits, _ := responses.stats()
+	equals(t, int64(2), hits, "# cache hits")
+
+	// cached exports answer conditional requests
+	rr := doRequest(t, "/collections/mock_a/items.csv?limit=2")
+	assert(t, rr.Header().Get(headerETag) != "", "export should have an ETag")
+	req := httptest.NewRequest(http.MethodGet, basePath+"/collections/mock_a/items.csv?limit=2", nil)
+	req.Header.Set("If-None-Match", rr.Header().Get(headerETag))
+	rrCond := httptest.NewRecorder()
+	router.ServeHTTP(rrCond, req)
+	equals(t, http.StatusNotModified, rrCond.Code, "status for cached export with matching ETag")
 }
 
-func TestLimitInvalid(t *testing.T) {
-	doRequestStatus(t, "/collections/mock_a/items?limit=x", http.StatusBadRequest)
+func TestResponseCachePurge(t *testing.T) {
+	cacheSaved := conf.Configuration().Cache
+	defer func() {
+		conf.Configuration().Cache = cacheSaved
+		initCache()
+	}()
+	conf.Configuration().Cache = conf.Cache{TTLSec: 60, MaxEntries: 10, MaxSizeMB: 1}
+	initCache()
+
+	doRequest(t, "/collections/mock_a/items?limit=2")
+	doRequest(t, "/collections/mock_b/items/4")
+	doRequest(t, "/collections/mock_b/items?limit=2")
+	entries, _, _, _ := responses.stats()
+	equals(t, 3, entries, "# cache entries")
+
+	// a dry run does not change the cached features
+	doRequestMethodStatus(t, http.MethodDelete, "/collections/mock_b/items/4?dry-run", http.StatusNoContent)
+	entries, _, _, _ = responses.stats()
+	equals(t, 3, entries, "# cache entries after dry run")
+
+	// writes remove the cached responses of the collection
+	doRequestMethodStatus(t, http.MethodDelete, "/collections/mock_b/items/4", http.StatusNoContent)
+	entries, _, _, _ = responses.stats()
+	equals(t, 1, entries, "# cache entries after delete")
+	doRequestStatus(t, "/collections/mock_b/items/4", http.StatusNotFound)
+}
+
+func TestResponseCacheCollectionTTL(t *testing.T) {
+	cacheSaved := conf.Configuration().Cache
+	collsSaved := conf.Configuration().Collections
+	defer func() {
+		conf.Configuration().Cache = cacheSaved
+		conf.Configuration().Collections = collsSaved
+		initCache()
+	}()
+	conf.Configuration().Cache = conf.Cache{TTLSec: 60, MaxEntries: 10, MaxSizeMB: 1}
+	conf.Configuration().Collections = []conf.Collection{{Id: "mock_a", CacheTTLSec: 600}, {Id: "mock_b", CacheTTLSec: -1}}
+	initCache()
+
+	rr := doRequest(t, "/collections/mock_a/items/1")
+	equals(t, "max-age=600", rr.Header().Get("Cache-Control"), "Cache-Control for collection TTL")
+	rr = doRequest(t, "/collections/mock_b/items?limit=1")
+	equals(t, "", rr.Header().Get("Cache-Control"), "Cache-Control for uncached collection")
+}
+
+func TestParsePrecision(t *testing.T) {
+	checkPrecision(t, "", -1, -1)
+	checkPrecision(t, "6", 6, -1)
+	checkPrecision(t, "geom:6,prop:2", 6, 2)
+	checkPrecision(t, "prop:2", -1, 2)
+	checkPrecision(t, "GEOM:30", 20, -1)
+
+	_, _, err := parsePrecision(api.NameValMap{api.ParamPrecision: "geom:6,z:2"})
+	assert(t, err != nil, "unknown precision key should be an error")
+	doRequestStatus(t, "/collections/mock_a/items?precision=prop:x", http.StatusBadRequest)
+}
+
+func checkPrecision(t *testing.T, val string, geomPrecision int, propPrecision int) {
+	geomActual, propActual, err := parsePrecision(api.NameValMap{api.ParamPrecision: val})
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, geomPrecision, geomActual, "geometry precision for "+val)
+	equals(t, propPrecision, propActual, "property precision for "+val)
+}
+
+func TestParseSqlArgs(t *testing.T) {
+	params := []data.SqlParameter{
+		{Name: "min_count", Type: data.SqlParamTypeInt, Default: "10"},
+		{Name: "day", Type: data.SqlParamTypeDate},
+		{Name: "active", Type: data.SqlParamTypeBool, Default: "true"},
+	}
+	args, err := parseSqlArgs(api.NameValMap{"day": "2024-03-01", "min_count": "5"}, params)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []interface{}{int64(5), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), true}, args, "SQL args")
+
+	_, err = parseSqlArgs(api.NameValMap{"min_count": "5"}, params)
+	equals(t, fmt.Sprintf(api.ErrMsgMissingParameter, "day"), fmt.Sprintf("%v", err), "missing parameter error")
+	_, err = parseSqlArgs(api.NameValMap{"day": "2024-03-01", "min_count": "many"}, params)
+	equals(t, fmt.Sprintf(api.ErrMsgInvalidParameterValue, "min_count", "many"), fmt.Sprintf("%v", err), "invalid parameter error")
+}
+
+func TestStrictQueryParams(t *testing.T) {
+	// lenient by default
+	doRequest(t, "/collections/mock_a/items?limt=10")
+
+	conf.Configuration().Server.StrictQueryParams = true
+	defer func() { conf.Configuration().Server.StrictQueryParams = false }()
+
+	rr := doRequestStatus(t, "/collections/mock_a/items?limt=10&ofset=2", http.StatusBadRequest)
+	assert(t, strings.Contains(rr.Body.String(), "limt, ofset"), "response should list unknown parameters")
+	doRequest(t, "/collections/mock_a/items?limit=10&prop_a=propA")
+	doRequestStatus(t, "/functions/fun_a/items?bad=1", http.StatusBadRequest)
 }
 
 func TestQueryParamCase(t *testing.T) {
@@ -295,6 +2126,23 @@ func TestOffsetInvalid(t *testing.T) {
 	doRequestStatus(t, "/collections/mock_a/items?offset=x", http.StatusBadRequest)
 }
 
+func TestOffsetMax(t *testing.T) {
+	// offset is not limited by LimitMax
+	doRequest(t, "/collections/mock_a/items?offset=5000")
+
+	conf.Configuration().Paging.OffsetMax = 2000
+	defer func() {
+		conf.Configuration().Paging.OffsetMax = 0
+		conf.Configuration().Paging.OffsetClamp = false
+	}()
+	doRequest(t, "/collections/mock_a/items?offset=2000")
+	rr := doRequestStatus(t, "/collections/mock_a/items?offset=2001", http.StatusBadRequest)
+	equals(t, fmt.Sprintf(api.ErrMsgOffsetMax, 2000)+"\n", rr.Body.String(), "error message")
+
+	conf.Configuration().Paging.OffsetClamp = true
+	doRequest(t, "/collections/mock_a/items?offset=2001")
+}
+
 func TestTransformValid(t *testing.T) {
 	doRequest(t, "/collections/mock_a/items?transform=centroid")
 	doRequest(t, "/collections/mock_a/items?transform=ST_centroid")
@@ -309,8 +2157,19 @@ func TestTransformInvalid(t *testing.T) {
 	doRequestStatus(t, "/collections/mock_a/items?transform=centroid|envelope", http.StatusBadRequest)
 }
 
+func TestTransformLimits(t *testing.T) {
+	doRequest(t, "/collections/mock_a/items?transform=centroid|centroid|centroid")
+	doRequest(t, "/collections/mock_a/items?transform=centroid,1,2")
+	// too many functions
+	doRequestStatus(t, "/collections/mock_a/items?transform=centroid|centroid|centroid|centroid", http.StatusBadRequest)
+	// too many arguments
+	doRequestStatus(t, "/collections/mock_a/items?transform=centroid,1,2,3", http.StatusBadRequest)
+}
+
 func TestBBox(t *testing.T) {
 	doRequest(t, "/collections/mock_a/items?bbox=1,2,3,4")
+	// antimeridian-crossing bbox is valid
+	doRequest(t, "/collections/mock_a/items?bbox=170,-20,-170,10")
 	// TODO: add some tests
 }
 
@@ -318,6 +2177,68 @@ func TestBBoxInvalid(t *testing.T) {
 	doRequestStatus(t, "/collections/mock_a/items?bbox=1,2,3,x", http.StatusBadRequest)
 }
 
+func TestBBoxForms(t *testing.T) {
+	expected := &data.Extent{Minx: 1, Miny: 2, Maxx: 3, Maxy: 4}
+	for _, val := range []string{
+		"1,2,3,4",
+		"[1, 2, 3, 4]",
+		"ENVELOPE(1, 3, 4, 2)",
+		"POLYGON((1 2, 3 2, 3 4, 1 4, 1 2))",
+		"polygon ((3 4,1 4,1 2,3 2))",
+		`{"type":"Polygon","coordinates":[[[1,2],[1,4],[3,4],[3,2],[1,2]]]}`,
+	} {
+		bbox, err := parseBbox(api.NameValMap{api.ParamBbox: val})
+		assert(t, err == nil, fmt.Sprintf("%v", err))
+		equals(t, expected, bbox, "bbox for "+val)
+	}
+	doRequest(t, "/collections/mock_a/items?bbox="+url.QueryEscape("[1,2,3,4]"))
+
+	for _, val := range []string{
+		"[1,2,3]",
+		"[1,2,3,\"x\"]",
+		"ENVELOPE(1,3,4)",
+		"POLYGON((1 2, 3 2, 3 4, 1 4, 1 2), (1 2, 2 2, 2 3, 1 2))",
+		"POLYGON((1 2, 3 2, 3 5, 1 4, 1 2))",
+		"POLYGON((1 2, 3 2, 1 2, 3 2, 1 2))",
+		"POLYGON((1 2, 3 2, 3 4, 1 4, 1 3))",
+		`{"type":"Point","coordinates":[1,2]}`,
+	} {
+		_, err := parseBbox(api.NameValMap{api.ParamBbox: val})
+		assert(t, err != nil, "expected error for "+val)
+	}
+	doRequestStatus(t, "/collections/mock_a/items?bbox="+url.QueryEscape("POLYGON((1 2, 3 2))"), http.StatusBadRequest)
+}
+
+func TestFilterGeom(t *testing.T) {
+	doRequest(t, "/collections/mock_a/items?filter-geom="+url.QueryEscape("POLYGON((1 2, 3 2, 3 4, 1 2))"))
+	doRequest(t, "/collections/mock_a/items?filter-geom-op=within&filter-geom="+url.QueryEscape("MULTIPOINT((1 2),(3 4))"))
+	doRequest(t, "/collections/mock_a/items?filter-crs=3005&filter-geom="+url.QueryEscape("SRID=3005;POINT(1e6 4e5)"))
+	doRequest(t, "/collections/mock_a/items?bbox=1,2,3,4&filter-geom-op=contains&filter-geom="+url.QueryEscape(`{"type":"Point","coordinates":[1,2]}`))
+}
+
+func TestFilterGeomInvalid(t *testing.T) {
+	doRequestStatus(t, "/collections/mock_a/items?filter-geom="+url.QueryEscape("POLYGON((1 2, 3 2)"), http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?filter-geom="+url.QueryEscape("CIRCLE(1 2)"), http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?filter-geom="+url.QueryEscape(`{"type":"Point"}`), http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?filter-geom-op=touches&filter-geom="+url.QueryEscape("POINT(1 2)"), http.StatusBadRequest)
+	// geometry CRS must match filter-crs
+	doRequestStatus(t, "/collections/mock_a/items?filter-geom="+url.QueryEscape("SRID=3005;POINT(1 2)"), http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?filter-geom="+url.QueryEscape(`{"type":"Point","coordinates":[1,2],"crs":{"type":"name","properties":{"name":"EPSG:3005"}}}`), http.StatusBadRequest)
+}
+
+func TestFilterLang(t *testing.T) {
+	doRequest(t, "/collections/mock_a/items?filter="+url.QueryEscape("prop_a = 'propA'"))
+	doRequest(t, "/collections/mock_a/items?filter-lang=cql2-text&filter="+url.QueryEscape("prop_a = 'propA'"))
+	doRequest(t, "/collections/mock_a/items?filter-lang=cql2-json&filter="+
+		url.QueryEscape(`{"op": "=", "args": [{"property": "prop_a"}, "propA"]}`))
+}
+
+func TestFilterLangInvalid(t *testing.T) {
+	doRequestStatus(t, "/collections/mock_a/items?filter-lang=cql3&filter="+url.QueryEscape("prop_a = 'propA'"), http.StatusBadRequest)
+	// text filter is not valid JSON
+	doRequestStatus(t, "/collections/mock_a/items?filter-lang=cql2-json&filter="+url.QueryEscape("prop_a = 'propA'"), http.StatusBadRequest)
+}
+
 func TestProperties(t *testing.T) {
 	// Tests:
 	// - names are made unique (properties only include once)
@@ -334,6 +2255,13 @@ func TestProperties(t *testing.T) {
 	equals(t, "propC", v.Features[0].Props["prop_c"], "feature 1 # property C")
 }
 
+// TestPropertiesPathNotJSON tests that a property path must reference a JSON column
+func TestPropertiesPathNotJSON(t *testing.T) {
+	doRequestStatus(t, "/collections/mock_a/items?properties=prop_a.color", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?properties=not_prop.color", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items/1?properties=prop_a.color", http.StatusBadRequest)
+}
+
 // TestPropertiesAll tests that no properties parameter returns all props
 func TestPropertiesAll(t *testing.T) {
 	rr := doRequest(t, "/collections/mock_a/items?limit=2")
@@ -352,6 +2280,180 @@ func TestPropertiesAll(t *testing.T) {
 	equals(t, 1.0, v.Features[0].Props["prop_d"], "feature 1 # property D")
 }
 
+// TestPropertiesPattern tests that property patterns and groups select columns
+func TestPropertiesPattern(t *testing.T) {
+	collsSaved := conf.Configuration().Collections
+	defer func() { conf.Configuration().Collections = collsSaved }()
+	conf.Configuration().Collections = []conf.Collection{{Id: "mock_a",
+		PropertyGroups: map[string][]string{"summary": {"prop_b", "prop_d"}}}}
+
+	var v FeatureCollection
+	rr := doRequest(t, "/collections/mock_a/items?limit=2&properties=prop_*")
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 4, len(v.Features[0].Props), "pattern # properties")
+
+	v = FeatureCollection{}
+	rr = doRequest(t, "/collections/mock_a/items?limit=2&properties=@Summary,prop_a")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 3, len(v.Features[0].Props), "group # properties")
+	equals(t, "propA", v.Features[0].Props["prop_a"], "feature 1 # property A")
+	equals(t, 1.0, v.Features[0].Props["prop_d"], "feature 1 # property D")
+
+	v = FeatureCollection{}
+	rr = doRequest(t, "/collections/mock_a/items?limit=2&properties=meta_*")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 0, len(v.Features[0].Props), "unmatched pattern # properties")
+
+	doRequestStatus(t, "/collections/mock_a/items?properties=@missing", http.StatusBadRequest)
+}
+
+// TestPropertiesDenied tests that denied columns are not returned or filtered by
+func TestPropertiesDenied(t *testing.T) {
+	collsSaved := conf.Configuration().Collections
+	defer func() { conf.Configuration().Collections = collsSaved }()
+	conf.Configuration().Collections = []conf.Collection{{Id: "mock_a", DeniedColumns: []string{"prop_c"}}}
+
+	var v FeatureCollection
+	rr := doRequest(t, "/collections/mock_a/items?limit=2")
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 3, len(v.Features[0].Props), "all # properties")
+	_, ok := v.Features[0].Props["prop_c"]
+	assert(t, !ok, "denied property should not be returned")
+
+	v = FeatureCollection{}
+	rr = doRequest(t, "/collections/mock_a/items?limit=2&properties=prop_a,prop_c")
+	errUnMarsh = json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 1, len(v.Features[0].Props), "requested # properties")
+
+	rr = doRequest(t, "/collections/mock_a/items/1")
+	assert(t, !strings.Contains(rr.Body.String(), "prop_c"), "denied property should not be returned for item")
+
+	doRequestStatus(t, "/collections/mock_a/items?prop_c=propC", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/facets?property=prop_c", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?filter="+url.QueryEscape("prop_c = 'propC'"), http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?filter-lang=cql2-json&filter="+
+		url.QueryEscape(`{"op": "=", "args": [{"property": "prop_c"}, "propC"]}`), http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?sortby=prop_c", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?orderby=prop_c:desc", http.StatusBadRequest)
+	doRequest(t, "/collections/mock_a/items?filter="+url.QueryEscape("prop_a = 'propA'")+"&sortby=-prop_b")
+
+	//-- denied columns are not published in the collection metadata or queryables
+	var coll api.CollectionInfo
+	json.Unmarshal(readBody(doRequest(t, "/collections/mock_a")), &coll) //nolint:errcheck
+	for _, prop := range coll.Properties {
+		assert(t, prop.Name != "prop_c", "denied property should not be a collection property")
+	}
+	var q api.Queryables
+	json.Unmarshal(readBody(doRequest(t, "/collections/mock_a/queryables")), &q) //nolint:errcheck
+	assert(t, q.Properties["prop_a"] != nil, "allowed property should be queryable")
+	assert(t, q.Properties["prop_c"] == nil, "denied property should not be queryable")
+}
+
+// TestPropertiesAliases tests that aliased columns are returned with their alias,
+// and can be requested by either name
+func TestPropertiesAliases(t *testing.T) {
+	tbl := catalogMock.TableDefs[0]
+	tbl.PropertyAliases = map[string]string{"prop_b": "rank", "prop_c": "Category"}
+	defer func() { tbl.PropertyAliases = nil }()
+
+	var v FeatureCollection
+	rr := doRequest(t, "/collections/mock_a/items?limit=2")
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 1.0, v.Features[0].Props["rank"], "aliased property")
+	_, ok := v.Features[0].Props["prop_b"]
+	assert(t, !ok, "aliased column should not be returned by name")
+
+	for _, query := range []string{"properties=rank,prop_a&rank=3", "properties=prop_b,prop_a&prop_b=3"} {
+		v = FeatureCollection{}
+		rr = doRequest(t, "/collections/mock_a/items?"+query)
+		errUnMarsh = json.Unmarshal(readBody(rr), &v)
+		assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+		equals(t, 1, len(v.Features), "# features filtered by "+query)
+		equals(t, 2, len(v.Features[0].Props), "# properties for "+query)
+		equals(t, 3.0, v.Features[0].Props["rank"], "aliased property for "+query)
+	}
+
+	rr = doRequest(t, "/collections/mock_a/items.csv?limit=1&properties=prop_a,rank")
+	assert(t, strings.HasPrefix(rr.Body.String(), "id,prop_a,rank"), "CSV header: "+rr.Body.String())
+
+	var c api.CollectionInfo
+	rr = doRequest(t, "/collections/mock_a")
+	errUnMarsh = json.Unmarshal(readBody(rr), &c)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, "rank", c.Properties[1].Name, "aliased collection property")
+
+	//-- the queryables have the same names as the collection properties
+	var q api.Queryables
+	errUnMarsh = json.Unmarshal(readBody(doRequest(t, "/collections/mock_a/queryables")), &q)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	_, ok = q.Properties["rank"]
+	assert(t, ok, "aliased queryable")
+	_, ok = q.Properties["prop_b"]
+	assert(t, !ok, "aliased column should not be queryable by name")
+
+	//-- CQL filters, groupby and sortby resolve aliases (including mixed-case ones) to columns
+	reqParam := api.RequestParam{
+		Filter:  `rank = 3 AND "Category" = 'propC'`,
+		GroupBy: []string{"Category"},
+		SortBy:  []data.Sorting{{Name: "Category", IsDesc: true}},
+		Aliases: tbl.AliasColumns(),
+	}
+	query, err := createQueryParams(&reqParam, tbl.Columns, tbl.DbTypes, tbl.Srid)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	assert(t, strings.Contains(query.FilterSql, `"prop_b"`) && strings.Contains(query.FilterSql, `"prop_c"`),
+		"CQL filter columns: "+query.FilterSql)
+	equals(t, []string{"prop_c"}, query.GroupBy, "groupby column")
+	equals(t, "prop_c", query.SortBy[0].Name, "sortby column")
+	reqParam = api.RequestParam{
+		Distinct:   true,
+		Properties: []string{"Category"},
+		SortBy:     []data.Sorting{{Name: "Category"}},
+		Aliases:    tbl.AliasColumns(),
+	}
+	query, err = createQueryParams(&reqParam, tbl.Columns, tbl.DbTypes, tbl.Srid)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, []string{"prop_c"}, query.Columns, "distinct columns")
+	for _, query := range []string{"filter=" + url.QueryEscape("rank = 3"), "groupby=Category", "sortby=-Category", "distinct=true&properties=Category"} {
+		doRequest(t, "/collections/mock_a/items?"+query)
+	}
+}
+
+func TestPropertiesComputed(t *testing.T) {
+	initPropertyFunctions([]string{"ST_X", "ST_Buffer"})
+	defer initPropertyFunctions(conf.Configuration().Server.PropertyFunctions)
+	tbl := catalogMock.TableDefs[0]
+	tbl.GeometryColumn = "geom"
+	defer func() { tbl.GeometryColumn = "" }()
+
+	var v FeatureCollection
+	rr := doRequest(t, "/collections/mock_a/items?limit=2&properties=prop_a,lon:x(geom)")
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 2, len(v.Features[0].Props), "# properties")
+	equals(t, -120.0, v.Features[0].Props["lon"], "computed property")
+
+	var f Feature
+	rr = doRequest(t, "/collections/mock_a/items/1?properties=lon:ST_X(geom)")
+	errUnMarsh = json.Unmarshal(readBody(rr), &f)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, -120.0, f.Props["lon"], "computed property of item")
+
+	//-- arguments are split from the properties list
+	doRequestStatus(t, "/collections/mock_a/items?properties=prop_a,b:ST_Buffer(geom,0.5)", http.StatusOK)
+
+	doRequestStatus(t, "/collections/mock_a/items?properties=a:ST_Area(geom)", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?properties=lon:ST_X(missing)", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?properties=lon:ST_X(geom,x)", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?properties=prop_b:ST_X(geom)", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/mock_a/items?properties=lon:ST_X(ST_Buffer(geom,1))", http.StatusBadRequest)
+}
+
 func TestCollectionNotFound(t *testing.T) {
 	doRequestStatus(t, "/collections/missing", http.StatusNotFound)
 }
@@ -364,6 +2466,188 @@ func TestFeatureNotFound(t *testing.T) {
 	doRequestStatus(t, "/collections/mock_a/items/999", http.StatusNotFound)
 }
 
+// TestItemLookup tests looking up a feature by the value of a lookup column
+func TestItemLookup(t *testing.T) {
+	collsSaved := conf.Configuration().Collections
+	defer func() { conf.Configuration().Collections = collsSaved }()
+	conf.Configuration().Collections = []conf.Collection{{Id: "mock_a", LookupColumns: []string{"prop_a", "prop_b"}}}
+
+	rr := doRequest(t, "/collections/mock_a/lookup/prop_b/3?properties=prop_b")
+	var v Feature
+	errUnMarsh := json.Unmarshal(readBody(rr), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, "3", v.ID, "feature ID")
+	equals(t, 3.0, v.Props["prop_b"], "feature property B")
+
+	doRequestStatus(t, "/collections/mock_a/lookup/prop_b/99", http.StatusNotFound)
+	doRequestStatus(t, "/collections/mock_a/lookup/prop_a/propA", http.StatusConflict)
+	doRequestStatus(t, "/collections/mock_a/lookup/prop_c/propC", http.StatusBadRequest)
+	doRequestStatus(t, "/collections/missing/lookup/prop_b/3", http.StatusNotFound)
+}
+
+func TestItemNoPrimaryKey(t *testing.T) {
+	tbl := catalogMock.TableDefs[2]
+	idCols := tbl.IDColumns
+	tbl.IDColumns = nil
+	defer func() { tbl.IDColumns = idCols }()
+
+	doRequest(t, "/collections/mock_c/items?limit=5")
+	doRequestStatus(t, "/collections/mock_c/items/1", http.StatusNotFound)
+}
+
+func TestDeleteItem(t *testing.T) {
+	doRequestMethodStatus(t, "DELETE", "/collections/mock_b/items/5", http.StatusNoContent)
+	doRequestStatus(t, "/collections/mock_b/items/5", http.StatusNotFound)
+	// deleting again finds no feature
+	doRequestMethodStatus(t, "DELETE", "/collections/mock_b/items/5", http.StatusNotFound)
+}
+
+func TestDeleteItemDryRun(t *testing.T) {
+	doRequestMethodStatus(t, "DELETE", "/collections/mock_b/items/6?dry-run", http.StatusNoContent)
+	doRequest(t, "/collections/mock_b/items/6")
+	doRequestMethodStatus(t, "DELETE", "/collections/mock_b/items/999?dry-run", http.StatusNotFound)
+}
+
+func TestDeleteItemNotEditable(t *testing.T) {
+	rr := doRequestMethodStatus(t, "DELETE", "/collections/mock_a/items/1", http.StatusMethodNotAllowed)
+	equals(t, "GET", rr.Header().Get("Allow"), "Allow header")
+	doRequest(t, "/collections/mock_a/items/1")
+}
+
+func TestDeleteItemPreferMinimal(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodDelete, basePath+"/collections/mock_b/items/7?dry-run", nil)
+	req.Header.Set(headerPrefer, "handling=lenient, return=minimal")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	equals(t, http.StatusNoContent, rr.Code, "status")
+	equals(t, "return=minimal", rr.Header().Get(headerPreferenceApplied), "Preference-Applied header")
+
+	rr = doRequestMethodStatus(t, http.MethodDelete, "/collections/mock_b/items/7?dry-run", http.StatusNoContent)
+	equals(t, "", rr.Header().Get(headerPreferenceApplied), "Preference-Applied header")
+}
+
+func TestRequestPreferReturn(t *testing.T) {
+	tests := map[string]string{
+		"":                                    preferReturnRepresentation,
+		"return=minimal":                      preferReturnMinimal,
+		"respond-async, Return = \"minimal\"": preferReturnMinimal,
+		"return=representation; foo=bar":      preferReturnRepresentation,
+		"return=other":                        preferReturnRepresentation,
+	}
+	for hdr, expected := range tests {
+		req, _ := http.NewRequest(http.MethodDelete, "/", nil)
+		if hdr != "" {
+			req.Header.Set(headerPrefer, hdr)
+		}
+		equals(t, expected, requestPreferReturn(req), "return preference of "+hdr)
+	}
+}
+
+func TestUpsertItems(t *testing.T) {
+	body := `{"type":"FeatureCollection","features":[
+		{"type":"Feature","id":"8","geometry":{"type":"Point","coordinates":[1,2]},"properties":{"prop_a":"changed"}},
+		{"type":"Feature","id":1001,"geometry":null,"properties":{"prop_b":42}}]}`
+	rr := doRequestMethodBodyStatus(t, http.MethodPut, "/collections/mock_b/items", body, http.StatusOK)
+	var summary api.UpsertSummary
+	errUnMarsh := json.Unmarshal(readBody(rr), &summary)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, api.UpsertSummary{Inserted: 1, Updated: 1}, summary, "upsert summary")
+
+	var v Feature
+	errUnMarsh = json.Unmarshal(readBody(doRequest(t, "/collections/mock_b/items/8")), &v)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, "changed", v.Props["prop_a"], "updated property")
+	doRequest(t, "/collections/mock_b/items/1001")
+
+	//-- replace mode deletes the other features, unless dry-run is used
+	rr = doRequestMethodBodyStatus(t, http.MethodPut, "/collections/mock_b/items?mode=replace&dry-run", body, http.StatusOK)
+	errUnMarsh = json.Unmarshal(readBody(rr), &summary)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 2, summary.Updated, "updated in replace mode")
+	assert(t, summary.Deleted > 0, "replace mode should delete the other features")
+	doRequest(t, "/collections/mock_b/items/9")
+}
+
+func TestUpsertItemsInvalid(t *testing.T) {
+	invalid := []string{
+		`{"type":"Feature"}`,
+		`{"type":"FeatureCollection","features":[{"type":"Feature","properties":{}}]}`,
+		`{"type":"FeatureCollection","features":[{"type":"Feature","id":1},{"type":"Feature","id":"1"}]}`,
+		`{"type":"FeatureCollection","features":[{"type":"Feature","id":1,"properties":{"missing":1}}]}`,
+		`{"type":"FeatureCollection","features":[{"type":"Feature","id":1,"geometry":"POINT(1 2)"}]}`,
+		`not json`,
+	}
+	for _, body := range invalid {
+		doRequestMethodBodyStatus(t, http.MethodPut, "/collections/mock_b/items", body, http.StatusBadRequest)
+	}
+	doRequestMethodBodyStatus(t, http.MethodPut, "/collections/mock_b/items?mode=other",
+		`{"type":"FeatureCollection","features":[]}`, http.StatusBadRequest)
+	doRequestMethodBodyStatus(t, http.MethodPut, "/collections/mock_a/items",
+		`{"type":"FeatureCollection","features":[]}`, http.StatusMethodNotAllowed)
+	doRequestMethodBodyStatus(t, http.MethodPut, "/collections/missing/items",
+		`{"type":"FeatureCollection","features":[]}`, http.StatusNotFound)
+
+	//-- a configured id column with no unique index cannot be upserted on
+	tbl := catalogMock.TableDefs[1]
+	tbl.IDNotUnique = true
+	doRequestMethodBodyStatus(t, http.MethodPut, "/collections/mock_b/items",
+		`{"type":"FeatureCollection","features":[]}`, http.StatusConflict)
+	tbl.IDNotUnique = false
+
+	//-- the parse error location is reported
+	rr := doRequestMethodBodyStatus(t, http.MethodPut, "/collections/mock_b/items",
+		"{\"type\":\"FeatureCollection\",\n \"features\":[}", http.StatusBadRequest)
+	assert(t, strings.Contains(rr.Body.String(), "(line 2, column 14)"), "error location: "+rr.Body.String())
+}
+
+func TestUpsertItemsBodyLimits(t *testing.T) {
+	maxBytes := conf.Configuration().Server.WriteMaxBodyBytes
+	timeoutSec := conf.Configuration().Server.WriteBodyTimeoutSec
+	defer func() {
+		conf.Configuration().Server.WriteMaxBodyBytes = maxBytes
+		conf.Configuration().Server.WriteBodyTimeoutSec = timeoutSec
+	}()
+	body := `{"type":"FeatureCollection","features":[]}`
+	conf.Configuration().Server.WriteMaxBodyBytes = int64(len(body))
+	doRequestMethodBodyStatus(t, http.MethodPut, "/collections/mock_b/items", body, http.StatusOK)
+	conf.Configuration().Server.WriteMaxBodyBytes = int64(len(body) - 1)
+	rr := doRequestMethodBodyStatus(t, http.MethodPut, "/collections/mock_b/items", body, http.StatusRequestEntityTooLarge)
+	equals(t, fmt.Sprintf(api.ErrMsgBodyTooLarge, len(body)-1)+"\n", rr.Body.String(), "error message")
+
+	//-- search requests have the same limit
+	doRequestMethodBodyStatus(t, http.MethodPost, "/collections/mock_a/search",
+		fmt.Sprintf(`{"filter":"prop_a = '%v'"}`, strings.Repeat("x", len(body))), http.StatusRequestEntityTooLarge)
+
+	//-- a body which is never completed times out when reading the connection
+	conf.Configuration().Server.WriteMaxBodyBytes = maxBytes
+	conf.Configuration().Server.WriteBodyTimeoutSec = 1
+	ts := httptest.NewUnstartedServer(router)
+	ts.Config.ConnContext = withConn
+	ts.Start()
+	defer ts.Close()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	defer conn.Close()
+	fmt.Fprintf(conn, "PUT %v/collections/mock_b/items HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n{", basePath)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, http.StatusRequestTimeout, resp.StatusCode, "status for body timeout")
+}
+
+func TestJSONErrorLocation(t *testing.T) {
+	content := []byte("{\n  \"a\": 1,\n  \"b\": x\n}")
+	var v interface{}
+	err := jsonErrorLocation(content, json.Unmarshal(content, &v))
+	assert(t, strings.HasSuffix(err.Error(), "(line 3, column 8)"), err.Error())
+
+	err = jsonErrorLocation(content, io.ErrUnexpectedEOF)
+	equals(t, io.ErrUnexpectedEOF, err, "error without location")
+}
+
+func TestDeleteItemCollectionNotFound(t *testing.T) {
+	doRequestMethodStatus(t, "DELETE", "/collections/missing/items/1", http.StatusNotFound)
+}
+
 //=============  Test functions
 
 func TestFunctionsJSON(t *testing.T) {
@@ -398,6 +2682,14 @@ func TestFunctionMissingItemsNotFound(t *testing.T) {
 	doRequestStatus(t, "/functions/missing/items", http.StatusNotFound)
 }
 
+func TestFunctionItemsMissingRequiredArg(t *testing.T) {
+	rr := doRequestStatus(t, "/functions/fun_required/items?in_param2=bb", http.StatusBadRequest)
+	equals(t, fmt.Sprintf(api.ErrMsgMissingParameter, "in_param1")+"\n", rr.Body.String(), "error message")
+
+	// the mock function returns no data
+	doRequestStatus(t, "/functions/fun_required/items?in_param1=1", http.StatusNotFound)
+}
+
 // ============  Test HTML generation
 // For now these just test that the template executes correctly
 // correctness/completess of HTML is not tested
@@ -419,6 +2711,33 @@ func TestHTMLItems(t *testing.T) {
 func TestHTMLItem(t *testing.T) {
 	doRequest(t, "/collections/mock_a/items/1.html")
 }
+func TestHTMLItemsMapDisabled(t *testing.T) {
+	collsSaved := conf.Configuration().Collections
+	defer func() { conf.Configuration().Collections = collsSaved }()
+	conf.Configuration().Collections = []conf.Collection{{Id: "mock_a", MapDisabled: true}}
+
+	for _, path := range []string{"/collections/mock_a/items.html", "/collections/mock_a/items/1.html"} {
+		body := doRequest(t, path).Body.String()
+		assert(t, strings.Contains(body, "map view is disabled"), "map disabled message for "+path)
+		assert(t, !strings.Contains(body, `id="map"`), "no map for "+path)
+	}
+	body := doRequest(t, "/collections/mock_b/items.html").Body.String()
+	assert(t, strings.Contains(body, `id="map"`), "map for other collection")
+}
+func TestHTMLItemsAttributeTable(t *testing.T) {
+	for _, path := range []string{
+		"/collections/mock_a/items.html?distinct=true&properties=prop_a",
+		"/collections/mock_a/items.html?groupby=prop_a",
+		"/functions/fun_a/items.html",
+	} {
+		body := doRequest(t, path).Body.String()
+		assert(t, strings.Contains(body, `id='tbl-attrs'`), "attribute table for "+path)
+		assert(t, !strings.Contains(body, `id="map"`), "no map for "+path)
+	}
+	body := doRequest(t, "/collections/mock_a/items.html").Body.String()
+	assert(t, strings.Contains(body, `id="map"`), "map for spatial query")
+	assert(t, !strings.Contains(body, `id='tbl-attrs'`), "no attribute table for spatial query")
+}
 func TestHTMLFunctions(t *testing.T) {
 	rr := doRequest(t, "/functions.html")
 	for _, fun := range catalogMock.FunctionDefs {
@@ -444,7 +2763,12 @@ func doRequest(t *testing.T, url string) *httptest.ResponseRecorder {
 
 func doRequestStatus(t *testing.T, url string,
 	statusExpected int) *httptest.ResponseRecorder {
-	req, err := http.NewRequest("GET", basePath+url, nil)
+	return doRequestMethodStatus(t, "GET", url, statusExpected)
+}
+
+func doRequestMethodStatus(t *testing.T, method string, url string,
+	statusExpected int) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, basePath+url, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -461,6 +2785,64 @@ func doRequestStatus(t *testing.T, url string,
 	return rr
 }
 
+func TestSearchItems(t *testing.T) {
+	var get, search FeatureCollection
+	json.Unmarshal(readBody(doRequest(t, "/collections/mock_a/items?limit=2&offset=1&properties=prop_a,prop_b&bbox=-180,-90,180,90")), &get) //nolint:errcheck
+	rr := doRequestMethodBodyStatus(t, http.MethodPost, "/collections/mock_a/search",
+		`{"limit":2,"offset":1,"properties":["prop_a","prop_b"],"bbox":[-180,-90,180,90],"datetime":null}`, http.StatusOK)
+	errUnMarsh := json.Unmarshal(readBody(rr), &search)
+	assert(t, errUnMarsh == nil, fmt.Sprintf("%v", errUnMarsh))
+	equals(t, 2, len(search.Features), "# features")
+	equals(t, get.Features, search.Features, "search features")
+
+	//-- body parameters replace query parameters
+	rr = doRequestMethodBodyStatus(t, http.MethodPost, "/collections/mock_a/search?limit=5", `{"limit":3}`, http.StatusOK)
+	json.Unmarshal(readBody(rr), &search) //nolint:errcheck
+	equals(t, 3, len(search.Features), "# features with body limit")
+
+	doRequestMethodBodyStatus(t, http.MethodPost, "/collections/mock_a/search",
+		`{"filter":{"op":"=","args":[{"property":"prop_a"},"propA"]}}`, http.StatusOK)
+	doRequestMethodBodyStatus(t, http.MethodPost, "/collections/mock_a/search",
+		`{"filter":{"op":"=","args":[{"property":"prop_a"}]}}`, http.StatusBadRequest)
+	doRequestMethodBodyStatus(t, http.MethodPost, "/collections/mock_a/search", `{"limit":"x"}`, http.StatusBadRequest)
+	doRequestMethodBodyStatus(t, http.MethodPost, "/collections/mock_a/search", `{"limit":-1,"crs":3857}`, http.StatusBadRequest)
+	doRequestMethodBodyStatus(t, http.MethodPost, "/collections/mock_a/search", `{"sortby":[1]}`, http.StatusBadRequest)
+	doRequestMethodBodyStatus(t, http.MethodPost, "/collections/mock_a/search", `[]`, http.StatusBadRequest)
+	doRequestMethodBodyStatus(t, http.MethodPost, "/collections/missing/search", `{}`, http.StatusNotFound)
+}
+
+func TestParseSearchBody(t *testing.T) {
+	values, err := parseSearchBody(strings.NewReader(
+		`{"filter":{"op":"=","args":[{"property":"prop_a"},"x"]},"sortby":"-prop_b","datetime":"2024-01-01T00:00:00Z","bbox":[1.5,2,3,4]}`))
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, map[string]string{
+		api.ParamFilter:     `{"op":"=","args":[{"property":"prop_a"},"x"]}`,
+		api.ParamFilterLang: api.FilterLangJSON,
+		api.ParamSortBy:     "-prop_b",
+		api.ParamDatetime:   "2024-01-01T00:00:00Z",
+		api.ParamBbox:       "1.5,2,3,4",
+	}, values, "search values")
+
+	values, err = parseSearchBody(strings.NewReader(`{"filter":"prop_a = 'x'","filter-lang":"cql2-text"}`))
+	assert(t, err == nil, fmt.Sprintf("%v", err))
+	equals(t, map[string]string{api.ParamFilter: "prop_a = 'x'", api.ParamFilterLang: api.FilterLangText}, values, "text filter")
+}
+
+func doRequestMethodBodyStatus(t *testing.T, method string, url string, body string,
+	statusExpected int) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, basePath+url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != statusExpected {
+		t.Errorf("handler returned wrong status code for %v: got %v want %v",
+			body, status, statusExpected)
+	}
+	return rr
+}
+
 func checkCollection(tb testing.TB, coll *api.CollectionInfo, name string, title string) {
 	equals(tb, name, coll.Name, "Collection name")
 	equals(tb, title, coll.Title, "Collection title")
@@ -550,3 +2932,85 @@ func equals(tb testing.TB, exp, act interface{}, msg string) {
 		tb.FailNow()
 	}
 }
+
+func TestShutdownServers(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewUnstartedServer(inFlightHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("done"))
+	})))
+	ts.Start()
+	defer close(release)
+
+	//-- a request in progress is cut off at the timeout
+	slowErr := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/slow")
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		slowErr <- err
+	}()
+	for i := 0; i < 100 && atomic.LoadInt64(&requestsInFlight) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	equals(t, int64(1), atomic.LoadInt64(&requestsInFlight), "requests in flight")
+
+	start := time.Now()
+	shutdownServers(100*time.Millisecond, ts.Config)
+	assert(t, time.Since(start) < 5*time.Second, "shutdown waits no longer than the timeout")
+	select {
+	case err := <-slowErr:
+		assert(t, err != nil, "slow request cut off")
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow request not cut off")
+	}
+	_, err := http.Get(ts.URL + "/")
+	assert(t, err != nil, "no requests accepted after shutdown")
+}
+
+// TestRequestTimeoutHandler tests that collection items are not buffered by the timeout handler,
+// so they can be streamed, and have a deadline instead
+func TestRequestTimeoutHandler(t *testing.T) {
+	var isFlusher, hasDeadline bool
+	h := requestTimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isFlusher = w.(http.Flusher)
+		_, hasDeadline = r.Context().Deadline()
+	}), time.Minute)
+
+	for _, path := range []string{"/collections/mock_a/items", "/collections/mock_a/items.json"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, basePath+path, nil))
+		assert(t, isFlusher, "items response should not be buffered: "+path)
+		assert(t, hasDeadline, "items request should have a deadline: "+path)
+	}
+	for _, path := range []string{"/collections/mock_a", "/collections/mock_a/items/1"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, basePath+path, nil))
+		assert(t, !isFlusher, "response should be buffered: "+path)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, basePath+"/collections/mock_b/items", nil))
+	assert(t, !isFlusher, "edit response should be buffered")
+}
+
+// TestReloadDuringRequests tests that the settings initialized from the configuration
+// can be replaced while requests are using them (run with -race)
+func TestReloadDuringRequests(t *testing.T) {
+	defer api.InitCrs(nil)
+	config := *conf.Configuration()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			conf.SetConfiguration(config)
+			initTransforms(config.Server.TransformFunctions, config.Server.TransformMetricFunctions)
+			initPrecisionMode(data.PrecisionModeRound)
+			api.InitCrs(nil)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		doRequest(t, "/collections/mock_a/items?limit=1&crs=3857&transform=centroid")
+	}
+	<-done
+}
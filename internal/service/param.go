@@ -14,48 +14,68 @@ package service
 */
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/CrunchyData/pg_featureserv/internal/api"
 	"github.com/CrunchyData/pg_featureserv/internal/conf"
 	"github.com/CrunchyData/pg_featureserv/internal/cql"
 	"github.com/CrunchyData/pg_featureserv/internal/data"
+	log "github.com/sirupsen/logrus"
 )
 
-func parseRequestParams(r *http.Request) (api.RequestParam, error) {
+// parseRequestParams parses the request query parameters.
+// The limit parameter is constrained by the given paging limits.
+// In strict mode, parameters must be reserved names or one of the given names
+// (collection columns or function arguments)
+func parseRequestParams(r *http.Request, paging conf.Paging, names []string) (api.RequestParam, error) {
 	queryValues := r.URL.Query()
 	paramValues := extractSingleArgs(queryValues)
 
 	param := api.RequestParam{
-		Crs:       data.SRID_4326,
-		Limit:     conf.Configuration.Paging.LimitDefault,
-		Offset:    0,
-		Precision: -1,
-		BboxCrs:   data.SRID_4326,
-		Filter:    "",
-		Values:    paramValues,
+		Crs:           data.SRID_4326,
+		Limit:         paging.LimitDefault,
+		Offset:        0,
+		Precision:     -1,
+		PropPrecision: -1,
+		BboxCrs:       data.SRID_4326,
+		Filter:        "",
+		Values:        paramValues,
+	}
+
+	if conf.Configuration().Server.StrictQueryParams {
+		if err := checkParamNames(paramValues, names); err != nil {
+			return param, err
+		}
 	}
 
 	// --- crs parameter
-	crs, err := parseInt(paramValues, api.ParamCrs, 0, 99999999, data.SRID_4326)
+	crs, err := parseCrs(paramValues, api.ParamCrs)
 	if err != nil {
 		return param, err
 	}
 	param.Crs = crs
+	param.FlipAxes = isAuthoritativeAxisOrder(crs)
 
 	// --- limit parameter
-	limit, err := parseLimit(paramValues)
+	limit, err := parseLimit(paramValues, paging)
 	if err != nil {
 		return param, err
 	}
 	param.Limit = limit
 
 	// --- offset parameter
-	offset, err := parseInt(paramValues, api.ParamOffset, 0, -1, 0)
+	offset, err := parseOffset(paramValues, paging)
 	if err != nil {
 		return param, err
 	}
@@ -69,28 +89,155 @@ func parseRequestParams(r *http.Request) (api.RequestParam, error) {
 	param.Bbox = bbox
 
 	// --- bbox-crs parameter
-	bboxcrs, err := parseInt(paramValues, api.ParamBboxCrs, 0, 99999999, data.SRID_4326)
+	bboxcrs, err := parseCrs(paramValues, api.ParamBboxCrs)
+	if err != nil {
+		return param, err
+	}
+
+	// --- tile parameter
+	tile, err := parseTile(paramValues)
 	if err != nil {
 		return param, err
 	}
+	if tile != nil {
+		//-- the tile extent replaces the bbox, and is always in Web Mercator
+		for _, name := range []string{api.ParamBbox, api.ParamBboxCrs} {
+			if _, ok := paramValues[name]; ok {
+				return param, fmt.Errorf(api.ErrMsgTileConflict, name)
+			}
+		}
+		param.Bbox = tile
+		bboxcrs = data.SRID_3857
+	}
 	param.BboxCrs = bboxcrs
+	//-- bbox coordinates are in the axis order of the bbox CRS
+	if bbox != nil && isAuthoritativeAxisOrder(bboxcrs) {
+		param.Bbox = &data.Extent{Minx: bbox.Miny, Miny: bbox.Minx, Maxx: bbox.Maxy, Maxy: bbox.Maxx}
+	}
+
+	// --- bbox-buffer parameter
+	bboxBuffer, err := parseBboxBuffer(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.BboxBuffer = bboxBuffer
+	if err := checkBboxArea(param.Bbox.Expand(bboxBuffer), bboxcrs); err != nil {
+		return param, err
+	}
 
 	// --- filter parameter
 	param.Filter = parseString(paramValues, api.ParamFilter)
 
+	// --- filter-lang parameter
+	filterLang, err := parseFilterLang(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.FilterLang = filterLang
+
 	// --- filter-crs parameter
-	filterCrs, err := parseInt(paramValues, api.ParamFilterCrs, 0, 99999999, data.SRID_4326)
+	filterCrs, err := parseCrs(paramValues, api.ParamFilterCrs)
 	if err != nil {
 		return param, err
 	}
 	param.FilterCrs = filterCrs
 
+	// --- filter-geom and filter-geom-op parameters
+	filterGeom, err := parseFilterGeom(paramValues, filterCrs)
+	if err != nil {
+		return param, err
+	}
+	param.FilterGeom = filterGeom
+
+	// --- datetime parameter
+	datetime, err := parseDatetime(paramValues, time.Now())
+	if err != nil {
+		return param, err
+	}
+	param.Datetime = datetime
+
+	// --- sample parameter
+	sample, err := parseSample(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.Sample = sample
+
+	// --- resultType parameter
+	isHits, err := parseResultType(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.IsHits = isHits
+
+	// --- envelope parameter
+	isEnvelope, err := parseEnvelope(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.NoEnvelope = !isEnvelope
+
+	// --- geomtype parameter
+	geomType, err := parseGeomType(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.GeomType = geomType
+
 	// --- properties parameter
 	props, err := parseProperties(paramValues)
 	if err != nil {
 		return param, err
 	}
-	param.Properties = props
+	param.Properties, param.Computed, err = parseComputedProperties(props)
+	if err != nil {
+		return param, err
+	}
+
+	// --- distinct parameter
+	distinct, err := parseDistinct(paramValues)
+	if err != nil {
+		return param, err
+	}
+	if distinct && len(props) == 0 {
+		return param, fmt.Errorf(api.ErrMsgDistinctNoProperties)
+	}
+	param.Distinct = distinct
+
+	// --- cluster parameter
+	cluster, err := parseCluster(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.Cluster = cluster
+
+	// --- aggregate parameter
+	aggregate, err := parseAggregate(paramValues, paging)
+	if err != nil {
+		return param, err
+	}
+	param.Aggregate = aggregate
+
+	// --- geometry-format parameter
+	geomFormat, err := parseGeomFormat(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.GeomFormat = geomFormat
+
+	// --- empty-geometry parameter
+	emptyGeom, err := parseEmptyGeometry(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.EmptyGeometry = emptyGeom
+
+	// --- dimension parameter
+	dimension, err := parseDimension(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.Dimension = dimension
 
 	// --- orderBy parameter
 	groupBy, err := parseGroupBy(paramValues)
@@ -99,26 +246,42 @@ func parseRequestParams(r *http.Request) (api.RequestParam, error) {
 	}
 	param.GroupBy = groupBy
 
-	// --- orderBy parameter (DEPRECATED)
+	// --- sortBy parameter
+	sortBy, err := parseSortBy(paramValues)
+	if err != nil {
+		return param, err
+	}
+	param.SortBy = sortBy
+
+	// --- orderBy parameter (DEPRECATED), which takes precedence over sortBy
 	orderBy, err := parseOrderBy(paramValues)
 	if err != nil {
 		return param, err
 	}
-	param.SortBy = orderBy
+	if len(orderBy) > 0 {
+		param.SortBy = orderBy
+	}
 
-	// --- sortBy parameter
-	sortBy, err := parseSortBy(paramValues)
+	// --- point parameter, for ordering by distance
+	point, err := parsePoint(paramValues)
 	if err != nil {
 		return param, err
 	}
-	param.SortBy = sortBy
+	//-- the distance keyword is resolved when the collection columns are known,
+	//-- since a column named distance takes precedence
+	for i := range param.SortBy {
+		if strings.EqualFold(param.SortBy[i].Name, api.OrderByDistance) {
+			param.SortBy[i].Point = point
+		}
+	}
 
 	// --- precision parameter
-	precision, err := parseInt(paramValues, api.ParamPrecision, 0, 20, -1)
+	precision, propPrecision, err := parsePrecision(paramValues)
 	if err != nil {
 		return param, err
 	}
 	param.Precision = precision
+	param.PropPrecision = propPrecision
 
 	// --- transform parameter
 	param.TransformFuns, err = parseTransform(paramValues)
@@ -139,6 +302,26 @@ func extractSingleArgs(queryArgs url.Values) api.NameValMap {
 	return vals
 }
 
+// checkParamNames returns an error listing any parameters
+// which are not reserved names or one of the given names
+func checkParamNames(values api.NameValMap, names []string) error {
+	nameSet := make(map[string]bool)
+	for _, name := range names {
+		nameSet[name] = true
+	}
+	var unknown []string
+	for key := range values {
+		if !api.IsParameterReservedName(key) && !nameSet[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf(api.ErrMsgUnknownParameter, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
 func parseString(values api.NameValMap, key string) string {
 	return strings.TrimSpace(values[key])
 }
@@ -162,17 +345,48 @@ func parseInt(values api.NameValMap, key string, minVal int, maxVal int, default
 	return val, nil
 }
 
-func parseLimit(values api.NameValMap) (int, error) {
+// parseCrs parses a coordinate system parameter, given as a CRS URI or an SRID.
+// The default is 4326 (CRS84).
+// A coordinate system which is not supported is an error
+func parseCrs(values api.NameValMap, key string) (int, error) {
+	val := strings.TrimSpace(values[key])
+	if len(val) < 1 {
+		return data.SRID_4326, nil
+	}
+	srid, ok := api.CrsSrid(val)
+	if !ok {
+		return 0, fmt.Errorf(api.ErrMsgCrsNotSupported, key, val)
+	}
+	return srid, nil
+}
+
+// parseOffset parses the offset, which is limited to the OffsetMax.
+// Larger offsets are rejected, unless the paging configuration clamps them
+func parseOffset(values api.NameValMap, paging conf.Paging) (int, error) {
+	offset, err := parseInt(values, api.ParamOffset, 0, -1, 0)
+	if err != nil {
+		return 0, err
+	}
+	if paging.OffsetMax > 0 && offset > paging.OffsetMax {
+		if !paging.OffsetClamp {
+			return 0, fmt.Errorf(api.ErrMsgOffsetMax, paging.OffsetMax)
+		}
+		offset = paging.OffsetMax
+	}
+	return offset, nil
+}
+
+func parseLimit(values api.NameValMap, paging conf.Paging) (int, error) {
 	val := values[api.ParamLimit]
 	if len(val) < 1 {
-		return conf.Configuration.Paging.LimitDefault, nil
+		return paging.LimitDefault, nil
 	}
 	limit, err := strconv.Atoi(val)
 	if err != nil {
 		return 0, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamLimit, val)
 	}
-	if limit < 0 || limit > conf.Configuration.Paging.LimitMax {
-		limit = conf.Configuration.Paging.LimitMax
+	if limit < 0 || limit > paging.LimitMax {
+		limit = paging.LimitMax
 	}
 	return limit, nil
 }
@@ -180,38 +394,573 @@ func parseLimit(values api.NameValMap) (int, error) {
 /*
 parseBbox parses the bbox query parameter, if present, or nll if not
 This has the format bbox=minLon,minLat,maxLon,maxLat.
+If minLon is greater than maxLon the bbox crosses the antimeridian.
+The bbox may also be given as a JSON array [minLon,minLat,maxLon,maxLat],
+as a WKT ENVELOPE(minLon,maxLon,maxLat,minLat),
+or as a rectangular WKT or GeoJSON polygon.
 */
 func parseBbox(values api.NameValMap) (*data.Extent, error) {
 	val := values[api.ParamBbox]
 	if len(val) < 1 {
 		return nil, nil
 	}
-	nums := strings.Split(val, ",")
-	var isErr = false
-	if len(nums) != 4 {
+	bbox, ok := parseBboxValue(strings.TrimSpace(val))
+	if !ok {
 		return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamBbox, val)
 	}
-	minLon, err := strconv.ParseFloat(nums[0], 64)
-	if err != nil {
-		isErr = true
+	return bbox, nil
+}
+
+func parseBboxValue(val string) (*data.Extent, bool) {
+	upper := strings.ToUpper(val)
+	switch {
+	case strings.HasPrefix(val, "["):
+		var nums []float64
+		if err := json.Unmarshal([]byte(val), &nums); err != nil || len(nums) != 4 {
+			return nil, false
+		}
+		return &data.Extent{Minx: nums[0], Miny: nums[1], Maxx: nums[2], Maxy: nums[3]}, true
+	case strings.HasPrefix(val, "{"):
+		var geom struct {
+			Type        string        `json:"type"`
+			Coordinates [][][]float64 `json:"coordinates"`
+		}
+		if err := json.Unmarshal([]byte(val), &geom); err != nil || geom.Type != "Polygon" || len(geom.Coordinates) != 1 {
+			return nil, false
+		}
+		return rectangleExtent(geom.Coordinates[0])
+	case strings.HasPrefix(upper, "ENVELOPE"):
+		nums, ok := parseFloatList(wktBody(val[len("ENVELOPE"):], 1), ",")
+		if !ok || len(nums) != 4 {
+			return nil, false
+		}
+		//-- WKT envelope order is minx, maxx, maxy, miny
+		return &data.Extent{Minx: nums[0], Miny: nums[3], Maxx: nums[1], Maxy: nums[2]}, true
+	case strings.HasPrefix(upper, "POLYGON"):
+		body := wktBody(val[len("POLYGON"):], 2)
+		if body == "" || strings.ContainsAny(body, "()") {
+			return nil, false
+		}
+		var ring [][]float64
+		for _, pt := range strings.Split(body, ",") {
+			ords, ok := parseFloatList(pt, " ")
+			if !ok || len(ords) != 2 {
+				return nil, false
+			}
+			ring = append(ring, ords)
+		}
+		return rectangleExtent(ring)
+	}
+	nums, ok := parseFloatList(val, ",")
+	if !ok || len(nums) != 4 {
+		return nil, false
+	}
+	return &data.Extent{Minx: nums[0], Miny: nums[1], Maxx: nums[2], Maxy: nums[3]}, true
+}
+
+// wktBody returns the text inside the given number of enclosing parentheses,
+// or an empty string if the text is not enclosed by them
+func wktBody(s string, depth int) string {
+	s = strings.TrimSpace(s)
+	for i := 0; i < depth; i++ {
+		if !strings.HasPrefix(s, "(") || !strings.HasSuffix(s, ")") {
+			return ""
+		}
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+	return s
+}
+
+// parseFloatList parses a list of numbers separated by sep.
+// A space separator allows any amount of whitespace
+func parseFloatList(s string, sep string) ([]float64, bool) {
+	var items []string
+	if sep == " " {
+		items = strings.Fields(s)
+	} else {
+		items = strings.Split(s, sep)
 	}
-	minLat, err := strconv.ParseFloat(nums[1], 64)
+	nums := make([]float64, len(items))
+	for i, item := range items {
+		num, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil {
+			return nil, false
+		}
+		nums[i] = num
+	}
+	return nums, true
+}
+
+// rectangleExtent returns the extent of a polygon ring,
+// if it is an axis-aligned rectangle with an optional closing point
+func rectangleExtent(ring [][]float64) (*data.Extent, bool) {
+	if len(ring) == 5 {
+		if len(ring[0]) != 2 || len(ring[4]) != 2 || ring[0][0] != ring[4][0] || ring[0][1] != ring[4][1] {
+			return nil, false
+		}
+		ring = ring[:4]
+	}
+	if len(ring) != 4 {
+		return nil, false
+	}
+	bbox := data.Extent{Minx: math.Inf(1), Miny: math.Inf(1), Maxx: math.Inf(-1), Maxy: math.Inf(-1)}
+	for _, pt := range ring {
+		if len(pt) != 2 {
+			return nil, false
+		}
+		bbox.Minx = math.Min(bbox.Minx, pt[0])
+		bbox.Miny = math.Min(bbox.Miny, pt[1])
+		bbox.Maxx = math.Max(bbox.Maxx, pt[0])
+		bbox.Maxy = math.Max(bbox.Maxy, pt[1])
+	}
+	if bbox.Minx == bbox.Maxx || bbox.Miny == bbox.Maxy {
+		return nil, false
+	}
+	//-- each vertex must be a different corner of the extent
+	corners := map[[2]bool]bool{}
+	for _, pt := range ring {
+		isMinx, isMiny := pt[0] == bbox.Minx, pt[1] == bbox.Miny
+		if (!isMinx && pt[0] != bbox.Maxx) || (!isMiny && pt[1] != bbox.Maxy) {
+			return nil, false
+		}
+		corners[[2]bool{isMinx, isMiny}] = true
+	}
+	if len(corners) != 4 {
+		return nil, false
+	}
+	return &bbox, true
+}
+
+// checkBboxArea checks that the area of a bbox does not exceed the maximum for its CRS.
+// Bbox CRSs with EPSG geographic SRIDs (4000 to 4999) are limited by BboxMaxArea (in square degrees),
+// and other CRSs are limited by BboxMaxAreaProjected (in square CRS units)
+func checkBboxArea(bbox *data.Extent, bboxCrs int) error {
+	if bbox == nil {
+		return nil
+	}
+	isGeographic := data.IsGeographicSrid(bboxCrs)
+	maxArea := conf.Configuration().Server.BboxMaxAreaProjected
+	if isGeographic {
+		maxArea = conf.Configuration().Server.BboxMaxArea
+	}
+	if maxArea > 0 && bbox.Area(isGeographic) > maxArea {
+		return fmt.Errorf(api.ErrMsgBboxMaxArea, maxArea)
+	}
+	return nil
+}
+
+// isAuthoritativeAxisOrder tests if a CRS uses y/x axis order for coordinates.
+// The default CRS always uses lon/lat order, as required by GeoJSON
+func isAuthoritativeAxisOrder(srid int) bool {
+	if srid == data.SRID_4326 {
+		return false
+	}
+	for _, s := range conf.Configuration().Server.AuthoritativeAxisOrderSrids {
+		if s == srid {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFilterLang parses the filter encoding.
+// The default is CQL2 text
+func parseFilterLang(values api.NameValMap) (string, error) {
+	lang := strings.ToLower(parseString(values, api.ParamFilterLang))
+	switch lang {
+	case "":
+		return api.FilterLangText, nil
+	case api.FilterLangText, api.FilterLangJSON:
+		return lang, nil
+	}
+	return "", fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamFilterLang, values[api.ParamFilterLang])
+}
+
+// parseFilterGeom parses the filter geometry (WKT or GeoJSON) and spatial relationship.
+// The geometry must be in the filter CRS
+func parseFilterGeom(values api.NameValMap, filterCrs int) (*data.GeometryFilter, error) {
+	val := strings.TrimSpace(values[api.ParamFilterGeom])
+	if len(val) < 1 {
+		return nil, nil
+	}
+	op := strings.ToLower(values[api.ParamFilterGeomOp])
+	switch op {
+	case "":
+		op = data.GeometryFilterOpIntersects
+	case data.GeometryFilterOpIntersects, data.GeometryFilterOpWithin, data.GeometryFilterOpContains:
+	default:
+		return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamFilterGeomOp, values[api.ParamFilterGeomOp])
+	}
+	filter := data.GeometryFilter{Op: op, Srid: filterCrs}
+	var geom string
+	var srid int
+	var isValid bool
+	if strings.HasPrefix(val, "{") {
+		geom, srid, isValid = parseGeoJSONGeometry(val)
+		filter.IsGeoJSON = true
+	} else {
+		geom, srid, isValid = parseWKTGeometry(val)
+	}
+	if !isValid || (srid != 0 && srid != filterCrs) {
+		return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamFilterGeom, val)
+	}
+	filter.Geom = geom
+	return &filter, nil
+}
+
+var reWKTSrid = regexp.MustCompile(`(?i)^SRID=(\d+);`)
+var reWKTGeometry = regexp.MustCompile(`(?i)^(POINT|LINESTRING|POLYGON|MULTIPOINT|MULTILINESTRING|MULTIPOLYGON|GEOMETRYCOLLECTION)\s*(Z|M|ZM)?\s*(EMPTY|\([A-Z0-9 ,.+\-()]*\))$`)
+
+// parseWKTGeometry checks the syntax of a WKT or EWKT geometry.
+// It returns the WKT and the SRID of an EWKT geometry (or 0)
+func parseWKTGeometry(val string) (string, int, bool) {
+	srid := 0
+	if m := reWKTSrid.FindStringSubmatch(val); m != nil {
+		srid, _ = strconv.Atoi(m[1])
+		val = strings.TrimSpace(val[len(m[0]):])
+	}
+	if !reWKTGeometry.MatchString(val) || !isBalancedParens(val) {
+		return "", 0, false
+	}
+	return val, srid, true
+}
+
+func isBalancedParens(s string) bool {
+	depth := 0
+	for _, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		}
+	}
+	return depth == 0
+}
+
+type geoJSONGeometry struct {
+	Type        string            `json:"type"`
+	Coordinates json.RawMessage   `json:"coordinates"`
+	Geometries  []geoJSONGeometry `json:"geometries"`
+	Crs         *struct {
+		Properties struct {
+			Name string `json:"name"`
+		} `json:"properties"`
+	} `json:"crs"`
+}
+
+var reGeoJSONCrsCode = regexp.MustCompile(`(?i)EPSG:+(\d+)$`)
+
+// parseGeoJSONGeometry checks the structure of a GeoJSON geometry.
+// It returns the GeoJSON and the SRID of a named crs (or 0)
+func parseGeoJSONGeometry(val string) (string, int, bool) {
+	var geom geoJSONGeometry
+	if err := json.Unmarshal([]byte(val), &geom); err != nil {
+		return "", 0, false
+	}
+	if !isValidGeoJSONGeometry(&geom) {
+		return "", 0, false
+	}
+	srid := 0
+	if geom.Crs != nil {
+		m := reGeoJSONCrsCode.FindStringSubmatch(geom.Crs.Properties.Name)
+		if m == nil {
+			return "", 0, false
+		}
+		srid, _ = strconv.Atoi(m[1])
+	}
+	return val, srid, true
+}
+
+func isValidGeoJSONGeometry(geom *geoJSONGeometry) bool {
+	switch geom.Type {
+	case "Point", "LineString", "Polygon", "MultiPoint", "MultiLineString", "MultiPolygon":
+		var coords interface{}
+		if err := json.Unmarshal(geom.Coordinates, &coords); err != nil {
+			return false
+		}
+		_, isArray := coords.([]interface{})
+		return isArray
+	case "GeometryCollection":
+		for i := range geom.Geometries {
+			if !isValidGeoJSONGeometry(&geom.Geometries[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// parseDatetime parses the datetime parameter, as an instant or an interval start/end.
+// Interval ends may be open (.. or empty).
+// Times are RFC 3339 timestamps, dates, or now with an optional ISO 8601 duration offset
+// (e.g. now-P1D).  They are resolved relative to the given request time
+func parseDatetime(values api.NameValMap, now time.Time) (*data.TimeInterval, error) {
+	val := strings.TrimSpace(values[api.ParamDatetime])
+	if len(val) < 1 {
+		return nil, nil
+	}
+	errInvalid := fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamDatetime, val)
+	parts := strings.Split(val, api.DatetimeIntervalSep)
+	if len(parts) > 2 {
+		return nil, errInvalid
+	}
+	times := make([]*time.Time, len(parts))
+	for i, part := range parts {
+		t, err := parseDatetimeValue(part, now, len(parts) > 1)
+		if err != nil {
+			return nil, errInvalid
+		}
+		times[i] = t
+	}
+	if len(times) == 1 {
+		return &data.TimeInterval{Start: times[0], End: times[0]}, nil
+	}
+	if times[0] != nil && times[1] != nil && times[0].After(*times[1]) {
+		return nil, errInvalid
+	}
+	return &data.TimeInterval{Start: times[0], End: times[1]}, nil
+}
+
+// parsePoint parses the point parameter, which has the format point=lon,lat
+func parsePoint(values api.NameValMap) (*data.Point, error) {
+	val := values[api.ParamPoint]
+	if len(val) < 1 {
+		return nil, nil
+	}
+	nums := strings.Split(val, ",")
+	if len(nums) != 2 {
+		return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamPoint, val)
+	}
+	lon, errLon := strconv.ParseFloat(strings.TrimSpace(nums[0]), 64)
+	lat, errLat := strconv.ParseFloat(strings.TrimSpace(nums[1]), 64)
+	if errLon != nil || errLat != nil || !(lon >= -180 && lon <= 180) || !(lat >= -90 && lat <= 90) {
+		return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamPoint, val)
+	}
+	return &data.Point{X: lon, Y: lat}, nil
+}
+
+// parseBboxBuffer parses the distance to expand the bbox by, which must not be negative
+func parseBboxBuffer(values api.NameValMap) (float64, error) {
+	val := strings.TrimSpace(values[api.ParamBboxBuffer])
+	if len(val) < 1 {
+		return 0, nil
+	}
+	dist, err := strconv.ParseFloat(val, 64)
+	if err != nil || dist < 0 || math.IsNaN(dist) || math.IsInf(dist, 0) {
+		return 0, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamBboxBuffer, val)
+	}
+	return dist, nil
+}
+
+// maxTileZoom is the maximum zoom level of the tile parameter
+const maxTileZoom = 30
+
+// parseTile parses a Web Mercator tile as zoom/column/row,
+// and returns its extent
+func parseTile(values api.NameValMap) (*data.Extent, error) {
+	val := strings.TrimSpace(values[api.ParamTile])
+	if len(val) < 1 {
+		return nil, nil
+	}
+	errInvalid := fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamTile, val)
+	parts := strings.Split(val, "/")
+	if len(parts) != 3 {
+		return nil, errInvalid
+	}
+	var zxy [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, errInvalid
+		}
+		zxy[i] = n
+	}
+	z, x, y := zxy[0], zxy[1], zxy[2]
+	if z > maxTileZoom || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return nil, errInvalid
+	}
+	return data.TileExtent(z, x, y), nil
+}
+
+// parseResultType parses the WFS resultType parameter,
+// which is results (the default) or hits
+func parseResultType(values api.NameValMap) (bool, error) {
+	val := strings.ToLower(strings.TrimSpace(values[api.ParamResultType]))
+	switch val {
+	case "", api.ResultTypeResults:
+		return false, nil
+	case api.ResultTypeHits:
+		return true, nil
+	}
+	return false, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamResultType, values[api.ParamResultType])
+}
+
+// parseEnvelope parses the envelope parameter,
+// which is false to return features as a bare array
+func parseEnvelope(values api.NameValMap) (bool, error) {
+	val := strings.TrimSpace(values[api.ParamEnvelope])
+	if len(val) < 1 {
+		return true, nil
+	}
+	isEnvelope, err := strconv.ParseBool(val)
 	if err != nil {
-		isErr = true
+		return true, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamEnvelope, val)
+	}
+	return isEnvelope, nil
+}
+
+// parseGeomType parses the geometry type to select features by.
+// It must be the name of an OGC geometry type, in any case
+func parseGeomType(values api.NameValMap) (string, error) {
+	val := strings.TrimSpace(values[api.ParamGeomType])
+	if len(val) < 1 {
+		return "", nil
 	}
-	maxLon, err := strconv.ParseFloat(nums[2], 64)
+	geomType, ok := data.GeometryTypeName(val)
+	if !ok {
+		return "", fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamGeomType, val)
+	}
+	return geomType, nil
+}
+
+// parseSample parses the percentage of rows to sample.
+// Sampling retains each row with this probability,
+// so the number of features returned varies
+func parseSample(values api.NameValMap) (float64, error) {
+	val := strings.TrimSpace(values[api.ParamSample])
+	if len(val) < 1 {
+		return 0, nil
+	}
+	pct, err := strconv.ParseFloat(val, 64)
+	if err != nil || pct <= 0 || pct > 100 {
+		return 0, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamSample, val)
+	}
+	return pct, nil
+}
+
+// parseSqlArgs parses the values of the SQL parameters of a collection query.
+// Parameters which are not provided use their default, or are required if they have none
+func parseSqlArgs(values api.NameValMap, params []data.SqlParameter) ([]interface{}, error) {
+	var args []interface{}
+	for _, p := range params {
+		val, ok := values[p.Name]
+		if !ok || val == "" {
+			if p.Default == "" {
+				return nil, fmt.Errorf(api.ErrMsgMissingParameter, p.Name)
+			}
+			val = p.Default
+		}
+		arg, err := parseSqlArg(p.Type, strings.TrimSpace(val))
+		if err != nil {
+			return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, p.Name, val)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func parseSqlArg(paramType string, val string) (interface{}, error) {
+	switch paramType {
+	case data.SqlParamTypeInt:
+		return strconv.ParseInt(val, 10, 64)
+	case data.SqlParamTypeFloat:
+		return strconv.ParseFloat(val, 64)
+	case data.SqlParamTypeBool:
+		return strconv.ParseBool(val)
+	case data.SqlParamTypeDate:
+		return time.Parse("2006-01-02", val)
+	case data.SqlParamTypeTimestamp:
+		return time.Parse(time.RFC3339, val)
+	}
+	return val, nil
+}
+
+// parseDatetimeValue parses a time value.
+// It returns nil for an open interval end
+func parseDatetimeValue(val string, now time.Time, isInterval bool) (*time.Time, error) {
+	val = strings.TrimSpace(val)
+	if isInterval && (val == "" || val == api.DatetimeOpen) {
+		return nil, nil
+	}
+	valLower := strings.ToLower(val)
+	if strings.HasPrefix(valLower, api.DatetimeNow) {
+		offset := valLower[len(api.DatetimeNow):]
+		if offset == "" {
+			return &now, nil
+		}
+		sign := 1
+		switch offset[0] {
+		case '-':
+			sign = -1
+		case '+':
+		default:
+			return nil, fmt.Errorf("invalid time: %v", val)
+		}
+		t, err := addISODuration(now, strings.ToUpper(offset[1:]), sign)
+		if err != nil {
+			return nil, err
+		}
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, val)
 	if err != nil {
-		isErr = true
+		t, err = time.Parse("2006-01-02", val)
 	}
-	maxLat, err := strconv.ParseFloat(nums[3], 64)
 	if err != nil {
-		isErr = true
+		return nil, err
 	}
-	if isErr {
-		return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamBbox, val)
+	return &t, nil
+}
+
+var reISODuration = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// addISODuration adds (sign = 1) or subtracts (sign = -1) an ISO 8601 duration to a time
+func addISODuration(t time.Time, dur string, sign int) (time.Time, error) {
+	match := reISODuration.FindStringSubmatch(dur)
+	if match == nil || dur == "P" || strings.HasSuffix(dur, "T") {
+		return t, fmt.Errorf("invalid duration: %v", dur)
+	}
+	num := func(i int) int {
+		n, _ := strconv.Atoi(match[i])
+		return n * sign
 	}
-	var bbox = data.Extent{Minx: minLon, Miny: minLat, Maxx: maxLon, Maxy: maxLat}
-	return &bbox, nil
+	t = t.AddDate(num(1), num(2), 7*num(3)+num(4))
+	//-- seconds are optional, and may be fractional
+	secs, _ := strconv.ParseFloat(match[7], 64)
+	d := time.Duration(num(5))*time.Hour + time.Duration(num(6))*time.Minute +
+		time.Duration(float64(sign)*secs*float64(time.Second))
+	return t.Add(d), nil
+}
+
+// parsePrecision parses the precision parameter, as either a geometry precision
+// or a list of geom:N and prop:N values.
+// It returns the geometry and property precisions, or -1 if not specified
+func parsePrecision(values api.NameValMap) (int, int, error) {
+	val := values[api.ParamPrecision]
+	if !strings.Contains(val, api.PrecisionSep) {
+		//-- a bare integer applies to geometry only
+		precision, err := parseInt(values, api.ParamPrecision, 0, 20, -1)
+		return precision, -1, err
+	}
+	precisions := map[string]int{api.PrecisionKeyGeom: -1, api.PrecisionKeyProp: -1}
+	for _, item := range strings.Split(val, ",") {
+		keyVal := strings.Split(item, api.PrecisionSep)
+		key := strings.ToLower(strings.TrimSpace(keyVal[0]))
+		if _, ok := precisions[key]; !ok || len(keyVal) != 2 {
+			return -1, -1, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamPrecision, val)
+		}
+		precision, err := parseInt(api.NameValMap{key: strings.TrimSpace(keyVal[1])}, key, 0, 20, -1)
+		if err != nil {
+			return -1, -1, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamPrecision, val)
+		}
+		precisions[key] = precision
+	}
+	return precisions[api.PrecisionKeyGeom], precisions[api.PrecisionKeyProp], nil
 }
 
 // parseProperties extracts an array of rawo property names to be included
@@ -228,10 +977,223 @@ func parseProperties(values api.NameValMap) ([]string, error) {
 		return []string{}, nil
 	}
 	// return array of raw property names
-	namesRaw := strings.Split(val, ",")
+	namesRaw := splitPropertyList(val)
 	return namesRaw, nil
 }
 
+// splitPropertyList splits a properties list at the commas
+// which are not within the arguments of a computed property
+func splitPropertyList(val string) []string {
+	var items []string
+	depth := 0
+	start := 0
+	for i, c := range val {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, val[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, val[start:])
+}
+
+// computedPropertySep separates the name and the expression of a computed property
+const computedPropertySep = ":"
+
+// reComputedProperty matches a computed property expression: function(column, args)
+var reComputedProperty = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*\(\s*([^,()]+?)\s*((?:,\s*[^,()]+?\s*)*)\)\s*$`)
+
+// reIdentifier matches a valid computed property name
+var reIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseComputedProperties separates the computed properties (name:function(column, args))
+// of a properties list from the property names.
+// Only whitelisted functions are allowed, and the function arguments must be numbers
+func parseComputedProperties(props []string) ([]string, []data.ComputedProperty, error) {
+	var names []string
+	var computed []data.ComputedProperty
+	for _, prop := range props {
+		if !strings.Contains(prop, computedPropertySep) {
+			names = append(names, prop)
+			continue
+		}
+		comp, err := parseComputedProperty(prop)
+		if err != nil {
+			return nil, nil, err
+		}
+		computed = append(computed, comp)
+	}
+	//-- a list of only computed properties selects no column properties
+	if names == nil && props != nil {
+		names = []string{}
+	}
+	return names, computed, nil
+}
+
+func parseComputedProperty(prop string) (data.ComputedProperty, error) {
+	errInvalid := fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamProperties, prop)
+	parts := strings.SplitN(prop, computedPropertySep, 2)
+	name := strings.TrimSpace(parts[0])
+	match := reComputedProperty.FindStringSubmatch(parts[1])
+	if !reIdentifier.MatchString(name) || match == nil {
+		return data.ComputedProperty{}, errInvalid
+	}
+	funName := whitelistedFunctionName(currentWhitelists().properties, match[1])
+	if funName == "" {
+		return data.ComputedProperty{}, fmt.Errorf(api.ErrMsgComputedFunction, match[1])
+	}
+	var args []string
+	for _, arg := range strings.Split(match[3], ",")[1:] {
+		arg = strings.TrimSpace(arg)
+		if _, err := strconv.ParseFloat(arg, 64); err != nil {
+			return data.ComputedProperty{}, errInvalid
+		}
+		args = append(args, arg)
+	}
+	return data.ComputedProperty{
+		Name:     name,
+		Column:   match[2],
+		Function: data.TransformFunction{Name: funName, Arg: args},
+	}, nil
+}
+
+// setComputedProperties adds computed properties to the columns of a query.
+// Their column must be the geometry column or one of the allowed columns,
+// and their name must not be the name of a column
+func setComputedProperties(param *data.QueryParam, computed []data.ComputedProperty, tbl *data.Table, colNames []string) error {
+	if len(computed) == 0 {
+		return nil
+	}
+	if param.Cluster != nil || param.Aggregate != nil || param.GroupBy != nil {
+		return fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamProperties, computed[0].Name)
+	}
+	colSet := toNameSet(colNames)
+	names := toNameSet(param.Columns)
+	for _, comp := range computed {
+		if comp.Column != tbl.GeometryColumn && !colSet[comp.Column] {
+			return fmt.Errorf(api.ErrMsgComputedColumn, comp.Column)
+		}
+		if _, isCol := tbl.DbTypes[comp.Name]; isCol || names[comp.Name] || comp.Name == tbl.GeometryColumn {
+			return fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamProperties, comp.Name)
+		}
+		names[comp.Name] = true
+		param.Columns = append(param.Columns, comp.Name)
+	}
+	param.Computed = computed
+	return nil
+}
+
+func parseDistinct(values api.NameValMap) (bool, error) {
+	val := strings.TrimSpace(values[api.ParamDistinct])
+	if len(val) < 1 {
+		return false, nil
+	}
+	distinct, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamDistinct, val)
+	}
+	return distinct, nil
+}
+
+// parseCluster parses the cluster distance and optional minimum number of features
+func parseCluster(values api.NameValMap) (*data.Cluster, error) {
+	val := strings.TrimSpace(values[api.ParamCluster])
+	if len(val) < 1 {
+		return nil, nil
+	}
+	errInvalid := fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamCluster, val)
+	items := strings.Split(val, ",")
+	if len(items) > 2 {
+		return nil, errInvalid
+	}
+	distance, err := strconv.ParseFloat(strings.TrimSpace(items[0]), 64)
+	if err != nil || distance <= 0 {
+		return nil, errInvalid
+	}
+	cluster := &data.Cluster{Distance: distance, MinPoints: 1}
+	if len(items) > 1 {
+		minPoints, err := strconv.Atoi(strings.TrimSpace(items[1]))
+		if err != nil || minPoints < 1 {
+			return nil, errInvalid
+		}
+		cluster.MinPoints = minPoints
+	}
+	return cluster, nil
+}
+
+// aggregateFunctions are the geometry aggregate functions for the aggregate values
+var aggregateFunctions = map[string]string{
+	api.AggregateCollect: data.AggregateCollect,
+	api.AggregateUnion:   data.AggregateUnion,
+}
+
+// parseAggregate parses the aggregate function.
+// The number of features aggregated is limited by the paging AggregateMaxFeatures
+func parseAggregate(values api.NameValMap, paging conf.Paging) (*data.Aggregate, error) {
+	val := strings.TrimSpace(values[api.ParamAggregate])
+	if len(val) < 1 {
+		return nil, nil
+	}
+	fun, ok := aggregateFunctions[strings.ToLower(val)]
+	if !ok {
+		return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamAggregate, val)
+	}
+	return &data.Aggregate{Function: fun, MaxFeatures: paging.AggregateMaxFeatures}, nil
+}
+
+// geomFormats are the feature geometry encodings for the geometry-format values
+var geomFormats = map[string]string{
+	api.GeomFormatGeoJSON: data.GeomFormatGeoJSON,
+	api.GeomFormatWKT:     data.GeomFormatWKT,
+	api.GeomFormatWKBHex:  data.GeomFormatWKBHex,
+	api.GeomFormatEWKB:    data.GeomFormatEWKB,
+}
+
+func parseGeomFormat(values api.NameValMap) (string, error) {
+	val := strings.ToLower(strings.TrimSpace(values[api.ParamGeomFormat]))
+	if len(val) < 1 {
+		return data.GeomFormatGeoJSON, nil
+	}
+	geomFormat, ok := geomFormats[val]
+	if !ok {
+		return "", fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamGeomFormat, val)
+	}
+	return geomFormat, nil
+}
+
+// parseEmptyGeometry parses how features with empty geometry are returned.
+// If not present the collection configuration applies
+func parseEmptyGeometry(values api.NameValMap) (string, error) {
+	val := strings.ToLower(strings.TrimSpace(values[api.ParamEmptyGeom]))
+	if len(val) < 1 {
+		return "", nil
+	}
+	if !data.IsEmptyGeometryMode(val) {
+		return "", fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamEmptyGeom, val)
+	}
+	return val, nil
+}
+
+// parseDimension parses the coordinate dimension geometry is output with.
+// Only 2D can be requested, since other dimensions would have to invent ordinates.
+// If not present the collection configuration applies
+func parseDimension(values api.NameValMap) (int, error) {
+	val := strings.TrimSpace(values[api.ParamDimension])
+	if len(val) < 1 {
+		return 0, nil
+	}
+	if val != strconv.Itoa(data.Dimension2D) {
+		return 0, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamDimension, val)
+	}
+	return data.Dimension2D, nil
+}
+
 func parseGroupBy(values api.NameValMap) ([]string, error) {
 	val, ok := values[api.ParamGroupBy]
 	// no properties param => nil
@@ -248,26 +1210,42 @@ func parseGroupBy(values api.NameValMap) ([]string, error) {
 	return namesRaw, nil
 }
 
-// parseSortBy determines an Sorting array
+// parseSortBy determines a Sorting array from a list of sort properties.
+// A property prefixed with - is sorted in descending order,
+// and with + (or no prefix) in ascending order
 func parseSortBy(values api.NameValMap) ([]data.Sorting, error) {
 	var sorting []data.Sorting
 	val := values[api.ParamSortBy]
 	if len(val) < 1 {
 		return sorting, nil
 	}
-	valLow := strings.ToLower(val)
-	sortCols := strings.Split(valLow, ",")
-	sortCol := sortCols[0]
-	isDesc := false
-	name := strings.TrimSpace(sortCol)
-	if strings.HasPrefix(name, "+") {
-		name = strings.TrimSpace(name[1:])
-		isDesc = false
-	} else if strings.HasPrefix(name, "-") {
-		name = strings.TrimSpace(name[1:])
-		isDesc = true
-	}
-	sorting = append(sorting, data.Sorting{Name: name, IsDesc: isDesc})
+	//-- property names (and JSON keys) are case-sensitive, so only keywords are lower-cased
+	for _, sortSpec := range strings.Split(val, ",") {
+		spec, cast, err := splitSortCast(api.ParamSortBy, sortSpec)
+		if err != nil {
+			return nil, err
+		}
+		sortCol := strings.Split(spec, api.OrderByDirSep)
+		isDesc := false
+		name := strings.TrimSpace(sortCol[0])
+		if strings.HasPrefix(name, "+") {
+			name = strings.TrimSpace(name[1:])
+		} else if strings.HasPrefix(name, "-") {
+			name = strings.TrimSpace(name[1:])
+			isDesc = true
+		}
+		if name == "" {
+			return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamSortBy, val)
+		}
+		nulls := data.NullsDefault
+		if len(sortCol) >= 2 {
+			nulls, err = parseOrderByNulls(api.ParamSortBy, sortCol[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		sorting = append(sorting, data.Sorting{Name: name, IsDesc: isDesc, Nulls: nulls, Cast: cast})
+	}
 	return sorting, nil
 }
 
@@ -278,11 +1256,14 @@ func parseOrderBy(values api.NameValMap) ([]data.Sorting, error) {
 	if len(val) < 1 {
 		return orderBy, nil
 	}
-	valLow := strings.ToLower(val)
-	nameDir := strings.Split(valLow, api.OrderByDirSep)
+	spec, cast, err := splitSortCast(api.ParamOrderBy, val)
+	if err != nil {
+		return nil, err
+	}
+	nameDir := strings.Split(spec, api.OrderByDirSep)
 	name := nameDir[0]
 	isDesc := false
-	var err error
+	nulls := data.NullsDefault
 	if len(nameDir) >= 2 {
 		dirSpec := nameDir[1]
 		isDesc, err = parseOrderByDir(dirSpec)
@@ -290,11 +1271,49 @@ func parseOrderBy(values api.NameValMap) ([]data.Sorting, error) {
 			return nil, err
 		}
 	}
-	orderBy = append(orderBy, data.Sorting{Name: name, IsDesc: isDesc})
+	if len(nameDir) >= 3 {
+		nulls, err = parseOrderByNulls(api.ParamOrderBy, nameDir[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+	orderBy = append(orderBy, data.Sorting{Name: name, IsDesc: isDesc, Nulls: nulls, Cast: cast})
 	return orderBy, nil
 }
 
+// splitSortCast removes the cast hint (e.g. attributes.priority::int) from a sort specification,
+// returning the specification without it and the SQL type of the cast (if any)
+func splitSortCast(key string, spec string) (string, string, error) {
+	i := strings.Index(spec, api.OrderByCastSep)
+	if i < 0 {
+		return spec, "", nil
+	}
+	name := spec[:i]
+	castName := spec[i+len(api.OrderByCastSep):]
+	rest := ""
+	if j := strings.Index(castName, api.OrderByDirSep); j >= 0 {
+		castName, rest = castName[:j], castName[j:]
+	}
+	cast, ok := data.SortCastType(strings.ToLower(strings.TrimSpace(castName)))
+	if !ok {
+		return "", "", fmt.Errorf(api.ErrMsgInvalidParameterValue, key, spec)
+	}
+	return name + rest, cast, nil
+}
+
+// parseOrderByNulls parses the position of NULL values in an ordering
+func parseOrderByNulls(key string, nulls string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(nulls)) {
+	case api.OrderByNullsFirst:
+		return data.NullsFirst, nil
+	case api.OrderByNullsLast:
+		return data.NullsLast, nil
+	}
+	return "", fmt.Errorf(api.ErrMsgInvalidParameterValue, key, nulls)
+}
+
 func parseOrderByDir(dir string) (bool, error) {
+	dir = strings.ToLower(dir)
 	if dir == api.OrderByDirD {
 		return true, nil
 	}
@@ -309,24 +1328,124 @@ func parseOrderByDir(dir string) (bool, error) {
 // into a clean list of valid, unique column names
 // If the request properties list is empty,
 // the full column list is returned
-func normalizePropNames(requestNames []string, colNames []string) []string {
+// Names may be paths to keys in JSON columns (e.g. attributes.color),
+// which are returned after the name of the JSON column.
+// A path which does not reference a JSON column is an error
+func normalizePropNames(requestNames []string, colNames []string, colTypes map[string]string, aliases map[string]string) ([]string, error) {
 	// no properties parameter => use all columns
 	if requestNames == nil {
-		return colNames
+		return colNames, nil
 	}
 	// empty properties parameter => use NO columns
 	if len(requestNames) == 0 {
-		return requestNames
+		return requestNames, nil
 	}
+	requestNames = resolveAliases(requestNames, aliases)
 	nameSet := toNameSet(requestNames)
+	colSet := toNameSet(colNames)
+	//-- collect property paths by column
+	colPaths := make(map[string][]string)
+	for _, name := range uniqueNames(requestNames) {
+		//-- a pattern selects the columns it matches (if any)
+		if isPropertyPattern(name) {
+			for _, colName := range colNames {
+				if isMatch, _ := path.Match(name, colName); isMatch {
+					nameSet[colName] = true
+				}
+			}
+			continue
+		}
+		colName, keys := data.SplitPropertyPath(name)
+		if colSet[name] || len(keys) == 0 {
+			continue
+		}
+		colType := colTypes[colName]
+		if !colSet[colName] || (colType != data.PGTypeJSON && colType != data.PGTypeJSONB) {
+			return nil, fmt.Errorf(api.ErrMsgInvalidPropertyPath, name)
+		}
+		colPaths[colName] = append(colPaths[colName], name)
+	}
 	// select cols which appear in set
-	var propNames []string
+	// (if none do, the selection is empty)
+	propNames := []string{}
 	for _, colName := range colNames {
 		if _, ok := nameSet[colName]; ok {
 			propNames = append(propNames, colName)
 		}
+		propNames = append(propNames, colPaths[colName]...)
+	}
+	return propNames, nil
+}
+
+// resolveAlias returns the column of a property name which is an alias,
+// or else the name itself.
+// Aliases are never column names, so a column name always refers to its column
+func resolveAlias(name string, aliases map[string]string) string {
+	if col, ok := aliases[name]; ok {
+		return col
+	}
+	return name
+}
+
+// resolveAliases returns the columns of a list of property names
+func resolveAliases(names []string, aliases map[string]string) []string {
+	if len(aliases) == 0 {
+		return names
+	}
+	cols := make([]string, len(names))
+	for i, name := range names {
+		cols[i] = resolveAlias(name, aliases)
+	}
+	return cols
+}
+
+// isPropertyPattern tests if a property name is a pattern containing * or ? wildcards
+func isPropertyPattern(name string) bool {
+	return strings.ContainsAny(name, "*?")
+}
+
+// expandPropertyGroups replaces the names of property groups (@name)
+// with the properties of the group.
+// Group names are matched case-insensitively, since config keys may be lower-cased
+func expandPropertyGroups(names []string, groups map[string][]string) ([]string, error) {
+	if names == nil {
+		return nil, nil
+	}
+	expanded := []string{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, api.PropertyGroupPrefix) {
+			expanded = append(expanded, name)
+			continue
+		}
+		group, ok := findPropertyGroup(groups, strings.TrimPrefix(name, api.PropertyGroupPrefix))
+		if !ok {
+			return nil, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamProperties, name)
+		}
+		expanded = append(expanded, group...)
+	}
+	return expanded, nil
+}
+
+func findPropertyGroup(groups map[string][]string, name string) ([]string, bool) {
+	for groupName, props := range groups {
+		if strings.EqualFold(groupName, name) {
+			return props, true
+		}
+	}
+	return nil, false
+}
+
+// uniqueNames removes duplicate names from a list, preserving order
+func uniqueNames(names []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
 	}
-	return propNames
+	return unique
 }
 
 func toNameSet(strs []string) map[string]bool {
@@ -344,27 +1463,86 @@ const (
 	functionPrefixST  = "st_"
 )
 
-var transformFunctionWhitelist map[string]string
+// functionWhitelists are the functions allowed in requests.
+// They are replaced as a whole when the configuration is reloaded
+type functionWhitelists struct {
+	transforms map[string]string
+	// metricTransforms are the transform functions computed in a projected CRS
+	metricTransforms map[string]string
+	// properties are the functions allowed in computed properties
+	properties map[string]string
+}
+
+// whitelists is the current *functionWhitelists
+var whitelists atomic.Value
+
+// precisionModeValue is the current precision mode (a string)
+var precisionModeValue atomic.Value
+
+func init() {
+	whitelists.Store(&functionWhitelists{})
+	precisionModeValue.Store(data.PrecisionModeRound)
+}
+
+func currentWhitelists() *functionWhitelists {
+	return whitelists.Load().(*functionWhitelists)
+}
+
+func initTransforms(funNames []string, metricFunNames []string) {
+	wl := *currentWhitelists()
+	wl.transforms = makeFunctionWhitelist(funNames)
+	wl.metricTransforms = makeFunctionWhitelist(metricFunNames)
+	whitelists.Store(&wl)
+}
+
+func initPropertyFunctions(funNames []string) {
+	wl := *currentWhitelists()
+	wl.properties = makeFunctionWhitelist(funNames)
+	whitelists.Store(&wl)
+}
+
+// precisionMode is how coordinates are reduced to the requested precision
+func precisionMode() string {
+	return precisionModeValue.Load().(string)
+}
 
-func initTransforms(funNames []string) {
-	transformFunctionWhitelist = make(map[string]string)
+// initPrecisionMode sets the precision mode.
+// An unknown mode is logged, and the encoder rounding is used
+func initPrecisionMode(mode string) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if !data.IsPrecisionMode(mode) {
+		log.Warnf("Unknown PrecisionMode: %v (using %v)", mode, data.PrecisionModeRound)
+		mode = data.PrecisionModeRound
+	}
+	precisionModeValue.Store(mode)
+}
+
+func makeFunctionWhitelist(funNames []string) map[string]string {
+	whitelist := make(map[string]string)
 	for _, name := range funNames {
 		nameLow := strings.ToLower(name)
-		transformFunctionWhitelist[nameLow] = name
+		whitelist[nameLow] = name
 	}
+	return whitelist
 }
 
 // actualFunctionName converts an input function name
 // to an actual function name from the whitelist
 func actualFunctionName(name string) string {
+	return whitelistedFunctionName(currentWhitelists().transforms, name)
+}
+
+// whitelistedFunctionName converts an input function name
+// to an actual function name from a whitelist, or "" if it is not allowed
+func whitelistedFunctionName(whitelist map[string]string, name string) string {
 	nameLow := strings.ToLower(name)
-	if actual, ok := transformFunctionWhitelist[nameLow]; ok {
+	if actual, ok := whitelist[nameLow]; ok {
 		return actual
 	}
 	if !strings.HasPrefix(nameLow, functionPrefixST) {
 		// supply ST_ prefix if not there and try again
 		stName := functionPrefixST + nameLow
-		if actual, ok := transformFunctionWhitelist[stName]; ok {
+		if actual, ok := whitelist[stName]; ok {
 			return actual
 		}
 	}
@@ -377,6 +1555,12 @@ func parseTransform(values api.NameValMap) ([]data.TransformFunction, error) {
 		return nil, nil
 	}
 	funDefs := strings.Split(val, transformFunSep)
+	maxFuns := conf.Configuration().Server.TransformMaxFunctions
+	if maxFuns > 0 && len(funDefs) > maxFuns {
+		err := fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamTransform, val)
+		return nil, err
+	}
+	maxArgs := conf.Configuration().Server.TransformMaxArgs
 
 	funList := make([]data.TransformFunction, 0)
 	for _, fun := range funDefs {
@@ -386,7 +1570,13 @@ func parseTransform(values api.NameValMap) ([]data.TransformFunction, error) {
 			err := fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamTransform, tf.Name)
 			return nil, err
 		}
+		if maxArgs > 0 && len(tf.Arg) > maxArgs {
+			err := fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamTransform, fun)
+			return nil, err
+		}
 		tf.Name = actualName
+		tf.IsMetric = whitelistedFunctionName(currentWhitelists().metricTransforms, actualName) != ""
+		tf.MetricSrid = conf.Configuration().Server.TransformMetricSrid
 		if tf.Name != "" {
 			funList = append(funList, tf)
 		}
@@ -404,40 +1594,117 @@ func parseTransformFun(def string) data.TransformFunction {
 	return data.TransformFunction{Name: name, Arg: args}
 }
 
-// parseFilter creates a filter list from applicable query parameters
-func parseFilter(paramMap map[string]string, colNameMap map[string]string) []*data.PropertyFilter {
+// parseFilter creates a filter list from applicable query parameters.
+// Parameters may be named by a column or its alias.
+// Filtering by a denied column is an error
+func parseFilter(paramMap map[string]string, colNameMap map[string]string, denied map[string]bool, aliases map[string]string) ([]*data.PropertyFilter, error) {
 	var conds []*data.PropertyFilter
-	for name, val := range paramMap {
+	for param, val := range paramMap {
 		//log.Debugf("testing request param %v", name)
-		if api.IsParameterReservedName(name) {
+		if api.IsParameterReservedName(param) {
 			continue
 		}
+		name := resolveAlias(param, aliases)
+		if denied[name] {
+			return nil, fmt.Errorf(api.ErrMsgFilterDenied, name)
+		}
 		if _, ok := colNameMap[name]; ok {
 			cond := &data.PropertyFilter{Name: name, Value: val}
 			conds = append(conds, cond)
 			//log.Debugf("Adding filter %v = %v ", name, val)
 		}
 	}
-	return conds
+	return conds, nil
+}
+
+// allowedColumns removes the denied columns from a list of columns
+func allowedColumns(colNames []string, denied map[string]bool) []string {
+	if len(denied) == 0 {
+		return colNames
+	}
+	allowed := []string{}
+	for _, name := range colNames {
+		if !denied[name] {
+			allowed = append(allowed, name)
+		}
+	}
+	return allowed
 }
 
 // createQueryParams applies any cross-parameter logic
-func createQueryParams(param *api.RequestParam, colNames []string, sourceSRID int) (*data.QueryParam, error) {
+func createQueryParams(param *api.RequestParam, colNames []string, colTypes map[string]string, sourceSRID int) (*data.QueryParam, error) {
 	query := data.QueryParam{
 		Crs:           param.Crs,
+		FlipAxes:      param.FlipAxes,
 		Limit:         param.Limit,
 		Offset:        param.Offset,
 		Bbox:          param.Bbox,
 		BboxCrs:       param.BboxCrs,
+		BboxBuffer:    param.BboxBuffer,
+		FilterGeom:    param.FilterGeom,
+		Datetime:      param.Datetime,
+		Sample:        param.Sample,
+		GeomType:      param.GeomType,
+		Distinct:      param.Distinct,
+		Cluster:       param.Cluster,
+		Aggregate:     param.Aggregate,
 		GroupBy:       param.GroupBy,
 		SortBy:        param.SortBy,
 		Precision:     param.Precision,
+		PrecisionMode: precisionMode(),
+		PropPrecision: param.PropPrecision,
 		TransformFuns: param.TransformFuns,
+		GeomFormat:    param.GeomFormat,
+		EmptyGeometry: param.EmptyGeometry,
+		Dimension:     param.Dimension,
+	}
+	if err := resolveDistanceSorting(query.SortBy, colNames); err != nil {
+		return &query, err
+	}
+	// --- an aggregate is a single feature with only the count property
+	if param.Aggregate != nil {
+		if param.Cluster != nil {
+			return &query, fmt.Errorf(api.ErrMsgAggregateConflict, api.ParamCluster)
+		}
+		if param.GroupBy != nil {
+			return &query, fmt.Errorf(api.ErrMsgAggregateConflict, api.ParamGroupBy)
+		}
+		if param.Distinct {
+			return &query, fmt.Errorf(api.ErrMsgAggregateConflict, api.ParamDistinct)
+		}
+		if len(param.SortBy) > 0 {
+			return &query, fmt.Errorf(api.ErrMsgAggregateConflict, api.ParamSortBy)
+		}
+		query.Columns = []string{data.ClusterCountColumn}
+		return createQueryFilter(param, &query, sourceSRID)
+	}
+	// --- clusters have only the count property, and can only be sorted by it
+	if param.Cluster != nil {
+		if param.GroupBy != nil {
+			return &query, fmt.Errorf(api.ErrMsgClusterConflict, api.ParamGroupBy)
+		}
+		if param.Distinct {
+			return &query, fmt.Errorf(api.ErrMsgClusterConflict, api.ParamDistinct)
+		}
+		for _, sorting := range param.SortBy {
+			if sorting.Name != data.ClusterCountColumn {
+				return &query, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamSortBy, sorting.Name)
+			}
+		}
+		query.Columns = []string{data.ClusterCountColumn}
+		return createQueryFilter(param, &query, sourceSRID)
 	}
 	cols := param.Properties
 	// --- if groupby is present it replaces properties (it may be empty)
 	if param.GroupBy != nil {
+		// grouped features have no geometry to order by distance
+		if isDistanceSorting(param.SortBy) {
+			return &query, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamSortBy, api.OrderByDistance)
+		}
 		cols = param.GroupBy
+		query.GroupBy = resolveAliases(param.GroupBy, param.Aliases)
+		// JSON property paths cannot be grouped by
+		colTypes = nil
 		// ensure a aggregating transform is set to avoid error
 		if len(param.TransformFuns) == 0 {
 			query.TransformFuns = []data.TransformFunction{
@@ -450,13 +1717,146 @@ func createQueryParams(param *api.RequestParam, colNames []string, sourceSRID in
 			}
 		}
 	}
-	query.Columns = normalizePropNames(cols, colNames)
-	//-- convert filter CQL
-	sql, err := cql.TranspileToSQL(param.Filter, param.FilterCrs, sourceSRID)
+	propNames, err := normalizePropNames(cols, colNames, colTypes, param.Aliases)
 	if err != nil {
 		return &query, err
 	}
+	query.Columns = propNames
+	for i, sorting := range query.SortBy {
+		query.SortBy[i].Name = resolveColumnCase(resolveAlias(sorting.Name, param.Aliases), colNames)
+		//-- denied columns cannot be sorted by
+		if colName, _ := data.SplitPropertyPath(query.SortBy[i].Name); param.Denied[colName] {
+			return &query, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamSortBy, sorting.Name)
+		}
+	}
+	if err := checkSortPaths(query.SortBy, colNames, colTypes); err != nil {
+		return &query, err
+	}
+	//-- distinct rows can only be sorted by the selected columns
+	if query.Distinct {
+		colSet := toNameSet(propNames)
+		for _, sorting := range query.SortBy {
+			if !colSet[sorting.Name] {
+				return &query, fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamSortBy, sorting.Name)
+			}
+		}
+	}
+	return createQueryFilter(param, &query, sourceSRID)
+}
+
+// resolveColumnCase provides the column name for a sort property (or the column of a path)
+// which matches a column case-insensitively, for compatibility with lower-case requests.
+// JSON keys in a path are case-sensitive, so they are unchanged
+func resolveColumnCase(name string, colNames []string) string {
+	colName, keys := data.SplitPropertyPath(name)
+	for _, col := range colNames {
+		if col == name || col == colName {
+			return name
+		}
+	}
+	for _, col := range colNames {
+		if strings.EqualFold(col, name) {
+			return col
+		}
+	}
+	for _, col := range colNames {
+		if strings.EqualFold(col, colName) {
+			return strings.Join(append([]string{col}, keys...), data.PropertyPathSeparator)
+		}
+	}
+	return name
+}
+
+// checkSortPaths flags the orderings which are property paths to keys in JSON columns.
+// A path which does not reference a JSON column is an error,
+// as is a cast of a value which is not a path
+func checkSortPaths(sortBy []data.Sorting, colNames []string, colTypes map[string]string) error {
+	colSet := toNameSet(colNames)
+	for i, sorting := range sortBy {
+		colName, keys := data.SplitPropertyPath(sorting.Name)
+		if colSet[sorting.Name] || len(keys) == 0 {
+			if sorting.Cast != "" {
+				return fmt.Errorf(api.ErrMsgInvalidParameterValue, api.ParamSortBy, sorting.Name+api.OrderByCastSep+sorting.Cast)
+			}
+			continue
+		}
+		colType := colTypes[colName]
+		if !colSet[colName] || (colType != data.PGTypeJSON && colType != data.PGTypeJSONB) {
+			return fmt.Errorf(api.ErrMsgInvalidPropertyPath, sorting.Name)
+		}
+		sortBy[i].IsPath = true
+	}
+	return nil
+}
+
+// resolveDistanceSorting determines whether orderings named distance are by distance from the point.
+// A column named distance is sorted by its value, so the keyword does not hide it.
+// Otherwise it is an error if there is no point to sort by distance from
+func resolveDistanceSorting(sortBy []data.Sorting, colNames []string) error {
+	for i, sorting := range sortBy {
+		if !strings.EqualFold(sorting.Name, api.OrderByDistance) {
+			continue
+		}
+		if isNameInFold(sorting.Name, colNames) {
+			sortBy[i].Point = nil
+			continue
+		}
+		if sorting.Point == nil {
+			return fmt.Errorf(api.ErrMsgDistanceNoPoint)
+		}
+	}
+	return nil
+}
+
+// isNameInFold tests if a name is in a list, ignoring case
+func isNameInFold(name string, names []string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDistanceSorting tests if an ordering is by distance from a point
+func isDistanceSorting(sortBy []data.Sorting) bool {
+	for _, sorting := range sortBy {
+		if sorting.Point != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// createQueryFilter converts the filter CQL to SQL
+func createQueryFilter(param *api.RequestParam, query *data.QueryParam, sourceSRID int) (*data.QueryParam, error) {
+	filter := param.Filter
+	if param.FilterLang == api.FilterLangJSON && strings.TrimSpace(filter) != "" {
+		var err error
+		filter, err = cql.JSONToText(filter)
+		if err != nil {
+			return query, err
+		}
+	}
+	sql, args, err := cql.TranspileToSQLResolved(filter, param.FilterCrs, sourceSRID, filterColumnResolver(param))
+	if err != nil {
+		return query, err
+	}
 	query.FilterSql = sql
+	query.FilterArgs = args
 
-	return &query, nil
+	return query, nil
+}
+
+// filterColumnResolver provides the columns of the properties in a CQL filter,
+// which may be named by a column or its alias.
+// Denied columns cannot be filtered by
+func filterColumnResolver(param *api.RequestParam) cql.NameResolver {
+	return func(name string) (string, error) {
+		col := resolveAlias(name, param.Aliases)
+		if param.Denied[col] {
+			return "", fmt.Errorf(api.ErrMsgFilterDenied, col)
+		}
+		return col, nil
+	}
 }
@@ -0,0 +1,93 @@
+package service
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/CrunchyData/pg_featureserv/internal/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// prettyContentTypes are the response content types which are indented
+// by the pretty parameter.
+// Streamed formats are not included, since they are written as they are read
+var prettyContentTypes = map[string]bool{
+	api.ContentTypeJSON:       true,
+	api.ContentTypeGeoJSON:    true,
+	api.ContentTypeSchemaJSON: true,
+}
+
+// isPrettyRequested tests if a request has the pretty parameter.
+// The parameter has no value, or a true value
+func isPrettyRequested(r *http.Request) bool {
+	vals, ok := r.URL.Query()[api.ParamPretty]
+	if !ok {
+		return false
+	}
+	if len(vals) == 0 || vals[0] == "" {
+		return true
+	}
+	isPretty, err := strconv.ParseBool(vals[0])
+	return err == nil && isPretty
+}
+
+// prettyWriter indents JSON response bodies.
+// Responses with other content types are written unchanged.
+// The body of a JSON response is buffered until writeBody is called
+type prettyWriter struct {
+	http.ResponseWriter
+	isChecked bool
+	isJSON    bool
+	body      bytes.Buffer
+}
+
+func (pw *prettyWriter) Write(b []byte) (int, error) {
+	if !pw.isChecked {
+		pw.isChecked = true
+		pw.isJSON = prettyContentTypes[pw.Header().Get("Content-Type")]
+	}
+	if !pw.isJSON {
+		return pw.ResponseWriter.Write(b)
+	}
+	return pw.body.Write(b)
+}
+
+func (pw *prettyWriter) Flush() {
+	if pw.isJSON {
+		return
+	}
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeBody writes the indented JSON body, if any
+func (pw *prettyWriter) writeBody() {
+	if pw.body.Len() == 0 {
+		return
+	}
+	//-- invalid JSON is written as it is
+	content := pw.body.Bytes()
+	var out bytes.Buffer
+	if err := json.Indent(&out, content, "", "  "); err == nil {
+		content = out.Bytes()
+	}
+	if _, err := pw.ResponseWriter.Write(content); err != nil {
+		log.Debugf("Error writing response: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package service
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CrunchyData/pg_featureserv/internal/api"
+	"github.com/CrunchyData/pg_featureserv/internal/conf"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	headerForwardedFor = "X-Forwarded-For"
+	headerRetryAfter   = "Retry-After"
+)
+
+// pathsRateLimitExempt are never rate limited, so that monitoring keeps working
+var pathsRateLimitExempt = map[string]bool{
+	"healthz": true,
+	"readyz":  true,
+	"metrics": true,
+}
+
+// rateLimitBucket is the token bucket of a client
+type rateLimitBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the request rate of clients using token buckets.
+// Each client bucket holds up to burst tokens, and is refilled at rate tokens per second.
+// A request uses one token
+type rateLimiter struct {
+	lock        sync.Mutex
+	buckets     map[string]*rateLimitBucket
+	lastCleanup time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*rateLimitBucket)}
+}
+
+// allow tests if a client request is allowed at a given time.
+// If it is not, the time until a token is available is returned
+func (limiter *rateLimiter) allow(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	if burst < 1 {
+		burst = 1
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.cleanup(rate, burst, now)
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: float64(burst), last: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := (1 - bucket.tokens) / rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// cleanup removes the buckets which have refilled, about once a minute.
+// A refilled bucket is the same as a new bucket, so this does not change limiting
+func (limiter *rateLimiter) cleanup(rate float64, burst int, now time.Time) {
+	if now.Sub(limiter.lastCleanup) < time.Minute {
+		return
+	}
+	limiter.lastCleanup = now
+	for key, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= float64(burst) {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// rateLimitMiddleware rejects requests from clients which exceed the configured rate,
+// if rate limiting is configured
+func rateLimitMiddleware(basePath string) mux.MiddlewareFunc {
+	limiter := newRateLimiter()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			confLimit := conf.Configuration().RateLimit
+			if confLimit.RequestsPerSec <= 0 || isRateLimitExempt(basePath, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := rateLimitKey(r, conf.Configuration().Auth.ApiKeys, confLimit.TrustedProxies)
+			isAllowed, wait := limiter.allow(key, confLimit.RequestsPerSec, confLimit.Burst, time.Now())
+			if !isAllowed {
+				log.Debugf("Request rate limited: %v", key)
+				w.Header().Set(headerRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, api.Message(api.RequestedLang(r), api.ErrMsgRateLimited), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isRateLimitExempt tests if a request path is not rate limited.
+// The path name is compared without the base path and any format extension
+func isRateLimitExempt(basePath string, urlPath string) bool {
+	name := strings.Trim(strings.TrimPrefix(urlPath, basePath), "/")
+	name = strings.TrimSuffix(name, path.Ext(name))
+	return pathsRateLimitExempt[name]
+}
+
+// rateLimitKey identifies the client of a request.
+// Requests with a valid API key are limited by key, and others by client IP,
+// so clients can not avoid the limit by sending arbitrary keys
+func rateLimitKey(r *http.Request, apiKeys []string, trustedProxies []string) string {
+	if key := requestAPIKey(r); isValidAPIKey(key, apiKeys) {
+		return "key:" + key
+	}
+	return "ip:" + clientIP(r, trustedProxies)
+}
+
+// clientIP is the IP address of the client of a request.
+// The X-Forwarded-For header is only used if the request is from a trusted proxy,
+// since otherwise clients can set it to any address.
+// The client is the last address in the header which is not a trusted proxy
+func clientIP(r *http.Request, trustedProxies []string) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	xff := r.Header.Get(headerForwardedFor)
+	if xff == "" || !isTrustedProxy(host, trustedProxies) {
+		return host
+	}
+	addrs := strings.Split(xff, ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(addrs[i])
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !isTrustedProxy(addr, trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
+// isTrustedProxy tests if an IP address matches one of the trusted proxy IP addresses or CIDR ranges
+func isTrustedProxy(addr string, trustedProxies []string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if _, ipNet, err := net.ParseCIDR(proxy); err == nil {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
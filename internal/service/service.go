@@ -4,14 +4,20 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/CrunchyData/pg_featureserv/internal/api"
 	"github.com/CrunchyData/pg_featureserv/internal/conf"
 	"github.com/CrunchyData/pg_featureserv/internal/data"
+	"github.com/CrunchyData/pg_featureserv/internal/tracing"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -35,37 +41,47 @@ var router *mux.Router
 var server *http.Server
 var isTLSEnabled bool
 var serverTLS *http.Server
+var certLoader *certificateLoader
+
+// requestsInFlight is the number of requests being processed,
+// which are waited for on shutdown
+var requestsInFlight int64
 
 // Initialize sets the service state from configuration
 func Initialize() {
-	initTransforms(conf.Configuration.Server.TransformFunctions)
+	initTransforms(conf.Configuration().Server.TransformFunctions, conf.Configuration().Server.TransformMetricFunctions)
+	initPropertyFunctions(conf.Configuration().Server.PropertyFunctions)
+	initPrecisionMode(conf.Configuration().Server.PrecisionMode)
+	api.InitCrs(conf.Configuration().Crs)
+	initAuth()
+	initCache()
+	initTracing()
 }
 
 func createServers() {
-	confServ := conf.Configuration.Server
+	confServ := conf.Configuration().Server
 
 	bindAddress := fmt.Sprintf("%v:%v", confServ.HttpHost, confServ.HttpPort)
 	bindAddressTLS := fmt.Sprintf("%v:%v", confServ.HttpHost, confServ.HttpsPort)
 	// Use HTTPS only if server certificate and private key files specified
-	isTLSEnabled = conf.Configuration.IsTLSEnabled()
+	isTLSEnabled = conf.Configuration().IsTLSEnabled()
 
 	log.Infof("Serving HTTP  at %s", formatBaseURL("http://", bindAddress, confServ.BasePath))
 	if isTLSEnabled {
 		log.Infof("Serving HTTPS at %s", formatBaseURL("https://", bindAddressTLS, confServ.BasePath))
 	}
-	log.Infof("CORS Allowed Origins: %v\n", conf.Configuration.Server.CORSOrigins)
+	log.Infof("CORS policies: %v\n", len(corsPolicies()))
 
 	router = initRouter(confServ.BasePath)
 
 	// writeTimeout is slighlty longer than request timeout to allow writing error response
-	timeoutSecRequest := conf.Configuration.Server.WriteTimeoutSec
+	timeoutSecRequest := conf.Configuration().Server.WriteTimeoutSec
 	timeoutSecWrite := timeoutSecRequest + 1
 
 	// ----  Handler chain  --------
 	// set CORS handling according to config
-	corsOpt := handlers.AllowedOrigins([]string{conf.Configuration.Server.CORSOrigins})
-	corsHandler := handlers.CORS(corsOpt)(router)
-	compressHandler := handlers.CompressHandler(corsHandler)
+	corsRouter := corsHandler(confServ.BasePath, router)
+	compressHandler := handlers.CompressHandler(corsRouter)
 
 	// Use a TimeoutHandler to ensure a request does not run past the WriteTimeout duration.
 	// This provides a context that allows cancellation to be propagated
@@ -73,39 +89,192 @@ func createServers() {
 	//(Unfortunately this does not propagate to the database itself.
 	// That will require another mechanism such as session config statement_timeout)
 	// If timeout expires, service returns 503 and a text message
-	timeoutHandler := http.TimeoutHandler(compressHandler,
-		time.Duration(timeoutSecRequest)*time.Second,
-		api.ErrMsgRequestTimeout)
+	timeoutHandler := requestTimeoutHandler(compressHandler,
+		time.Duration(timeoutSecRequest)*time.Second)
+
+	// HTTP requests are redirected to HTTPS if configured
+	var httpHandler http.Handler = timeoutHandler
+	if isTLSEnabled && confServ.HttpsRedirect {
+		httpHandler = httpsRedirectHandler(confServ.HttpsPort)
+	}
+	httpHandler = inFlightHandler(httpHandler)
 
 	// more "production friendly" timeouts
 	// https://blog.simon-frey.eu/go-as-in-golang-standard-net-http-config-will-break-your-production/#You_should_at_least_do_this_The_easy_path
 	server = &http.Server{
-		ReadTimeout:  time.Duration(conf.Configuration.Server.ReadTimeoutSec) * time.Second,
+		ReadTimeout:  time.Duration(conf.Configuration().Server.ReadTimeoutSec) * time.Second,
 		WriteTimeout: time.Duration(timeoutSecWrite) * time.Second,
 		Addr:         bindAddress,
-		Handler:      timeoutHandler,
+		Handler:      httpHandler,
+		ConnContext:  withConn,
 	}
 
 	if isTLSEnabled {
+		minVersion, err := tlsMinVersion(confServ.TlsMinVersion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the certificate is provided by a loader, so it can be reloaded on SIGHUP
+		certLoader, err = newCertificateLoader(confServ.TlsServerCertificateFile, confServ.TlsServerPrivateKeyFile)
+		if err != nil {
+			log.Fatalf("Unable to load TLS certificate: %v", err)
+		}
 		serverTLS = &http.Server{
-			ReadTimeout:  time.Duration(conf.Configuration.Server.ReadTimeoutSec) * time.Second,
+			ReadTimeout:  time.Duration(conf.Configuration().Server.ReadTimeoutSec) * time.Second,
 			WriteTimeout: time.Duration(timeoutSecWrite) * time.Second,
 			Addr:         bindAddressTLS,
-			Handler:      timeoutHandler,
+			Handler:      inFlightHandler(timeoutHandler),
+			ConnContext:  withConn,
 			TLSConfig: &tls.Config{
-				MinVersion: tls.VersionTLS12, // Secure TLS versions only
+				MinVersion:     minVersion,
+				GetCertificate: certLoader.getCertificate,
 			},
 		}
 	}
 }
 
+// requestTimeoutHandler ends requests which run past the request timeout.
+// A TimeoutHandler buffers the response, so that it can be replaced by the timeout message.
+// Collection items can be streamed, so they are not buffered;
+// their timeout is a context deadline instead, which cancels the database query
+func requestTimeoutHandler(next http.Handler, timeout time.Duration) http.Handler {
+	buffered := http.TimeoutHandler(next, timeout, api.ErrMsgRequestTimeout)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isStreamedRequest(r) {
+			buffered.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// isStreamedRequest tests if a request is for the items of a collection,
+// whose response may be streamed
+func isStreamedRequest(r *http.Request) bool {
+	var match mux.RouteMatch
+	if r.Method != http.MethodGet || router == nil || !router.Match(r, &match) {
+		return false
+	}
+	tpl, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(tpl, "/collections/{id}/items") || strings.HasSuffix(tpl, "/collections/{id}/items.{fmt}")
+}
+
+const contextKeyConn contextKey = "conn"
+
+// withConn provides the connection of a request in the request context,
+// so that a handler can set a deadline for reading the request body
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, contextKeyConn, conn)
+}
+
+// setReadDeadline sets the deadline for reading the rest of a request from its connection.
+// A zero deadline removes it.
+// HTTP/2 requests share a connection, so their body is limited by the server ReadTimeout instead
+func setReadDeadline(r *http.Request, deadline time.Time) {
+	conn, ok := r.Context().Value(contextKeyConn).(net.Conn)
+	if !ok || r.ProtoMajor != 1 {
+		return
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		log.Debugf("Error setting read deadline: %v", err)
+	}
+}
+
+// inFlightHandler counts the requests in progress
+func inFlightHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requestsInFlight, 1)
+		defer atomic.AddInt64(&requestsInFlight, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shutdownServers stops the servers accepting connections,
+// and waits for the requests in progress to finish until the timeout.
+// Requests still running at the timeout (e.g. long downloads) are cut off
+func shutdownServers(timeout time.Duration, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			err := srv.Shutdown(ctx)
+			if err == nil {
+				return
+			}
+			if err == context.DeadlineExceeded {
+				log.Warnf("Shutdown timeout of %v reached for %v with %v requests in progress - closing connections",
+					timeout, srv.Addr, atomic.LoadInt64(&requestsInFlight))
+			} else {
+				log.Warnf("Server %v failed to shutdown: %v", srv.Addr, err)
+			}
+			if errClose := srv.Close(); errClose != nil {
+				log.Warnf("Server %v failed to close: %v", srv.Addr, errClose)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+// handleReloadSignal reloads the configuration and the TLS certificate when a SIGHUP is received
+func handleReloadSignal() {
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	for range sigHup {
+		reloadConfig()
+		if certLoader == nil {
+			continue
+		}
+		if err := certLoader.load(); err != nil {
+			log.Warnf("Unable to reload TLS certificate (keeping current certificate): %v", err)
+			continue
+		}
+		log.Infoln("Reloaded TLS certificate")
+	}
+}
+
+// reloadConfig reads the config file again and applies the settings
+// which can be changed without restarting the service.
+// The configuration and the state initialized from it are replaced as a whole,
+// so requests in progress read either the previous or the reloaded settings.
+// The HTTP listeners and database pool are not changed,
+// so changes to their settings are logged as requiring a restart
+func reloadConfig() {
+	changed, err := conf.ReloadConfig()
+	if err != nil {
+		log.Warnf("Unable to reload configuration (keeping current configuration): %v", err)
+		return
+	}
+	for _, name := range changed {
+		log.Warnf("Configuration setting %v changed, but requires a restart to take effect", name)
+	}
+	config := conf.Configuration()
+	initTransforms(config.Server.TransformFunctions, config.Server.TransformMetricFunctions)
+	initPropertyFunctions(config.Server.PropertyFunctions)
+	initPrecisionMode(config.Server.PrecisionMode)
+	api.InitCrs(config.Crs)
+	catalogInstance.SetIncludeExclude(config.Database.TableIncludes, config.Database.TableExcludes)
+	// reload the tables to apply the changed includes and excludes
+	catalogInstance.InvalidateTables()
+	if _, err := catalogInstance.Tables(); err != nil {
+		log.Warnf("Unable to reload collections: %v", err)
+	}
+	log.Infoln("Reloaded configuration")
+}
+
 // Serve starts the web service
 func Serve(catalog data.Catalog) {
-	confServ := conf.Configuration.Server
 	catalogInstance = catalog
 	createServers()
 
-	log.Infof("====  Service: %s  ====\n", conf.Configuration.Metadata.Title)
+	log.Infof("====  Service: %s  ====\n", conf.Configuration().Metadata.Title)
 
 	// start http service
 	go func() {
@@ -121,41 +290,40 @@ func Serve(catalog data.Catalog) {
 		go func() {
 			// ListenAndServe returns http.ErrServerClosed when the server receives
 			// a call to Shutdown(). Other errors are unexpected.
-			if err := serverTLS.ListenAndServeTLS(confServ.TlsServerCertificateFile, confServ.TlsServerPrivateKeyFile); err != nil && err != http.ErrServerClosed {
+			// The certificate is provided by the TLS config
+			if err := serverTLS.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 				log.Fatal(err)
 			}
 		}()
 	}
+	go handleReloadSignal()
 
-	// wait here for interrupt signal (^C)
+	// wait here for interrupt (^C) or termination signal
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
-	<-sig
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	received := <-sig
 
-	// Interrupt signal received:  Start shutting down
-	log.Infoln("Shutting down...")
+	// Signal received:  Start shutting down
+	shutdownTimeoutSec := conf.Configuration().Server.ShutdownTimeoutSec
+	log.Infof("Received %v - shutting down (waiting up to %v sec for requests in progress)...", received, shutdownTimeoutSec)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	errConn := server.Shutdown(ctx)
-	if errConn != nil {
-		log.Warnf("Server connection failed to shutdown: %v", errConn.Error())
-	}
+	servers := []*http.Server{server}
 	if isTLSEnabled {
-		errConnTls := serverTLS.Shutdown(ctx)
-		if errConnTls != nil {
-			log.Warnf("Server TLS connection failed to shutdown: %v", errConnTls.Error())
-		}
+		servers = append(servers, serverTLS)
 	}
+	shutdownServers(time.Duration(shutdownTimeoutSec)*time.Second, servers...)
 
 	// abort after waiting long enough for service to shutdown gracefully
 	// this terminates long-running DB queries, which otherwise block shutdown
-	abortTimeoutSec := conf.Configuration.Server.WriteTimeoutSec + 10
+	abortTimeoutSec := conf.Configuration().Server.WriteTimeoutSec + 10
 	chanCancelFatal := FatalAfter(abortTimeoutSec, "Timeout on shutdown - aborting.")
 
 	log.Debugln("Closing DB connections")
 	catalogInstance.Close()
 
+	log.Debugln("Exporting trace spans")
+	tracing.Shutdown()
+
 	log.Infoln("Service stopped.")
 	// cancel the abort since it is not needed
 	close(chanCancelFatal)
@@ -0,0 +1,94 @@
+package service
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// tlsVersions are the allowed values of the TlsMinVersion setting
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsMinVersion returns the TLS version for a TlsMinVersion setting
+func tlsMinVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+	ver, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("Invalid TlsMinVersion: %v", version)
+	}
+	return ver, nil
+}
+
+// certificateLoader provides the TLS server certificate.
+// The certificate can be reloaded from its files,
+// so that it can be rotated without restarting the server
+type certificateLoader struct {
+	lock     sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+func newCertificateLoader(certFile string, keyFile string) (*certificateLoader, error) {
+	loader := &certificateLoader{certFile: certFile, keyFile: keyFile}
+	if err := loader.load(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// load reads the certificate files.
+// If they cannot be read the current certificate is kept
+func (loader *certificateLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(loader.certFile, loader.keyFile)
+	if err != nil {
+		return err
+	}
+	loader.lock.Lock()
+	defer loader.lock.Unlock()
+	loader.cert = &cert
+	return nil
+}
+
+func (loader *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loader.lock.RLock()
+	defer loader.lock.RUnlock()
+	return loader.cert, nil
+}
+
+// httpsRedirectHandler redirects requests to the same URL on the HTTPS port
+func httpsRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,89 @@
+package service
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"net/http"
+
+	"github.com/CrunchyData/pg_featureserv/internal/conf"
+	"github.com/CrunchyData/pg_featureserv/internal/tracing"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+func initTracing() {
+	confTracing := conf.Configuration().Tracing
+	tracing.Init(confTracing.Endpoint, confTracing.SampleRatio, confTracing.ServiceName)
+	if tracing.IsEnabled() {
+		log.Infof("Exporting traces to %v (sample ratio %v)", confTracing.Endpoint, confTracing.SampleRatio)
+	}
+}
+
+// tracingMiddleware records a server span for each request.
+// The span continues the trace of an incoming traceparent header,
+// and is the parent of the spans of the database queries of the request.
+// If tracing is not enabled requests are passed through unchanged
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing.IsEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				name = tmpl
+			}
+		}
+		ctx, span := tracing.StartRemoteSpan(r.Context(), r.Header.Get(tracing.HeaderTraceparent), r.Method+" "+name, tracing.KindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", name)
+		span.SetAttribute("url.path", r.URL.Path)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttribute("http.response.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetError(errorStatus(rec.status))
+		}
+	})
+}
+
+// errorStatus is an error for a failed response status
+type errorStatus int
+
+func (status errorStatus) Error() string {
+	return http.StatusText(int(status))
+}
+
+// statusRecorder records the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -15,17 +15,22 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/CrunchyData/pg_featureserv/internal/api"
 	"github.com/CrunchyData/pg_featureserv/internal/conf"
+	"github.com/CrunchyData/pg_featureserv/internal/data"
 	"github.com/CrunchyData/pg_featureserv/internal/ui"
+	"github.com/ghodss/yaml"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/theckman/httpforwarded"
@@ -59,8 +64,13 @@ type appHandler func(http.ResponseWriter, *http.Request) *appError
 // Common handling logic is placed here
 // See also https://golang.org/pkg/net/http/#Handler
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// --- identify the request, to correlate its query log with the request log
+	reqID := requestID(r)
+	w.Header().Set(headerRequestID, reqID)
+	r = r.WithContext(data.WithRequestID(r.Context(), reqID))
+
 	// --- log the request
-	log.Printf("%v %v %v\n", r.RemoteAddr, r.Method, r.URL)
+	log.Printf("%v %v %v (request %v)\n", r.RemoteAddr, r.Method, r.URL, reqID)
 
 	// signal for normal completion of handler
 	handlerDone := make(chan struct{})
@@ -82,6 +92,13 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	// indent JSON responses if requested
+	if isPrettyRequested(r) {
+		pw := &prettyWriter{ResponseWriter: w}
+		defer pw.writeBody()
+		w = pw
+	}
+
 	// execute the handler
 	e := fn(w, r)
 
@@ -91,12 +108,49 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// log error here?
 		// should log attached error?
 		// panic on severe error?
+		//-- a streamed request which ran past its deadline is reported as the timeout handler does
+		if r.Context().Err() == context.DeadlineExceeded {
+			e = &appError{Error: e.Error, Message: api.ErrMsgRequestTimeout, Code: http.StatusServiceUnavailable}
+		}
 		log.Debugf("Request processing error: %v (%v)\n", e.Message, e.Code)
-		http.Error(w, e.Message, e.Code)
+		//-- an error is not a download
+		w.Header().Del(headerContentDisposition)
+		http.Error(w, api.LocalizeMessage(api.RequestedLang(r), e.Message), e.Code)
 	}
 	close(handlerDone)
 }
 
+// headerRequestID identifies a request in the logs
+const headerRequestID = "X-Request-ID"
+
+// maxRequestIDLen is the maximum length of a client-provided request id
+const maxRequestIDLen = 128
+
+// requestID returns the id provided by the request X-Request-ID header,
+// if it is safe to log, or otherwise a new random id
+func requestID(r *http.Request) string {
+	id := r.Header.Get(headerRequestID)
+	if id != "" && len(id) <= maxRequestIDLen && isLoggableID(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// isLoggableID tests if an id contains only letters, digits and the characters -_.:
+func isLoggableID(id string) bool {
+	for _, c := range id {
+		isAlphaNum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlphaNum && !strings.ContainsRune("-_.:", c) {
+			return false
+		}
+	}
+	return true
+}
+
 // FatalAfter aborts by logging a fatal message, after a time delay.
 // The abort can be cancelled by closing the returned channel
 func FatalAfter(delaySec int, msg string) chan struct{} {
@@ -140,7 +194,7 @@ func appErrorNotFoundFmt(err error, format string, v string) *appError {
 
 func serveURLBase(r *http.Request) string {
 	// Use configuration file settings if we have them
-	configURL := conf.Configuration.Server.UrlBase
+	configURL := conf.Configuration().Server.UrlBase
 
 	if configURL != "" {
 		return configURL + "/"
@@ -154,6 +208,9 @@ func serveURLBase(r *http.Request) string {
 	// Preferred host:port
 	ph := strings.TrimRight(r.Host, "/")
 
+	// Path prefix added by a reverse proxy
+	path := forwardedPrefix(r) + conf.Configuration().Server.BasePath
+
 	// Check IETF standard "Forwarded" header
 	// for reverse proxy information
 	xf := http.CanonicalHeaderKey("Forwarded")
@@ -162,7 +219,7 @@ func serveURLBase(r *http.Request) string {
 			if len(fm["host"]) > 0 && len(fm["proto"]) > 0 {
 				ph = fm["host"][0]
 				ps = fm["proto"][0]
-				return fmt.Sprintf("%v://%v/", ps, ph)
+				return fmt.Sprintf("%v://%v%v/", ps, ph, path)
 			}
 		}
 	}
@@ -177,10 +234,20 @@ func serveURLBase(r *http.Request) string {
 		ps = fp[0]
 	}
 
-	path := conf.Configuration.Server.BasePath
 	return fmt.Sprintf("%v://%v%v/", ps, ph, path)
 }
 
+// forwardedPrefix is the path a reverse proxy serves the service under,
+// from the X-Forwarded-Prefix header.
+// It has a leading slash and no trailing slash, or is empty if there is no prefix
+func forwardedPrefix(r *http.Request) string {
+	prefix := strings.Trim(strings.TrimSpace(r.Header.Get("X-Forwarded-Prefix")), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
 func getRequestVar(varname string, r *http.Request) string {
 	vars := mux.Vars(r)
 	nameFull := vars[varname]
@@ -267,6 +334,24 @@ func writeJSON(w http.ResponseWriter, contype string, content interface{}) *appE
 	return nil
 }
 
+// writeYAML writes content as YAML.
+// The content is encoded as JSON first, so the JSON encoding rules
+// of the content types apply to the YAML document as well
+func writeYAML(w http.ResponseWriter, contype string, content interface{}) *appError {
+	encodedContent, err := json.Marshal(content)
+	if err != nil {
+		log.Printf("JSON encoding error: %v", err.Error())
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	yamlContent, err := yaml.JSONToYAML(encodedContent)
+	if err != nil {
+		log.Printf("YAML encoding error: %v", err.Error())
+		return appErrorInternal(err, api.ErrMsgEncoding)
+	}
+	writeResponse(w, contype, yamlContent)
+	return nil
+}
+
 func writeText(w http.ResponseWriter, contype string, encodedContent []byte) *appError {
 	//fmt.Println(string(encodedContent))
 	writeResponse(w, contype, encodedContent)
@@ -0,0 +1,235 @@
+package tracing
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	exportBatchSize = 512
+	exportQueueSize = 4096
+	exportInterval  = 5 * time.Second
+	exportTimeout   = 10 * time.Second
+)
+
+// exporter sends spans to an OTLP/HTTP collector in batches.
+// Spans are dropped if the queue is full, so tracing never blocks requests
+type exporter struct {
+	endpoint    string
+	sampleRatio float64
+	serviceName string
+	client      *http.Client
+	queue       chan *Span
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+func newExporter(endpoint string, sampleRatio float64, serviceName string) *exporter {
+	exp := &exporter{
+		endpoint:    endpoint,
+		sampleRatio: sampleRatio,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, exportQueueSize),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go exp.run()
+	return exp
+}
+
+// isSampled decides if a new trace is recorded
+func (exp *exporter) isSampled() bool {
+	if exp.sampleRatio >= 1 {
+		return true
+	}
+	if exp.sampleRatio <= 0 {
+		return false
+	}
+	var b [8]byte
+	randomBytes(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/float64(1<<53) < exp.sampleRatio
+}
+
+func (exp *exporter) add(span *Span) {
+	select {
+	case exp.queue <- span:
+	default:
+		log.Debugf("Trace span dropped (export queue full): %v", span.name)
+	}
+}
+
+func (exp *exporter) stop() {
+	close(exp.done)
+	<-exp.stopped
+}
+
+func (exp *exporter) run() {
+	defer close(exp.stopped)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case span := <-exp.queue:
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				exp.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			exp.export(batch)
+			batch = nil
+		case <-exp.done:
+			for len(exp.queue) > 0 {
+				batch = append(batch, <-exp.queue)
+			}
+			exp.export(batch)
+			return
+		}
+	}
+}
+
+func (exp *exporter) export(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(toOTLP(spans, exp.serviceName))
+	if err != nil {
+		log.Warnf("Unable to encode trace spans: %v", err)
+		return
+	}
+	resp, err := exp.client.Post(exp.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("Unable to export trace spans: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warnf("Unable to export trace spans: %v", resp.Status)
+	}
+}
+
+//==============  OTLP JSON encoding  ==============
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func toOTLP(spans []*Span, serviceName string) *otlpTraces {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = span.toOTLP()
+	}
+	return &otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpKeyValue{toKeyValue("service.name", serviceName)}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: serviceName},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+func (span *Span) toOTLP() otlpSpan {
+	span.lock.Lock()
+	defer span.lock.Unlock()
+	out := otlpSpan{
+		TraceID:           fmt.Sprintf("%x", span.traceID),
+		SpanID:            fmt.Sprintf("%x", span.spanID),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+	}
+	if span.parentID != [8]byte{} {
+		out.ParentSpanID = fmt.Sprintf("%x", span.parentID)
+	}
+	for key, val := range span.attributes {
+		out.Attributes = append(out.Attributes, toKeyValue(key, val))
+	}
+	if span.statusCode != 0 {
+		out.Status = &otlpStatus{Code: span.statusCode, Message: span.statusMsg}
+	}
+	return out
+}
+
+// toKeyValue encodes an attribute as an OTLP AnyValue.
+// Integers are encoded as strings, as required for 64-bit values in JSON
+func toKeyValue(key string, val interface{}) otlpKeyValue {
+	var value map[string]interface{}
+	switch v := val.(type) {
+	case bool:
+		value = map[string]interface{}{"boolValue": v}
+	case int:
+		value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		value = map[string]interface{}{"doubleValue": v}
+	default:
+		value = map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+	}
+	return otlpKeyValue{Key: key, Value: value}
+}
@@ -0,0 +1,229 @@
+package tracing
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package tracing records OpenTelemetry trace spans,
+// and exports them to an OTLP/HTTP collector using the JSON encoding.
+// If tracing is not enabled, spans are nil and recording them does nothing.
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, using the OTLP values
+const (
+	KindServer = 2
+	KindClient = 3
+)
+
+// Span status codes, using the OTLP values
+const (
+	statusOK    = 1
+	statusError = 2
+)
+
+// HeaderTraceparent is the W3C trace context header
+const HeaderTraceparent = "traceparent"
+
+type contextKey string
+
+const contextKeySpan contextKey = "span"
+
+// Span is an operation in a trace.
+// A nil span is not recorded, so all methods accept a nil receiver
+type Span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	lock       sync.Mutex
+	attributes map[string]interface{}
+	statusCode int
+	statusMsg  string
+}
+
+// tracer is the active tracer, or nil if tracing is not enabled
+var tracer *exporter
+
+// tracerLock protects the active tracer
+var tracerLock sync.RWMutex
+
+// Init enables tracing, exporting spans to an OTLP/HTTP traces endpoint.
+// Root spans are sampled with the given ratio (between 0 and 1).
+// If the endpoint is empty tracing is disabled
+func Init(endpoint string, sampleRatio float64, serviceName string) {
+	Shutdown()
+	if endpoint == "" {
+		return
+	}
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+	tracer = newExporter(endpoint, sampleRatio, serviceName)
+}
+
+// Shutdown exports any pending spans and disables tracing
+func Shutdown() {
+	tracerLock.Lock()
+	active := tracer
+	tracer = nil
+	tracerLock.Unlock()
+	if active != nil {
+		active.stop()
+	}
+}
+
+// IsEnabled tests if tracing is enabled
+func IsEnabled() bool {
+	return activeTracer() != nil
+}
+
+func activeTracer() *exporter {
+	tracerLock.RLock()
+	defer tracerLock.RUnlock()
+	return tracer
+}
+
+// StartSpan starts a span which is a child of the span in the context (if any).
+// A root span is started if the context has no span, subject to sampling.
+// The returned context contains the span
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	exp := activeTracer()
+	if exp == nil {
+		return ctx, nil
+	}
+	parent := FromContext(ctx)
+	if parent == nil {
+		if !exp.isSampled() {
+			return ctx, nil
+		}
+		span := newSpan(name, kind)
+		return context.WithValue(ctx, contextKeySpan, span), span
+	}
+	span := newSpan(name, kind)
+	span.traceID = parent.traceID
+	span.parentID = parent.spanID
+	return context.WithValue(ctx, contextKeySpan, span), span
+}
+
+// StartRemoteSpan starts a span which continues the trace of a W3C traceparent header.
+// If the header is not valid a span is started as for StartSpan.
+// The trace is recorded if the remote trace is sampled
+func StartRemoteSpan(ctx context.Context, traceparent string, name string, kind int) (context.Context, *Span) {
+	exp := activeTracer()
+	if exp == nil {
+		return ctx, nil
+	}
+	traceID, parentID, isSampled, ok := parseTraceparent(traceparent)
+	if !ok {
+		return StartSpan(ctx, name, kind)
+	}
+	if !isSampled {
+		return ctx, nil
+	}
+	span := newSpan(name, kind)
+	span.traceID = traceID
+	span.parentID = parentID
+	return context.WithValue(ctx, contextKeySpan, span), span
+}
+
+// FromContext returns the span of a context, or nil if there is none
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKeySpan).(*Span)
+	return span
+}
+
+func newSpan(name string, kind int) *Span {
+	span := &Span{name: name, kind: kind, start: time.Now(), attributes: make(map[string]interface{})}
+	randomBytes(span.traceID[:])
+	randomBytes(span.spanID[:])
+	return span
+}
+
+// SetAttribute sets an attribute of the span.
+// Values may be strings, bools, ints or floats
+func (span *Span) SetAttribute(key string, val interface{}) {
+	if span == nil {
+		return
+	}
+	span.lock.Lock()
+	defer span.lock.Unlock()
+	span.attributes[key] = val
+}
+
+// SetError records that the span operation failed
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.lock.Lock()
+	defer span.lock.Unlock()
+	span.statusCode = statusError
+	span.statusMsg = err.Error()
+}
+
+// End ends the span, and queues it for export
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	span.lock.Lock()
+	span.end = time.Now()
+	span.lock.Unlock()
+	if exp := activeTracer(); exp != nil {
+		exp.add(span)
+	}
+}
+
+// Traceparent is the W3C traceparent header value for the span
+func (span *Span) Traceparent() string {
+	if span == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%x-%x-01", span.traceID, span.spanID)
+}
+
+// parseTraceparent parses a W3C traceparent header (version-traceid-parentid-flags)
+func parseTraceparent(header string) ([16]byte, [8]byte, bool, bool) {
+	var traceID [16]byte
+	var parentID [8]byte
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return traceID, parentID, false, false
+	}
+	flags, errFlags := hex.DecodeString(parts[3])
+	_, errTrace := hex.Decode(traceID[:], []byte(parts[1]))
+	_, errParent := hex.Decode(parentID[:], []byte(parts[2]))
+	if errFlags != nil || len(flags) != 1 || errTrace != nil || errParent != nil ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 ||
+		traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		//-- fall back to the time, which is unique enough for tracing
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(time.Now().UnixNano()))
+	}
+}
@@ -0,0 +1,71 @@
+package tracing
+
+/*
+ Copyright 2019 - 2024 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parentID, isSampled, ok := parseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if !ok || !isSampled {
+		t.Fatalf("valid traceparent not parsed: ok=%v sampled=%v", ok, isSampled)
+	}
+	span := &Span{traceID: traceID, spanID: parentID}
+	if got := span.Traceparent(); got != "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01" {
+		t.Errorf("traceparent round trip: got %v", got)
+	}
+	if _, _, isSampled, ok := parseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"); !ok || isSampled {
+		t.Errorf("unsampled traceparent: ok=%v sampled=%v", ok, isSampled)
+	}
+	for _, header := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0af7651916cd43dd-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01",
+	} {
+		if _, _, _, ok := parseTraceparent(header); ok {
+			t.Errorf("invalid traceparent parsed: %v", header)
+		}
+	}
+}
+
+func TestChildSpan(t *testing.T) {
+	tracer = &exporter{sampleRatio: 1, queue: make(chan *Span, 10)}
+	defer func() { tracer = nil }()
+
+	ctx, parent := StartSpan(context.Background(), "request", KindServer)
+	_, child := StartSpan(ctx, "query", KindClient)
+	if child.traceID != parent.traceID || child.parentID != parent.spanID {
+		t.Errorf("child span is not in the parent trace")
+	}
+	child.SetAttribute("db.response.returned_rows", 3)
+	child.End()
+	if len(tracer.queue) != 1 {
+		t.Errorf("ended span not queued for export")
+	}
+	kv := toKeyValue("db.response.returned_rows", 3)
+	if kv.Value["intValue"] != "3" {
+		t.Errorf("int attribute encoding: got %v", kv.Value)
+	}
+
+	tracer.sampleRatio = 0
+	if _, span := StartSpan(context.Background(), "request", KindServer); span != nil {
+		t.Errorf("root span recorded with sample ratio 0")
+	}
+}
@@ -45,6 +45,11 @@ type PageData struct {
 	Function        *data.Function
 	FeatureID       string
 	ShowFeatureLink bool
+	// MapDisabled omits the map view of features
+	MapDisabled bool
+	// AttributeTable shows features in a table instead of a map,
+	// for results which have no geometry
+	AttributeTable bool
 }
 
 var htmlTemp struct {
@@ -96,8 +101,8 @@ func loadPageTemplate(curr *template.Template, filename string) *template.Templa
 		return curr
 	}
 	return createTemplate(
-		conf.Configuration.Server.AssetsPath+"/page.gohtml",
-		conf.Configuration.Server.AssetsPath+"/"+filename)
+		conf.Configuration().Server.AssetsPath+"/page.gohtml",
+		conf.Configuration().Server.AssetsPath+"/"+filename)
 }
 
 func loadMapPageTemplate(curr *template.Template, filename string) *template.Template {
@@ -105,9 +110,9 @@ func loadMapPageTemplate(curr *template.Template, filename string) *template.Tem
 		return curr
 	}
 	return createTemplate(
-		conf.Configuration.Server.AssetsPath+"/page.gohtml",
-		conf.Configuration.Server.AssetsPath+"/map_script.gohtml",
-		conf.Configuration.Server.AssetsPath+"/"+filename)
+		conf.Configuration().Server.AssetsPath+"/page.gohtml",
+		conf.Configuration().Server.AssetsPath+"/map_script.gohtml",
+		conf.Configuration().Server.AssetsPath+"/"+filename)
 }
 
 func PageHome() *template.Template {
@@ -119,7 +124,7 @@ func PageConformance() *template.Template {
 	return htmlTemp.conformance
 }
 func PageAPI() *template.Template {
-	htmlTemp.api = loadTemplate(htmlTemp.api, conf.Configuration.Server.AssetsPath+"/api.gohtml")
+	htmlTemp.api = loadTemplate(htmlTemp.api, conf.Configuration().Server.AssetsPath+"/api.gohtml")
 	return htmlTemp.api
 }
 func PageCollections() *template.Template {
@@ -148,17 +153,17 @@ func PageFunction() *template.Template {
 }
 func PageFunctionItems() *template.Template {
 	htmlTemp.functionItems = loadTemplate(htmlTemp.functionItems,
-		conf.Configuration.Server.AssetsPath+"/page.gohtml",
-		conf.Configuration.Server.AssetsPath+"/items.gohtml",
-		conf.Configuration.Server.AssetsPath+"/map_script.gohtml",
-		conf.Configuration.Server.AssetsPath+"/fun_script.gohtml")
+		conf.Configuration().Server.AssetsPath+"/page.gohtml",
+		conf.Configuration().Server.AssetsPath+"/items.gohtml",
+		conf.Configuration().Server.AssetsPath+"/map_script.gohtml",
+		conf.Configuration().Server.AssetsPath+"/fun_script.gohtml")
 	return htmlTemp.functionItems
 }
 
 // RenderHTML tbd
 func RenderHTML(temp *template.Template, content interface{}, context interface{}) ([]byte, error) {
 	bodyData := map[string]interface{}{
-		"config":  conf.Configuration,
+		"config":  conf.Configuration(),
 		"context": context,
 		"data":    content}
 	contentBytes, err := renderTemplate(temp, bodyData)